@@ -0,0 +1,130 @@
+/*
+ * alert.go - alerts and notifiers
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "sync"
+    "time"
+)
+
+// Notifier sends alert messages to user.
+type Notifier interface {
+    Notify(msg string)
+}
+
+type logNotifier struct{}
+
+func (ln logNotifier) Notify(msg string) {
+    Logger.Warn("ALERT: ", msg)
+}
+
+// runs shell command with message in BBC_ALERT environment variable
+type commandNotifier struct {
+    command string
+}
+
+func (cn *commandNotifier) Notify(msg string) {
+    Logger.Warn("ALERT: ", msg)
+    cmd := exec.Command("sh", "-c", cn.command)
+    cmd.Env = append(os.Environ(), "BBC_ALERT=" + msg)
+    go func() {
+        if err := cmd.Run(); err!=nil {
+            Logger.Error("Alert command failed: ", err)
+        }
+    }()
+}
+
+func newNotifier(config *Config) Notifier {
+    if config.AlertCommand != "" {
+        return &commandNotifier{ config.AlertCommand }
+    }
+    return logNotifier{}
+}
+
+// monitor of funding rate - notifies once per crossing the threshold
+type rateAlertMonitor struct {
+    mutex sync.Mutex
+    currency string
+    threshold float64   // daily rate in percent
+    above bool
+    notifier Notifier
+}
+
+func newRateAlertMonitor(currency string, threshold float64,
+                        notifier Notifier) *rateAlertMonitor {
+    return &rateAlertMonitor{ currency: currency, threshold: threshold,
+                notifier: notifier }
+}
+
+// check rate (daily rate in percent). Return true if alert has been sent.
+func (ram *rateAlertMonitor) check(rate float64) bool {
+    ram.mutex.Lock()
+    defer ram.mutex.Unlock()
+    if rate <= ram.threshold {
+        ram.above = false
+        return false
+    }
+    if ram.above { return false }   // already notified
+    ram.above = true
+    ram.notifier.Notify(fmt.Sprint("Funding rate for ", ram.currency, ": ",
+                    rate, "% is above ", ram.threshold, "%"))
+    return true
+}
+
+// default window of counting parse errors
+const defaultParseErrorWindow = time.Hour
+
+// monitor of parse errors - notifies if number of errors in time window
+// reaches threshold (layout of exchange API responses has probably changed)
+type parseErrorMonitor struct {
+    mutex sync.Mutex
+    currency string
+    threshold uint
+    window time.Duration
+    times []time.Time   // times of errors in window
+    notifier Notifier
+}
+
+func newParseErrorMonitor(currency string, threshold uint, window time.Duration,
+                        notifier Notifier) *parseErrorMonitor {
+    if window <= 0 { window = defaultParseErrorWindow }
+    return &parseErrorMonitor{ currency: currency, threshold: threshold,
+                window: window, notifier: notifier }
+}
+
+// add parse error at time. Return true if alert has been sent.
+func (pem *parseErrorMonitor) add(now time.Time) bool {
+    pem.mutex.Lock()
+    defer pem.mutex.Unlock()
+    i := 0
+    for ; i < len(pem.times) && now.Sub(pem.times[i]) >= pem.window; i++ {}
+    pem.times = append(pem.times[i:], now)
+    if uint(len(pem.times)) < pem.threshold { return false }
+    pem.times = pem.times[:0]   // count again after alert
+    pem.notifier.Notify(fmt.Sprint("Repeated parse errors for ", pem.currency, ": ",
+                    pem.threshold, " in ", pem.window, " - exchange API has changed?"))
+    return true
+}
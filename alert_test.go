@@ -0,0 +1,162 @@
+/*
+ * alert_test.go - alerts and notifiers tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "testing"
+    "time"
+    "github.com/matszpk/godec64"
+)
+
+type fakeNotifier struct {
+    msgs []string
+}
+
+func (fn *fakeNotifier) Notify(msg string) {
+    fn.msgs = append(fn.msgs, msg)
+}
+
+func TestRateAlertMonitor(t *testing.T) {
+    fn := &fakeNotifier{}
+    ram := newRateAlertMonitor("UST", 0.1, fn)
+    rates := []float64{ 0.05, 0.08, 0.12, 0.15, 0.11, 0.09, 0.1, 0.2, 0.3 }
+    expAlerts := []bool{ false, false, true, false, false, false, false, true, false }
+    for i, rate := range rates {
+        if alert := ram.check(rate); alert!=expAlerts[i] {
+            t.Errorf("Alert mismatch %d: %v!=%v", i, expAlerts[i], alert)
+        }
+    }
+    if len(fn.msgs)!=2 {
+        t.Errorf("Alerts count mismatch: %v", fn.msgs)
+    }
+}
+
+func TestEngineRateAlert(t *testing.T) {
+    eng := getTestEngine0()
+    fn := &fakeNotifier{}
+    eng.rateAlert = newRateAlertMonitor("UST", 0.1, fn)
+    // alert is independent of borrowing (checkOBEnabled is 0)
+    for _, rate := range []uint64{ 411100000, 1211100000, 1311100000 } {
+        eng.checkOrderBook(&OrderBook{ Ask: []OrderBookEntry{
+                OrderBookEntry{ 2, 16000000000, godec64.UDec64(rate), 1 } } })
+    }
+    if len(fn.msgs)!=1 {
+        t.Errorf("Alerts count mismatch: %v", fn.msgs)
+    }
+}
+
+func TestParseErrorMonitor(t *testing.T) {
+    fn := &fakeNotifier{}
+    pem := newParseErrorMonitor("UST", 3, time.Hour, fn)
+    start := time.Date(2021, 9, 14, 12, 0, 0, 0, time.UTC)
+    // minutes of parse errors, old errors are out of window
+    minutes := []int{ 0, 10, 70, 80, 90, 100, 110, 120 }
+    expAlerts := []bool{ false, false, false, false, true, false, false, true }
+    for i, m := range minutes {
+        if alert := pem.add(start.Add(time.Duration(m)*time.Minute));
+                alert!=expAlerts[i] {
+            t.Errorf("Alert mismatch %d: %v!=%v", i, expAlerts[i], alert)
+        }
+    }
+    if len(fn.msgs)!=2 {
+        t.Errorf("Alerts count mismatch: %v", fn.msgs)
+    }
+}
+
+func TestEngineParseErrorEscalation(t *testing.T) {
+    eng := getTestEngine0()
+    fn := &fakeNotifier{}
+    eng.parseErrors = newParseErrorMonitor("UST", 3, time.Hour, fn)
+    eng.config.PauseOnParseErrors = true
+    // other errors are not counted
+    for i := 0; i < 3; i++ {
+        eng.callSafe("test", func() { panic(&APIError{ "test", 0, "error" }) })
+    }
+    if len(fn.msgs)!=0 || eng.IsPaused() {
+        t.Fatalf("Escalation by other errors: %v %v", fn.msgs, eng.IsPaused())
+    }
+    for i := 0; i < 3; i++ {
+        if eng.IsPaused() {
+            t.Fatalf("Engine paused too early: %d", i)
+        }
+        eng.callSafe("test", func() { panic(errWrongJsonBody) })
+    }
+    if len(fn.msgs)!=1 || !eng.IsPaused() {
+        t.Errorf("No escalation: %v %v", fn.msgs, eng.IsPaused())
+    }
+}
+
+// private API with key revoked after first call
+type revokedPrivateApi struct {
+    *fakePrivateApi
+    calls int
+}
+
+func (rp *revokedPrivateApi) GetCredits(currency string) []Credit {
+    rp.calls++
+    if rp.calls > 1 {
+        panic(&APIError{ "Can't get credits", bitfinexErrApiKey, "apikey: invalid" })
+    }
+    return rp.fakePrivateApi.GetCredits(currency)
+}
+
+func TestEngineApiKeyInvalid(t *testing.T) {
+    eng := getTestEngine0()
+    fn := &fakeNotifier{}
+    eng.notifier = fn
+    eng.fatalCh = make(chan error, 1)
+    bpriv := &revokedPrivateApi{ fakePrivateApi: &fakePrivateApi{} }
+    eng.bpriv = bpriv
+    getCredits := func() { eng.bpriv.GetCredits("UST") }
+    if !eng.callSafe("GetCredits", getCredits) || eng.IsPaused() {
+        t.Fatalf("Unexpected failure before revoke")
+    }
+    // other errors do not stop engine
+    eng.callSafe("test", func() { panic(&APIError{ "test", 0, "error" }) })
+    if eng.IsPaused() || len(fn.msgs)!=0 || len(eng.Fatal())!=0 {
+        t.Fatalf("Engine stopped by other error")
+    }
+    // key revoked mid-run
+    for i := 0; i < 2; i++ {
+        if eng.callSafe("GetCredits", getCredits) {
+            t.Fatalf("No failure after revoke")
+        }
+    }
+    if !eng.IsPaused() {
+        t.Errorf("Engine is not paused")
+    }
+    if len(fn.msgs)!=1 {
+        t.Errorf("Alerts count mismatch: %v", fn.msgs)
+    }
+    select {
+        case err := <-eng.Fatal():
+            if code, _ := fatalExitInfo(err); code!=exitApiKeyInvalid {
+                t.Errorf("Exit code mismatch: %d!=%d", exitApiKeyInvalid, code)
+            }
+            if !isApiKeyError(err) {
+                t.Errorf("Fatal error is not API key error: %v", err)
+            }
+        default:
+            t.Errorf("No fatal error signaled")
+    }
+}
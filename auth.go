@@ -23,14 +23,19 @@
 package main
 
 import (
+    "bufio"
     "bytes"
     "crypto/aes"
     "crypto/cipher"
     "crypto/rand"
     "encoding/hex"
+    "errors"
+    "fmt"
     "io"
     "io/ioutil"
     "os"
+    "path/filepath"
+    "strings"
     "time"
     "golang.org/x/crypto/argon2"
     "github.com/chzyer/readline"
@@ -48,6 +53,49 @@ const (
 
 const pricePeriod = time.Minute
 
+// default mode of generated files (password and auth file)
+const defaultFileMode os.FileMode = 0600
+
+// expand '~' at beginning of path to home directory
+func expandPathHome(path, home string) string {
+    if path == "~" {
+        return home
+    }
+    if strings.HasPrefix(path, "~/") {
+        return filepath.Join(home, path[2:])
+    }
+    return path
+}
+
+func expandPath(path string) string {
+    if path != "~" && !strings.HasPrefix(path, "~/") {
+        return path
+    }
+    home, err := os.UserHomeDir()
+    if err!=nil {
+        ErrorPanic("Can't get home directory", err)
+    }
+    return expandPathHome(path, home)
+}
+
+// return mode for generated files
+func (config *Config) fileMode() os.FileMode {
+    if config.FileMode == 0 { return defaultFileMode }
+    return config.FileMode
+}
+
+// warn if file is readable by group or others. return true if warned
+func warnInsecureFile(filename string) bool {
+    st, err := os.Stat(filename)
+    if err!=nil { return false }
+    if st.Mode().Perm() & 0077 != 0 {
+        Logger.Warn("File ", filename, " is accessible by group or others (mode ",
+                    fmt.Sprintf("%04o", st.Mode().Perm()), ")")
+        return true
+    }
+    return false
+}
+
 func passwordHash(password []byte) []byte {
     return argon2.IDKey(password, argon2Salt, argon2TimeCost,
                     argon2MemCost, argon2Parallel, argon2HashLength)
@@ -60,6 +108,7 @@ func passwordKeyHash(password []byte) []byte {
 
 // return password hash
 func GetPasswordFile(passwordFile string) []byte {
+    warnInsecureFile(passwordFile)
     // get password hash from file
     if content, err := ioutil.ReadFile(passwordFile); err==nil {
         if len(content) < 2*argon2HashLength {
@@ -88,7 +137,18 @@ func genAESKey(password []byte) []byte {
     return aesKey[:]
 }
 
+// pair of exchange keys
+type KeyPair struct {
+    ApiKey, SecretKey []byte
+}
+
 func encryptExchAuth(passwordHash, apiKey, secretKey []byte) []byte {
+    return encryptExchAuthKeys(passwordHash, []KeyPair{ { apiKey, secretKey } })
+}
+
+// encrypt key pairs. first pair is main key, next pairs are backup keys.
+// pairs are stored one after another and terminated by zero length.
+func encryptExchAuthKeys(passwordHash []byte, keys []KeyPair) []byte {
     key := genAESKey(passwordHash)
     var iv [aes.BlockSize]byte
     if _, err := io.ReadFull(rand.Reader, iv[:]); err!=nil {
@@ -97,16 +157,24 @@ func encryptExchAuth(passwordHash, apiKey, secretKey []byte) []byte {
     if aesCiph, err := aes.NewCipher(key); err==nil {
          blkMode := cipher.NewCBCEncrypter(aesCiph, iv[:])
          // create text plain
-         apiKeyLen, secretKeyLen := len(apiKey), len(secretKey)
-         totLen := 4 + apiKeyLen + secretKeyLen
+         totLen := 0
+         for _, kp := range keys {
+             totLen += 4 + len(kp.ApiKey) + len(kp.SecretKey)
+         }
          ciphLen := ((totLen + aes.BlockSize-1) / aes.BlockSize) * aes.BlockSize
          textPlain := make([]byte, ciphLen + aes.BlockSize)
-         textPlain[0] = byte(apiKeyLen&0xff)
-         textPlain[1] = byte(apiKeyLen>>8)
-         copy(textPlain[2:2+apiKeyLen], apiKey)
-         textPlain[2+apiKeyLen] = byte(secretKeyLen&0xff)
-         textPlain[3+apiKeyLen] = byte(secretKeyLen>>8)
-         copy(textPlain[4+apiKeyLen:], secretKey)
+         pos := 0
+         for _, kp := range keys {
+             apiKeyLen, secretKeyLen := len(kp.ApiKey), len(kp.SecretKey)
+             textPlain[pos] = byte(apiKeyLen&0xff)
+             textPlain[pos+1] = byte(apiKeyLen>>8)
+             copy(textPlain[pos+2:pos+2+apiKeyLen], kp.ApiKey)
+             pos += 2+apiKeyLen
+             textPlain[pos] = byte(secretKeyLen&0xff)
+             textPlain[pos+1] = byte(secretKeyLen>>8)
+             copy(textPlain[pos+2:], kp.SecretKey)
+             pos += 2+secretKeyLen
+         }
          for i := 0; i < aes.BlockSize; i++ {
              textPlain[ciphLen+i] = 117
          }
@@ -122,6 +190,12 @@ func encryptExchAuth(passwordHash, apiKey, secretKey []byte) []byte {
 }
 
 func decryptExchAuth(passwordHash, ciphData []byte) ([]byte, []byte) {
+    keys := decryptExchAuthKeys(passwordHash, ciphData)
+    return keys[0].ApiKey, keys[0].SecretKey
+}
+
+// decrypt key pairs. returns at least one pair.
+func decryptExchAuthKeys(passwordHash, ciphData []byte) []KeyPair {
     key := genAESKey(passwordHash)
     iv := ciphData[:aes.BlockSize]
     if aesCiph, err := aes.NewCipher(key); err==nil {
@@ -137,30 +211,113 @@ func decryptExchAuth(passwordHash, ciphData []byte) ([]byte, []byte) {
             }
         }
         
-        apiKeyLen := int(plainData[0]) + (int(plainData[1])<<8)
-        if apiKeyLen+2 > ciphLen - aes.BlockSize {
-            panic("Wrong data in exchange auth file")
+        dataLen := ciphLen - aes.BlockSize
+        var keys []KeyPair
+        for pos := 0; pos+2 <= dataLen; {
+            apiKeyLen := int(plainData[pos]) + (int(plainData[pos+1])<<8)
+            if apiKeyLen == 0 && len(keys) != 0 { break }    // end of keys
+            if pos + apiKeyLen + 4 > dataLen {
+                panic("Wrong data in exchange auth file")
+            }
+            secretKeyLen := int(plainData[pos+2+apiKeyLen]) +
+                    (int(plainData[pos+3+apiKeyLen])<<8)
+            if pos + apiKeyLen + secretKeyLen + 4 > dataLen {
+                panic("Wrong data in exchange auth file")
+            }
+            
+            apiKey := plainData[pos+2:pos+2+apiKeyLen]
+            secretKey := plainData[pos+4+apiKeyLen:pos+4+apiKeyLen+secretKeyLen]
+            keys = append(keys, KeyPair{ apiKey, secretKey })
+            pos += 4 + apiKeyLen + secretKeyLen
         }
-        secretKeyLen := int(plainData[2+apiKeyLen]) + (int(plainData[3+apiKeyLen])<<8)
-        if apiKeyLen + secretKeyLen + 4 > ciphLen - aes.BlockSize {
+        if len(keys) == 0 {
             panic("Wrong data in exchange auth file")
         }
-        
-        apiKey := plainData[2:2+apiKeyLen]
-        secretKey := plainData[4+apiKeyLen:4+apiKeyLen+secretKeyLen]
-        return apiKey, secretKey
+        return keys
     } else {
         ErrorPanic("Can't create AES cipher", err)
     }
-    return nil, nil
+    return nil
 }
 
-func AuthenticateExchange(config *Config) ([]byte, []byte) {
-    return authenticateExchangeInt(config, readline.Password)
+// check whether files needed by authentication are available
+// before asking about password
+func (config *Config) checkFiles() error {
+    if config.AuthBackend!="" && config.AuthBackend!=authBackendFile {
+        return nil // no files needed
+    }
+    if config.PasswordFile=="" {
+        return errors.New("No password file in config")
+    }
+    if st, err := os.Stat(config.PasswordFile); err!=nil {
+        return fmt.Errorf("Password file %q is not available: %v",
+                          config.PasswordFile, err)
+    } else if st.IsDir() {
+        return fmt.Errorf("Password file %q is directory", config.PasswordFile)
+    }
+    if config.AuthFile=="" {
+        return errors.New("No auth file in config")
+    }
+    if _, err := os.Stat(config.AuthFile); err==nil {
+        return nil  // already exists, will be only read
+    } else if !os.IsNotExist(err) {
+        return fmt.Errorf("Auth file %q is not available: %v", config.AuthFile, err)
+    }
+    // auth file will be created - check whether directory is writable
+    authDir := filepath.Dir(config.AuthFile)
+    f, err := ioutil.TempFile(authDir, ".bbc_check")
+    if err!=nil {
+        return fmt.Errorf("Directory %q of auth file is not writable: %v", authDir, err)
+    }
+    f.Close()
+    os.Remove(f.Name())
+    return nil
+}
+
+// environment variable that holds password (for non-interactive runs)
+const passwordEnvVar = "BBC_PASSWORD"
+
+// read password from first line of reader (stdin pipe)
+func readPasswordLine(r io.Reader) ([]byte, error) {
+    line, err := bufio.NewReader(r).ReadBytes('\n')
+    if err!=nil && (err!=io.EOF || len(line)==0) {
+        return nil, err
+    }
+    return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// choose password source: environment variable, stdin pipe or
+// interactive terminal (as fallback)
+func selectPasswordReader(getenv func(string) string, stdin io.Reader, useStdin bool,
+                interactive func(string) ([]byte, error)) func(string) ([]byte, error) {
+    if pwd := getenv(passwordEnvVar); pwd!="" {
+        return func(string) ([]byte, error) { return []byte(pwd), nil }
+    }
+    if useStdin {
+        return func(string) ([]byte, error) { return readPasswordLine(stdin) }
+    }
+    return interactive
+}
+
+func AuthenticateExchange(config *Config, pwdStdin bool) ([]byte, []byte) {
+    return getCredentials(newCredentialProvider(config, pwdStdin))
+}
+
+// returns main key and backup keys (only file backend stores backup keys)
+func AuthenticateExchangeKeys(config *Config, pwdStdin bool) []KeyPair {
+    return getAllCredentials(newCredentialProvider(config, pwdStdin))
+}
+
+// rdpwd - read password, rdkey - read api key and secret key
+func authenticateExchangeInt(config *Config, rdpwd,
+                    rdkey func(string) ([]byte, error)) ([]byte, []byte) {
+    keys := authenticateExchangeKeysInt(config, rdpwd, rdkey)
+    return keys[0].ApiKey, keys[0].SecretKey
 }
 
-func authenticateExchangeInt(config *Config,
-                             rdpwd func(string) ([]byte, error)) ([]byte, []byte) {
+// returns main key and backup keys
+func authenticateExchangeKeysInt(config *Config, rdpwd,
+                    rdkey func(string) ([]byte, error)) []KeyPair {
     expPasswordHash := GetPasswordFile(config.PasswordFile)
     pwd, err := rdpwd("Enter password:")
     if err!=nil {
@@ -176,35 +333,63 @@ func authenticateExchangeInt(config *Config,
     
     if exauthRaw, err := ioutil.ReadFile(config.AuthFile); os.IsNotExist(err) {
         // if file doesn't exist
-        apiKey, err := rdpwd("Enter APIKey:")
+        apiKey, err := rdkey("Enter APIKey:")
         if err!=nil {
             ErrorPanic("Can't read APIKey", err)
         }
-        secretKey, err := rdpwd("Enter SecretKey:")
+        secretKey, err := rdkey("Enter SecretKey:")
         if err!=nil {
             ErrorPanic("Can't read SecretKey", err)
         }
+        keys := []KeyPair{ { apiKey, secretKey } }
+        for {
+            apiKey, err := rdkey("Enter backup APIKey (empty - no more keys):")
+            if err!=nil {
+                ErrorPanic("Can't read APIKey", err)
+            }
+            if len(apiKey) == 0 { break }
+            secretKey, err := rdkey("Enter backup SecretKey:")
+            if err!=nil {
+                ErrorPanic("Can't read SecretKey", err)
+            }
+            keys = append(keys, KeyPair{ apiKey, secretKey })
+        }
         
         // write to exchange auth file
-        data := encryptExchAuth(pwdKeyHash, apiKey, secretKey)
-        if err =  ioutil.WriteFile(config.AuthFile, data, 0600); err!=nil {
+        data := encryptExchAuthKeys(pwdKeyHash, keys)
+        if err =  ioutil.WriteFile(config.AuthFile, data,
+                                   config.fileMode()); err!=nil {
             ErrorPanic("Can't write exchange auth file", err)
         }
-        return apiKey, secretKey
+        return keys
     } else if err!=nil {
         ErrorPanic("Can't read exchange auth file", err)
-        return nil, nil
+        return nil
     } else {
+        warnInsecureFile(config.AuthFile)
         // read from exchange
-        return decryptExchAuth(pwdKeyHash, exauthRaw)
+        return decryptExchAuthKeys(pwdKeyHash, exauthRaw)
     }
 }
 
-func GenPassword(filename string) {
-    genPasswordInt(filename, readline.Password)
+// mask all characters of key except first 4 and last 4 characters
+func maskApiKey(key []byte) string {
+    if len(key) <= 8 { return strings.Repeat("*", len(key)) }
+    return string(key[:4]) + strings.Repeat("*", len(key)-8) + string(key[len(key)-4:])
+}
+
+// print masked api key and length of secret key (never secret key)
+func PrintWhichKey(out io.Writer, apiKey, secretKey []byte) {
+    fmt.Fprintln(out, "APIKey:", maskApiKey(apiKey))
+    fmt.Fprintln(out, "SecretKey length:", len(secretKey))
+}
+
+func GenPassword(filename string, mode os.FileMode) {
+    genPasswordInt(filename, mode, readline.Password)
 }
 
-func genPasswordInt(filename string, rdpwd func(string) ([]byte, error)) {
+func genPasswordInt(filename string, mode os.FileMode,
+                    rdpwd func(string) ([]byte, error)) {
     pwd, err := rdpwd("Enter password:")
     if err!=nil {
         ErrorPanic("Can't read password", err)
@@ -220,7 +405,7 @@ func genPasswordInt(filename string, rdpwd func(string) ([]byte, error)) {
     pwdHash := passwordHash(pwd)
     pwdHashHex := make([]byte, len(pwdHash)*2)
     hex.Encode(pwdHashHex, pwdHash)
-    if err := ioutil.WriteFile(filename, pwdHashHex, 0600); err!=nil {
+    if err := ioutil.WriteFile(filename, pwdHashHex, mode); err!=nil {
         ErrorPanic("Can't write password to file", err)
     }
 }
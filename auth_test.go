@@ -0,0 +1,217 @@
+/*
+ * auth_test.go - authentication tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "bytes"
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func noInteractive(prompt string) ([]byte, error) {
+    return nil, errors.New("Interactive read is not allowed: " + prompt)
+}
+
+// prepare password file and exchange auth file in temporary directory
+func prepareTestAuthFiles(t *testing.T, pwd, apiKey, secretKey []byte) *Config {
+    dir := t.TempDir()
+    config := &Config{ PasswordFile: filepath.Join(dir, "password"),
+                AuthFile: filepath.Join(dir, "exauth") }
+    genPasswordInt(config.PasswordFile, 0600, func(string) ([]byte, error) {
+        return pwd, nil
+    })
+    data := encryptExchAuth(passwordKeyHash(pwd), apiKey, secretKey)
+    if err := ioutil.WriteFile(config.AuthFile, data, 0600); err!=nil {
+        t.Fatal("Can't write auth file:", err)
+    }
+    return config
+}
+
+func TestAuthenticateExchangeNonInteractive(t *testing.T) {
+    pwd := []byte("secret password")
+    apiKey, secretKey := []byte("myApiKey1234"), []byte("mySecretKey5678")
+    config := prepareTestAuthFiles(t, pwd, apiKey, secretKey)
+    
+    // from environment variable
+    getenv := func(name string) string {
+        if name == passwordEnvVar { return string(pwd) }
+        return ""
+    }
+    rdpwd := selectPasswordReader(getenv, nil, false, noInteractive)
+    resApiKey, resSecretKey := authenticateExchangeInt(config, rdpwd, noInteractive)
+    if !bytes.Equal(apiKey, resApiKey) || !bytes.Equal(secretKey, resSecretKey) {
+        t.Errorf("Keys mismatch: %v,%v!=%v,%v", string(apiKey), string(secretKey),
+                 string(resApiKey), string(resSecretKey))
+    }
+    
+    // from stdin pipe
+    noenv := func(string) string { return "" }
+    rdpwd = selectPasswordReader(noenv, strings.NewReader("secret password\n"),
+                                 true, noInteractive)
+    resApiKey, resSecretKey = authenticateExchangeInt(config, rdpwd, noInteractive)
+    if !bytes.Equal(apiKey, resApiKey) || !bytes.Equal(secretKey, resSecretKey) {
+        t.Errorf("Keys mismatch: %v,%v!=%v,%v", string(apiKey), string(secretKey),
+                 string(resApiKey), string(resSecretKey))
+    }
+}
+
+func TestExchAuthKeys(t *testing.T) {
+    pwdHash := passwordKeyHash([]byte("secret password"))
+    keys := []KeyPair{
+        { []byte("mainApiKey1234"), []byte("mainSecretKey5678") },
+        { []byte("backupKey"), []byte("backupSecret") },
+        { []byte("backupKey2_0123456789abcdef"), []byte("x") },
+    }
+    resKeys := decryptExchAuthKeys(pwdHash, encryptExchAuthKeys(pwdHash, keys))
+    if len(resKeys)!=len(keys) {
+        t.Fatalf("Keys length mismatch: %v!=%v", len(keys), len(resKeys))
+    }
+    for i := range keys {
+        if !bytes.Equal(keys[i].ApiKey, resKeys[i].ApiKey) ||
+                !bytes.Equal(keys[i].SecretKey, resKeys[i].SecretKey) {
+            t.Errorf("Key %d mismatch: %s,%s!=%s,%s", i, keys[i].ApiKey,
+                     keys[i].SecretKey, resKeys[i].ApiKey, resKeys[i].SecretKey)
+        }
+    }
+    // file with single key
+    resKeys = decryptExchAuthKeys(pwdHash, encryptExchAuth(pwdHash,
+                    []byte("key"), []byte("secret")))
+    if len(resKeys)!=1 || string(resKeys[0].ApiKey)!="key" ||
+            string(resKeys[0].SecretKey)!="secret" {
+        t.Errorf("Keys mismatch: %v", resKeys)
+    }
+}
+
+func TestReadPasswordLine(t *testing.T) {
+    for _, input := range []string{ "abc\n", "abc\r\n", "abc", "abc\nxyz\n" } {
+        pwd, err := readPasswordLine(strings.NewReader(input))
+        if err!=nil || string(pwd)!="abc" {
+            t.Errorf("Password mismatch for %q: %q %v", input, string(pwd), err)
+        }
+    }
+    if _, err := readPasswordLine(strings.NewReader("")); err==nil {
+        t.Errorf("No error for empty input")
+    }
+}
+
+func TestConfigCheckFiles(t *testing.T) {
+    config := prepareTestAuthFiles(t, []byte("pwd"), []byte("key"), []byte("secret"))
+    if err := config.checkFiles(); err!=nil {
+        t.Errorf("Unexpected error: %v", err)
+    }
+    
+    // missing password file
+    dir := t.TempDir()
+    missingPwd := *config
+    missingPwd.PasswordFile = filepath.Join(dir, "nopassword")
+    if err := missingPwd.checkFiles(); err==nil {
+        t.Errorf("No error for missing password file")
+    }
+    
+    // not yet created auth file in writable directory
+    newAuth := *config
+    newAuth.AuthFile = filepath.Join(dir, "exauth")
+    if err := newAuth.checkFiles(); err!=nil {
+        t.Errorf("Unexpected error: %v", err)
+    }
+    
+    // unwritable auth directory
+    noDirAuth := *config
+    noDirAuth.AuthFile = filepath.Join(dir, "nodir", "exauth")
+    if err := noDirAuth.checkFiles(); err==nil {
+        t.Errorf("No error for missing auth directory")
+    }
+    if os.Geteuid()!=0 {    // root can write everywhere
+        roDir := filepath.Join(dir, "rodir")
+        if err := os.Mkdir(roDir, 0500); err!=nil {
+            t.Fatal("Can't create directory:", err)
+        }
+        roAuth := *config
+        roAuth.AuthFile = filepath.Join(roDir, "exauth")
+        if err := roAuth.checkFiles(); err==nil {
+            t.Errorf("No error for unwritable auth directory")
+        }
+    }
+}
+
+func TestExpandPathHome(t *testing.T) {
+    cases := [][3]string{
+        { "~", "/home/user", "/home/user" },
+        { "~/exauth", "/home/user", "/home/user/exauth" },
+        { "~/bbc/password", "/home/user", "/home/user/bbc/password" },
+        { "/etc/exauth", "/home/user", "/etc/exauth" },
+        { "exauth", "/home/user", "exauth" },
+        { "~other/exauth", "/home/user", "~other/exauth" },
+    }
+    for _, c := range cases {
+        if res := expandPathHome(c[0], c[1]); res!=c[2] {
+            t.Errorf("Path mismatch for %q: %q!=%q", c[0], c[2], res)
+        }
+    }
+}
+
+func TestWarnInsecureFile(t *testing.T) {
+    dir := t.TempDir()
+    secureFile := filepath.Join(dir, "secure")
+    if err := ioutil.WriteFile(secureFile, []byte("x"), 0600); err!=nil {
+        t.Fatal("Can't write file:", err)
+    }
+    if warnInsecureFile(secureFile) {
+        t.Errorf("Warning for secure file")
+    }
+    insecureFile := filepath.Join(dir, "insecure")
+    if err := ioutil.WriteFile(insecureFile, []byte("x"), 0600); err!=nil {
+        t.Fatal("Can't write file:", err)
+    }
+    if err := os.Chmod(insecureFile, 0644); err!=nil {
+        t.Fatal("Can't change mode:", err)
+    }
+    if !warnInsecureFile(insecureFile) {
+        t.Errorf("No warning for group/world readable file")
+    }
+}
+
+func TestMaskApiKey(t *testing.T) {
+    cases := [][2]string{
+        { "abcd1234efgh5678", "abcd********5678" },
+        { "abcdefghi", "abcd*fghi" },
+        { "abcdefgh", "********" },
+        { "abc", "***" },
+        { "", "" },
+    }
+    for _, c := range cases {
+        if res := maskApiKey([]byte(c[0])); res!=c[1] {
+            t.Errorf("Masked key mismatch for %q: %q!=%q", c[0], c[1], res)
+        }
+    }
+    var out bytes.Buffer
+    PrintWhichKey(&out, []byte("abcd1234efgh5678"), []byte("supersecretvalue"))
+    expOut := "APIKey: abcd********5678\nSecretKey length: 16\n"
+    if out.String()!=expOut {
+        t.Errorf("Output mismatch: %q!=%q", expOut, out.String())
+    }
+}
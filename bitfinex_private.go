@@ -26,7 +26,11 @@ import (
     "crypto/hmac"
     "crypto/sha512"
     "encoding/hex"
+    "errors"
     "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
     "time"
     "github.com/matszpk/godec64"
     "github.com/valyala/fasthttp"
@@ -41,14 +45,18 @@ var (
     bitfinexStrApiPrefix = []byte("/api/")
     bitfinexStrEmptyJson = []byte("{}")
     bitfinexApiWallets = []byte("v2/auth/r/wallets")
-    bitfinexApiFundingLoans = []byte("v2/auth/r/funding/loans/f")
-    bitfinexApiFundingCredits = []byte("v2/auth/r/funding/credits/f")
-    bitfinexApiFundingTrades = []byte("v2/auth/r/funding/trades/f")
+    bitfinexApiFundingLoans = []byte("v2/auth/r/funding/loans/")
+    bitfinexApiFundingCredits = []byte("v2/auth/r/funding/credits/")
+    bitfinexApiFundingTrades = []byte("v2/auth/r/funding/trades/")
     bitfinexApiPositions = []byte("v2/auth/r/positions")
+    bitfinexApiMarginInfo = []byte("v2/auth/r/info/margin/base")
     bitfinexApiFundingClose = []byte("v2/auth/w/funding/close")
+    bitfinexApiFundingKeep = []byte("v2/auth/w/funding/keep")
     bitfinexApiSubmit = []byte("v2/auth/w/funding/offer/submit")
     bitfinexApiCancel = []byte("v2/auth/w/funding/offer/cancel")
-    bitfinexApiOrders = []byte("v2/auth/r/funding/offers/f")
+    bitfinexApiUpdate = []byte("v2/auth/w/funding/offer/update")
+    bitfinexApiOrders = []byte("v2/auth/r/funding/offers/")
+    bitfinexApiMarginOrders = []byte("v2/auth/r/orders")
     bitfinexStrSUCCESS = []byte("SUCCESS")
 )
 
@@ -85,6 +93,8 @@ const (
     OrderExecuted
     OrderPartiallyFilled
     OrderCanceled
+    // null status - order state is not known yet
+    OrderUnknown
 )
 
 type Order struct {
@@ -97,6 +107,7 @@ type Order struct {
     Status OrderStatus
     Rate godec64.UDec64
     Period uint32
+    Hidden bool
     Renew bool
 }
 
@@ -111,32 +122,218 @@ type Op2Result struct {
     Message string
 }
 
+type PositionType uint8
+
+const (
+    PositionMargin = iota
+    PositionDerivative
+)
+
 type Position struct {
     Id uint64
     Market string
     Status string
+    Type PositionType
     Amount godec64.UDec64
     Long bool
     BasePrice godec64.UDec64
     Funding godec64.UDec64
     LiqPrice godec64.UDec64
+    Collateral godec64.UDec64
+}
+
+// position is active (not closing or closed)
+func (pos *Position) IsActive() bool {
+    return pos.Status == "ACTIVE"
+}
+
+// margin info of account (in USD). negative values are set to zero.
+type MarginInfo struct {
+    MarginBalance godec64.UDec64
+    MarginNet godec64.UDec64
+    RequiredMargin godec64.UDec64
+}
+
+// order in trading market
+type MarginOrder struct {
+    Id uint64
+    Market string
+    Type string
+    Amount godec64.UDec64
+    Long bool
+    Price godec64.UDec64
+}
+
+type FundingTrade struct {
+    Id uint64
+    Currency string
+    CreateTime time.Time
+    OfferId uint64
+    Amount godec64.UDec64
+    Borrow bool     // true if funds has been taken (negative amount)
+    Rate godec64.UDec64
+    Period uint32
 }
 
+// default divisor of nanoseconds in nonce (100 microseconds)
+const defaultNonceDivisor = 100000
+
 type BitfinexPrivate struct {
+    lastNonce int64 // atomic, first field for 64-bit alignment
+    // divisor of Unix time in nanoseconds (resolution of nonce)
+    nonceDivisor int64
     httpClient fasthttp.HostClient
-    apiKey, apiSecret []byte
+    // main key and backup keys
+    keys []KeyPair
+    keyMutex sync.Mutex
+    keyIdx int
+    limiter *rateLimiter
+    // flags of submitted offers
+    offerFlags uint32
+    // currencies of markets (nil - not checked)
+    knownCurrencies map[string]bool
+    // deadline of requests (zero - no deadline), set by WithDeadline
+    deadline time.Time
+    // driver that owns keys, nonce and connections (nil - this driver)
+    parent *BitfinexPrivate
 }
 
 func NewBitfinexPrivate(apiKey, apiSecret []byte) *BitfinexPrivate {
     return &BitfinexPrivate{ httpClient: fasthttp.HostClient{
         Addr: "api.bitfinex.com,api-pub.bitfinex.com",
         IsTLS: true, ReadTimeout: time.Second*60 },
-        apiKey: apiKey, apiSecret: apiSecret }
+        keys: []KeyPair{ { apiKey, apiSecret } },
+        nonceDivisor: defaultNonceDivisor,
+        limiter: newRateLimiter(0, defaultPrivateRateBurst) }  // no limit
+}
+
+// get driver whose requests fail if they are not finished before deadline.
+// it shares keys, nonce and connections with drv.
+func (drv *BitfinexPrivate) WithDeadline(deadline time.Time) PrivateApi {
+    root := drv.root()
+    return &BitfinexPrivate{ nonceDivisor: root.nonceDivisor, limiter: root.limiter,
+        offerFlags: root.offerFlags, knownCurrencies: root.knownCurrencies,
+        deadline: deadline, parent: root }
+}
+
+// get driver that owns keys, nonce and connections
+func (drv *BitfinexPrivate) root() *BitfinexPrivate {
+    if drv.parent!=nil { return drv.parent }
+    return drv
+}
+
+// set rate limit for every endpoint group (requests per minute, 0 - no limit)
+func (drv *BitfinexPrivate) SetRateLimit(perMinute float64, burst int) {
+    drv.limiter = newRateLimiter(perMinute, burst)
+}
+
+// set divisor of Unix time in nanoseconds used as nonce (0 - default).
+// coarser nonce leaves gaps for other services that use same key, but
+// allows fewer requests per time unit.
+func (drv *BitfinexPrivate) SetNonceDivisor(divisor int64) {
+    if divisor <= 0 { divisor = defaultNonceDivisor }
+    drv.nonceDivisor = divisor
+}
+
+// get next nonce from time. nonce always increases, also if many requests
+// are done in single unit of nonce resolution.
+func (drv *BitfinexPrivate) nextNonce(now time.Time) int64 {
+    nonce := now.UnixNano() / drv.nonceDivisor
+    root := drv.root()
+    for {
+        last := atomic.LoadInt64(&root.lastNonce)
+        if nonce <= last { nonce = last + 1 }
+        if atomic.CompareAndSwapInt64(&root.lastNonce, last, nonce) {
+            return nonce
+        }
+    }
+}
+
+// submit hidden offers (not visible in public orderbook)
+func (drv *BitfinexPrivate) SetHiddenOffers(hidden bool) {
+    if hidden { drv.offerFlags |= bitfinexOfferFlagHidden
+    } else { drv.offerFlags &^= bitfinexOfferFlagHidden }
+}
+
+// set currencies from markets. offers can be submitted only in these
+// currencies (must be called before submitting offers).
+func (drv *BitfinexPrivate) SetKnownCurrencies(markets []Market) {
+    drv.knownCurrencies = make(map[string]bool)
+    for _, m := range markets {
+        drv.knownCurrencies[m.BaseCurrency] = true
+        drv.knownCurrencies[m.QuoteCurrency] = true
+    }
+}
+
+// panic if currency of offer is empty or unknown
+func (drv *BitfinexPrivate) checkOfferCurrency(currency string) {
+    if currency == "" {
+        panic(errors.New("Can't submit order: empty currency"))
+    }
+    if drv.knownCurrencies!=nil && !drv.knownCurrencies[currency] {
+        panic(errors.New("Can't submit order: unknown currency " + currency))
+    }
+}
+
+// resolve again API hosts after refresh period
+func (drv *BitfinexPrivate) SetDNSRefresh(refresh time.Duration) {
+    SetHttpClientDNSRefresh(&drv.httpClient, refresh)
+}
+
+// add backup key used if previous key is invalid or rate limited
+func (drv *BitfinexPrivate) AddBackupKey(apiKey, apiSecret []byte) {
+    drv.keyMutex.Lock()
+    defer drv.keyMutex.Unlock()
+    drv.keys = append(drv.keys, KeyPair{ apiKey, apiSecret })
+}
+
+func (drv *BitfinexPrivate) currentKey() (int, *KeyPair) {
+    root := drv.root()
+    root.keyMutex.Lock()
+    defer root.keyMutex.Unlock()
+    return root.keyIdx, &root.keys[root.keyIdx]
+}
+
+// switch to next key if failed key is still current key
+func (drv *BitfinexPrivate) nextKey(failedIdx int) {
+    root := drv.root()
+    root.keyMutex.Lock()
+    defer root.keyMutex.Unlock()
+    if root.keyIdx != failedIdx { return }   // already switched
+    root.keyIdx = (root.keyIdx + 1) % len(root.keys)
+    Logger.Warn("Switch to API key ", root.keyIdx+1, " of ", len(root.keys))
+}
+
+// return true if error response requires switching to other key
+func bitfinexKeyFailover(v *fastjson.Value) bool {
+    if v==nil || v.Type()!=fastjson.TypeArray { return false }
+    arr, err := v.Array()
+    if err!=nil || len(arr) < 2 || string(arr[0].GetStringBytes())!="error" {
+        return false
+    }
+    code, err := arr[1].Uint64()
+    return err==nil && (code==bitfinexErrApiKey || code==bitfinexErrRateLimit)
 }
 
+// do request and switch to next key (and repeat request) if key is invalid
+// or rate limited
 func (drv *BitfinexPrivate) handleHttpPostJson(rh *RequestHandle,
                 host, uri, query []byte, bodyStr []byte) (*fastjson.Value, int) {
-    nonceB := strconv.AppendInt(nil ,time.Now().UnixNano()/100000, 10)
+    for tries := 1; ; tries++ {
+        idx, kp := drv.currentKey()
+        v, sc := drv.handleHttpPostJsonKey(rh, kp, host, uri, query, bodyStr)
+        if sc < 400 || tries >= len(drv.root().keys) || !bitfinexKeyFailover(v) {
+            return v, sc
+        }
+        drv.nextKey(idx)
+        rh.Release()
+    }
+}
+
+func (drv *BitfinexPrivate) handleHttpPostJsonKey(rh *RequestHandle, kp *KeyPair,
+                host, uri, query []byte, bodyStr []byte) (*fastjson.Value, int) {
+    drv.limiter.wait(bitfinexEndpointGroup(uri))
+    nonceB := strconv.AppendInt(nil, drv.nextNonce(time.Now()), 10)
     // generate signature
     sig := make([]byte, 0, 200)
     sig = append(sig, bitfinexStrApiPrefix...)
@@ -144,7 +341,7 @@ func (drv *BitfinexPrivate) handleHttpPostJson(rh *RequestHandle,
     sig = append(sig, nonceB...)
     sig = append(sig, bodyStr...)
     
-    sumGen := hmac.New(sha512.New384, drv.apiSecret)
+    sumGen := hmac.New(sha512.New384, kp.SecretKey)
     if _, err := sumGen.Write(sig); err!=nil {
         ErrorPanic("Error while generating signature hash:", err)
     }
@@ -154,39 +351,49 @@ func (drv *BitfinexPrivate) handleHttpPostJson(rh *RequestHandle,
     
     headers := [][]byte{
         bitfinexStrNonce, nonceB,
-        bitfinexStrApiKey, drv.apiKey,
+        bitfinexStrApiKey, kp.ApiKey,
         bitfinexStrSignature, sumHex }
     
-    return rh.HandleHttpPostJson(&drv.httpClient, host, uri, query, bodyStr, headers)
+    rh.Deadline = drv.deadline
+    return rh.HandleHttpPostJson(&drv.root().httpClient, host, uri, query,
+                                 bodyStr, headers)
 }
 
 func bitfinexGetBalanceFromJson(v *fastjson.Value, bal *Balance) {
     arr := FastjsonGetArray(v)
     if len(arr) < 7 {
-        panic("Wrong json body")
+        panic(errWrongJsonBody)
     }
     *bal = Balance{}
     
     bal.Currency = FastjsonGetString(arr[1])
     bal.Type = FastjsonGetString(arr[0])
-    t, m := FastjsonGetUDec64Signed(arr[2], 8)
+    prec := amountPrecision(bal.Currency)
+    t, m := FastjsonGetUDec64Signed(arr[2], prec)
     if !m { bal.Total = t }
-    bal.Available = FastjsonGetUDec64(arr[4], 8)
+    bal.Available = FastjsonGetUDec64(arr[4], prec)
 }
 
-func (drv *BitfinexPrivate) GetMarginBalances() []Balance {
+// get balances of all wallets (exchange, margin and funding)
+func (drv *BitfinexPrivate) GetWallets() []Balance {
     var rh RequestHandle
     defer rh.Release()
     v, sc := drv.handleHttpPostJson(&rh, bitfinexPrivApiHost, bitfinexApiWallets, nil,
                                     bitfinexStrEmptyJson)
-    if sc >= 400 { bitfinexPanic("Can't get margin balances", v, sc) }
+    if sc >= 400 { bitfinexPanic("Can't get wallets", v, sc) }
     
     arr := FastjsonGetArray(v)
+    bals := make([]Balance, len(arr))
+    for i, v := range arr {
+        bitfinexGetBalanceFromJson(v, &bals[i])
+    }
+    return bals
+}
+
+func (drv *BitfinexPrivate) GetMarginBalances() []Balance {
+    wallets := drv.GetWallets()
     bals := make([]Balance, 0)
-    
-    for _, v := range arr {
-        var bal Balance
-        bitfinexGetBalanceFromJson(v, &bal)
+    for _, bal := range wallets {
         if bal.Type == "margin" {
             bals = append(bals, bal)
         }
@@ -197,15 +404,15 @@ func (drv *BitfinexPrivate) GetMarginBalances() []Balance {
 func bitfinexGetLoanFromJson(v *fastjson.Value, loan *Loan) {
     arr := FastjsonGetArray(v)
     if len(arr) < 21 {
-        panic("Wrong json body")
+        panic(errWrongJsonBody)
     }
     *loan = Loan{}
     loan.Id = FastjsonGetUInt64(arr[0])
-    loan.Currency = FastjsonGetString(arr[1])[1:]
+    loan.Currency = currencyFromSymbol(FastjsonGetString(arr[1]))
     loan.Side = FastjsonGetInt(arr[2])
     loan.CreateTime = FastjsonGetUnixTimeMilli(arr[3])
     loan.UpdateTime = FastjsonGetUnixTimeMilli(arr[4])
-    loan.Amount = FastjsonGetUDec64(arr[5], 8)
+    loan.Amount = FastjsonGetUDec64(arr[5], amountPrecision(loan.Currency))
     loan.Status = FastjsonGetString(arr[7])
     loan.Rate = FastjsonGetUDec64(arr[11], 12)
     loan.Period = FastjsonGetUInt32(arr[12])
@@ -216,7 +423,7 @@ func bitfinexGetLoanFromJson(v *fastjson.Value, loan *Loan) {
 func (drv *BitfinexPrivate) GetLoans(currency string) []Loan {
     apiUrl := make([]byte, 0, 60)
     apiUrl = append(apiUrl, bitfinexApiFundingLoans...)
-    apiUrl = append(apiUrl, currency...)
+    apiUrl = append(apiUrl, fundingSymbol(currency)...)
         
     var rh RequestHandle
     defer rh.Release()
@@ -238,7 +445,7 @@ func (drv *BitfinexPrivate) GetLoansHistory(currency string,
                                 since time.Time, limit uint) []Loan {
     apiUrl := make([]byte, 0, 60)
     apiUrl = append(apiUrl, bitfinexApiFundingLoans...)
-    apiUrl = append(apiUrl, currency...)
+    apiUrl = append(apiUrl, fundingSymbol(currency)...)
     apiUrl = append(apiUrl, "/hist"...)
     body := make([]byte, 0, 40)
     body = append(body, `{"limit":`...)
@@ -268,27 +475,27 @@ func (drv *BitfinexPrivate) GetLoansHistory(currency string,
 func bitfinexGetCreditFromJson(v *fastjson.Value, credit *Credit) {
     arr := FastjsonGetArray(v)
     if len(arr) < 22 {
-        panic("Wrong json body")
+        panic(errWrongJsonBody)
     }
     *credit = Credit{}
     credit.Id = FastjsonGetUInt64(arr[0])
-    credit.Currency = FastjsonGetString(arr[1])[1:]
+    credit.Currency = currencyFromSymbol(FastjsonGetString(arr[1]))
     credit.Side = FastjsonGetInt(arr[2])
     credit.CreateTime = FastjsonGetUnixTimeMilli(arr[3])
     credit.UpdateTime = FastjsonGetUnixTimeMilli(arr[4])
-    credit.Amount = FastjsonGetUDec64(arr[5], 8)
+    credit.Amount = FastjsonGetUDec64(arr[5], amountPrecision(credit.Currency))
     credit.Status = FastjsonGetString(arr[7])
     credit.Rate = FastjsonGetUDec64(arr[11], 12)
     credit.Period = FastjsonGetUInt32(arr[12])
     credit.Renew = FastjsonGetUInt32(arr[18])!=0
     credit.NoClose = FastjsonGetUInt32(arr[20])!=0
-    credit.Market = FastjsonGetString(arr[21])[1:]
+    credit.Market = marketFromSymbol(FastjsonGetString(arr[21]))
 }
 
 func (drv *BitfinexPrivate) GetCredits(currency string) []Credit {
     apiUrl := make([]byte, 0, 60)
     apiUrl = append(apiUrl, bitfinexApiFundingCredits...)
-    apiUrl = append(apiUrl, currency...)
+    apiUrl = append(apiUrl, fundingSymbol(currency)...)
         
     var rh RequestHandle
     defer rh.Release()
@@ -310,7 +517,7 @@ func (drv *BitfinexPrivate) GetCreditsHistory(currency string,
                                 since time.Time, limit uint) []Credit {
     apiUrl := make([]byte, 0, 60)
     apiUrl = append(apiUrl, bitfinexApiFundingCredits...)
-    apiUrl = append(apiUrl, currency...)
+    apiUrl = append(apiUrl, fundingSymbol(currency)...)
     apiUrl = append(apiUrl, "/hist"...)
     body := make([]byte, 0, 40)
     body = append(body, `{"limit":`...)
@@ -340,30 +547,39 @@ func (drv *BitfinexPrivate) GetCreditsHistory(currency string,
 func bitfinexGetOrderFromJson(v *fastjson.Value, order *Order) {
     arr := FastjsonGetArray(v)
     if len(arr) < 20 {
-        panic("Wrong json body")
+        panic(errWrongJsonBody)
     }
     *order = Order{}
     order.Id = FastjsonGetUInt64(arr[0])
-    order.Currency = FastjsonGetString(arr[1])[1:]
+    order.Currency = currencyFromSymbol(FastjsonGetString(arr[1]))
     order.CreateTime = FastjsonGetUnixTimeMilli(arr[2])
     order.UpdateTime = FastjsonGetUnixTimeMilli(arr[3])
-    order.Amount, _ = FastjsonGetUDec64Signed(arr[4], 8)
-    order.AmountOrig, _ = FastjsonGetUDec64Signed(arr[5], 8)
+    prec := amountPrecision(order.Currency)
+    order.Amount, _ = FastjsonGetUDec64Signed(arr[4], prec)
+    order.AmountOrig, _ = FastjsonGetUDec64Signed(arr[5], prec)
+    // status of closed orders have additional details, e.g. "EXECUTED at 0.0002(10.0)"
     status := FastjsonGetString(arr[10])
-    switch status {
-        case "ACTIVE":
+    switch {
+        case status=="":    // null - no status yet
+            order.Status = OrderUnknown
+        case strings.HasPrefix(status, "ACTIVE"):
             order.Status = OrderActive
-        case "EXECUTED":
+        case strings.HasPrefix(status, "EXECUTED"):
             order.Status = OrderExecuted
-        case "PARTIALLY FILLED":
+        case strings.HasPrefix(status, "PARTIALLY FILLED"):
             order.Status = OrderPartiallyFilled
-        case "CANCELED":
+        case strings.HasPrefix(status, "CANCELED"):
             order.Status = OrderCanceled
         default:
-            panic("Unknown order status")
+            panic(&ParseError{ Context: "Unknown order status" })
     }
     order.Rate = FastjsonGetUDec64(arr[14], 12)
     order.Period = FastjsonGetUInt32(arr[15])
+    if arr[17].Type() == fastjson.TypeNumber {
+        order.Hidden = FastjsonGetInt(arr[17])!=0
+    } else {
+        order.Hidden = FastjsonGetBool(arr[17])
+    }
     if arr[19].Type() == fastjson.TypeNumber {
         order.Renew = FastjsonGetInt(arr[19])!=0
     } else {
@@ -371,6 +587,20 @@ func bitfinexGetOrderFromJson(v *fastjson.Value, order *Order) {
     }
 }
 
+// parse result of write operation without order. error array (for example
+// ["error",10001,"..."]) is reported as APIError.
+func bitfinexGetOp2ResultFromJson(msg string, v *fastjson.Value, or *Op2Result) {
+    bitfinexCheckErrorArray(msg, v)
+    arr := FastjsonGetArray(v)
+    if len(arr) < 8 {
+        panic(errWrongJsonBody)
+    }
+    
+    *or = Op2Result{}
+    or.Success = FastjsonCheckString(arr[6], bitfinexStrSUCCESS)
+    or.Message = FastjsonGetString(arr[7])
+}
+
 func (drv *BitfinexPrivate) CloseFunding(loanId uint64, or *Op2Result) {
     body := make([]byte, 0, 30)
     body = append(body, `{"id":`...)
@@ -383,29 +613,77 @@ func (drv *BitfinexPrivate) CloseFunding(loanId uint64, or *Op2Result) {
                                     bitfinexApiFundingClose, nil, body)
     if sc >= 400 { bitfinexPanic("Can't close funding", v, sc) }
     
-    // parse submit result
+    bitfinexGetOp2ResultFromJson("Can't close funding", v, or)
+}
+
+// set keep (auto-renew after expiration) of credits
+func (drv *BitfinexPrivate) SetKeepCredits(creditIds []uint64, keep bool,
+                                           or *Op2Result) {
+    body := make([]byte, 0, 40 + 25*len(creditIds))
+    body = append(body, `{"type":"credit","changes":{`...)
+    for i, id := range creditIds {
+        if i != 0 { body = append(body, ',') }
+        body = append(body, '"')
+        body = strconv.AppendUint(body, id, 10)
+        body = append(body, `":`...)
+        if keep {
+            body = append(body, '1')
+        } else {
+            body = append(body, '0')
+        }
+    }
+    body = append(body, `}}`...)
+    
+    var rh RequestHandle
+    defer rh.Release()
+    v, sc := drv.handleHttpPostJson(&rh, bitfinexPrivApiHost,
+                                    bitfinexApiFundingKeep, nil, body)
+    if sc >= 400 { bitfinexPanic("Can't set keep funding", v, sc) }
+    
+    bitfinexGetOp2ResultFromJson("Can't set keep funding", v, or)
+}
+
+// parse result of order operation (notification with order). error array
+// is reported as APIError.
+func bitfinexGetOpResultFromJson(msg string, v *fastjson.Value, or *OpResult) {
+    bitfinexCheckErrorArray(msg, v)
     arr := FastjsonGetArray(v)
     if len(arr) < 8 {
-        panic("Wrong json body")
+        panic(errWrongJsonBody)
     }
     
-    *or = Op2Result{}
+    *or = OpResult{}
+    if arr[4].Type() == fastjson.TypeArray {    // no order if failed
+        bitfinexGetOrderFromJson(arr[4], &or.Order)
+    }
     or.Success = FastjsonCheckString(arr[6], bitfinexStrSUCCESS)
+    or.Message = FastjsonGetString(arr[7])
 }
 
-func (drv *BitfinexPrivate) SubmitBidOrder(currency string,
-                            amount,rate godec64.UDec64, period uint32,
-                            or *OpResult) {
+const bitfinexOfferFlagHidden = 64
+
+func bitfinexSubmitBidOrderBody(currency string, amount, rate godec64.UDec64,
+                                period, flags uint32) []byte {
     body := make([]byte, 0, 80)
-    body = append(body, `{"type":"LIMIT","symbol":"f`...)
-    body = append(body, currency...)
+    body = append(body, `{"type":"LIMIT","symbol":"`...)
+    body = append(body, fundingSymbol(currency)...)
     body = append(body, `","amount":"-`...)
-    body = append(body, amount.FormatBytes(8, false)...)
+    body = append(body, amount.FormatBytes(amountPrecision(currency), false)...)
     body = append(body, `","rate":"`...)
     body = append(body, rate.FormatBytes(12, false)...)
     body = append(body, `","period":`...)
     body = strconv.AppendUint(body, uint64(period), 10)
-    body = append(body, `,"flags":0}`...)
+    body = append(body, `,"flags":`...)
+    body = strconv.AppendUint(body, uint64(flags), 10)
+    body = append(body, '}')
+    return body
+}
+
+func (drv *BitfinexPrivate) SubmitBidOrder(currency string,
+                            amount,rate godec64.UDec64, period uint32,
+                            or *OpResult) {
+    drv.checkOfferCurrency(currency)
+    body := bitfinexSubmitBidOrderBody(currency, amount, rate, period, drv.offerFlags)
     
     var rh RequestHandle
     defer rh.Release()
@@ -413,16 +691,7 @@ func (drv *BitfinexPrivate) SubmitBidOrder(currency string,
                                     bitfinexApiSubmit, nil, body)
     if sc >= 400 { bitfinexPanic("Can't submit order", v, sc) }
     
-    // parse submit result
-    arr := FastjsonGetArray(v)
-    if len(arr) < 8 {
-        panic("Wrong json body")
-    }
-    
-    *or = OpResult{}
-    bitfinexGetOrderFromJson(arr[4], &or.Order)
-    or.Success = FastjsonCheckString(arr[6], bitfinexStrSUCCESS)
-    or.Message = FastjsonGetString(arr[7])
+    bitfinexGetOpResultFromJson("Can't submit order", v, or)
 }
 
 func (drv *BitfinexPrivate) CancelOrder(orderId uint64, or *OpResult) {
@@ -437,22 +706,40 @@ func (drv *BitfinexPrivate) CancelOrder(orderId uint64, or *OpResult) {
                                     bitfinexApiCancel, nil, body)
     if sc >= 400 { bitfinexPanic("Can't cancel order", v, sc) }
     
-    // parse submit result
-    arr := FastjsonGetArray(v)
-    if len(arr) < 8 {
-        panic("Wrong json body")
-    }
+    bitfinexGetOpResultFromJson("Can't cancel order", v, or)
+}
+
+func bitfinexUpdateOfferBody(orderId uint64, amount, rate godec64.UDec64,
+                             prec uint) []byte {
+    body := make([]byte, 0, 80)
+    body = append(body, `{"id":`...)
+    body = strconv.AppendUint(body, orderId, 10)
+    body = append(body, `,"amount":"-`...)
+    body = append(body, amount.FormatBytes(prec, false)...)
+    body = append(body, `","rate":"`...)
+    body = append(body, rate.FormatBytes(12, false)...)
+    body = append(body, `"}`...)
+    return body
+}
+
+// update amount and rate of bid offer in place (keeps queue priority)
+func (drv *BitfinexPrivate) UpdateOffer(currency string, orderId uint64,
+                            amount, rate godec64.UDec64, or *OpResult) {
+    body := bitfinexUpdateOfferBody(orderId, amount, rate, amountPrecision(currency))
     
-    *or = OpResult{}
-    bitfinexGetOrderFromJson(arr[4], &or.Order)
-    or.Success = FastjsonCheckString(arr[6], bitfinexStrSUCCESS)
-    or.Message = FastjsonGetString(arr[7])
+    var rh RequestHandle
+    defer rh.Release()
+    v, sc := drv.handleHttpPostJson(&rh, bitfinexPrivApiHost,
+                                    bitfinexApiUpdate, nil, body)
+    if sc >= 400 { bitfinexPanic("Can't update order", v, sc) }
+    
+    bitfinexGetOpResultFromJson("Can't update order", v, or)
 }
 
 func (drv *BitfinexPrivate) GetActiveOrders(currency string) []Order {
     apiUrl := make([]byte, 0, 60)
     apiUrl = append(apiUrl, bitfinexApiOrders...)
-    apiUrl = append(apiUrl, currency...)
+    apiUrl = append(apiUrl, fundingSymbol(currency)...)
     
     var rh RequestHandle
     defer rh.Release()
@@ -469,14 +756,105 @@ func (drv *BitfinexPrivate) GetActiveOrders(currency string) []Order {
     return orders
 }
 
+// get history of funding offers (oldest first)
+func (drv *BitfinexPrivate) GetOffersHistory(currency string,
+                                since time.Time, limit uint) []Order {
+    apiUrl := make([]byte, 0, 60)
+    apiUrl = append(apiUrl, bitfinexApiOrders...)
+    apiUrl = append(apiUrl, fundingSymbol(currency)...)
+    apiUrl = append(apiUrl, "/hist"...)
+    body := make([]byte, 0, 40)
+    body = append(body, `{"limit":`...)
+    body = strconv.AppendUint(body, uint64(limit), 10)
+    if !since.IsZero() {
+        unixTime := since.Unix()*1000 + int64(since.Nanosecond()/1000000)
+        body = append(body, `,"start":`...)
+        body = strconv.AppendInt(body, unixTime, 10)
+    }
+    body = append(body, '}')
+    
+    var rh RequestHandle
+    defer rh.Release()
+    v, sc := drv.handleHttpPostJson(&rh, bitfinexPrivApiHost, apiUrl, nil, body)
+    if sc >= 400 { bitfinexPanic("Can't get funding offers history", v, sc) }
+    
+    arr := FastjsonGetArray(v)
+    ordersLen := len(arr)
+    orders := make([]Order, ordersLen)
+    for i, v := range arr {
+        bitfinexGetOrderFromJson(v, &orders[ordersLen-i-1])
+    }
+    return orders
+}
+
+// get order by id from active orders or from orders history
+func (drv *BitfinexPrivate) GetOrder(currency string, orderId uint64) (Order, bool) {
+    orders := drv.GetActiveOrders(currency)
+    for i := 0; i < len(orders); i++ {
+        if orders[i].Id == orderId { return orders[i], true }
+    }
+    apiUrl := make([]byte, 0, 60)
+    apiUrl = append(apiUrl, bitfinexApiOrders...)
+    apiUrl = append(apiUrl, fundingSymbol(currency)...)
+    apiUrl = append(apiUrl, "/hist"...)
+    
+    var rh RequestHandle
+    defer rh.Release()
+    v, sc := drv.handleHttpPostJson(&rh, bitfinexPrivApiHost, apiUrl, nil,
+                                    bitfinexStrEmptyJson)
+    if sc >= 400 { bitfinexPanic("Can't get orders history", v, sc) }
+    
+    var order Order
+    for _, v := range FastjsonGetArray(v) {
+        bitfinexGetOrderFromJson(v, &order)
+        if order.Id == orderId { return order, true }
+    }
+    return Order{}, false
+}
+
+func bitfinexGetMarginOrderFromJson(v *fastjson.Value, order *MarginOrder) {
+    arr := FastjsonGetArray(v)
+    if len(arr) < 17 {
+        panic(errWrongJsonBody)
+    }
+    *order = MarginOrder{}
+    order.Id = FastjsonGetUInt64(arr[0])
+    order.Market = marketFromSymbol(FastjsonGetString(arr[3]))
+    amount, neg := FastjsonGetUDec64Signed(arr[6], 8)
+    order.Amount = amount
+    order.Long = !neg
+    order.Type = FastjsonGetString(arr[8])
+    order.Price, _ = FastjsonGetUDec64Signed(arr[16], 8)
+}
+
+// get active orders in margin trading (exchange orders are skipped)
+func (drv *BitfinexPrivate) GetActiveMarginOrders() []MarginOrder {
+    var rh RequestHandle
+    defer rh.Release()
+    v, sc := drv.handleHttpPostJson(&rh, bitfinexPrivApiHost, bitfinexApiMarginOrders,
+                                    nil, bitfinexStrEmptyJson)
+    if sc >= 400 { bitfinexPanic("Can't get margin orders", v, sc) }
+    
+    arr := FastjsonGetArray(v)
+    orders := make([]MarginOrder, 0, len(arr))
+    for _, v := range arr {
+        var order MarginOrder
+        bitfinexGetMarginOrderFromJson(v, &order)
+        if !strings.HasPrefix(order.Type, "EXCHANGE") {
+            orders = append(orders, order)
+        }
+    }
+    return orders
+}
+
 func bitfinexGetPositionFromJson(v *fastjson.Value, pos *Position) {
     arr := FastjsonGetArray(v)
     if len(arr) < 19 {
-        panic("Wrong json body")
+        panic(errWrongJsonBody)
     }
     *pos = Position{}
     pos.Id = FastjsonGetUInt64(arr[11])
-    pos.Market = FastjsonGetString(arr[0])[1:]
+    pos.Market = marketFromSymbol(FastjsonGetString(arr[0]))
     amount, neg := FastjsonGetUDec64Signed(arr[2], 8)
     pos.Long = !neg
     pos.Amount = amount
@@ -485,6 +863,55 @@ func bitfinexGetPositionFromJson(v *fastjson.Value, pos *Position) {
     pos.Funding, _ = FastjsonGetUDec64Signed(arr[4], 8)
     pos.LiqPrice = FastjsonGetUDec64(arr[8], 8)
     pos.Status = FastjsonGetString(arr[1])
+    pos.Type = PositionType(FastjsonGetUInt32(arr[15]))
+    pos.Collateral, _ = FastjsonGetUDec64Signed(arr[17], 8)
+}
+
+func bitfinexGetFundingTradeFromJson(v *fastjson.Value, ft *FundingTrade) {
+    arr := FastjsonGetArray(v)
+    if len(arr) < 7 {
+        panic(errWrongJsonBody)
+    }
+    *ft = FundingTrade{}
+    ft.Id = FastjsonGetUInt64(arr[0])
+    ft.Currency = currencyFromSymbol(FastjsonGetString(arr[1]))
+    ft.CreateTime = FastjsonGetUnixTimeMilli(arr[2])
+    ft.OfferId = FastjsonGetUInt64(arr[3])
+    ft.Amount, ft.Borrow = FastjsonGetUDec64Signed(arr[4],
+                                    amountPrecision(ft.Currency))
+    ft.Rate = FastjsonGetUDec64(arr[5], 12)
+    ft.Period = FastjsonGetUInt32(arr[6])
+}
+
+func (drv *BitfinexPrivate) GetFundingTrades(currency string,
+                                since time.Time, limit uint) []FundingTrade {
+    apiUrl := make([]byte, 0, 60)
+    apiUrl = append(apiUrl, bitfinexApiFundingTrades...)
+    apiUrl = append(apiUrl, fundingSymbol(currency)...)
+    apiUrl = append(apiUrl, "/hist"...)
+    body := make([]byte, 0, 40)
+    body = append(body, `{"limit":`...)
+    body = strconv.AppendUint(body, uint64(limit), 10)
+    if !since.IsZero() {
+        unixTime := since.Unix()*1000 + int64(since.Nanosecond()/1000000)
+        body = append(body, `,"start":`...)
+        body = strconv.AppendInt(body, unixTime, 10)
+    }
+    body = append(body, '}')
+    
+    var rh RequestHandle
+    defer rh.Release()
+    v, sc := drv.handleHttpPostJson(&rh, bitfinexPrivApiHost, apiUrl, nil, body)
+    if sc >= 400 { bitfinexPanic("Can't get funding trades", v, sc) }
+    
+    arr := FastjsonGetArray(v)
+    tradesLen := len(arr)
+    trades := make([]FundingTrade, tradesLen)
+    
+    for i, v := range arr {
+        bitfinexGetFundingTradeFromJson(v, &trades[tradesLen-i-1])
+    }
+    return trades
 }
 
 func (drv *BitfinexPrivate) GetPositions() []Position {
@@ -502,3 +929,31 @@ func (drv *BitfinexPrivate) GetPositions() []Position {
     }
     return poss
 }
+
+// parse base margin info: ["base",[USER_PL,USER_SWAPS,MARGIN_BALANCE,MARGIN_NET,MARGIN_MIN]]
+func bitfinexGetMarginInfoFromJson(v *fastjson.Value, mi *MarginInfo) {
+    arr := FastjsonGetArray(v)
+    if len(arr) < 2 {
+        panic(errWrongJsonBody)
+    }
+    arr = FastjsonGetArray(arr[1])
+    if len(arr) < 5 {
+        panic(errWrongJsonBody)
+    }
+    *mi = MarginInfo{}
+    if b, neg := FastjsonGetUDec64Signed(arr[2], 8); !neg { mi.MarginBalance = b }
+    if n, neg := FastjsonGetUDec64Signed(arr[3], 8); !neg { mi.MarginNet = n }
+    mi.RequiredMargin = FastjsonGetUDec64(arr[4], 8)
+}
+
+func (drv *BitfinexPrivate) GetMarginInfo() MarginInfo {
+    var rh RequestHandle
+    defer rh.Release()
+    v, sc := drv.handleHttpPostJson(&rh, bitfinexPrivApiHost, bitfinexApiMarginInfo,
+                                    nil, bitfinexStrEmptyJson)
+    if sc >= 400 { bitfinexPanic("Can't get margin info", v, sc) }
+    
+    var mi MarginInfo
+    bitfinexGetMarginInfoFromJson(v, &mi)
+    return mi
+}
@@ -0,0 +1,480 @@
+/*
+ * bitfinex_private_test.go - Bitfinex Private client tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "net"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    "github.com/valyala/fasthttp"
+    "github.com/valyala/fasthttp/fasthttputil"
+    "github.com/valyala/fastjson"
+)
+
+func TestBitfinexGetLoanFromJsonNulls(t *testing.T) {
+    v := fastjson.MustParse(`[2995368,"fUST",1,1621845005000,null,
+        1000.5,0,null,"FIXED",null,null,0.0002,2,null,null,0,0,null,null,null,null]`)
+    var loan Loan
+    bitfinexGetLoanFromJson(v, &loan)
+    expLoan := Loan{ Id: 2995368, Currency: "UST", Side: 1,
+        CreateTime: time.Unix(1621845005, 0), Amount: 100050000000,
+        Rate: 200000000, Period: 2 }
+    if loan!=expLoan {
+        t.Errorf("Loan mismatch: %v!=%v", expLoan, loan)
+    }
+}
+
+func TestBitfinexGetCreditFromJsonNulls(t *testing.T) {
+    v := fastjson.MustParse(`[26222883,"fUST",-1,1621845005000,1621845006000,
+        120.25,0,"ACTIVE","FIXED",null,null,0.0001,2,null,null,0,0,null,0,null,0,null]`)
+    var credit Credit
+    bitfinexGetCreditFromJson(v, &credit)
+    expCredit := Credit{ Loan{ Id: 26222883, Currency: "UST", Side: -1,
+        CreateTime: time.Unix(1621845005, 0), UpdateTime: time.Unix(1621845006, 0),
+        Amount: 12025000000, Status: "ACTIVE", Rate: 100000000, Period: 2 }, "" }
+    if credit!=expCredit {
+        t.Errorf("Credit mismatch: %v!=%v", expCredit, credit)
+    }
+}
+
+func TestBitfinexGetCreditFromJsonCreateTime(t *testing.T) {
+    // timestamps of credits are in milliseconds
+    v := fastjson.MustParse(`[26222883,"fUST",-1,1621845005000,1621845006000,
+        120.25,0,"ACTIVE","FIXED",null,null,0.0001,2,null,null,0,0,null,0,null,0,null]`)
+    var credit Credit
+    bitfinexGetCreditFromJson(v, &credit)
+    if year := credit.CreateTime.UTC().Year(); year!=2021 {
+        t.Errorf("CreateTime is not sane: %v", credit.CreateTime)
+    }
+    expireTime := credit.CreateTime.Add(24*time.Hour*time.Duration(credit.Period))
+    if expireTime.Sub(credit.UpdateTime) != 48*time.Hour - time.Second {
+        t.Errorf("Expire time mismatch: %v", expireTime)
+    }
+}
+
+func TestBitfinexGetPositionFromJsonNulls(t *testing.T) {
+    v := fastjson.MustParse(`["tBTCUST","ACTIVE",0.5,40000,null,null,null,null,
+        null,null,null,142355652,null,null,null,null,null,null,null]`)
+    var pos Position
+    bitfinexGetPositionFromJson(v, &pos)
+    expPos := Position{ Id: 142355652, Market: "BTCUST", Status: "ACTIVE",
+        Amount: 50000000, Long: true, BasePrice: 4000000000000 }
+    if pos!=expPos {
+        t.Errorf("Position mismatch: %v!=%v", expPos, pos)
+    }
+}
+
+func TestBitfinexGetOrderFromJsonNulls(t *testing.T) {
+    v := fastjson.MustParse(`[1234567,"fUST",1621845005000,null,-150,-150,
+        "LIMIT",null,null,0,null,null,null,null,0.0003,2,0,0,null,null,null]`)
+    var order Order
+    bitfinexGetOrderFromJson(v, &order)
+    expOrder := Order{ Id: 1234567, Currency: "UST",
+        CreateTime: time.Unix(1621845005, 0), Amount: 15000000000,
+        AmountOrig: 15000000000, Status: OrderUnknown, Rate: 300000000, Period: 2 }
+    if order!=expOrder {
+        t.Errorf("Order mismatch: %v!=%v", expOrder, order)
+    }
+}
+
+func TestBitfinexGetOrderFromJsonStatus(t *testing.T) {
+    cases := []struct{
+        status string
+        expStatus OrderStatus
+    }{
+        { "ACTIVE", OrderActive },
+        { "EXECUTED at 0.0003(150.0)", OrderExecuted },
+        { "PARTIALLY FILLED at 0.0003(50.0)", OrderPartiallyFilled },
+        { "CANCELED", OrderCanceled },
+        { "CANCELED was: PARTIALLY FILLED at 0.0003(50.0)", OrderCanceled },
+    }
+    for _, c := range cases {
+        v := fastjson.MustParse(`[1234567,"fUST",1621845005000,1621845006000,-100,-150,
+            "LIMIT",null,null,0,"` + c.status + `",null,null,null,0.0003,2,0,0,null,0,null]`)
+        var order Order
+        bitfinexGetOrderFromJson(v, &order)
+        if order.Status!=c.expStatus {
+            t.Errorf("Status mismatch for %q: %v!=%v", c.status, c.expStatus, order.Status)
+        }
+    }
+}
+
+func TestBitfinexGetBalanceFromJsonNulls(t *testing.T) {
+    v := fastjson.MustParse(`["margin","UST",1500.5,0,null,null,null]`)
+    var bal Balance
+    bitfinexGetBalanceFromJson(v, &bal)
+    expBal := Balance{ Type: "margin", Currency: "UST", Total: 150050000000 }
+    if bal!=expBal {
+        t.Errorf("Balance mismatch: %v!=%v", expBal, bal)
+    }
+}
+
+func TestBitfinexGetFundingTradeFromJson(t *testing.T) {
+    v := fastjson.MustParse(`[636040,"fUST",1621845005000,1234567,-150.5,0.0003,2,null]`)
+    var ft FundingTrade
+    bitfinexGetFundingTradeFromJson(v, &ft)
+    expFt := FundingTrade{ Id: 636040, Currency: "UST",
+        CreateTime: time.Unix(1621845005, 0), OfferId: 1234567,
+        Amount: 15050000000, Borrow: true, Rate: 300000000, Period: 2 }
+    if ft!=expFt {
+        t.Errorf("FundingTrade mismatch: %v!=%v", expFt, ft)
+    }
+}
+
+func TestBitfinexGetMarginOrderFromJson(t *testing.T) {
+    v := fastjson.MustParse(`[31234,null,1621,"tBTCUST",1621845005000,1621845005000,
+        -0.25,-0.25,"LIMIT",null,null,null,0,"ACTIVE",null,null,40100,0,0,0]`)
+    var order MarginOrder
+    bitfinexGetMarginOrderFromJson(v, &order)
+    expOrder := MarginOrder{ Id: 31234, Market: "BTCUST", Type: "LIMIT",
+        Amount: 25000000, Long: false, Price: 4010000000000 }
+    if order!=expOrder {
+        t.Errorf("MarginOrder mismatch: %v!=%v", expOrder, order)
+    }
+}
+
+func TestBitfinexParseAmountPrecision(t *testing.T) {
+    SetAmountPrecisions(map[string]uint{ "XYZ": 6 })
+    defer SetAmountPrecisions(nil)
+    
+    v := fastjson.MustParse(`[26222883,"fXYZ",-1,1621845005000,1621845006000,
+        120.123456,0,"ACTIVE","FIXED",null,null,0.0001,2,null,null,0,0,null,0,null,0,
+        "tXYZUSD"]`)
+    var credit Credit
+    bitfinexGetCreditFromJson(v, &credit)
+    if credit.Amount!=120123456 {
+        t.Errorf("Credit amount mismatch: %v!=%v", 120123456, credit.Amount)
+    }
+    v = fastjson.MustParse(`["margin","XYZ",1500.5,0,1400.25,null,null]`)
+    var bal Balance
+    bitfinexGetBalanceFromJson(v, &bal)
+    if bal.Total!=1500500000 || bal.Available!=1400250000 {
+        t.Errorf("Balance mismatch: %v", bal)
+    }
+    // default precision for other currencies
+    v = fastjson.MustParse(`["margin","UST",1500.5,0,1400.25,null,null]`)
+    bitfinexGetBalanceFromJson(v, &bal)
+    if bal.Total!=150050000000 || bal.Available!=140025000000 {
+        t.Errorf("Balance mismatch: %v", bal)
+    }
+    
+    var ob OrderBook
+    bitfinexGetOrderBookFromJson(fastjson.MustParse(`[[0.0002,2,3,-1000.5],
+        [0.0003,2,1,250.000001]]`), &ob, amountPrecision("XYZ"))
+    if len(ob.Bid)!=1 || len(ob.Ask)!=1 || ob.Bid[0].Amount!=1000500000 ||
+            ob.Ask[0].Amount!=250000001 {
+        t.Errorf("Orderbook mismatch: %v", ob)
+    }
+}
+
+func TestBitfinexUpdateOfferBody(t *testing.T) {
+    body := bitfinexUpdateOfferBody(1234567, 15050000000, 300000000, 8)
+    expBody := `{"id":1234567,"amount":"-150.50000000","rate":"0.000300000000"}`
+    if string(body)!=expBody {
+        t.Errorf("Body mismatch: %s!=%s", expBody, string(body))
+    }
+}
+
+func TestBitfinexSubmitBidOrderBodyHidden(t *testing.T) {
+    drv := NewBitfinexPrivate([]byte("key"), []byte("secret"))
+    body := bitfinexSubmitBidOrderBody("UST", 15050000000, 300000000, 2, drv.offerFlags)
+    expBody := `{"type":"LIMIT","symbol":"fUST","amount":"-150.50000000",` +
+            `"rate":"0.000300000000","period":2,"flags":0}`
+    if string(body)!=expBody {
+        t.Errorf("Body mismatch: %s!=%s", expBody, string(body))
+    }
+    drv.SetHiddenOffers(true)
+    body = bitfinexSubmitBidOrderBody("UST", 15050000000, 300000000, 2, drv.offerFlags)
+    expBody = `{"type":"LIMIT","symbol":"fUST","amount":"-150.50000000",` +
+            `"rate":"0.000300000000","period":2,"flags":64}`
+    if string(body)!=expBody {
+        t.Errorf("Body mismatch: %s!=%s", expBody, string(body))
+    }
+    // hidden flag of offer
+    v := fastjson.MustParse(`[1234567,"fUST",1621845005000,1621845006000,-50,-150,
+        "LIMIT",null,null,64,"PARTIALLY FILLED at 0.0003(100.0)",null,null,null,
+        0.0003,2,0,1,null,0,null]`)
+    var order Order
+    bitfinexGetOrderFromJson(v, &order)
+    if !order.Hidden || order.Status!=OrderPartiallyFilled {
+        t.Errorf("Order mismatch: %v", order)
+    }
+}
+
+func TestBitfinexGetOpResultFromJson(t *testing.T) {
+    v := fastjson.MustParse(`[1621845006000,"fou-req",null,null,
+        [1234567,"fUST",1621845005000,1621845006000,-150.5,-150.5,"LIMIT",null,null,0,
+        "ACTIVE",null,null,null,0.0003,2,0,0,null,0,null],
+        null,"SUCCESS","Updating offer"]`)
+    var or OpResult
+    bitfinexGetOpResultFromJson("Can't update order", v, &or)
+    expOr := OpResult{ Order: Order{ Id: 1234567, Currency: "UST",
+        CreateTime: time.Unix(1621845005, 0), UpdateTime: time.Unix(1621845006, 0),
+        Amount: 15050000000, AmountOrig: 15050000000, Status: OrderActive,
+        Rate: 300000000, Period: 2 }, Success: true, Message: "Updating offer" }
+    if or!=expOr {
+        t.Errorf("Result mismatch: %v!=%v", expOr, or)
+    }
+    v = fastjson.MustParse(`[1621845006000,"fou-req",null,null,null,null,"ERROR",
+        "offer not found"]`)
+    bitfinexGetOpResultFromJson("Can't update order", v, &or)
+    expOr = OpResult{ Message: "offer not found" }
+    if or!=expOr {
+        t.Errorf("Result mismatch: %v!=%v", expOr, or)
+    }
+}
+
+func TestBitfinexWriteResultErrorArray(t *testing.T) {
+    v := fastjson.MustParse(`["error",10001,"Invalid offer: not enough balance"]`)
+    cases := []struct{
+        name string
+        f func()
+    }{
+        { "Can't submit order", func() {
+            var or OpResult
+            bitfinexGetOpResultFromJson("Can't submit order", v, &or)
+        } },
+        { "Can't cancel order", func() {
+            var or OpResult
+            bitfinexGetOpResultFromJson("Can't cancel order", v, &or)
+        } },
+        { "Can't update order", func() {
+            var or OpResult
+            bitfinexGetOpResultFromJson("Can't update order", v, &or)
+        } },
+        { "Can't close funding", func() {
+            var or Op2Result
+            bitfinexGetOp2ResultFromJson("Can't close funding", v, &or)
+        } },
+        { "Can't set keep funding", func() {
+            var or Op2Result
+            bitfinexGetOp2ResultFromJson("Can't set keep funding", v, &or)
+        } },
+    }
+    for _, c := range cases {
+        err, _ := recoverCall(c.f)
+        apiErr, ok := err.(*APIError)
+        if !ok {
+            t.Errorf("No APIError for %s: %v", c.name, err)
+            continue
+        }
+        expErr := APIError{ Context: c.name, Code: 10001,
+                Message: "Invalid offer: not enough balance" }
+        if *apiErr!=expErr {
+            t.Errorf("Error mismatch for %s: %v!=%v", c.name, expErr, *apiErr)
+        }
+    }
+    // correct result of close funding
+    v = fastjson.MustParse(`[1621845006000,"fcc-req",null,null,null,null,"SUCCESS",
+        "Closing funding"]`)
+    var or Op2Result
+    bitfinexGetOp2ResultFromJson("Can't close funding", v, &or)
+    if !or.Success || or.Message!="Closing funding" {
+        t.Errorf("Result mismatch: %v", or)
+    }
+}
+
+func TestBitfinexGetMarginInfoFromJson(t *testing.T) {
+    v := fastjson.MustParse(`["base",[-12.5,0,1500.25,1487.75,300.5]]`)
+    var mi MarginInfo
+    bitfinexGetMarginInfoFromJson(v, &mi)
+    expMi := MarginInfo{ MarginBalance: 150025000000, MarginNet: 148775000000,
+                RequiredMargin: 30050000000 }
+    if mi!=expMi {
+        t.Errorf("Margin info mismatch: %v!=%v", expMi, mi)
+    }
+    v = fastjson.MustParse(`["base",[-2000,0,1500,-500,300]]`)
+    bitfinexGetMarginInfoFromJson(v, &mi)
+    expMi = MarginInfo{ MarginBalance: 150000000000, RequiredMargin: 30000000000 }
+    if mi!=expMi {
+        t.Errorf("Margin info mismatch: %v!=%v", expMi, mi)
+    }
+}
+
+func TestBitfinexPrivateKeyFailover(t *testing.T) {
+    ln := fasthttputil.NewInmemoryListener()
+    defer ln.Close()
+    var usedKeys []string
+    var mutex sync.Mutex
+    server := &fasthttp.Server{ Handler: func(ctx *fasthttp.RequestCtx) {
+        apiKey := string(ctx.Request.Header.Peek("bfx-apikey"))
+        mutex.Lock()
+        usedKeys = append(usedKeys, apiKey)
+        mutex.Unlock()
+        ctx.SetContentType("application/json; charset=utf-8")
+        if apiKey=="key1" {
+            ctx.SetStatusCode(500)
+            ctx.SetBodyString(`["error",10100,"apikey: invalid"]`)
+            return
+        }
+        ctx.SetBodyString(`[]`)
+    } }
+    go server.Serve(ln)
+    
+    drv := NewBitfinexPrivate([]byte("key1"), []byte("secret1"))
+    drv.httpClient = fasthttp.HostClient{ Addr: "api.bitfinex.com",
+        Dial: func(addr string) (net.Conn, error) { return ln.Dial() } }
+    drv.SetRateLimit(0, 0)
+    drv.AddBackupKey([]byte("key2"), []byte("secret2"))
+    if poss := drv.GetPositions(); len(poss)!=0 {
+        t.Errorf("Positions mismatch: %v", poss)
+    }
+    // next request uses backup key
+    drv.GetPositions()
+    expKeys := []string{ "key1", "key2", "key2" }
+    if len(usedKeys)!=len(expKeys) {
+        t.Fatalf("Used keys mismatch: %v", usedKeys)
+    }
+    for i := range expKeys {
+        if usedKeys[i]!=expKeys[i] {
+            t.Errorf("Used keys mismatch: %v!=%v", expKeys, usedKeys)
+        }
+    }
+    
+    // single invalid key - error is reported
+    drv = NewBitfinexPrivate([]byte("key1"), []byte("secret1"))
+    drv.httpClient = fasthttp.HostClient{ Addr: "api.bitfinex.com",
+        Dial: func(addr string) (net.Conn, error) { return ln.Dial() } }
+    drv.SetRateLimit(0, 0)
+    err, _ := recoverCall(func() { drv.GetPositions() })
+    if apiErr, ok := err.(*APIError); !ok || apiErr.Code!=bitfinexErrApiKey {
+        t.Errorf("Error mismatch: %v", err)
+    }
+}
+
+func TestBitfinexPrivateWithDeadline(t *testing.T) {
+    ln := fasthttputil.NewInmemoryListener()
+    defer ln.Close()
+    hangCh := make(chan struct{})
+    defer close(hangCh)
+    var usedKeys []string
+    var mutex sync.Mutex
+    server := &fasthttp.Server{ Handler: func(ctx *fasthttp.RequestCtx) {
+        mutex.Lock()
+        usedKeys = append(usedKeys, string(ctx.Request.Header.Peek("bfx-apikey")))
+        mutex.Unlock()
+        <-hangCh    // endpoint hangs
+    } }
+    go server.Serve(ln)
+    
+    drv := NewBitfinexPrivate([]byte("key1"), []byte("secret1"))
+    drv.httpClient = fasthttp.HostClient{ Addr: "api.bitfinex.com",
+        Dial: func(addr string) (net.Conn, error) { return ln.Dial() } }
+    drv.SetRateLimit(0, 0)
+    start := time.Now()
+    ddrv := drv.WithDeadline(start.Add(50*time.Millisecond))
+    err, _ := recoverCall(func() { ddrv.GetPositions() })
+    if err==nil {
+        t.Errorf("Request not failed at deadline")
+    }
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("Request not finished at deadline: %v", d)
+    }
+    mutex.Lock()
+    defer mutex.Unlock()
+    if len(usedKeys)!=1 || usedKeys[0]!="key1" {
+        t.Errorf("Used keys mismatch: %v", usedKeys)
+    }
+}
+
+func TestBitfinexPrivateSubmitUnknownCurrency(t *testing.T) {
+    drv := NewBitfinexPrivate([]byte("key"), []byte("secret"))
+    drv.SetKnownCurrencies([]Market{ Market{ "BTCUST", "BTC", "UST" },
+                Market{ "TESTBTC:TESTUSD", "TESTBTC", "TESTUSD" } })
+    // guard fires before any request
+    for _, curr := range []string{ "XYZ", "" } {
+        var or OpResult
+        err, _ := recoverCall(func() {
+            drv.SubmitBidOrder(curr, 10000000000, 200000000, 2, &or)
+        })
+        if err==nil || !strings.Contains(err.Error(), "currency") {
+            t.Errorf("No currency error for %q: %v", curr, err)
+        }
+    }
+    drv.checkOfferCurrency("UST")
+    drv.checkOfferCurrency("TESTUSD")
+}
+
+func TestBitfinexPrivateNonce(t *testing.T) {
+    drv := NewBitfinexPrivate([]byte("key"), []byte("secret"))
+    now := time.Date(2021, 9, 14, 15, 37, 11, 123456789, time.UTC)
+    // default resolution - 100 microseconds
+    if nonce := drv.nextNonce(now); nonce!=now.UnixNano()/100000 {
+        t.Errorf("Nonce mismatch: %v!=%v", now.UnixNano()/100000, nonce)
+    }
+    // milliseconds
+    drv = NewBitfinexPrivate([]byte("key"), []byte("secret"))
+    drv.SetNonceDivisor(1000000)
+    if nonce := drv.nextNonce(now); nonce!=1631633831123 {
+        t.Errorf("Nonce mismatch: %v!=1631633831123", nonce)
+    }
+    // nonce increases in same unit of resolution
+    if nonce := drv.nextNonce(now.Add(time.Microsecond)); nonce!=1631633831124 {
+        t.Errorf("Nonce mismatch: %v!=1631633831124", nonce)
+    }
+    if nonce := drv.nextNonce(now.Add(10*time.Millisecond)); nonce!=1631633831133 {
+        t.Errorf("Nonce mismatch: %v!=1631633831133", nonce)
+    }
+}
+
+func TestBitfinexPrivateGetOffersHistory(t *testing.T) {
+    ln := fasthttputil.NewInmemoryListener()
+    defer ln.Close()
+    var reqPath, reqBody string
+    server := &fasthttp.Server{ Handler: func(ctx *fasthttp.RequestCtx) {
+        reqPath = string(ctx.Path())
+        reqBody = string(ctx.PostBody())
+        ctx.SetContentType("application/json; charset=utf-8")
+        // newest first
+        ctx.SetBodyString(`[
+[1002,"fUST",1621845009000,1621845010000,0,-150,"LIMIT",null,null,0,
+    "EXECUTED at 0.0003(150.0)",null,null,null,0.0003,2,0,0,null,0,null],
+[1001,"fUST",1621845005000,1621845006000,-100,-150,"LIMIT",null,null,0,
+    "CANCELED was: PARTIALLY FILLED at 0.0002(50.0)",null,null,null,0.0002,2,0,0,null,0,null]]`)
+    } }
+    go server.Serve(ln)
+    
+    drv := NewBitfinexPrivate([]byte("key"), []byte("secret"))
+    drv.httpClient = fasthttp.HostClient{ Addr: "api.bitfinex.com",
+        Dial: func(addr string) (net.Conn, error) { return ln.Dial() } }
+    drv.SetRateLimit(0, 0)
+    orders := drv.GetOffersHistory("UST", time.Unix(1621845000, 0), 50)
+    if reqPath!="/v2/auth/r/funding/offers/fUST/hist" ||
+            reqBody!=`{"limit":50,"start":1621845000000}` {
+        t.Errorf("Request mismatch: %v %v", reqPath, reqBody)
+    }
+    if len(orders)!=2 || orders[0].Id!=1001 || orders[1].Id!=1002 {
+        t.Fatalf("Orders mismatch: %v", orders)
+    }
+    if orders[0].Status!=OrderCanceled || orders[0].Amount!=10000000000 ||
+            orders[1].Status!=OrderExecuted || orders[1].AmountOrig!=15000000000 {
+        t.Errorf("Orders mismatch: %v", orders)
+    }
+    // without start
+    drv.GetOffersHistory("UST", time.Time{}, 10)
+    if reqBody!=`{"limit":10}` {
+        t.Errorf("Request body mismatch: %v", reqBody)
+    }
+}
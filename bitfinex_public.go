@@ -23,10 +23,11 @@
 package main
 
 import (
-    "fmt"
+    "net/http"
     "sort"
     "strconv"
     "strings"
+    "sync"
     "time"
     "github.com/matszpk/godec64"
     "github.com/valyala/fasthttp"
@@ -35,11 +36,14 @@ import (
 
 var (
     bitfinexPubApiHost = []byte("api-pub.bitfinex.com")
-    bitfinexApiTrades = []byte("/v2/trades/f")
-    bitfinexApiOrderBook = []byte("/v2/book/f")
+    bitfinexApiTrades = []byte("/v2/trades/")
+    bitfinexApiOrderBook = []byte("/v2/book/")
     bitfinexApiCandles = []byte("/v2/candles/trade:")
     bitfinexApiMarkets = []byte("v2/conf/pub:list:pair:exchange")
     bitfinexApiTicker = []byte("/v2/ticker/t")
+    bitfinexApiFundingTicker = []byte("/v2/ticker/")
+    bitfinexApiTickers = []byte("/v2/tickers?symbols=")
+    bitfinexApiPlatformStatus = []byte("/v2/platform/status")
 )
 
 // About rate: interest rate in percent is multiplied by 10000000000
@@ -120,6 +124,8 @@ func (s OrderBookEntryRevSorter) Swap(i, j int) {
 type OrderBook struct {
     Bid []OrderBookEntry
     Ask []OrderBookEntry
+    // true if it is first realtime orderbook after resubscription
+    Baseline bool
 }
 
 func (ob *OrderBook) copyFrom(src *OrderBook) {
@@ -130,6 +136,68 @@ func (ob *OrderBook) copyFrom(src *OrderBook) {
     ob.Ask = append(ob.Ask, src.Ask[:alen]...)
 }
 
+func appendOrderBookEntriesJson(body []byte, entries []OrderBookEntry,
+                                prec uint) []byte {
+    body = append(body, '[')
+    for i := 0; i < len(entries); i++ {
+        if i != 0 { body = append(body, ',') }
+        body = append(body, `{"period":`...)
+        body = strconv.AppendUint(body, uint64(entries[i].Period), 10)
+        body = append(body, `,"amount":"`...)
+        body = append(body, entries[i].Amount.FormatBytes(prec, true)...)
+        body = append(body, `","rate":"`...)
+        body = append(body, entries[i].Rate.FormatBytes(12, true)...)
+        body = append(body, `","count":`...)
+        body = strconv.AppendUint(body, uint64(entries[i].Count), 10)
+        body = append(body, '}')
+    }
+    return append(body, ']')
+}
+
+// append orderbook (all levels of both sides) in JSON.
+// prec - number of decimals of amounts.
+func (ob *OrderBook) AppendJson(body []byte, prec uint) []byte {
+    body = append(body, `{"bid":`...)
+    body = appendOrderBookEntriesJson(body, ob.Bid, prec)
+    body = append(body, `,"ask":`...)
+    body = appendOrderBookEntriesJson(body, ob.Ask, prec)
+    return append(body, '}')
+}
+
+// cumulative amount fractions of asks used by depth summary
+var depthSummaryPercentiles = [5]float64{ 0.1, 0.25, 0.5, 0.75, 0.9 }
+
+// summary of orderbook liquidity
+type DepthSummary struct {
+    TotalAsk godec64.UDec64
+    TotalBid godec64.UDec64
+    // rates of asks at cumulative amounts given by depthSummaryPercentiles
+    AskRates [len(depthSummaryPercentiles)]godec64.UDec64
+}
+
+// get total ask and bid amounts and ask rates at cumulative amount percentiles.
+// asks must be sorted from lowest rate.
+func (ob *OrderBook) DepthSummary() DepthSummary {
+    var ds DepthSummary
+    for i := 0; i < len(ob.Bid); i++ {
+        ds.TotalBid += ob.Bid[i].Amount
+    }
+    for i := 0; i < len(ob.Ask); i++ {
+        ds.TotalAsk += ob.Ask[i].Amount
+    }
+    if len(ob.Ask) == 0 { return ds }
+    var cumAmount godec64.UDec64
+    obi := 0
+    for pi, p := range depthSummaryPercentiles {
+        threshold := godec64.UDec64(float64(ds.TotalAsk)*p)
+        for ; obi < len(ob.Ask)-1 && cumAmount + ob.Ask[obi].Amount < threshold; obi++ {
+            cumAmount += ob.Ask[obi].Amount
+        }
+        ds.AskRates[pi] = ob.Ask[obi].Rate
+    }
+    return ds
+}
+
 // Candle structure
 type Candle struct {
     TimeStamp time.Time     /// timestamp
@@ -139,34 +207,138 @@ type Candle struct {
     Volume godec64.UDec64
 }
 
+// default time to live of cached markets
+const defaultMarketsCacheTTL = 5*time.Minute
+
+// default number of retries of first markets fetch and delay before first retry
+// (doubled for every next retry)
+const (
+    defaultMarketsFetchRetries = 5
+    marketsFetchRetryDelay = 2*time.Second
+)
+
 type BitfinexPublic struct {
     httpClient fasthttp.HostClient
+    
+    marketsMutex sync.Mutex
+    markets []Market
+    marketsTime time.Time
+    marketsTTL time.Duration
+    fetchMarkets func() []Market
+    // retries of first markets fetch (at startup)
+    marketsRetries int
+    now func() time.Time
+    sleep func(time.Duration)
 }
 
 func NewBitfinexPublic() *BitfinexPublic {
-    return &BitfinexPublic{ httpClient: fasthttp.HostClient{
+    drv := &BitfinexPublic{ httpClient: fasthttp.HostClient{
         Addr: "api.bitfinex.com,api-pub.bitfinex.com",
-        IsTLS: true, ReadTimeout: time.Second*60 } }
+        IsTLS: true, ReadTimeout: time.Second*60 },
+        marketsTTL: defaultMarketsCacheTTL, marketsRetries: defaultMarketsFetchRetries,
+        now: time.Now, sleep: time.Sleep }
+    drv.fetchMarkets = drv.getMarketsFromApi
+    return drv
+}
+
+// set time to live of cached markets
+func (drv *BitfinexPublic) SetMarketsCacheTTL(ttl time.Duration) {
+    drv.marketsMutex.Lock()
+    defer drv.marketsMutex.Unlock()
+    drv.marketsTTL = ttl
+}
+
+// set number of retries of first markets fetch if error is transient
+func (drv *BitfinexPublic) SetMarketsFetchRetries(retries int) {
+    drv.marketsMutex.Lock()
+    defer drv.marketsMutex.Unlock()
+    drv.marketsRetries = retries
+}
+
+// resolve again API hosts after refresh period
+func (drv *BitfinexPublic) SetDNSRefresh(refresh time.Duration) {
+    SetHttpClientDNSRefresh(&drv.httpClient, refresh)
+}
+
+// default number of decimals of amounts
+const defaultAmountPrecision = 8
+
+var (
+    amountPrecisionsMutex sync.RWMutex
+    amountPrecisions map[string]uint
+)
+
+// set number of decimals of amounts for currencies with non-standard precision
+func SetAmountPrecisions(precs map[string]uint) {
+    amountPrecisionsMutex.Lock()
+    defer amountPrecisionsMutex.Unlock()
+    amountPrecisions = make(map[string]uint, len(precs))
+    for curr, prec := range precs {
+        amountPrecisions[curr] = prec
+    }
+}
+
+// return number of decimals of amounts in currency
+func amountPrecision(currency string) uint {
+    amountPrecisionsMutex.RLock()
+    defer amountPrecisionsMutex.RUnlock()
+    if prec, ok := amountPrecisions[currency]; ok {
+        return prec
+    }
+    return defaultAmountPrecision
+}
+
+// return funding symbol for currency. Derivative currencies (with F0 suffix)
+// are funded in base currency (USTF0 - fUST).
+func fundingSymbol(currency string) string {
+    if len(currency) > 1 && currency[0]=='f' {
+        return currency     // already symbol
+    }
+    if len(currency) > 2 && strings.HasSuffix(currency, "F0") {
+        currency = currency[:len(currency)-2]
+    }
+    return "f" + currency
+}
+
+// return currency from funding symbol (fUST - UST). Empty if symbol is empty.
+func currencyFromSymbol(symbol string) string {
+    if len(symbol) > 1 && symbol[0]=='f' {
+        return symbol[1:]
+    }
+    return symbol
+}
+
+// return market from trading symbol (tBTCUST - BTCUST, tBTCF0:USTF0 - BTCF0:USTF0)
+func marketFromSymbol(symbol string) string {
+    if len(symbol) > 1 && symbol[0]=='t' {
+        return symbol[1:]
+    }
+    return symbol
+}
+
+// panic with APIError if response is error array: ["error", code, "msg"]
+func bitfinexCheckErrorArray(msg string, v *fastjson.Value) {
+    if v==nil || v.Type()!=fastjson.TypeArray { return }
+    arr := FastjsonGetArray(v)
+    if len(arr) >= 2 && arr[0].Type()==fastjson.TypeString &&
+            FastjsonGetString(arr[0])=="error" {
+        code := FastjsonGetUInt64(arr[1])
+        var errMsg string
+        if len(arr) > 2 {
+            errMsg = FastjsonGetString(arr[2])
+        }
+        panic(&APIError{ Context: msg, Code: code, Message: errMsg })
+    }
 }
 
 func bitfinexPanic(msg string, v *fastjson.Value, sc int) {
     if v!=nil {
         switch v.Type() {
-            case fastjson.TypeArray: {
-                arr := FastjsonGetArray(v)
-                first := FastjsonGetString(arr[0])
-                if len(arr)!=0 && first=="error" {
-                    code := FastjsonGetUInt64(arr[1])
-                    var errMsg string
-                    if len(arr) > 2 {
-                        errMsg = FastjsonGetString(arr[2])
-                    }
-                    panic(fmt.Sprint(msg, ": ", code, " ", errMsg))
-                }
-            }
+            case fastjson.TypeArray:
+                bitfinexCheckErrorArray(msg, v)
             case fastjson.TypeObject: {
                 errMsg := string(v.GetStringBytes("message"))
-                panic(fmt.Sprint(msg, ": ", errMsg))
+                panic(&APIError{ Context: msg, Message: errMsg })
             }
         }
     }
@@ -187,7 +359,41 @@ func bitfinexGetMarketsFromJson(v *fastjson.Value, market *Market) {
     }
 }
 
+// get markets. markets are cached for TTL.
 func (drv *BitfinexPublic) GetMarkets() []Market {
+    drv.marketsMutex.Lock()
+    defer drv.marketsMutex.Unlock()
+    now := drv.now()
+    if drv.markets != nil && now.Sub(drv.marketsTime) < drv.marketsTTL {
+        return drv.markets
+    }
+    var markets []Market
+    if drv.markets == nil {
+        markets = drv.fetchMarketsWithRetries()
+    } else {
+        markets = drv.fetchMarkets()
+    }
+    drv.markets = markets
+    drv.marketsTime = now
+    return markets
+}
+
+// fetch markets and retry with backoff if error is transient (for example
+// exchange is unavailable at startup). panics with last error.
+func (drv *BitfinexPublic) fetchMarketsWithRetries() []Market {
+    delay := marketsFetchRetryDelay
+    for i := 0; ; i++ {
+        var markets []Market
+        err, retry := recoverCall(func() { markets = drv.fetchMarkets() })
+        if err==nil { return markets }
+        if !retry || i >= drv.marketsRetries { panic(err) }
+        Logger.Warn("Can't get markets: ", err, " - retry after ", delay)
+        drv.sleep(delay)
+        delay *= 2
+    }
+}
+
+func (drv *BitfinexPublic) getMarketsFromApi() []Market {
     var rh RequestHandle
     defer rh.Release()
     v, sc := rh.HandleHttpGetJson(&drv.httpClient, bitfinexPubApiHost,
@@ -195,7 +401,7 @@ func (drv *BitfinexPublic) GetMarkets() []Market {
     if sc >= 400 { bitfinexPanic("Can't get markets", v, sc) }
     arr := FastjsonGetArray(v)
     if len(arr) < 1 {
-        panic("Wrong json body")
+        panic(errWrongJsonBody)
     }
     arr = FastjsonGetArray(arr[0])
     marketsLen := len(arr)
@@ -209,7 +415,7 @@ func (drv *BitfinexPublic) GetMarkets() []Market {
 func bitfinexGetMarketPriceFromJson(v *fastjson.Value) godec64.UDec64 {
     arr := FastjsonGetArray(v)
     if len(arr) < 7 {
-        panic("Wrong json body")
+        panic(errWrongJsonBody)
     }
     return FastjsonGetUDec64(arr[6], 8)
 }
@@ -227,17 +433,91 @@ func (drv *BitfinexPublic) GetMarketPrice(market string) godec64.UDec64 {
     return bitfinexGetMarketPriceFromJson(v)
 }
 
+// parse funding ticker response (FRR at 0)
+func bitfinexGetFRRFromJson(v *fastjson.Value) godec64.UDec64 {
+    arr := FastjsonGetArray(v)
+    if len(arr) < 1 {
+        panic(errWrongJsonBody)
+    }
+    return FastjsonGetUDec64(arr[0], 12)
+}
+
+// get flash return rate of currency
+func (drv *BitfinexPublic) GetFRR(currency string) godec64.UDec64 {
+    apiUrl := make([]byte, 0, 20)
+    apiUrl = append(apiUrl, bitfinexApiFundingTicker...)
+    apiUrl = append(apiUrl, fundingSymbol(currency)...)
+    
+    var rh RequestHandle
+    defer rh.Release()
+    v, sc := rh.HandleHttpGetJson(&drv.httpClient, bitfinexPubApiHost, apiUrl, nil)
+    if sc >= 400 { bitfinexPanic("Can't get funding ticker", v, sc) }
+    
+    return bitfinexGetFRRFromJson(v)
+}
 
-func bitfinexGetTradeFromJson(v *fastjson.Value, trade *Trade) {
+// parse tickers response (ticker for trading pair: SYMBOL, ..., LAST_PRICE at 7)
+func bitfinexGetMarketPricesFromJson(v *fastjson.Value) map[string]godec64.UDec64 {
+    arr := FastjsonGetArray(v)
+    prices := make(map[string]godec64.UDec64, len(arr))
+    for _, tv := range arr {
+        tarr := FastjsonGetArray(tv)
+        if len(tarr) < 8 {
+            panic(errWrongJsonBody)
+        }
+        symbol := FastjsonGetString(tarr[0])
+        if len(symbol) < 2 || symbol[0]!='t' {
+            continue // skip not trading pairs
+        }
+        prices[marketFromSymbol(symbol)] = FastjsonGetUDec64(tarr[7], 8)
+    }
+    return prices
+}
+
+// get prices of many markets in single request
+func (drv *BitfinexPublic) GetMarketPrices(markets []string) map[string]godec64.UDec64 {
+    if len(markets)==0 { return map[string]godec64.UDec64{} }
+    apiUrl := make([]byte, 0, 20 + 12*len(markets))
+    apiUrl = append(apiUrl, bitfinexApiTickers...)
+    for i, market := range markets {
+        if i!=0 { apiUrl = append(apiUrl, ',') }
+        apiUrl = append(apiUrl, 't')
+        apiUrl = append(apiUrl, market...)
+    }
+    
+    var rh RequestHandle
+    defer rh.Release()
+    v, sc := rh.HandleHttpGetJson(&drv.httpClient, bitfinexPubApiHost, apiUrl, nil)
+    if sc >= 400 { bitfinexPanic("Can't get tickers", v, sc) }
+    
+    return bitfinexGetMarketPricesFromJson(v)
+}
+
+
+// return server time (from Date header of platform status response)
+func (drv *BitfinexPublic) GetServerTime() time.Time {
+    var rh RequestHandle
+    defer rh.Release()
+    v, sc := rh.HandleHttpGetJson(&drv.httpClient, bitfinexPubApiHost,
+                                  bitfinexApiPlatformStatus, nil)
+    if sc >= 400 { bitfinexPanic("Can't get platform status", v, sc) }
+    t, err := http.ParseTime(string(rh.Response.Header.Peek("Date")))
+    if err!=nil {
+        ParseErrorPanic("Can't parse server time", err)
+    }
+    return t
+}
+
+func bitfinexGetTradeFromJson(v *fastjson.Value, trade *Trade, prec uint) {
     arr := FastjsonGetArray(v)
     if len(arr) < 5 {
-        panic("Wrong json body")
+        panic(errWrongJsonBody)
     }
     trade.Id = FastjsonGetUInt64(arr[0])
     trade.TimeStamp = FastjsonGetUnixTimeMilli(arr[1])
     var neg bool
     trade.Side = SideOffer
-    trade.Amount, neg = FastjsonGetUDec64Signed(arr[2], 8)
+    trade.Amount, neg = FastjsonGetUDec64Signed(arr[2], prec)
     if neg {
         trade.Side = SideBid
     }
@@ -250,7 +530,7 @@ func (drv *BitfinexPublic) GetTrades(currency string,
                             since time.Time, limit uint) []Trade {
     apiUrl := make([]byte, 0, 60)
     apiUrl = append(apiUrl, bitfinexApiTrades...)
-    apiUrl = append(apiUrl, currency...)
+    apiUrl = append(apiUrl, fundingSymbol(currency)...)
     apiUrl = append(apiUrl, "/hist?limit="...)
     apiUrl = strconv.AppendUint(apiUrl, uint64(limit), 10)
     if !since.IsZero() {
@@ -264,29 +544,31 @@ func (drv *BitfinexPublic) GetTrades(currency string,
     v, sc := rh.HandleHttpGetJson(&drv.httpClient, bitfinexPubApiHost, apiUrl, nil)
     if sc >= 400 { bitfinexPanic("Can't get trades", v, sc) }
     arr := FastjsonGetArray(v)
+    prec := amountPrecision(currency)
     
     tradesLen := len(arr)
     trades := make([]Trade, tradesLen)
     for i, v := range arr {
-        bitfinexGetTradeFromJson(v, &trades[tradesLen-i-1])
+        bitfinexGetTradeFromJson(v, &trades[tradesLen-i-1], prec)
     }
     return trades
 }
 
-func bitfinexGetOrderBookEntryFromJson(v *fastjson.Value, obe *OrderBookEntry) bool {
+func bitfinexGetOrderBookEntryFromJson(v *fastjson.Value, obe *OrderBookEntry,
+                                       prec uint) bool {
     arr := FastjsonGetArray(v)
     if len(arr) < 3 {
-        panic("Wrong json body")
+        panic(errWrongJsonBody)
     }
     obe.Period = FastjsonGetUInt32(arr[1])
     obe.Rate = FastjsonGetUDec64(arr[0], 12)
     var neg bool
-    obe.Amount, neg = FastjsonGetUDec64Signed(arr[3], 8)
+    obe.Amount, neg = FastjsonGetUDec64Signed(arr[3], prec)
     obe.Count = FastjsonGetUInt32(arr[2])
     return neg
 }
 
-func bitfinexGetOrderBookFromJson(v *fastjson.Value, ob *OrderBook) {
+func bitfinexGetOrderBookFromJson(v *fastjson.Value, ob *OrderBook, prec uint) {
     arr := FastjsonGetArray(v)
     
     arrLen := len(arr)
@@ -296,7 +578,7 @@ func bitfinexGetOrderBookFromJson(v *fastjson.Value, ob *OrderBook) {
     var obe OrderBookEntry
     // orderbook entries is in correct order
     for _, obev := range arr {
-        if bitfinexGetOrderBookEntryFromJson(obev, &obe) {
+        if bitfinexGetOrderBookEntryFromJson(obev, &obe, prec) {
             ob.Bid = append(ob.Bid, obe)
         } else {
             ob.Ask = append(ob.Ask, obe)
@@ -306,33 +588,38 @@ func bitfinexGetOrderBookFromJson(v *fastjson.Value, ob *OrderBook) {
     sort.Sort(OrderBookEntrySorter(ob.Ask))
 }
 
-func (drv *BitfinexPublic) GetOrderBook(currency string, ob *OrderBook) {
+// orderbook depths supported by exchange
+const (
+    bitfinexOrderBookDepth = 25
+    bitfinexMaxOrderBookDepth = 100
+)
+
+// get orderbook with given depth (1, 25 or 100 entries for each side)
+func (drv *BitfinexPublic) GetOrderBookDepth(currency string, depth uint,
+                                             ob *OrderBook) {
     apiUrl := make([]byte, 0, 60)
     apiUrl = append(apiUrl, bitfinexApiOrderBook...)
-    apiUrl = append(apiUrl, currency...)
-    apiUrl = append(apiUrl, "/P0?len=25"...)
+    apiUrl = append(apiUrl, fundingSymbol(currency)...)
+    apiUrl = append(apiUrl, "/P0?len="...)
+    apiUrl = strconv.AppendUint(apiUrl, uint64(depth), 10)
     
     var rh RequestHandle
     defer rh.Release()
     v, sc := rh.HandleHttpGetJson(&drv.httpClient, bitfinexPubApiHost, apiUrl, nil)
     if sc >= 400 { bitfinexPanic("Can't get orderbook", v, sc) }
-    bitfinexGetOrderBookFromJson(v, ob)
+    bitfinexGetOrderBookFromJson(v, ob, amountPrecision(currency))
+}
+
+func (drv *BitfinexPublic) GetOrderBook(currency string, ob *OrderBook) {
+    drv.GetOrderBookDepth(currency, bitfinexOrderBookDepth, ob)
 }
 
 func (drv *BitfinexPublic) GetMaxOrderBook(currency string, ob *OrderBook) {
-    apiUrl := make([]byte, 0, 60)
-    apiUrl = append(apiUrl, bitfinexApiOrderBook...)
-    apiUrl = append(apiUrl, currency...)
-    apiUrl = append(apiUrl, "/P0?len=100"...)
-    
-    var rh RequestHandle
-    defer rh.Release()
-    v, sc := rh.HandleHttpGetJson(&drv.httpClient, bitfinexPubApiHost, apiUrl, nil)
-    if sc >= 400 { bitfinexPanic("Can't get orderbook", v, sc) }
-    bitfinexGetOrderBookFromJson(v, ob)
+    drv.GetOrderBookDepth(currency, bitfinexMaxOrderBookDepth, ob)
 }
 
-func bitfinexCandlePeriodString(period uint32) string {
+// get name of candle period (in seconds). returns false if period is not supported.
+func bitfinexCandlePeriodName(period uint32) (string, bool) {
     periodStr := ""
     switch period {
         case 60: periodStr = "1m"
@@ -348,15 +635,21 @@ func bitfinexCandlePeriodString(period uint32) string {
         case 14*24*3600: periodStr = "14D"
         case 30*24*3600: periodStr = "1M"
         default:
-            panic("Unsupported candle period")
+            return "", false
     }
+    return periodStr, true
+}
+
+func bitfinexCandlePeriodString(period uint32) string {
+    periodStr, ok := bitfinexCandlePeriodName(period)
+    if !ok { panic("Unsupported candle period") }
     return periodStr
 }
 
 func bitfinexGetCandleFromJson(v *fastjson.Value, candle *Candle) {
     arr := FastjsonGetArray(v)
     if len(arr) < 6 {
-        panic("Wrong json body")
+        panic(errWrongJsonBody)
     }
     candle.TimeStamp = FastjsonGetUnixTimeMilli(arr[0])
     candle.Open = FastjsonGetUDec64(arr[1], 12)
@@ -371,8 +664,8 @@ func (drv *BitfinexPublic) GetCandles(currency string, period uint32,
     apiUrl := make([]byte, 0, 60)
     apiUrl = append(apiUrl, bitfinexApiCandles...)
     apiUrl = append(apiUrl, bitfinexCandlePeriodString(period)...)
-    apiUrl = append(apiUrl, ":f"...)
-    apiUrl = append(apiUrl, currency...)
+    apiUrl = append(apiUrl, ':')
+    apiUrl = append(apiUrl, fundingSymbol(currency)...)
     apiUrl = append(apiUrl, ":a30:p2:p30/hist?sort=1&start="...)
     if since.IsZero() {
         since = time.Now().Add(-time.Duration(limit) *
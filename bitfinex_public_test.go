@@ -0,0 +1,221 @@
+/*
+ * bitfinex_public_test.go - Bitfinex Public client tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "fmt"
+    "testing"
+    "time"
+    "github.com/matszpk/godec64"
+    "github.com/valyala/fastjson"
+)
+
+func TestBitfinexGetMarketPricesFromJson(t *testing.T) {
+    v := fastjson.MustParse(`[
+["tBTCUSD",47123,12.5,47124,8.1,-523,-0.011,47123.5,3412.2,48100,46800],
+["tETHUSD",3301.2,120.1,3301.3,88.2,12.1,0.0037,3301.25,22101.1,3350,3200],
+["fUSD",0.0002,0.00019,30,2000,0.00021,2,1500,0.00001,0.05,0.0002,1000,0.0003,0.0001,null,null,100],
+["tTESTBTC:TESTUSD",100,1,101,1,0,0,100.5,10,110,90]]`)
+    prices := bitfinexGetMarketPricesFromJson(v)
+    expPrices := map[string]godec64.UDec64{
+        "BTCUSD": 4712350000000, "ETHUSD": 330125000000,
+        "TESTBTC:TESTUSD": 10050000000 }
+    if len(prices)!=len(expPrices) {
+        t.Errorf("Prices length mismatch: %v!=%v", expPrices, prices)
+    }
+    for market, expPrice := range expPrices {
+        if price, ok := prices[market]; !ok || price!=expPrice {
+            t.Errorf("Price mismatch for %v: %v!=%v", market, expPrice, price)
+        }
+    }
+}
+
+func TestBitfinexGetFRRFromJson(t *testing.T) {
+    v := fastjson.MustParse(
+        `[0.0002,0.00019,30,2000,0.00021,2,1500,0.00001,0.05,0.0002,1000,0.0003,0.0001,null,null,100]`)
+    if frr := bitfinexGetFRRFromJson(v); frr!=200000000 {
+        t.Errorf("FRR mismatch: %v!=200000000", frr)
+    }
+}
+
+func getPanicMessage(f func()) (msg string) {
+    defer func() {
+        if x := recover(); x!=nil {
+            msg = fmt.Sprint(x)
+        }
+    }()
+    f()
+    return
+}
+
+func TestBitfinexPanic(t *testing.T) {
+    cases := []struct{
+        body string
+        exp string
+    }{
+        { `["error",10020,"symbol: invalid"]`, "Can't get: 10020 symbol: invalid" },
+        { `["error",10100]`, "Can't get: 10100 " },
+        { `[]`, "Can't get: status code: Internal Server Error (500)" },
+        { `[12,"error"]`, "Can't get: status code: Internal Server Error (500)" },
+        { `{"message":"Nonce small"}`, "Can't get: Nonce small" },
+    }
+    for _, c := range cases {
+        v := fastjson.MustParse(c.body)
+        msg := getPanicMessage(func() { bitfinexPanic("Can't get", v, 500) })
+        if msg!=c.exp {
+            t.Errorf("Panic message mismatch for %v: %q!=%q", c.body, c.exp, msg)
+        }
+    }
+    msg := getPanicMessage(func() { bitfinexPanic("Can't get", nil, 404) })
+    if msg!="Can't get: status code: Not Found (404)" {
+        t.Errorf("Panic message mismatch: %q", msg)
+    }
+}
+
+func TestBitfinexSymbols(t *testing.T) {
+    fundingCases := [][2]string{
+        { "UST", "fUST" }, { "USD", "fUSD" }, { "BTC", "fBTC" },
+        { "USTF0", "fUST" }, { "BTCF0", "fBTC" }, { "fUST", "fUST" },
+    }
+    for _, c := range fundingCases {
+        if res := fundingSymbol(c[0]); res!=c[1] {
+            t.Errorf("Funding symbol mismatch for %v: %v!=%v", c[0], c[1], res)
+        }
+    }
+    currencyCases := [][2]string{
+        { "fUST", "UST" }, { "fUSTF0", "USTF0" }, { "UST", "UST" }, { "", "" },
+        { "f", "f" },
+    }
+    for _, c := range currencyCases {
+        if res := currencyFromSymbol(c[0]); res!=c[1] {
+            t.Errorf("Currency mismatch for %v: %v!=%v", c[0], c[1], res)
+        }
+    }
+    marketCases := [][2]string{
+        { "tBTCUST", "BTCUST" }, { "tBTCF0:USTF0", "BTCF0:USTF0" },
+        { "BTCUST", "BTCUST" }, { "", "" },
+    }
+    for _, c := range marketCases {
+        if res := marketFromSymbol(c[0]); res!=c[1] {
+            t.Errorf("Market mismatch for %v: %v!=%v", c[0], c[1], res)
+        }
+    }
+}
+
+func TestBitfinexPublicMarketsCache(t *testing.T) {
+    bp := NewBitfinexPublic()
+    calls := 0
+    bp.fetchMarkets = func() []Market {
+        calls++
+        return []Market{ Market{ "BTCUST", "BTC", "UST" } }
+    }
+    now := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    bp.now = func() time.Time { return now }
+    bp.SetMarketsCacheTTL(time.Minute)
+    
+    markets := bp.GetMarkets()
+    if calls!=1 || len(markets)!=1 || markets[0].Name!="BTCUST" {
+        t.Errorf("Markets mismatch: %d %v", calls, markets)
+    }
+    now = now.Add(59*time.Second)
+    markets = bp.GetMarkets()
+    if calls!=1 || len(markets)!=1 {
+        t.Errorf("Markets fetched again within TTL: %d %v", calls, markets)
+    }
+    now = now.Add(time.Second)
+    bp.GetMarkets()
+    if calls!=2 {
+        t.Errorf("Markets not fetched after TTL: %d", calls)
+    }
+}
+
+func TestBitfinexPublicMarketsFetchRetry(t *testing.T) {
+    bp := NewBitfinexPublic()
+    calls := 0
+    bp.fetchMarkets = func() []Market {
+        calls++
+        if calls < 3 {
+            panic(&HTTPError{ Context: "Can't get markets", Status: 503 })
+        }
+        return []Market{ Market{ "BTCUST", "BTC", "UST" } }
+    }
+    var sleeps []time.Duration
+    bp.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+    markets := bp.GetMarkets()
+    if calls!=3 || len(markets)!=1 || markets[0].Name!="BTCUST" {
+        t.Errorf("Markets mismatch: %d %v", calls, markets)
+    }
+    if len(sleeps)!=2 || sleeps[0]!=2*time.Second || sleeps[1]!=4*time.Second {
+        t.Errorf("Sleeps mismatch: %v", sleeps)
+    }
+    
+    // retries exhausted
+    bp = NewBitfinexPublic()
+    bp.SetMarketsFetchRetries(1)
+    bp.sleep = func(time.Duration) {}
+    calls = 0
+    bp.fetchMarkets = func() []Market {
+        calls++
+        panic(&HTTPError{ Context: "Can't get markets", Status: 503 })
+    }
+    if err, _ := recoverCall(func() { bp.GetMarkets() }); err==nil || calls!=2 {
+        t.Errorf("Retry mismatch: %d %v", calls, err)
+    }
+    // not transient error is not retried
+    calls = 0
+    bp.fetchMarkets = func() []Market {
+        calls++
+        panic(&HTTPError{ Context: "Can't get markets", Status: 404 })
+    }
+    if err, _ := recoverCall(func() { bp.GetMarkets() }); err==nil || calls!=1 {
+        t.Errorf("Retry mismatch: %d %v", calls, err)
+    }
+}
+
+func TestOrderBookDepthSummary(t *testing.T) {
+    ob := OrderBook{
+        Bid: []OrderBookEntry{
+            OrderBookEntry{ 2, 20000000000, 90000000, 1 },
+            OrderBookEntry{ 2, 5000000000, 80000000, 1 },
+        },
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 5000000000, 100000000, 1 },
+            OrderBookEntry{ 2, 15000000000, 110000000, 2 },
+            OrderBookEntry{ 2, 30000000000, 120000000, 1 },
+            OrderBookEntry{ 2, 40000000000, 150000000, 3 },
+            OrderBookEntry{ 2, 10000000000, 200000000, 1 },
+        },
+    }
+    ds := ob.DepthSummary()
+    expDs := DepthSummary{ TotalAsk: 100000000000, TotalBid: 25000000000,
+        AskRates: [5]godec64.UDec64{ 110000000, 120000000, 120000000,
+                        150000000, 150000000 } }
+    if ds!=expDs {
+        t.Errorf("DepthSummary mismatch: %v!=%v", expDs, ds)
+    }
+    // empty orderbook
+    ob = OrderBook{}
+    if ds = ob.DepthSummary(); ds!=(DepthSummary{}) {
+        t.Errorf("DepthSummary mismatch: %v", ds)
+    }
+}
@@ -26,6 +26,7 @@ import (
     "bytes"
     "errors"
     "fmt"
+    "sort"
     "sync"
     "sync/atomic"
     "time"
@@ -39,6 +40,7 @@ var (
     bitfinexStrEvent = []byte("event")
     bitfinexStrChanId = []byte("chanId")
     bitfinexStrMsg = []byte("msg")
+    bitfinexStrCode = []byte("code")
 )
 
 type BitfinexRTPublic struct {
@@ -47,6 +49,7 @@ type BitfinexRTPublic struct {
     wsMarketPriceChanIdMap map[string]string
     wsTradeChanIdMap map[string]string
     wsOrderBookChanIdMap map[string]string
+    wsCandleChanIdMap map[string]string
     wsOrderBookBrokenMap sync.Map
     wsOrderBookResubTicker *time.Ticker
     wsOrderBookResubTickerQuit chan struct{}
@@ -98,6 +101,7 @@ func (drv *BitfinexRTPublic) wsLateInit() {
     drv.wsMarketPriceChanIdMap = make(map[string]string)
     drv.wsTradeChanIdMap = make(map[string]string)
     drv.wsOrderBookChanIdMap = make(map[string]string)
+    drv.wsCandleChanIdMap = make(map[string]string)
     drv.wsOrderBookBrokenMap = sync.Map{}
     drv.wsOrderBookResubTickerQuit = make(chan struct{})
     drv.wsOrderBookResubTicker = time.NewTicker(10*time.Minute)
@@ -120,6 +124,9 @@ func (drv *BitfinexRTPublic) wsHandleMessage(msg []byte) {
         }
     }()
     
+    statsType := wsChannelType(wsStatsOther)
+    defer func() { drv.msgStats.add(statsType, len(msg)) }()
+    
     jp := JsonParserPool.Get()
     defer JsonParserPool.Put(jp)
     msgv, err := jp.ParseBytes(msg)
@@ -139,16 +146,23 @@ func (drv *BitfinexRTPublic) wsHandleMessage(msg []byte) {
             drv.sendErr(drv.errCh, errors.New("Wrong channel message"))
             return
         }
+        chanId := string(arr[0].MarshalTo(nil))
         if arr[1].Type()==fastjson.TypeString && FastjsonGetString(arr[1])=="hb" {
-            return  // ignore heartbeat
+            // ignore heartbeat, but count it to its channel
+            if v, ok := drv.wsChannelMap.Load(chanId); ok {
+                if channEntry := v.(*bitfinexChannelEntry); len(channEntry.key)!=0 {
+                    statsType = channEntry.channelType
+                }
+            }
+            return
         }
-        chanId := string(arr[0].MarshalTo(nil))
         // check channel
         v, ok := drv.wsChannelMap.LoadOrStore(chanId, &bitfinexChannelEntry{
                             firstMsgs: [][]byte{msg} })
         if ok { // if already initialized, handle message
             channEntry := v.(*bitfinexChannelEntry)
             if len(channEntry.key)!=0 {
+                statsType = channEntry.channelType
                 drv.handleChannelMessage(channEntry.channelType, channEntry.key, arr)
             } else {
                 // not ready just add next firstMsg
@@ -164,6 +178,7 @@ func (drv *BitfinexRTPublic) wsHandleMessage(msg []byte) {
         }
         // get fields
         var eventStr, msgStr, chanIdStr string
+        var code uint64
         mask := 0
         msgo.Visit(func(key []byte, vx *fastjson.Value) {
             if (mask&1)==0 && bytes.Equal(key, bitfinexStrEvent) {
@@ -178,19 +193,24 @@ func (drv *BitfinexRTPublic) wsHandleMessage(msg []byte) {
                 msgStr = FastjsonGetString(vx)
                 mask |= 4
             }
+            if (mask&8)==0 && bytes.Equal(key, bitfinexStrCode) {
+                code = FastjsonGetUInt64(vx)
+                mask |= 8
+            }
         })
         
         if eventStr!="error" {
             drv.sendFuncRet(chanIdStr)  // send channel id
         } else {
-            drv.sendErr(drv.funcErrCh, errors.New(
-                            fmt.Sprint("Bitfinex command error: ", msgStr)))
+            drv.sendErr(drv.funcErrCh, &APIError{ Context: "Bitfinex command error",
+                            Code: code, Message: msgStr })
         }
     }
 }
 
-func bitfinexGetOrderBookEntryDiffFromJson(v *fastjson.Value, diff *OrderBookEntryDiff) {
-    neg := bitfinexGetOrderBookEntryFromJson(v, &diff.Obe)
+func bitfinexGetOrderBookEntryDiffFromJson(v *fastjson.Value,
+                            diff *OrderBookEntryDiff, prec uint) {
+    neg := bitfinexGetOrderBookEntryFromJson(v, &diff.Obe, prec)
     diff.Side = SideOffer
     if neg { diff.Side = SideBid }
 }
@@ -203,7 +223,8 @@ func (drv *BitfinexRTPublic) handleChannelMessage(chType wsChannelType,
                 drv.sendErr(drv.errCh, errors.New("Wrong ticker message"))
                 return
             }
-            go drv.callMarketPriceHandler(key, bitfinexGetMarketPriceFromJson(arr[1]))
+            mp := bitfinexGetMarketPriceFromJson(arr[1])
+            goHandler(func() { drv.callMarketPriceHandler(key, mp) })
         }
         case wsTrades: {
             if len(arr) < 3 {
@@ -214,8 +235,8 @@ func (drv *BitfinexRTPublic) handleChannelMessage(chType wsChannelType,
             if arr[2].Type()==fastjson.TypeArray &&
                     arr[2].GetArray()[0].Type()!=fastjson.TypeArray {
                 var trade Trade
-                bitfinexGetTradeFromJson(arr[2], &trade)
-                go drv.callTradeHandler(key, &trade)
+                bitfinexGetTradeFromJson(arr[2], &trade, amountPrecision(key))
+                goHandler(func() { drv.callTradeHandler(key, &trade) })
             }
         }
         case wsDiffOrderBook: {
@@ -228,7 +249,7 @@ func (drv *BitfinexRTPublic) handleChannelMessage(chType wsChannelType,
                     arr[1].GetArray()[0].Type()==fastjson.TypeArray {
                 // if initial orderbook snapshot
                 var ob OrderBook
-                bitfinexGetOrderBookFromJson(arr[1], &ob)
+                bitfinexGetOrderBookFromJson(arr[1], &ob, amountPrecision(key))
                 rtOBH := drv.getDiffOrderBookHandle(key)
                 rtOBH.pushInitial(&ob)
                 // unmark that is orderbook is broken
@@ -236,13 +257,27 @@ func (drv *BitfinexRTPublic) handleChannelMessage(chType wsChannelType,
             } else {
                 // otherwise is single difference
                 var diff OrderBookEntryDiff
-                bitfinexGetOrderBookEntryDiffFromJson(arr[1], &diff)
+                bitfinexGetOrderBookEntryDiffFromJson(arr[1], &diff,
+                                                      amountPrecision(key))
                 rtOBH := drv.getDiffOrderBookHandle(key)
                 if rtOBH!=nil {
                     rtOBH.pushDiff(&diff)
                 }
             }
         }
+        case wsCandles: {
+            if len(arr) < 2 {
+                drv.sendErr(drv.errCh, errors.New("Wrong candles message"))
+                return
+            }
+            // ignore candles snapshot
+            if arr[1].Type()==fastjson.TypeArray && len(arr[1].GetArray())!=0 &&
+                    arr[1].GetArray()[0].Type()!=fastjson.TypeArray {
+                var candle Candle
+                bitfinexGetCandleFromJson(arr[1], &candle)
+                goHandler(func() { drv.callCandleHandler(key, &candle) })
+            }
+        }
     }
 }
 
@@ -277,20 +312,40 @@ func (drv *BitfinexRTPublic) Stop() {
     drv.wsMarketPriceChanIdMap = nil
     drv.wsTradeChanIdMap = nil
     drv.wsOrderBookChanIdMap = nil
+    drv.wsCandleChanIdMap = nil
     drv.wsOrderBookBrokenMap = sync.Map{} // clear map
 }
 
 func (drv *BitfinexRTPublic) handleCommand(cmdBytes []byte) string {
+    // drop late confirmation of previous timed out command
+    for drained := false; !drained; {
+        select {
+            case <-drv.funcRetCh:
+            case <-drv.funcErrCh:
+            default:
+                drained = true
+        }
+    }
     drv.sendCommand(cmdBytes)
     atomic.StoreUint32(&drv.awaitingFuncRet, 1)
     defer atomic.StoreUint32(&drv.awaitingFuncRet, 0)
+    timer := time.NewTimer(drv.commandTimeout())
+    defer timer.Stop()
     select {
         case ret := <-drv.funcRetCh:
             return ret
         case err := <-drv.funcErrCh:
+            if apiErr, ok := err.(*APIError); ok {
+                panic(apiErr)   // error event, can be classified
+            }
             if err!=nil {
                 ErrorPanic("Bitfinex function error: ", err)
             }
+        case <-timer.C:
+            // connection is probably broken, force reconnection
+            atomic.StoreUint32(&drv.awaitingFuncRet, 0)
+            drv.sendErr(drv.errCh, errWSCommandTimeout)
+            ErrorPanic("Bitfinex function error: ", errWSCommandTimeout)
     }
     return ""
 }
@@ -326,7 +381,7 @@ func (drv *BitfinexRTPublic) wsAddChannel(chanId string, chType wsChannelType,
 }
 
 var bitfinexCmdSubscribeTrades0 = []byte(
-                `{"event":"subscribe","channel":"trades","symbol":"f`)
+                `{"event":"subscribe","channel":"trades","symbol":"`)
 
 func bitfinexUnsubscribeCmd(chanId string) []byte {
     cmdBytes := make([]byte, 0, 50)
@@ -377,7 +432,7 @@ func (drv *BitfinexRTPublic) UnsubscribeMarketPrice(market string) {
 func (drv *BitfinexRTPublic) subscribeTradesInt(currency string, h TradeHandler) {
     cmdBytes := make([]byte, 0, 60)
     cmdBytes = append(cmdBytes, bitfinexCmdSubscribeTrades0...)
-    cmdBytes = append(cmdBytes, currency...)
+    cmdBytes = append(cmdBytes, fundingSymbol(currency)...)
     cmdBytes = append(cmdBytes, bitfinexCmdEnd0...)
     chanId := drv.handleCommand(cmdBytes)
     if h!=nil { // conditional used by resubscription after reconnection
@@ -407,25 +462,33 @@ func (drv *BitfinexRTPublic) UnsubscribeTrades(currency string) {
 }
 
 var bitfinexCmdSubscribeOrderBook0 = []byte(
-                `{"event":"subscribe","channel":"book","symbol":"f`)
+                `{"event":"subscribe","channel":"book","symbol":"`)
 var bitfinexCmdSubscribeOrderBooEnd0 = []byte(`","freq":"F0","prec":"P0","len":"25"}`)
 
 func bitfinexSubscribeOrderBookCmd(currency string) []byte {
     cmdBytes := make([]byte, 0, 60)
     cmdBytes = append(cmdBytes, bitfinexCmdSubscribeOrderBook0...)
-    cmdBytes = append(cmdBytes, currency...)
+    cmdBytes = append(cmdBytes, fundingSymbol(currency)...)
     cmdBytes = append(cmdBytes, bitfinexCmdSubscribeOrderBooEnd0...)
     return cmdBytes
 }
 
-// internal routine SubscribeOrderBook (for resubscription after reconnection)
-func (drv *BitfinexRTPublic) subscribeOrderBookInt(currency string, h OrderBookHandler) {
+// internal routine SubscribeOrderBook (for resubscription after reconnection).
+// if baseline is true, first orderbook is marked as baseline.
+func (drv *BitfinexRTPublic) subscribeOrderBookInt(currency string, h OrderBookHandler,
+                            baseline bool) {
     drv.wsOrderBookBrokenMap.Delete(currency)
     
     chanId := drv.handleCommand(bitfinexSubscribeOrderBookCmd(currency))
     if h!=nil { // conditional used by resubscription after reconnection
         drv.setDiffOrderBookHandler(currency, h)
     }
+    if baseline {
+        // before adding channel - first messages are handled after it
+        if rtOBH := drv.getDiffOrderBookHandle(currency); rtOBH!=nil {
+            rtOBH.markBaseline()
+        }
+    }
     
     drv.wsOrderBookChanIdMap[currency] = chanId
     drv.wsAddChannel(chanId, wsDiffOrderBook, currency, true)
@@ -434,7 +497,7 @@ func (drv *BitfinexRTPublic) subscribeOrderBookInt(currency string, h OrderBookH
 func (drv *BitfinexRTPublic) SubscribeOrderBook(currency string, h OrderBookHandler) {
     drv.callMutex.Lock()
     defer drv.callMutex.Unlock()
-    drv.subscribeOrderBookInt(currency, h)
+    drv.subscribeOrderBookInt(currency, h, false)
 }
 
 func (drv *BitfinexRTPublic) unsubscribeOrderBookInt(currency string) {
@@ -463,7 +526,7 @@ func (drv *BitfinexRTPublic) resubscribeOrderBook(currency string) {
     h := drv.getDiffOrderBookHandle(currency).h
     drv.unsubscribeOrderBookInt(currency)
     // subscribe again
-    drv.subscribeOrderBookInt(currency, h)
+    drv.subscribeOrderBookInt(currency, h, true)
 }
 
 func (drv *BitfinexRTPublic) getActiveOrderBooks() []string {
@@ -484,6 +547,92 @@ func (drv *BitfinexRTPublic) resubscribeOrderBooks() {
     }
 }
 
+var bitfinexCmdSubscribeCandles0 = []byte(
+                `{"event":"subscribe","channel":"candles","key":"`)
+
+func bitfinexSubscribeCandlesCmd(key string) []byte {
+    cmdBytes := make([]byte, 0, 80)
+    cmdBytes = append(cmdBytes, bitfinexCmdSubscribeCandles0...)
+    cmdBytes = append(cmdBytes, key...)
+    cmdBytes = append(cmdBytes, bitfinexCmdEnd0...)
+    return cmdBytes
+}
+
+// internal routine SubscribeCandles (for resubscription after reconnection)
+func (drv *BitfinexRTPublic) subscribeCandlesInt(key string, h CandleHandler) {
+    chanId := drv.handleCommand(bitfinexSubscribeCandlesCmd(key))
+    if h!=nil { // conditional used by resubscription after reconnection
+        drv.setCandleHandler(key, h)
+    }
+    
+    drv.wsCandleChanIdMap[key] = chanId
+    drv.wsAddChannel(chanId, wsCandles, key, true)
+}
+
+// subscribe candle updates. key is candle key, for example "trade:1m:fUSD"
+// or "trade:30m:fUSD:a30:p2:p30". snapshot of candles is ignored.
+func (drv *BitfinexRTPublic) SubscribeCandles(key string, h CandleHandler) {
+    drv.callMutex.Lock()
+    defer drv.callMutex.Unlock()
+    drv.subscribeCandlesInt(key, h)
+}
+
+func (drv *BitfinexRTPublic) UnsubscribeCandles(key string) {
+    drv.callMutex.Lock()
+    defer drv.callMutex.Unlock()
+    
+    chanId := drv.wsCandleChanIdMap[key]
+    drv.handleCommand(bitfinexUnsubscribeCmd(chanId))
+    drv.unsetCandleHandler(key)
+    
+    delete(drv.wsCandleChanIdMap, key)
+    drv.wsChannelMap.Delete(chanId)
+}
+
+// names of channel types in subscriptions
+const (
+    bitfinexChannelTicker = "ticker"
+    bitfinexChannelTrades = "trades"
+    bitfinexChannelBook = "book"
+    bitfinexChannelCandles = "candles"
+)
+
+// get sorted keys of channel id map
+func sortedChanIdMapKeys(m map[string]string) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// get currently subscribed keys (markets or currencies) for every channel type
+func (drv *BitfinexRTPublic) Subscriptions() map[string][]string {
+    drv.callMutex.Lock()
+    defer drv.callMutex.Unlock()
+    
+    subs := make(map[string][]string)
+    if len(drv.wsMarketPriceChanIdMap) != 0 {
+        subs[bitfinexChannelTicker] = sortedChanIdMapKeys(drv.wsMarketPriceChanIdMap)
+    }
+    if len(drv.wsTradeChanIdMap) != 0 {
+        subs[bitfinexChannelTrades] = sortedChanIdMapKeys(drv.wsTradeChanIdMap)
+    }
+    if len(drv.wsOrderBookChanIdMap) != 0 {
+        subs[bitfinexChannelBook] = sortedChanIdMapKeys(drv.wsOrderBookChanIdMap)
+    }
+    if len(drv.wsCandleChanIdMap) != 0 {
+        subs[bitfinexChannelCandles] = sortedChanIdMapKeys(drv.wsCandleChanIdMap)
+    }
+    return subs
+}
+
+// get statistics of received messages
+func (drv *BitfinexRTPublic) MessageStats() wsMessageStats {
+    return drv.msgStats.load()
+}
+
 func (drv *BitfinexRTPublic) wsResubscribeChannel(chType wsChannelType, key string) {
     switch chType {
         case wsInitialize:
@@ -494,6 +643,8 @@ func (drv *BitfinexRTPublic) wsResubscribeChannel(chType wsChannelType, key stri
             drv.subscribeTradesInt(key, nil)
         case wsDiffOrderBook:
             drv.getDiffOrderBookHandle(key).clear()
-            drv.subscribeOrderBookInt(key, nil)
+            drv.subscribeOrderBookInt(key, nil, true)
+        case wsCandles:
+            drv.subscribeCandlesInt(key, nil)
     }
 }
@@ -0,0 +1,90 @@
+/*
+ * clock.go - source of time for engine
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "time"
+)
+
+// source of time and timers (replaced by fake clock in tests)
+type Clock interface {
+    Now() time.Time
+    NewTimer(d time.Duration) Timer
+    NewTicker(d time.Duration) Ticker
+    Sleep(d time.Duration)
+}
+
+// timer created by Clock
+type Timer interface {
+    C() <-chan time.Time
+    Stop() bool
+}
+
+// ticker created by Clock
+type Ticker interface {
+    C() <-chan time.Time
+    Stop()
+}
+
+// clock with system time
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+    return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+    return realTimer{ time.NewTimer(d) }
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+    return realTicker{ time.NewTicker(d) }
+}
+
+func (realClock) Sleep(d time.Duration) {
+    time.Sleep(d)
+}
+
+type realTimer struct {
+    t *time.Timer
+}
+
+func (rt realTimer) C() <-chan time.Time {
+    return rt.t.C
+}
+
+func (rt realTimer) Stop() bool {
+    return rt.t.Stop()
+}
+
+type realTicker struct {
+    t *time.Ticker
+}
+
+func (rt realTicker) C() <-chan time.Time {
+    return rt.t.C
+}
+
+func (rt realTicker) Stop() {
+    rt.t.Stop()
+}
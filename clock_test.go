@@ -0,0 +1,257 @@
+/*
+ * clock_test.go - fake clock and period tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// clock with time changed only by advance (and sleep)
+type fakeClock struct {
+    mutex sync.Mutex
+    now time.Time
+    timers []*fakeTimer
+}
+
+type fakeTimer struct {
+    fc *fakeClock
+    when time.Time
+    period time.Duration    // non-zero for ticker
+    ch chan time.Time
+}
+
+// ticker of fake clock (ticks are dropped if channel is full)
+type fakeTicker struct {
+    *fakeTimer
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+    return &fakeClock{ now: now }
+}
+
+func (fc *fakeClock) Now() time.Time {
+    fc.mutex.Lock()
+    defer fc.mutex.Unlock()
+    return fc.now
+}
+
+func (fc *fakeClock) NewTimer(d time.Duration) Timer {
+    fc.mutex.Lock()
+    defer fc.mutex.Unlock()
+    ft := &fakeTimer{ fc: fc, when: fc.now.Add(d), ch: make(chan time.Time, 1) }
+    fc.timers = append(fc.timers, ft)
+    fc.fireTimers()
+    return ft
+}
+
+func (fc *fakeClock) NewTicker(d time.Duration) Ticker {
+    fc.mutex.Lock()
+    defer fc.mutex.Unlock()
+    ft := &fakeTimer{ fc: fc, when: fc.now.Add(d), period: d,
+                ch: make(chan time.Time, 1) }
+    fc.timers = append(fc.timers, ft)
+    fc.fireTimers()
+    return fakeTicker{ ft }
+}
+
+func (fc *fakeClock) Sleep(d time.Duration) {
+    fc.Advance(d)
+}
+
+// move time forward and fire expired timers
+func (fc *fakeClock) Advance(d time.Duration) {
+    fc.mutex.Lock()
+    defer fc.mutex.Unlock()
+    fc.now = fc.now.Add(d)
+    fc.fireTimers()
+}
+
+// get number of active timers
+func (fc *fakeClock) Timers() int {
+    fc.mutex.Lock()
+    defer fc.mutex.Unlock()
+    return len(fc.timers)
+}
+
+// must be called under mutex
+func (fc *fakeClock) fireTimers() {
+    active := fc.timers[:0]
+    for _, ft := range fc.timers {
+        if ft.when.After(fc.now) {
+            active = append(active, ft)
+        } else if ft.period > 0 {
+            for !ft.when.After(fc.now) {
+                select {
+                    case ft.ch <- ft.when:
+                    default:
+                }
+                ft.when = ft.when.Add(ft.period)
+            }
+            active = append(active, ft)
+        } else {
+            ft.ch <- ft.when
+        }
+    }
+    fc.timers = active
+}
+
+func (ft *fakeTimer) C() <-chan time.Time {
+    return ft.ch
+}
+
+func (ft *fakeTimer) Stop() bool {
+    ft.fc.mutex.Lock()
+    defer ft.fc.mutex.Unlock()
+    for i, t := range ft.fc.timers {
+        if t == ft {
+            ft.fc.timers = append(ft.fc.timers[:i], ft.fc.timers[i+1:]...)
+            return true
+        }
+    }
+    return false
+}
+
+func (ft fakeTicker) Stop() {
+    ft.fakeTimer.Stop()
+}
+
+// wait until condition is true (with real timeout)
+func waitFor(t *testing.T, what string, cond func() bool) {
+    deadline := time.Now().Add(5*time.Second)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatalf("Timeout of waiting for %s", what)
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func TestEngineAutoLoanPeriodFakeClock(t *testing.T) {
+    eng := getTestEngine0()
+    eng.df = &DataFetcher{ usdFiat: true }
+    eng.getMaxOrderBook = func(ob *OrderBook) {}
+    eng.bpriv = &fakePrivateApi{}
+    eng.stopCh = make(chan struct{})
+    eng.config.ObservePhase = time.Minute
+    eng.config.TaskCooldown = time.Hour
+    // period at 15:15, borrow until 15:29:20
+    alPeriodTime := time.Date(2021, 9, 14, 15, 15, 0, 0, time.UTC)
+    alDur := eng.config.AutoLoanFetchEndShift - eng.config.AutoLoanFetchShift +
+            eng.config.AutoLoanFetchPeriod
+    fc := newFakeClock(alPeriodTime)
+    eng.clock = fc
+    eng.marketsUpdateTime = alPeriodTime.UnixNano()   // markets are fresh
+    
+    done := make(chan bool, 1)
+    go func() { done <- eng.handleAutoLoanPeriod(alPeriodTime) }()
+    // end, task and observe timers
+    waitFor(t, "timers", func() bool { return fc.Timers()==3 })
+    if atomic.LoadUint32(&eng.checkOBEnabled)!=1 ||
+            atomic.LoadUint32(&eng.observing)!=1 {
+        t.Errorf("Orderbook check not started in observe phase")
+    }
+    fc.Advance(time.Minute)
+    waitFor(t, "end of observe phase", func() bool {
+        return atomic.LoadUint32(&eng.observing)==0
+    })
+    if atomic.LoadUint32(&eng.btDone)!=0 {
+        t.Errorf("Borrow task started before task time")
+    }
+    // task time is at most 60.1 seconds before end of period
+    fc.Advance(alDur - time.Minute - 60100*time.Millisecond - time.Millisecond)
+    if fc.Timers()!=2 {
+        t.Errorf("Timers fired before task time: %v", fc.Timers())
+    }
+    fc.Advance(60*time.Second + 50*time.Millisecond)
+    waitFor(t, "borrow task", func() bool { return atomic.LoadUint32(&eng.btDone)==1 })
+    select {
+        case <-done:
+            t.Fatalf("Period finished before end time")
+        default:
+    }
+    // end of period
+    fc.Advance(100*time.Millisecond)
+    select {
+        case res := <-done:
+            if !res { t.Errorf("Period not passed") }
+        case <-time.After(5*time.Second):
+            t.Fatalf("Period not finished")
+    }
+    if atomic.LoadUint32(&eng.checkOBEnabled)!=0 {
+        t.Errorf("Orderbook check not stopped after period")
+    }
+}
+
+func TestEngineStopWhileWaitingForPeriod(t *testing.T) {
+    eng := getTestEngine0()
+    eng.df = &DataFetcher{ usdFiat: true }
+    eng.stopCh = make(chan struct{})
+    // next period starts at 15:15
+    fc := newFakeClock(time.Date(2021, 9, 14, 15, 0, 0, 0, time.UTC))
+    eng.clock = fc
+    done := make(chan struct{})
+    go func() {
+        eng.mainRoutine()
+        close(done)
+    }()
+    waitFor(t, "wait for period", func() bool { return fc.Timers()==1 })
+    eng.Stop()
+    select {
+        case <-done:
+        case <-time.After(5*time.Second):
+            t.Fatalf("Main routine not stopped")
+    }
+    if fc.Timers()!=0 {
+        t.Errorf("Timer not stopped: %v", fc.Timers())
+    }
+}
+
+func TestEngineTaskCooldownFakeClock(t *testing.T) {
+    eng := getTestEngine0()
+    eng.stopCh = make(chan struct{})
+    eng.paused = 1  // borrow task returns immediately
+    eng.config.TaskCooldown = time.Minute
+    fc := newFakeClock(time.Date(2021, 9, 14, 15, 15, 0, 0, time.UTC))
+    eng.clock = fc
+    
+    if !eng.startBorrowTask(fc.Now()) {
+        t.Fatalf("First task not started")
+    }
+    waitFor(t, "cooldown timer", func() bool { return fc.Timers()==1 })
+    fc.Advance(59*time.Second)
+    if eng.startBorrowTask(fc.Now()) {
+        t.Errorf("Task started in cooldown")
+    }
+    fc.Advance(time.Second)
+    waitFor(t, "end of cooldown", func() bool { return atomic.LoadUint32(&eng.btDone)==0 })
+    if !eng.startBorrowTask(fc.Now()) {
+        t.Errorf("Second task not started after cooldown")
+    }
+    // stop cancels cooldown
+    waitFor(t, "cooldown timer", func() bool { return fc.Timers()==1 })
+    close(eng.stopCh)
+    waitFor(t, "stopped cooldown", func() bool { return fc.Timers()==0 })
+}
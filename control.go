@@ -0,0 +1,253 @@
+/*
+ * control.go - control HTTP server
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "net/http"
+    "net/http/pprof"
+    "runtime"
+    "sort"
+    "strconv"
+    "time"
+)
+
+type ControlServer struct {
+    eng *Engine
+    server *http.Server
+    start time.Time
+}
+
+func NewControlServer(addr string, eng *Engine) *ControlServer {
+    cs := &ControlServer{ eng: eng, start: time.Now() }
+    mux := http.NewServeMux()
+    mux.HandleFunc("/status", cs.handleStatus)
+    mux.HandleFunc("/pause", cs.handlePause)
+    mux.HandleFunc("/resume", cs.handleResume)
+    mux.HandleFunc("/orderbook", cs.handleOrderBook)
+    mux.HandleFunc("/diagnostics", cs.handleDiagnostics)
+    mux.HandleFunc("/reprice", cs.handleReprice)
+    mux.HandleFunc("/metrics", cs.handleMetrics)
+    cs.server = &http.Server{ Addr: addr, Handler: mux }
+    return cs
+}
+
+func (cs *ControlServer) Start() {
+    go func() {
+        if err := cs.server.ListenAndServe(); err!=nil &&
+                err!=http.ErrServerClosed {
+            Logger.Error("Control server error: ", err)
+        }
+    }()
+}
+
+func (cs *ControlServer) Stop() {
+    cs.server.Close()
+}
+
+func writeJsonResponse(w http.ResponseWriter, body []byte) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(body)
+}
+
+func (cs *ControlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+    body := make([]byte, 0, 40)
+    body = append(body, `{"paused":`...)
+    body = strconv.AppendBool(body, cs.eng.IsPaused())
+    if ob := cs.eng.LastOrderBook(); ob!=nil && len(ob.Ask) != 0 {
+        body = append(body, `,"lastAskRate":"`...)
+        body = append(body, ob.Ask[0].Rate.FormatBytes(12, true)...)
+        body = append(body, '"')
+        body = cs.appendDepthSummary(body, ob)
+    }
+    if ema, ok := cs.eng.rateStats.EMA(); ok {
+        body = append(body, `,"rateEma":"`...)
+        body = strconv.AppendFloat(body, ema, 'f', 12, 64)
+        body = append(body, '"')
+    }
+    if cs.eng.df != nil {
+        if subs := cs.eng.df.Subscriptions(); subs != nil {
+            body = appendSubscriptions(body, subs)
+        }
+    }
+    body = append(body, '}')
+    writeJsonResponse(w, body)
+}
+
+func appendSubscriptions(body []byte, subs map[string][]string) []byte {
+    chTypes := make([]string, 0, len(subs))
+    for chType := range subs {
+        chTypes = append(chTypes, chType)
+    }
+    sort.Strings(chTypes)
+    body = append(body, `,"subscriptions":{`...)
+    for i, chType := range chTypes {
+        if i != 0 { body = append(body, ',') }
+        body = strconv.AppendQuote(body, chType)
+        body = append(body, ":["...)
+        for j, key := range subs[chType] {
+            if j != 0 { body = append(body, ',') }
+            body = strconv.AppendQuote(body, key)
+        }
+        body = append(body, ']')
+    }
+    body = append(body, '}')
+    return body
+}
+
+func (cs *ControlServer) appendDepthSummary(body []byte, ob *OrderBook) []byte {
+    prec := cs.eng.amountPrec()
+    ds := ob.DepthSummary()
+    body = append(body, `,"depth":{"totalAsk":"`...)
+    body = append(body, ds.TotalAsk.FormatBytes(prec, true)...)
+    body = append(body, `","totalBid":"`...)
+    body = append(body, ds.TotalBid.FormatBytes(prec, true)...)
+    body = append(body, `","askRates":{`...)
+    for i, p := range depthSummaryPercentiles {
+        if i != 0 { body = append(body, ',') }
+        body = append(body, '"')
+        body = strconv.AppendInt(body, int64(p*100), 10)
+        body = append(body, `":"`...)
+        body = append(body, ds.AskRates[i].FormatBytes(12, true)...)
+        body = append(body, '"')
+    }
+    body = append(body, "}}"...)
+    return body
+}
+
+func (cs *ControlServer) handlePause(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    cs.eng.Pause()
+    cs.handleStatus(w, r)
+}
+
+func (cs *ControlServer) handleResume(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    cs.eng.Resume()
+    cs.handleStatus(w, r)
+}
+
+// start reprice of all offers in background (it can take long time)
+func (cs *ControlServer) handleReprice(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if cs.eng.IsPaused() {
+        http.Error(w, "Engine paused", http.StatusConflict)
+        return
+    }
+    go cs.eng.RepriceAllSafe()
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    w.Write([]byte(`{"reprice":"started"}`))
+}
+
+// dump current orderbook (for troubleshooting)
+func (cs *ControlServer) handleOrderBook(w http.ResponseWriter, r *http.Request) {
+    ob := cs.eng.CurrentOrderBook()
+    if ob == nil {
+        http.Error(w, "No orderbook", http.StatusServiceUnavailable)
+        return
+    }
+    body := make([]byte, 0, 100 + 80*(len(ob.Bid) + len(ob.Ask)))
+    writeJsonResponse(w, ob.AppendJson(body, cs.eng.amountPrec()))
+}
+
+// diagnostics of goroutines: number of goroutines, websocket connections and
+// channels and pending and dropped handler calls of realtime messages
+func (cs *ControlServer) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+    body := make([]byte, 0, 100)
+    body = append(body, `{"goroutines":`...)
+    body = strconv.AppendInt(body, int64(runtime.NumGoroutine()), 10)
+    var conns, channels int
+    if cs.eng.df != nil {
+        conns, channels = cs.eng.df.WSChannels()
+    }
+    body = append(body, `,"wsConnections":`...)
+    body = strconv.AppendInt(body, int64(conns), 10)
+    body = append(body, `,"wsChannels":`...)
+    body = strconv.AppendInt(body, int64(channels), 10)
+    body = append(body, `,"pendingHandlers":`...)
+    body = strconv.AppendInt(body, PendingHandlers(), 10)
+    body = append(body, `,"droppedHandlers":`...)
+    body = strconv.AppendUint(body, DroppedHandlers(), 10)
+    body = append(body, '}')
+    writeJsonResponse(w, body)
+}
+
+// websocket message metrics by channel type: numbers of received messages and
+// bytes and their average rates per second since start of control server
+func (cs *ControlServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+    var stats wsMessageStats
+    if cs.eng.df != nil {
+        stats = cs.eng.df.WSMessageStats()
+    }
+    elapsed := time.Since(cs.start).Seconds()
+    if elapsed < 1 { elapsed = 1 }
+    body := make([]byte, 0, 100 + 120*len(wsStatsNames))
+    body = append(body, `{"uptime":`...)
+    body = strconv.AppendFloat(body, elapsed, 'f', 0, 64)
+    body = append(body, `,"ws":{`...)
+    for i, name := range wsStatsNames {
+        if i!=0 { body = append(body, ',') }
+        body = append(body, '"')
+        body = append(body, name...)
+        body = append(body, `":{"messages":`...)
+        body = strconv.AppendUint(body, stats.Messages[i], 10)
+        body = append(body, `,"bytes":`...)
+        body = strconv.AppendUint(body, stats.Bytes[i], 10)
+        body = append(body, `,"messagesPerSec":`...)
+        body = strconv.AppendFloat(body, float64(stats.Messages[i]) / elapsed,
+                                   'f', 3, 64)
+        body = append(body, `,"bytesPerSec":`...)
+        body = strconv.AppendFloat(body, float64(stats.Bytes[i]) / elapsed,
+                                   'f', 3, 64)
+        body = append(body, '}')
+    }
+    body = append(body, "}}"...)
+    writeJsonResponse(w, body)
+}
+
+// start pprof HTTP server (separated from control server)
+func startPprofServer(addr string) *http.Server {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/debug/pprof/", pprof.Index)
+    mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+    mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+    mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+    mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+    server := &http.Server{ Addr: addr, Handler: mux }
+    go func() {
+        if err := server.ListenAndServe(); err!=nil &&
+                err!=http.ErrServerClosed {
+            Logger.Error("Pprof server error: ", err)
+        }
+    }()
+    return server
+}
@@ -0,0 +1,210 @@
+/*
+ * control_test.go - control HTTP server tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "runtime"
+    "testing"
+    "time"
+)
+
+func doControlRequest(cs *ControlServer, method, path string) (int, string) {
+    req := httptest.NewRequest(method, path, nil)
+    rec := httptest.NewRecorder()
+    cs.server.Handler.ServeHTTP(rec, req)
+    return rec.Code, rec.Body.String()
+}
+
+func TestControlServerPauseResume(t *testing.T) {
+    eng := getTestEngine0()
+    cs := NewControlServer("127.0.0.1:0", eng)
+    
+    if code, body := doControlRequest(cs, http.MethodGet, "/status");
+            code!=200 || body!=`{"paused":false}` {
+        t.Errorf("Status mismatch: %v %v", code, body)
+    }
+    if code, _ := doControlRequest(cs, http.MethodGet, "/pause"); code!=405 {
+        t.Errorf("Code mismatch: %v", code)
+    }
+    if code, body := doControlRequest(cs, http.MethodPost, "/pause");
+            code!=200 || body!=`{"paused":true}` || !eng.IsPaused() {
+        t.Errorf("Pause mismatch: %v %v", code, body)
+    }
+    if code, body := doControlRequest(cs, http.MethodPost, "/resume");
+            code!=200 || body!=`{"paused":false}` || eng.IsPaused() {
+        t.Errorf("Resume mismatch: %v %v", code, body)
+    }
+}
+
+func TestControlServerStatusLastAsk(t *testing.T) {
+    eng := getTestEngine0()
+    cs := NewControlServer("127.0.0.1:0", eng)
+    eng.lastOb = &OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 1000000000, 300000000, 1 } } }
+    if code, body := doControlRequest(cs, http.MethodGet, "/status");
+            code!=200 || body!=`{"paused":false,"lastAskRate":"0.0003",` +
+                `"depth":{"totalAsk":"10.0","totalBid":"0.0","askRates":{` +
+                `"10":"0.0003","25":"0.0003","50":"0.0003","75":"0.0003",` +
+                `"90":"0.0003"}}}` {
+        t.Errorf("Status mismatch: %v %v", code, body)
+    }
+}
+
+func TestControlServerOrderBook(t *testing.T) {
+    eng := getTestEngine0()
+    cs := NewControlServer("127.0.0.1:0", eng)
+    if code, _ := doControlRequest(cs, http.MethodGet, "/orderbook"); code!=503 {
+        t.Errorf("Code mismatch: %v", code)
+    }
+    eng.df = &DataFetcher{ usdFiat: true }
+    eng.df.orderBook.Store(&OrderBook{
+        Bid: []OrderBookEntry{ OrderBookEntry{ 30, 15050000000, 250000000, 2 } },
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 1000000000, 300000000, 1 },
+            OrderBookEntry{ 7, 200000000, 310000000, 3 } } })
+    if code, body := doControlRequest(cs, http.MethodGet, "/orderbook");
+            code!=200 || body!=`{"bid":[{"period":30,"amount":"150.5",` +
+                `"rate":"0.00025","count":2}],"ask":[{"period":2,"amount":"10.0",` +
+                `"rate":"0.0003","count":1},{"period":7,"amount":"2.0",` +
+                `"rate":"0.00031","count":3}]}` {
+        t.Errorf("Orderbook mismatch: %v %v", code, body)
+    }
+    // empty orderbook
+    ob := OrderBook{}
+    if body := string(ob.AppendJson(nil, 8)); body!=`{"bid":[],"ask":[]}` {
+        t.Errorf("Orderbook mismatch: %v", body)
+    }
+}
+
+func TestControlAppendSubscriptions(t *testing.T) {
+    subs := map[string][]string{ "trades": { "UST" }, "book": { "BTC", "UST" } }
+    expBody := `,"subscriptions":{"book":["BTC","UST"],"trades":["UST"]}`
+    if body := string(appendSubscriptions(nil, subs)); body!=expBody {
+        t.Errorf("Subscriptions mismatch: %v!=%v", expBody, body)
+    }
+}
+
+func TestControlServerDiagnostics(t *testing.T) {
+    eng := getTestEngine0()
+    cs := NewControlServer("127.0.0.1:0", eng)
+    // block some handlers
+    blockCh := make(chan struct{})
+    for i := 0; i < 3; i++ {
+        goHandler(func() { <-blockCh })
+    }
+    defer close(blockCh)
+    code, body := doControlRequest(cs, http.MethodGet, "/diagnostics")
+    if code!=200 {
+        t.Fatalf("Status code mismatch: %v %v", code, body)
+    }
+    var diag struct {
+        Goroutines int `json:"goroutines"`
+        WSConnections int `json:"wsConnections"`
+        WSChannels int `json:"wsChannels"`
+        PendingHandlers int `json:"pendingHandlers"`
+    }
+    if err := json.Unmarshal([]byte(body), &diag); err!=nil {
+        t.Fatalf("Wrong diagnostics %q: %v", body, err)
+    }
+    // at least test goroutine and blocked handlers
+    if diag.Goroutines < 4 || diag.Goroutines > runtime.NumGoroutine()+10 {
+        t.Errorf("Implausible goroutine count: %v", diag.Goroutines)
+    }
+    if diag.PendingHandlers < 3 || diag.WSConnections!=0 || diag.WSChannels!=0 {
+        t.Errorf("Diagnostics mismatch: %v", body)
+    }
+}
+
+func TestControlServerReprice(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.df = &DataFetcher{ usdFiat: true }
+    eng.getMaxOrderBook = func(ob *OrderBook) {}
+    // no credits and positions - only cancel offers
+    fp := &fakePrivateApi{ orders: []Order{ Order{ Id: 501, Currency: "UST",
+                Amount: 50000000000, Status: OrderActive, Rate: 3000000000 } } }
+    eng.bpriv = fp
+    cs := NewControlServer("127.0.0.1:0", eng)
+    if code, _ := doControlRequest(cs, http.MethodGet, "/reprice"); code!=405 {
+        t.Errorf("Code mismatch: %v", code)
+    }
+    // paused engine keeps offers
+    eng.Pause()
+    if code, _ := doControlRequest(cs, http.MethodPost, "/reprice"); code!=409 {
+        t.Errorf("Code mismatch: %v", code)
+    }
+    if n := eng.RepriceAll(); n!=0 || len(fp.canceled)!=0 {
+        t.Errorf("Offers canceled while paused: %v %v", n, fp.canceled)
+    }
+    eng.Resume()
+    if code, body := doControlRequest(cs, http.MethodPost, "/reprice");
+            code!=202 || body!=`{"reprice":"started"}` {
+        t.Errorf("Reprice mismatch: %v %v", code, body)
+    }
+    // wait for end of reprice
+    deadline := time.Now().Add(5*time.Second)
+    for time.Now().Before(deadline) {
+        eng.taskMutex.Lock()
+        done := len(fp.canceled)!=0
+        eng.taskMutex.Unlock()
+        if done { break }
+        time.Sleep(5*time.Millisecond)
+    }
+    eng.taskMutex.Lock()
+    defer eng.taskMutex.Unlock()
+    if len(fp.canceled)!=1 || fp.canceled[0]!=501 {
+        t.Errorf("Canceled offers mismatch: %v", fp.canceled)
+    }
+}
+
+func TestControlServerMetrics(t *testing.T) {
+    eng := getTestEngine0()
+    cs := NewControlServer("127.0.0.1:0", eng)
+    code, body := doControlRequest(cs, http.MethodGet, "/metrics")
+    if code!=200 {
+        t.Fatalf("Status code mismatch: %v %v", code, body)
+    }
+    var metrics struct {
+        Uptime float64 `json:"uptime"`
+        WS map[string]struct {
+            Messages uint64 `json:"messages"`
+            Bytes uint64 `json:"bytes"`
+            MessagesPerSec float64 `json:"messagesPerSec"`
+            BytesPerSec float64 `json:"bytesPerSec"`
+        } `json:"ws"`
+    }
+    if err := json.Unmarshal([]byte(body), &metrics); err!=nil {
+        t.Fatalf("Wrong metrics %q: %v", body, err)
+    }
+    if len(metrics.WS)!=len(wsStatsNames) || metrics.Uptime < 1 {
+        t.Errorf("Metrics mismatch: %v", body)
+    }
+    for _, name := range wsStatsNames {
+        if m, ok := metrics.WS[name]; !ok || m.Messages!=0 || m.Bytes!=0 {
+            t.Errorf("Metrics mismatch for %v: %v", name, body)
+        }
+    }
+}
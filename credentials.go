@@ -0,0 +1,180 @@
+/*
+ * credentials.go - credential providers
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "bytes"
+    "os"
+    "os/exec"
+    "strings"
+    "time"
+    "github.com/chzyer/readline"
+    "github.com/valyala/fasthttp"
+)
+
+const (
+    authBackendFile = "file"
+    authBackendKeyring = "keyring"
+    authBackendVault = "vault"
+)
+
+const defaultKeyringService = "bitfinex_borrow_catcher"
+
+// CredentialProvider returns api key and secret key for exchange.
+// It panics if credentials can't be retrieved.
+type CredentialProvider interface {
+    GetCredentials() ([]byte, []byte)
+}
+
+// MultiCredentialProvider returns main key and backup keys.
+type MultiCredentialProvider interface {
+    GetAllCredentials() []KeyPair
+}
+
+/* encrypted file (default) */
+
+type fileCredentialProvider struct {
+    config *Config
+    rdpwd, rdkey func(string) ([]byte, error)
+}
+
+func (fp *fileCredentialProvider) GetCredentials() ([]byte, []byte) {
+    return authenticateExchangeInt(fp.config, fp.rdpwd, fp.rdkey)
+}
+
+func (fp *fileCredentialProvider) GetAllCredentials() []KeyPair {
+    return authenticateExchangeKeysInt(fp.config, fp.rdpwd, fp.rdkey)
+}
+
+/* OS keyring (through secret-tool from libsecret) */
+
+type keyringCredentialProvider struct {
+    service string
+    lookup func(service, account string) ([]byte, error)
+}
+
+func secretToolLookup(service, account string) ([]byte, error) {
+    out, err := exec.Command("secret-tool", "lookup",
+                    "service", service, "account", account).Output()
+    if err!=nil { return nil, err }
+    return bytes.TrimRight(out, "\r\n"), nil
+}
+
+func (kp *keyringCredentialProvider) GetCredentials() ([]byte, []byte) {
+    apiKey, err := kp.lookup(kp.service, "apiKey")
+    if err!=nil {
+        ErrorPanic("Can't get APIKey from keyring", err)
+    }
+    secretKey, err := kp.lookup(kp.service, "secretKey")
+    if err!=nil {
+        ErrorPanic("Can't get SecretKey from keyring", err)
+    }
+    return apiKey, secretKey
+}
+
+/* HashiCorp Vault (KV secrets engine) */
+
+type vaultCredentialProvider struct {
+    addr, path, token string
+}
+
+func (vp *vaultCredentialProvider) GetCredentials() ([]byte, []byte) {
+    req := fasthttp.AcquireRequest()
+    defer fasthttp.ReleaseRequest(req)
+    resp := fasthttp.AcquireResponse()
+    defer fasthttp.ReleaseResponse(resp)
+    
+    req.SetRequestURI(strings.TrimRight(vp.addr, "/") + "/v1/" +
+                    strings.TrimLeft(vp.path, "/"))
+    req.Header.SetMethod(fasthttp.MethodGet)
+    req.Header.SetUserAgentBytes(UserAgentBytes)
+    req.Header.Set("X-Vault-Token", vp.token)
+    if err := fasthttp.DoTimeout(req, resp, time.Minute); err!=nil {
+        ErrorPanic("Error while doing Vault request", err)
+    }
+    if sc := resp.StatusCode(); sc >= 400 {
+        HttpPanic("Can't get credentials from Vault", sc)
+    }
+    
+    jp := JsonParserPool.Get()
+    defer JsonParserPool.Put(jp)
+    v, err := jp.ParseBytes(resp.Body())
+    if err!=nil {
+        ParseErrorPanic("Error while parsing Vault response", err)
+    }
+    // KV version 2 holds secret in data.data, version 1 in data
+    data := v.Get("data", "data")
+    if data==nil { data = v.Get("data") }
+    if data==nil {
+        panic(&ParseError{ Context: "No data in Vault response" })
+    }
+    apiKey := append([]byte(nil), data.GetStringBytes("apiKey")...)
+    secretKey := append([]byte(nil), data.GetStringBytes("secretKey")...)
+    return apiKey, secretKey
+}
+
+func newCredentialProvider(config *Config, pwdStdin bool) CredentialProvider {
+    switch config.AuthBackend {
+        case "", authBackendFile:
+            rdpwd := selectPasswordReader(os.Getenv, os.Stdin, pwdStdin,
+                                          readline.Password)
+            return &fileCredentialProvider{ config: config,
+                        rdpwd: rdpwd, rdkey: readline.Password }
+        case authBackendKeyring:
+            service := config.KeyringService
+            if service=="" { service = defaultKeyringService }
+            return &keyringCredentialProvider{ service: service,
+                        lookup: secretToolLookup }
+        case authBackendVault:
+            addr := config.VaultAddr
+            if addr=="" { addr = os.Getenv("VAULT_ADDR") }
+            return &vaultCredentialProvider{ addr: addr, path: config.VaultPath,
+                        token: os.Getenv("VAULT_TOKEN") }
+    }
+    panic("Unknown auth backend: " + config.AuthBackend)
+}
+
+// get credentials from provider and check them
+func getCredentials(cp CredentialProvider) ([]byte, []byte) {
+    apiKey, secretKey := cp.GetCredentials()
+    if len(apiKey)==0 || len(secretKey)==0 {
+        panic("Empty APIKey or SecretKey")
+    }
+    return apiKey, secretKey
+}
+
+// get main key and backup keys from provider and check them
+func getAllCredentials(cp CredentialProvider) []KeyPair {
+    mcp, ok := cp.(MultiCredentialProvider)
+    if !ok {
+        apiKey, secretKey := getCredentials(cp)
+        return []KeyPair{ { apiKey, secretKey } }
+    }
+    keys := mcp.GetAllCredentials()
+    for _, kp := range keys {
+        if len(kp.ApiKey)==0 || len(kp.SecretKey)==0 {
+            panic("Empty APIKey or SecretKey")
+        }
+    }
+    return keys
+}
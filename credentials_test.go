@@ -0,0 +1,78 @@
+/*
+ * credentials_test.go - credential providers tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "testing"
+)
+
+type fakeCredentialProvider struct {
+    apiKey, secretKey string
+}
+
+func (fp *fakeCredentialProvider) GetCredentials() ([]byte, []byte) {
+    return []byte(fp.apiKey), []byte(fp.secretKey)
+}
+
+func TestGetCredentials(t *testing.T) {
+    apiKey, secretKey := getCredentials(&fakeCredentialProvider{ "key1", "secret1" })
+    if string(apiKey)!="key1" || string(secretKey)!="secret1" {
+        t.Errorf("Credentials mismatch: %v,%v", string(apiKey), string(secretKey))
+    }
+    
+    // empty credentials
+    func() {
+        defer func() {
+            if x := recover(); x==nil {
+                t.Errorf("No panic for empty credentials")
+            }
+        }()
+        getCredentials(&fakeCredentialProvider{ "key1", "" })
+    }()
+}
+
+func TestKeyringCredentialProvider(t *testing.T) {
+    kp := &keyringCredentialProvider{ service: "bbc",
+        lookup: func(service, account string) ([]byte, error) {
+            return []byte(service + ":" + account), nil
+        } }
+    apiKey, secretKey := getCredentials(kp)
+    if string(apiKey)!="bbc:apiKey" || string(secretKey)!="bbc:secretKey" {
+        t.Errorf("Credentials mismatch: %v,%v", string(apiKey), string(secretKey))
+    }
+}
+
+func TestNewCredentialProvider(t *testing.T) {
+    if _, ok := newCredentialProvider(&Config{}, false).(*fileCredentialProvider);
+            !ok {
+        t.Errorf("Default provider is not file provider")
+    }
+    if _, ok := newCredentialProvider(&Config{ AuthBackend: "keyring" },
+                        false).(*keyringCredentialProvider); !ok {
+        t.Errorf("Provider is not keyring provider")
+    }
+    if _, ok := newCredentialProvider(&Config{ AuthBackend: "vault" },
+                        false).(*vaultCredentialProvider); !ok {
+        t.Errorf("Provider is not vault provider")
+    }
+}
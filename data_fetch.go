@@ -23,6 +23,8 @@
 package main
 
 import (
+    "fmt"
+    "math"
     "sync"
     "sync/atomic"
     "time"
@@ -33,11 +35,16 @@ const maxRtPeriodUpdate = 60*5
 const maxPeriodUpdate = 10
 const dfUpdaterPeriod = time.Second*10
 
+// number of top levels compared by orderbook deviation check
+const obCheckLevels = 5
+const defaultObCheckInterval = 5*time.Minute
+// number of successive checks with deviation needed to resubscribe orderbook
+const obCheckConfirmations = 2
+
 var usdMarketsOnce sync.Once
 var usdMarkets map[string]Market
 
-func initUSDMarkets() {
-    bp := NewBitfinexPublic()
+func initUSDMarkets(bp *BitfinexPublic) {
     markets := bp.GetMarkets()
     
     usdMarkets = make(map[string]Market)
@@ -57,7 +64,7 @@ type DataFetcher struct {
     noUsdPrice bool
     currency string
     public *BitfinexPublic
-    rtPublic *BitfinexRTPublic
+    rtPublic *BitfinexRTPublicPool
     
     marketPriceLastUpdate int64     // atomic
     rtMarketPriceLastUpdate int64   // atomic
@@ -72,17 +79,34 @@ type DataFetcher struct {
     marketPriceHandlerU MarketPriceHandler
     orderBookHandlerU OrderBookHandler
     lastTradeHandlerU TradeHandler
+    
+    // depth of orderbook fetched by HTTP if websocket fails
+    fallbackObDepth uint
+    getOrderBook func(currency string, depth uint, ob *OrderBook)
+    getMarketPrice func(market string) godec64.UDec64
+    
+    // check of deviation between realtime and REST orderbooks
+    obCheckMaxDev float64
+    obCheckInterval int64   // in seconds
+    obCheckLastTime int64
+    obCheckNotifier Notifier
+    obChecking uint32   // 1 if check is running
+    obCheckDeviations int   // number of successive checks with deviation
+    resubscribeOrderBook func(currency string)
 }
 
-func NewDataFetcher(public *BitfinexPublic, rtPublic *BitfinexRTPublic,
+func NewDataFetcher(public *BitfinexPublic, rtPublic *BitfinexRTPublicPool,
                     currency string) *DataFetcher {
-    usdMarketsOnce.Do(initUSDMarkets)
+    usdMarketsOnce.Do(func() { initUSDMarkets(public) })
     
     df := &DataFetcher{ stopCh: make(chan struct{}),
         usdFiat: false, noUsdPrice: false,
         currency: currency, public: public, rtPublic: rtPublic,
         marketPriceLastUpdate: 0, orderBookLastUpdate: 0, tradeLastUpdate: 0,
-        rtMarketPriceLastUpdate: 0, rtOrderBookLastUpdate: 0, rtTradeLastUpdate: 0 }
+        rtMarketPriceLastUpdate: 0, rtOrderBookLastUpdate: 0, rtTradeLastUpdate: 0,
+        fallbackObDepth: bitfinexMaxOrderBookDepth,
+        getOrderBook: public.GetOrderBookDepth,
+        getMarketPrice: public.GetMarketPrice }
     
     if currency!="USD" && currency!="UST" {
         if _, ok := usdMarkets[currency]; ok {
@@ -101,10 +125,36 @@ func NewDataFetcher(public *BitfinexPublic, rtPublic *BitfinexRTPublic,
         }
         rtPublic.SubscribeOrderBook(currency, df.orderBookHandler)
         rtPublic.SubscribeTrades(currency, df.tradeHandler)
+        df.resubscribeOrderBook = func(currency string) {
+            defer func() {
+                if x := recover(); x!=nil {
+                    Logger.Error("Error on calling resubscribeOrderBook", x)
+                }
+            }()
+            rtPublic.resubscribeOrderBook(currency)
+        }
     }
     return df
 }
 
+// get realtime subscriptions (nil if realtime is not used)
+func (df *DataFetcher) Subscriptions() map[string][]string {
+    if df.rtPublic == nil { return nil }
+    return df.rtPublic.Subscriptions()
+}
+
+// get number of websocket connections and subscribed channels
+func (df *DataFetcher) WSChannels() (int, int) {
+    if df.rtPublic == nil { return 0, 0 }
+    return df.rtPublic.Connections(), df.rtPublic.Channels()
+}
+
+// get statistics of received websocket messages
+func (df *DataFetcher) WSMessageStats() wsMessageStats {
+    if df.rtPublic == nil { return wsMessageStats{} }
+    return df.rtPublic.MessageStats()
+}
+
 func (df *DataFetcher) GetCurrency() string {
     return df.currency
 }
@@ -121,6 +171,23 @@ func (df *DataFetcher) SetLastTradeHandler(th TradeHandler) {
     df.lastTradeHandlerU = th
 }
 
+// set depth of orderbook fetched by HTTP if websocket fails.
+// default is depth of orderbook used by borrow task.
+func (df *DataFetcher) SetFallbackOrderBookDepth(depth uint) {
+    df.fallbackObDepth = depth
+}
+
+// enable periodic check of deviation between realtime orderbook and REST
+// orderbook. maxDeviation - maximal relative deviation of top levels,
+// interval - interval of check (0 - default).
+func (df *DataFetcher) SetOrderBookCheck(maxDeviation float64, interval time.Duration,
+                                         notifier Notifier) {
+    if interval <= 0 { interval = defaultObCheckInterval }
+    df.obCheckMaxDev = maxDeviation
+    df.obCheckInterval = int64(interval / time.Second)
+    df.obCheckNotifier = notifier
+}
+
 func (df *DataFetcher) Start() {
     df.marketPrice.Store(godec64.UDec64(0))
     df.orderBook.Store(&OrderBook{})
@@ -139,13 +206,7 @@ func (df *DataFetcher) update() {
     
     mpObj := df.marketPrice.Load()
     if !df.usdFiat && !df.noUsdPrice && (needUpdate || mpObj==nil) {
-        // get from HTTP
-        mp := df.public.GetMarketPrice(usdMarkets[df.currency].Name)
-        df.marketPrice.Store(mp)
-        atomic.StoreInt64(&df.marketPriceLastUpdate, t)
-        if df.marketPriceHandlerU!=nil {
-            go df.marketPriceHandlerU(mp)
-        }
+        df.fetchMarketPrice(t)
     }
     
     needUpdate = t - atomic.LoadInt64(&df.rtOrderBookLastUpdate) >= maxRtPeriodUpdate
@@ -153,7 +214,7 @@ func (df *DataFetcher) update() {
     if needUpdate || obObj==nil {
         // get from HTTP
         var ob OrderBook
-        df.public.GetOrderBook(df.currency, &ob)
+        df.getOrderBook(df.currency, df.fallbackObDepth, &ob)
         df.orderBook.Store(&ob)
         atomic.StoreInt64(&df.orderBookLastUpdate, t)
         if df.orderBookHandlerU!=nil {
@@ -161,6 +222,18 @@ func (df *DataFetcher) update() {
         }
     }
     
+    if !needUpdate && df.obCheckMaxDev > 0 &&
+            t - df.obCheckLastTime >= df.obCheckInterval &&
+            atomic.CompareAndSwapUint32(&df.obChecking, 0, 1) {
+        // realtime orderbook is fresh. REST orderbook is fetched in background
+        // to not delay other updates.
+        df.obCheckLastTime = t
+        go func() {
+            defer atomic.StoreUint32(&df.obChecking, 0)
+            df.checkOrderBookDeviationSafe()
+        }()
+    }
+    
     needUpdate = t - atomic.LoadInt64(&df.rtTradeLastUpdate) >= maxRtPeriodUpdate
     trObj := df.lastTrade.Load()
     if needUpdate || trObj==nil {
@@ -178,6 +251,81 @@ func (df *DataFetcher) update() {
     }
 }
 
+// get USD price from HTTP (t - time of update in Unix seconds)
+func (df *DataFetcher) fetchMarketPrice(t int64) {
+    mp := df.getMarketPrice(usdMarkets[df.currency].Name)
+    df.marketPrice.Store(mp)
+    atomic.StoreInt64(&df.marketPriceLastUpdate, t)
+    if df.marketPriceHandlerU!=nil {
+        go df.marketPriceHandlerU(mp)
+    }
+}
+
+func relativeDeviation(a, b godec64.UDec64) float64 {
+    if a == b { return 0 }
+    fa, fb := float64(a), float64(b)
+    return math.Abs(fa - fb) / math.Max(fa, fb)
+}
+
+// get maximal relative deviation of rates of top levels of orderbooks.
+// amounts are not compared, because they change often between fetches.
+// missing level gives deviation 1.
+func orderBookDeviation(ob1, ob2 *OrderBook, levels int) float64 {
+    var dev float64
+    sideDeviation := func(side1, side2 []OrderBookEntry) {
+        for i := 0; i < levels; i++ {
+            if i >= len(side1) || i >= len(side2) {
+                if i < len(side1) || i < len(side2) { dev = 1 }
+                return
+            }
+            dev = math.Max(dev, relativeDeviation(side1[i].Rate, side2[i].Rate))
+        }
+    }
+    sideDeviation(ob1.Bid, ob2.Bid)
+    sideDeviation(ob1.Ask, ob2.Ask)
+    return dev
+}
+
+// compare realtime orderbook with REST orderbook. if deviation is too big
+// in successive checks, resubscribe orderbook and send alert.
+// returns true if deviation detected.
+func (df *DataFetcher) checkOrderBookDeviation() bool {
+    rtOb := df.orderBook.Load().(*OrderBook)
+    var restOb OrderBook
+    df.getOrderBook(df.currency, bitfinexOrderBookDepth, &restOb)
+    dev := orderBookDeviation(rtOb, &restOb, obCheckLevels)
+    if dev <= df.obCheckMaxDev {
+        df.obCheckDeviations = 0
+        return false
+    }
+    df.obCheckDeviations++
+    if df.obCheckDeviations < obCheckConfirmations {
+        Logger.Warn("Realtime orderbook of ", df.currency,
+                    " deviates from REST orderbook: ", dev, " - check again")
+        return false
+    }
+    df.obCheckDeviations = 0
+    msg := fmt.Sprint("Realtime orderbook of ", df.currency,
+                      " deviates from REST orderbook: ", dev)
+    Logger.Error(msg)
+    if df.obCheckNotifier!=nil {
+        df.obCheckNotifier.Notify(msg)
+    }
+    if df.resubscribeOrderBook!=nil {
+        go df.resubscribeOrderBook(df.currency)
+    }
+    return true
+}
+
+func (df *DataFetcher) checkOrderBookDeviationSafe() {
+    defer func() {
+        if x := recover(); x!=nil {
+            Logger.Error("Error while checking orderbook: ", x)
+        }
+    }()
+    df.checkOrderBookDeviation()
+}
+
 func (df *DataFetcher) safeUpdate() {
     defer func() {
         if x := recover(); x!=nil {
@@ -219,6 +367,7 @@ func (df *DataFetcher) marketPriceHandler(mp godec64.UDec64) {
 func (df *DataFetcher) orderBookHandler(ob *OrderBook) {
     var newOb OrderBook
     newOb.copyFrom(ob)        // copy to avoid problems
+    newOb.Baseline = ob.Baseline
     df.orderBook.Store(&newOb)
     atomic.StoreInt64(&df.rtOrderBookLastUpdate, time.Now().Unix())
     if df.orderBookHandlerU!=nil {
@@ -244,6 +393,47 @@ func (df *DataFetcher) GetUSDPrice() godec64.UDec64 {
     return df.marketPrice.Load().(godec64.UDec64)
 }
 
+// get age of USD price (time since last update by websocket or by HTTP).
+// returns 0 if currency is USD or it has no USD price.
+func (df *DataFetcher) USDPriceAge(now time.Time) time.Duration {
+    if df.usdFiat || df.noUsdPrice { return 0 }
+    last := atomic.LoadInt64(&df.marketPriceLastUpdate)
+    if rtLast := atomic.LoadInt64(&df.rtMarketPriceLastUpdate); rtLast > last {
+        last = rtLast
+    }
+    return now.Sub(time.Unix(last, 0))
+}
+
+// fetch USD price by HTTP now (for example if it is stale)
+func (df *DataFetcher) RefreshUSDPrice() {
+    if df.usdFiat || df.noUsdPrice { return }
+    df.fetchMarketPrice(time.Now().Unix())
+}
+
+// get USD prices of many currencies in single request.
+// Currencies without USD market are not in result.
+func (df *DataFetcher) GetUSDPrices(currencies []string) map[string]godec64.UDec64 {
+    prices := make(map[string]godec64.UDec64, len(currencies))
+    markets := make([]string, 0, len(currencies))
+    for _, curr := range currencies {
+        if curr=="USD" || curr=="UST" {
+            prices[curr] = 100000000
+        } else if m, ok := usdMarkets[curr]; ok {
+            markets = append(markets, m.Name)
+        }
+    }
+    if len(markets)==0 { return prices }
+    marketPrices := df.public.GetMarketPrices(markets)
+    for _, curr := range currencies {
+        if m, ok := usdMarkets[curr]; ok {
+            if mp, ok := marketPrices[m.Name]; ok {
+                prices[curr] = mp
+            }
+        }
+    }
+    return prices
+}
+
 func (df *DataFetcher) GetOrderBook() *OrderBook {
     return df.orderBook.Load().(*OrderBook)
 }
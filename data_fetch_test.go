@@ -0,0 +1,127 @@
+/*
+ * data_fetch_test.go - data fetcher tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestDataFetcherFallbackOrderBookDepth(t *testing.T) {
+    var depths []uint
+    df := &DataFetcher{ currency: "UST", usdFiat: true,
+        fallbackObDepth: bitfinexMaxOrderBookDepth,
+        getOrderBook: func(currency string, depth uint, ob *OrderBook) {
+            depths = append(depths, depth)
+        } }
+    // only orderbook is fetched by HTTP
+    df.lastTrade.Store(&Trade{})
+    atomic.StoreInt64(&df.rtTradeLastUpdate, time.Now().Unix())
+    df.update()
+    df.SetFallbackOrderBookDepth(25)
+    df.update()
+    if len(depths)!=2 || depths[0]!=100 || depths[1]!=25 {
+        t.Errorf("Depths mismatch: %v", depths)
+    }
+    // orderbook from websocket is fresh
+    atomic.StoreInt64(&df.rtOrderBookLastUpdate, time.Now().Unix())
+    df.update()
+    if len(depths)!=2 {
+        t.Errorf("Depths mismatch: %v", depths)
+    }
+}
+
+func TestDataFetcherOrderBookDeviation(t *testing.T) {
+    restOb := OrderBook{
+        Bid: []OrderBookEntry{
+            OrderBookEntry{ 2, 20000000000, 90000000, 1 },
+            OrderBookEntry{ 2, 5000000000, 80000000, 1 } },
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 5000000000, 100000000, 1 },
+            OrderBookEntry{ 2, 15000000000, 110000000, 2 } },
+    }
+    // realtime orderbook with drifted second ask level
+    rtOb := OrderBook{
+        Bid: append([]OrderBookEntry{}, restOb.Bid...),
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 5000000000, 100000000, 1 },
+            OrderBookEntry{ 2, 15000000000, 130000000, 2 } },
+    }
+    if dev := orderBookDeviation(&restOb, &restOb, obCheckLevels); dev!=0 {
+        t.Errorf("Deviation mismatch: %v", dev)
+    }
+    rtShort := OrderBook{ Bid: restOb.Bid, Ask: restOb.Ask[:1] }
+    if dev := orderBookDeviation(&rtShort, &restOb, obCheckLevels); dev!=1 {
+        t.Errorf("Deviation mismatch: %v", dev)
+    }
+    // amounts are not compared
+    rtAmounts := OrderBook{ Bid: restOb.Bid, Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 9000000000, 100000000, 3 },
+            OrderBookEntry{ 2, 1000000000, 110000000, 1 } } }
+    if dev := orderBookDeviation(&rtAmounts, &restOb, obCheckLevels); dev!=0 {
+        t.Errorf("Deviation mismatch: %v", dev)
+    }
+    
+    var resubscribed []string
+    resubCh := make(chan string, 1)
+    notifier := &fakeNotifier{}
+    df := &DataFetcher{ currency: "UST", usdFiat: true,
+        getOrderBook: func(currency string, depth uint, ob *OrderBook) {
+            ob.copyFrom(&restOb)
+        },
+        resubscribeOrderBook: func(currency string) { resubCh <- currency } }
+    df.SetOrderBookCheck(0.1, 0, notifier)
+    df.orderBook.Store(&rtOb)
+    df.lastTrade.Store(&Trade{})
+    now := time.Now().Unix()
+    atomic.StoreInt64(&df.rtOrderBookLastUpdate, now)
+    atomic.StoreInt64(&df.rtTradeLastUpdate, now)
+    // single deviation is not enough
+    if df.checkOrderBookDeviation() || len(notifier.msgs)!=0 {
+        t.Errorf("Deviation detected by single check: %v", notifier.msgs)
+    }
+    // check in background by update
+    df.update()
+    select {
+        case curr := <-resubCh:
+            resubscribed = append(resubscribed, curr)
+        case <-time.After(5*time.Second):
+    }
+    if len(resubscribed)!=1 || resubscribed[0]!="UST" || len(notifier.msgs)!=1 {
+        t.Errorf("Deviation not detected: %v %v", resubscribed, notifier.msgs)
+    }
+    // not checked again before interval
+    df.update()
+    if len(notifier.msgs)!=1 {
+        t.Errorf("Check mismatch: %v", notifier.msgs)
+    }
+    // deviation within tolerance
+    waitFor(t, "end of check", func() bool {
+        return atomic.LoadUint32(&df.obChecking)==0
+    })
+    df.obCheckMaxDev = 0.2
+    if df.checkOrderBookDeviation() || df.checkOrderBookDeviation() {
+        t.Errorf("Deviation detected within tolerance")
+    }
+}
@@ -0,0 +1,143 @@
+/*
+ * doctor.go - self-test (doctor) command
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "time"
+)
+
+const doctorMaxClockSkew = 5*time.Second
+const doctorWebsocketTimeout = 30*time.Second
+
+type doctorCheck struct {
+    name string
+    check func() error
+}
+
+// call check and convert panic to error
+func callDoctorCheck(check func() error) (err error) {
+    defer func() {
+        if x := recover(); x!=nil {
+            err = errors.New(fmt.Sprint(x))
+        }
+    }()
+    return check()
+}
+
+// run checks, print results and return true if all passed
+func runDoctorChecks(checks []doctorCheck, out io.Writer) bool {
+    good := true
+    for _, c := range checks {
+        if err := callDoctorCheck(c.check); err!=nil {
+            fmt.Fprintf(out, "FAIL %s: %v\n", c.name, err)
+            good = false
+        } else {
+            fmt.Fprintf(out, "PASS %s\n", c.name)
+        }
+    }
+    return good
+}
+
+func checkPublicApi(getMarkets func() []Market) error {
+    if len(getMarkets()) == 0 {
+        return errors.New("No markets")
+    }
+    return nil
+}
+
+func checkPrivateApi(getBalances func() []Balance) error {
+    getBalances()
+    return nil
+}
+
+// subscribe orderbook and wait for first orderbook snapshot
+func checkWebsocket(subscribe func(OrderBookHandler), timeout time.Duration) error {
+    obCh := make(chan struct{}, 1)
+    subscribe(func(ob *OrderBook) {
+        select {
+            case obCh <- struct{}{}:
+            default:
+        }
+    })
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    select {
+        case <-obCh:
+            return nil
+        case <-timer.C:
+            return errors.New("No orderbook snapshot")
+    }
+}
+
+func checkClockSkew(serverTime func() time.Time, now func() time.Time,
+                    maxSkew time.Duration) error {
+    before := now()
+    st := serverTime()
+    after := now()
+    // compare to middle of request time
+    local := before.Add(after.Sub(before)/2)
+    skew := local.Sub(st)
+    if skew < 0 { skew = -skew }
+    if skew > maxSkew {
+        return fmt.Errorf("Clock skew %v is too big (nonce can be rejected)", skew)
+    }
+    return nil
+}
+
+func checkFundingMarket(currency string,
+                        getOrderBook func(string, *OrderBook)) error {
+    var ob OrderBook
+    getOrderBook(currency, &ob)
+    if len(ob.Ask) == 0 && len(ob.Bid) == 0 {
+        return fmt.Errorf("No funding market for %s", currency)
+    }
+    return nil
+}
+
+func RunDoctor(config *Config, apiKey, secretKey []byte) bool {
+    bp := NewBitfinexPublic()
+    bpriv := NewBitfinexPrivate(apiKey, secretKey)
+    checks := []doctorCheck{
+        { "config", config.Validate },
+        { "public api", func() error { return checkPublicApi(bp.GetMarkets) } },
+        { "private api", func() error {
+            return checkPrivateApi(bpriv.GetMarginBalances) } },
+        { "websocket", func() error {
+            bprt := NewBitfinexRTPublic()
+            bprt.SetCompression(config.WSCompression)
+            bprt.Start()
+            defer bprt.Stop()
+            return checkWebsocket(func(h OrderBookHandler) {
+                bprt.SubscribeOrderBook(config.Currency, h)
+            }, doctorWebsocketTimeout) } },
+        { "clock skew", func() error {
+            return checkClockSkew(bp.GetServerTime, time.Now, doctorMaxClockSkew) } },
+        { "funding market", func() error {
+            return checkFundingMarket(config.Currency, bp.GetOrderBook) } },
+    }
+    return runDoctorChecks(checks, os.Stdout)
+}
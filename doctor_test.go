@@ -0,0 +1,176 @@
+/*
+ * doctor_test.go - self-test (doctor) command tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "bytes"
+    "errors"
+    "io/ioutil"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestRunDoctorChecks(t *testing.T) {
+    var out bytes.Buffer
+    checks := []doctorCheck{
+        { "good", func() error { return nil } },
+        { "bad", func() error { return errors.New("some error") } },
+        { "private api", func() error {
+            return checkPrivateApi(func() []Balance {
+                panic("Can't get margin balances: 10100 apikey: invalid")
+            }) } },
+    }
+    if runDoctorChecks(checks, &out) {
+        t.Errorf("Checks passed")
+    }
+    expOut := "PASS good\nFAIL bad: some error\n" +
+        "FAIL private api: Can't get margin balances: 10100 apikey: invalid\n"
+    if out.String() != expOut {
+        t.Errorf("Output mismatch: %q!=%q", expOut, out.String())
+    }
+    
+    out.Reset()
+    if !runDoctorChecks(checks[:1], &out) {
+        t.Errorf("Checks failed")
+    }
+}
+
+func TestCheckClockSkew(t *testing.T) {
+    now := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    fakeNow := func() time.Time { return now }
+    serverTime := func() time.Time { return now.Add(-2*time.Second) }
+    if err := checkClockSkew(serverTime, fakeNow, 5*time.Second); err!=nil {
+        t.Errorf("Unexpected error: %v", err)
+    }
+    serverTime = func() time.Time { return now.Add(7*time.Second) }
+    if err := checkClockSkew(serverTime, fakeNow, 5*time.Second); err==nil {
+        t.Errorf("No error for too big clock skew")
+    }
+}
+
+func TestCheckWebsocket(t *testing.T) {
+    err := checkWebsocket(func(h OrderBookHandler) {
+        go h(&OrderBook{})
+    }, time.Second)
+    if err!=nil {
+        t.Errorf("Unexpected error: %v", err)
+    }
+    err = checkWebsocket(func(h OrderBookHandler) {}, 10*time.Millisecond)
+    if err==nil {
+        t.Errorf("No error without orderbook snapshot")
+    }
+}
+
+func TestCheckFundingMarket(t *testing.T) {
+    err := checkFundingMarket("UST", func(currency string, ob *OrderBook) {
+        ob.Ask = []OrderBookEntry{ OrderBookEntry{ 2, 16000000000, 4111000000, 1 } }
+    })
+    if err!=nil {
+        t.Errorf("Unexpected error: %v", err)
+    }
+    err = checkFundingMarket("XXX", func(currency string, ob *OrderBook) {})
+    if err==nil {
+        t.Errorf("No error for empty funding market")
+    }
+}
+
+func TestConfigValidate(t *testing.T) {
+    config := *getTestEngine0().config
+    if err := config.Validate(); err!=nil {
+        t.Errorf("Unexpected error: %v", err)
+    }
+    wrongConfig := config
+    wrongConfig.Currency = ""
+    if err := wrongConfig.Validate(); err==nil {
+        t.Errorf("No error for empty currency")
+    }
+    wrongConfig = config
+    wrongConfig.AutoLoanFetchShift = 21*time.Minute
+    if err := wrongConfig.Validate(); err==nil {
+        t.Errorf("No error for wrong AutoLoanFetchShift")
+    }
+    wrongConfig = config
+    wrongConfig.MinRateDifference = 1.5
+    if err := wrongConfig.Validate(); err==nil {
+        t.Errorf("No error for wrong MinRateDifference")
+    }
+    // percent instead of fraction
+    wrongConfig = config
+    wrongConfig.MaxBookConsumptionFraction = 25
+    if err := wrongConfig.Validate(); err==nil {
+        t.Errorf("No error for wrong MaxBookConsumptionFraction")
+    }
+    wrongConfig = config
+    wrongConfig.ExpiryGrace = -time.Hour
+    if err := wrongConfig.Validate(); err==nil {
+        t.Errorf("No error for negative ExpiryGrace")
+    }
+    wrongConfig = config
+    wrongConfig.ChaseDuration = -time.Minute
+    if err := wrongConfig.Validate(); err==nil {
+        t.Errorf("No error for negative ChaseDuration")
+    }
+    wrongConfig = config
+    wrongConfig.TaskCooldown = -time.Second
+    if err := wrongConfig.Validate(); err==nil {
+        t.Errorf("No error for negative TaskCooldown")
+    }
+}
+
+func TestConfigForecastCandles(t *testing.T) {
+    config := *getTestEngine0().config
+    if period, limit := config.forecastCandles(); period!=30*60 || limit!=48 {
+        t.Errorf("Defaults mismatch: %v %v", period, limit)
+    }
+    // unsupported period is rejected at config load
+    dir := t.TempDir()
+    loadConfig := func(body string) (Config, error) {
+        filename := filepath.Join(dir, "config.json")
+        if err := ioutil.WriteFile(filename, []byte(body), 0600); err!=nil {
+            t.Fatal("Can't write config:", err)
+        }
+        var config Config
+        config.Load(filename)
+        return config, config.Validate()
+    }
+    base := `{"currency":"UST","autoLoanFetchPeriod":"20m",` +
+            `"autoLoanFetchShift":"15m","autoLoanFetchEndShift":"9m20s",`
+    config, err := loadConfig(base + `"forecastCandlePeriod":"1h",` +
+                              `"forecastCandleLimit":100}`)
+    if err!=nil {
+        t.Errorf("Unexpected error: %v", err)
+    }
+    if period, limit := config.forecastCandles(); period!=3600 || limit!=100 {
+        t.Errorf("Forecast candles mismatch: %v %v", period, limit)
+    }
+    if _, err = loadConfig(base + `"forecastCandlePeriod":"2h"}`); err==nil {
+        t.Errorf("No error for unsupported candle period")
+    }
+    if _, err = loadConfig(base + `"forecastCandlePeriod":"90s"}`); err==nil {
+        t.Errorf("No error for unsupported candle period")
+    }
+    if _, err = loadConfig(base + `"forecastCandleLimit":20000}`); err==nil {
+        t.Errorf("No error for too big candle limit")
+    }
+}
@@ -25,10 +25,14 @@ package main
 import (
     "bytes"
     "crypto/rand"
+    "errors"
+    "fmt"
     "io"
     "io/ioutil"
     "os"
     "sort"
+    "strconv"
+    "strings"
     "sync"
     "sync/atomic"
     "time"
@@ -36,9 +40,12 @@ import (
     "github.com/matszpk/godec64"
 )
 
+// source of random numbers (can be replaced by seeded source in tests)
+var randomSource io.Reader = rand.Reader
+
 func getRandom(n int64) int64 {
     var b [8]byte
-    if _, err := io.ReadFull(rand.Reader, b[:]); err == nil {
+    if _, err := io.ReadFull(randomSource, b[:]); err == nil {
         v := int64(b[0]) + (int64(b[1])<<8) + (int64(b[2])<<16) + (int64(b[3])<<24) +
             (int64(b[4])<<32) + (int64(b[5])<<40) + (int64(b[6])<<48) +
             (int64(b[7]&0x7f)<<56)
@@ -62,6 +69,87 @@ var (
     configStrMinOrderAmount = []byte("minOrderAmount")
     configStrMinRateDiffInAskToForceBorrow = []byte("minRateDiffInAskToForceBorrow")
     configStrRealtime = []byte("realtime")
+    configStrAuthBackend = []byte("authBackend")
+    configStrKeyringService = []byte("keyringService")
+    configStrVaultAddr = []byte("vaultAddr")
+    configStrVaultPath = []byte("vaultPath")
+    configStrFileMode = []byte("fileMode")
+    configStrPrivateRateLimit = []byte("privateRateLimit")
+    configStrPrivateRateBurst = []byte("privateRateBurst")
+    configStrMaxBookConsumptionFraction = []byte("maxBookConsumptionFraction")
+    configStrControlAddr = []byte("controlAddr")
+    configStrWSCompression = []byte("wsCompression")
+    configStrTaskCooldown = []byte("taskCooldown")
+    configStrDNSRefresh = []byte("dnsRefresh")
+    configStrStrictCoverage = []byte("strictCoverage")
+    configStrAlertRate = []byte("alertRate")
+    configStrAlertCommand = []byte("alertCommand")
+    configStrVerifyFill = []byte("verifyFill")
+    configStrIncludePendingOrders = []byte("includePendingOrders")
+    configStrSortLoanIdsToClose = []byte("sortLoanIdsToClose")
+    configStrKeepCheaperCredits = []byte("keepCheaperCredits")
+    configStrCurrencyPrecisions = []byte("currencyPrecisions")
+    configStrConfirmCancel = []byte("confirmCancel")
+    configStrActiveHoursStart = []byte("activeHoursStart")
+    configStrActiveHoursEnd = []byte("activeHoursEnd")
+    configStrMaxBorrowAttempts = []byte("maxBorrowAttempts")
+    configStrMinOrderAmountInCurrency = []byte("minOrderAmountInCurrency")
+    configStrAutoRenewBorrow = []byte("autoRenewBorrow")
+    configStrMarketsCacheTTL = []byte("marketsCacheTTL")
+    configStrPoolCurrencies = []byte("poolCurrencies")
+    configStrChaseDuration = []byte("chaseDuration")
+    configStrChaseStep = []byte("chaseStep")
+    configStrExchangeMinAmounts = []byte("exchangeMinAmounts")
+    configStrBumpToExchangeMin = []byte("bumpToExchangeMin")
+    configStrCheckMargin = []byte("checkMargin")
+    configStrExpiryGrace = []byte("expiryGrace")
+    configStrEventSinkURL = []byte("eventSinkURL")
+    configStrBorrowFee = []byte("borrowFee")
+    configStrMinInterestPeriod = []byte("minInterestPeriod")
+    configStrFallbackOrderBookDepth = []byte("fallbackOrderBookDepth")
+    configStrWarmPrefetch = []byte("warmPrefetch")
+    configStrWarmPrefetchTTL = []byte("warmPrefetchTTL")
+    configStrIncrementalBorrow = []byte("incrementalBorrow")
+    configStrIncrementalBorrowStep = []byte("incrementalBorrowStep")
+    configStrCloseFundingInterval = []byte("closeFundingInterval")
+    configStrWSCommandTimeout = []byte("wsCommandTimeout")
+    configStrDoNotCloseLoanIds = []byte("doNotCloseLoanIds")
+    configStrRecheckBeforeClose = []byte("recheckBeforeClose")
+    configStrHiddenOffers = []byte("hiddenOffers")
+    configStrSummaryInterval = []byte("summaryInterval")
+    configStrOrderBookMaxDeviation = []byte("orderBookMaxDeviation")
+    configStrOrderBookCheckInterval = []byte("orderBookCheckInterval")
+    configStrMarketsFetchRetries = []byte("marketsFetchRetries")
+    configStrUseFundingWalletBalance = []byte("useFundingWalletBalance")
+    configStrForecastCandlePeriod = []byte("forecastCandlePeriod")
+    configStrForecastCandleLimit = []byte("forecastCandleLimit")
+    configStrCloseOrphanCredits = []byte("closeOrphanCredits")
+    configStrWSMaxChannels = []byte("wsMaxChannels")
+    configStrCloseMarketPriority = []byte("closeMarketPriority")
+    configStrPreferCloseNonRenewing = []byte("preferCloseNonRenewing")
+    configStrMaxFRRMultiple = []byte("maxFRRMultiple")
+    configStrLogFile = []byte("logFile")
+    configStrLogMaxSizeMB = []byte("logMaxSizeMB")
+    configStrLogMaxBackups = []byte("logMaxBackups")
+    configStrObservePhase = []byte("observePhase")
+    configStrResubscribeBaseline = []byte("resubscribeBaseline")
+    configStrUseMarkPrice = []byte("useMarkPrice")
+    configStrMaxLastObAge = []byte("maxLastObAge")
+    configStrCloseUnusedFundings = []byte("closeUnusedFundings")
+    configStrTaskTimeout = []byte("taskTimeout")
+    configStrExchangeAmountPrecisions = []byte("exchangeAmountPrecisions")
+    configStrParseErrorThreshold = []byte("parseErrorThreshold")
+    configStrParseErrorWindow = []byte("parseErrorWindow")
+    configStrPauseOnParseErrors = []byte("pauseOnParseErrors")
+    configStrPprofAddr = []byte("pprofAddr")
+    configStrWarnUncoveredPositions = []byte("warnUncoveredPositions")
+    configStrMinBorrowRate = []byte("minBorrowRate")
+    configStrNonceDivisor = []byte("nonceDivisor")
+    configStrRollExpiringCredits = []byte("rollExpiringCredits")
+    configStrMaxPriceAge = []byte("maxPriceAge")
+    configStrMaxHandlerCalls = []byte("maxHandlerCalls")
+    configStrHandlerCallWait = []byte("handlerCallWait")
+    configStrMinFillFraction = []byte("minFillFraction")
 )
 
 type Config struct {
@@ -74,14 +162,200 @@ type Config struct {
     AutoLoanFetchShift time.Duration
     AutoLoanFetchEndShift time.Duration
     MinRateDifference float64
+    // minimal order amount in USD (8 decimals). config value is in units
+    // (150 is 150 USD) and can be string with unit ("150 USD").
     MinOrderAmount godec64.UDec64
     MinRateDiffInAskToForceBorrow float64
     Realtime bool
+    // credentials backend: "file" (default), "keyring" or "vault"
+    AuthBackend string
+    KeyringService string
+    VaultAddr string
+    VaultPath string
+    // mode of generated files (default 0600)
+    FileMode os.FileMode
+    // requests per minute for every private endpoint group (0 - default)
+    PrivateRateLimit float64
+    PrivateRateBurst int
+    // maximal fraction of total ask depth consumed by single offer (0 - no limit)
+    MaxBookConsumptionFraction float64
+    // address of control HTTP server (empty - disabled)
+    ControlAddr string
+    // enable websocket compression (permessage-deflate)
+    WSCompression bool
+    // minimal time between end of borrow task and next borrow task in the same
+    // period (0 - only single borrow task in period)
+    TaskCooldown time.Duration
+    // period of resolving again API hosts (0 - default behaviour)
+    DNSRefresh time.Duration
+    // never borrow more than needed to cover positions
+    StrictCoverage bool
+    // daily rate in percent above that alert will be sent (0 - no alert)
+    AlertRate float64
+    // shell command to run for alert (message in BBC_ALERT)
+    AlertCommand string
+    // verify fill of borrow by funding trades before closing old credits
+    VerifyFill bool
+    // include active margin orders in total borrow
+    IncludePendingOrders bool
+    // sort ids of loans to close by id
+    SortLoanIdsToClose bool
+    // never close credits with rate lower than rate of new borrow
+    KeepCheaperCredits bool
+    // number of decimals of amounts for currencies with non-standard precision
+    CurrencyPrecisions map[string]uint
+    ConfirmCancel bool
+    // window of day (UTC) where program borrows, both zero - always active
+    ActiveHoursStart time.Duration
+    ActiveHoursEnd time.Duration
+    MaxBorrowAttempts uint
+    // minimal order amount in currency (8 decimals), used instead of MinOrderAmount
+    MinOrderAmountInCurrency godec64.UDec64
+    AutoRenewBorrow bool
+    MarketsCacheTTL time.Duration
+    // currencies whose positions and balances are pooled with borrowed currency
+    PoolCurrencies []string
+    // time of repricing offer while orderbook moves down, 0 - no chasing
+    ChaseDuration time.Duration
+    // distance of offer rate below lowest ask (fraction)
+    ChaseStep float64
+    // minimal amounts of funding offers in exchange (8 decimals)
+    ExchangeMinAmounts map[string]godec64.UDec64
+    // if true, amount below exchange minimum is raised to minimum, otherwise skipped
+    BumpToExchangeMin bool
+    // if true, skip borrow if net margin doesn't exceed required margin
+    CheckMargin bool
+    // credits expiring within this time after next auto loan time are treated as
+    // expiring (they are not closed)
+    ExpiryGrace time.Duration
+    // URL of event sink (nats://host:port), empty - no events
+    EventSinkURL string
+    // fee as fraction of interest used in cost model (0.15 - 15%), it is
+    // charged from interest of kept credits and new borrow
+    BorrowFee float64
+    // minimal period of interest charged for funding closed earlier
+    MinInterestPeriod time.Duration
+    // depth of orderbook fetched by HTTP if websocket fails (1, 25 or 100),
+    // 0 - depth used by borrow task
+    FallbackOrderBookDepth uint
+    // if true, fetch credits, positions and balances at start of
+    // auto loan period and reuse them in first borrow task
+    WarmPrefetch bool
+    // time how long prefetched data are fresh
+    WarmPrefetchTTL time.Duration
+    // if true, borrow toward target of auto loan period in steps on
+    // successive orderbook ticks
+    IncrementalBorrow bool
+    // maximal amount borrowed in single tick in currency (8 decimals)
+    IncrementalBorrowStep godec64.UDec64
+    // minimal time between closing fundings (in addition to pause after batch)
+    CloseFundingInterval time.Duration
+    // time of waiting for confirmation of websocket command (0 - default)
+    WSCommandTimeout time.Duration
+    // ids of fundings (credits or loans) that never will be closed
+    DoNotCloseLoanIds []uint64
+    // if true, fetch again positions and fundings before closing fundings
+    // and skip closes that would leave positions under-funded
+    RecheckBeforeClose bool
+    // if true, borrow offers are hidden (not visible in public orderbook)
+    HiddenOffers bool
+    // interval of logging funding summary outside auto loan periods (0 - disabled)
+    SummaryInterval time.Duration
+    // maximal relative deviation of rates of top levels between realtime and
+    // REST orderbooks (0.1 - 10%, 0 - no check)
+    OrderBookMaxDeviation float64
+    // interval of orderbook deviation check (0 - default)
+    OrderBookCheckInterval time.Duration
+    // retries of markets fetch at startup (0 - default)
+    MarketsFetchRetries uint
+    // if true, idle balance of funding wallet reduces borrow
+    UseFundingWalletBalance bool
+    // period of candles used by rate forecast (0 - default)
+    ForecastCandlePeriod time.Duration
+    // number of candles used by rate forecast (0 - default)
+    ForecastCandleLimit uint
+    // if true, close credits whose market has no open position (regardless
+    // of rates) without replacing them
+    CloseOrphanCredits bool
+    // maximal number of channels per websocket connection (0 - default: 25)
+    WSMaxChannels uint
+    // markets whose credits are closed first (in order of list)
+    CloseMarketPriority []string
+    // if true, auto-renewing credits are closed only after non-renewing credits
+    PreferCloseNonRenewing bool
+    // maximal borrow rate as multiple of FRR (0 - no limit)
+    MaxFRRMultiple float64
+    // log file (empty - standard error output)
+    LogFile string
+    // maximal size of log file in megabytes before rotation (0 - default: 100)
+    LogMaxSizeMB uint
+    // maximal number of rotated log files (0 - default: 5)
+    LogMaxBackups uint
+    // time at start of auto loan period when orderbook is only observed
+    // (no borrow triggered by orderbook)
+    ObservePhase time.Duration
+    // if true, first realtime orderbook after resubscription only sets
+    // last orderbook (no borrow triggered by it)
+    ResubscribeBaseline bool
+    // if true, values of positions are calculated with current market prices
+    // instead of base prices
+    UseMarkPrice bool
+    // maximal age of last orderbook compared with current orderbook
+    // (0 - no limit). older orderbook does not trigger borrow.
+    MaxLastObAge time.Duration
+    // if true (default), unused fundings are closed at start of auto loan period
+    CloseUnusedFundings bool
+    // maximal duration of borrow task (0 - no limit). task that overruns it
+    // is aborted and its offer is canceled.
+    TaskTimeout time.Duration
+    // number of decimals of offer amounts allowed by exchange for currencies.
+    // amount to borrow is rounded down to it.
+    ExchangeAmountPrecisions map[string]uint
+    // number of parse errors in ParseErrorWindow that raises alert (0 - no alert)
+    ParseErrorThreshold uint
+    // window of counting parse errors (0 - default: 1 hour)
+    ParseErrorWindow time.Duration
+    // if true, engine is paused after alert about parse errors
+    PauseOnParseErrors bool
+    // address of pprof HTTP server (empty - disabled)
+    PprofAddr string
+    // if true, positions ignored in total borrow (not funded in currency)
+    // are logged
+    WarnUncoveredPositions bool
+    // minimal rate of borrow (floor of funding rate in market, 0 - no floor).
+    // offers are never submitted below it.
+    MinBorrowRate godec64.UDec64
+    // divisor of Unix time in nanoseconds used as nonce of private API
+    // (0 - default: 100000, resolution 100 microseconds)
+    NonceDivisor uint64
+    // if true (default), credits that expire in this auto loan period are
+    // borrowed again. if false, they lapse to auto-loan of exchange.
+    RollExpiringCredits bool
+    // maximal age of USD price used by MinOrderAmount check (0 - no limit).
+    // older price is refreshed by HTTP and if it fails, borrow task is skipped.
+    MaxPriceAge time.Duration
+    // maximal number of concurrent calls of realtime message handlers
+    // (0 - no limit)
+    MaxHandlerCalls uint
+    // maximal waiting for free slot of handler call if MaxHandlerCalls is
+    // reached. after it call is dropped (0 - dropped immediately). number of
+    // waiting calls is limited by MaxHandlerCalls.
+    HandlerCallWait time.Duration
+    // minimal filled fraction of borrow to close fundings (0 - no minimum).
+    // if less is filled, no funding is closed.
+    MinFillFraction float64
 }
 
+// default candles used by rate forecast
+const (
+    defaultForecastCandlePeriod = 30*time.Minute
+    defaultForecastCandleLimit = 48
+    maxForecastCandleLimit = 10000  // limit of candles endpoint
+)
+
 func configFromJson(v *fastjson.Value, config *Config) {
-    *config = Config{}
-    mask := 0
+    *config = Config{ CloseUnusedFundings: true, RollExpiringCredits: true }
+    var mask, mask2 uint64
     obj := FastjsonGetObjectRequired(v)
     obj.Visit(func(key []byte, vx *fastjson.Value) {
         if ((mask & 1) == 0 && bytes.Equal(key, configStrCurrency)) {
@@ -105,7 +379,7 @@ func configFromJson(v *fastjson.Value, config *Config) {
             mask |= 16
         }
         if ((mask & 32) == 0 && bytes.Equal(key, configStrMinOrderAmount)) {
-            config.MinOrderAmount = FastjsonGetUDec64(vx, 8)
+            config.MinOrderAmount = FastjsonGetUDec64Unit(vx, 8, "USD")
             mask |= 32
         }
         if ((mask & 64) == 0 && bytes.Equal(key, configStrAuthFile)) {
@@ -125,6 +399,369 @@ func configFromJson(v *fastjson.Value, config *Config) {
             config.Realtime = FastjsonGetBool(vx)
             mask |= 512
         }
+        if ((mask & 1024) == 0 && bytes.Equal(key, configStrAuthBackend)) {
+            config.AuthBackend = FastjsonGetString(vx)
+            mask |= 1024
+        }
+        if ((mask & 2048) == 0 && bytes.Equal(key, configStrKeyringService)) {
+            config.KeyringService = FastjsonGetString(vx)
+            mask |= 2048
+        }
+        if ((mask & 4096) == 0 && bytes.Equal(key, configStrVaultAddr)) {
+            config.VaultAddr = FastjsonGetString(vx)
+            mask |= 4096
+        }
+        if ((mask & 8192) == 0 && bytes.Equal(key, configStrVaultPath)) {
+            config.VaultPath = FastjsonGetString(vx)
+            mask |= 8192
+        }
+        if ((mask & 16384) == 0 && bytes.Equal(key, configStrFileMode)) {
+            config.FileMode = FastjsonGetFileMode(vx)
+            mask |= 16384
+        }
+        if ((mask & 32768) == 0 && bytes.Equal(key, configStrPrivateRateLimit)) {
+            config.PrivateRateLimit = FastjsonGetFloat64(vx)
+            mask |= 32768
+        }
+        if ((mask & 65536) == 0 && bytes.Equal(key, configStrPrivateRateBurst)) {
+            config.PrivateRateBurst = FastjsonGetInt(vx)
+            mask |= 65536
+        }
+        if ((mask & 131072) == 0 &&
+                bytes.Equal(key, configStrMaxBookConsumptionFraction)) {
+            config.MaxBookConsumptionFraction = FastjsonGetFloat64(vx)
+            mask |= 131072
+        }
+        if ((mask & 262144) == 0 && bytes.Equal(key, configStrControlAddr)) {
+            config.ControlAddr = FastjsonGetString(vx)
+            mask |= 262144
+        }
+        if ((mask & 524288) == 0 && bytes.Equal(key, configStrWSCompression)) {
+            config.WSCompression = FastjsonGetBool(vx)
+            mask |= 524288
+        }
+        if ((mask & 1048576) == 0 && bytes.Equal(key, configStrTaskCooldown)) {
+            config.TaskCooldown = FastjsonGetDuration(vx)
+            mask |= 1048576
+        }
+        if ((mask & 2097152) == 0 && bytes.Equal(key, configStrDNSRefresh)) {
+            config.DNSRefresh = FastjsonGetDuration(vx)
+            mask |= 2097152
+        }
+        if ((mask & 4194304) == 0 && bytes.Equal(key, configStrStrictCoverage)) {
+            config.StrictCoverage = FastjsonGetBool(vx)
+            mask |= 4194304
+        }
+        if ((mask & 8388608) == 0 && bytes.Equal(key, configStrAlertRate)) {
+            config.AlertRate = FastjsonGetFloat64(vx)
+            mask |= 8388608
+        }
+        if ((mask & 16777216) == 0 && bytes.Equal(key, configStrAlertCommand)) {
+            config.AlertCommand = FastjsonGetString(vx)
+            mask |= 16777216
+        }
+        if ((mask & 33554432) == 0 && bytes.Equal(key, configStrVerifyFill)) {
+            config.VerifyFill = FastjsonGetBool(vx)
+            mask |= 33554432
+        }
+        if ((mask & 67108864) == 0 &&
+                bytes.Equal(key, configStrIncludePendingOrders)) {
+            config.IncludePendingOrders = FastjsonGetBool(vx)
+            mask |= 67108864
+        }
+        if ((mask & 134217728) == 0 && bytes.Equal(key, configStrSortLoanIdsToClose)) {
+            config.SortLoanIdsToClose = FastjsonGetBool(vx)
+            mask |= 134217728
+        }
+        if ((mask & 268435456) == 0 && bytes.Equal(key, configStrKeepCheaperCredits)) {
+            config.KeepCheaperCredits = FastjsonGetBool(vx)
+            mask |= 268435456
+        }
+        if ((mask & 536870912) == 0 && bytes.Equal(key, configStrCurrencyPrecisions)) {
+            config.CurrencyPrecisions = make(map[string]uint)
+            FastjsonGetObjectRequired(vx).Visit(func(curr []byte, pv *fastjson.Value) {
+                config.CurrencyPrecisions[string(curr)] = FastjsonGetUInt(pv)
+            })
+            mask |= 536870912
+        }
+        if ((mask & 1073741824) == 0 && bytes.Equal(key, configStrConfirmCancel)) {
+            config.ConfirmCancel = FastjsonGetBool(vx)
+            mask |= 1073741824
+        }
+        if ((mask & 2147483648) == 0 && bytes.Equal(key, configStrActiveHoursStart)) {
+            config.ActiveHoursStart = FastjsonGetDuration(vx)
+            mask |= 2147483648
+        }
+        if ((mask & 4294967296) == 0 && bytes.Equal(key, configStrActiveHoursEnd)) {
+            config.ActiveHoursEnd = FastjsonGetDuration(vx)
+            mask |= 4294967296
+        }
+        if ((mask & 8589934592) == 0 && bytes.Equal(key, configStrMaxBorrowAttempts)) {
+            config.MaxBorrowAttempts = FastjsonGetUInt(vx)
+            mask |= 8589934592
+        }
+        if ((mask & 17179869184) == 0 &&
+                bytes.Equal(key, configStrMinOrderAmountInCurrency)) {
+            config.MinOrderAmountInCurrency = FastjsonGetUDec64(vx, 8)
+            mask |= 17179869184
+        }
+        if ((mask & 34359738368) == 0 && bytes.Equal(key, configStrAutoRenewBorrow)) {
+            config.AutoRenewBorrow = FastjsonGetBool(vx)
+            mask |= 34359738368
+        }
+        if ((mask & 68719476736) == 0 && bytes.Equal(key, configStrMarketsCacheTTL)) {
+            config.MarketsCacheTTL = FastjsonGetDuration(vx)
+            mask |= 68719476736
+        }
+        if ((mask & 137438953472) == 0 && bytes.Equal(key, configStrPoolCurrencies)) {
+            arr := FastjsonGetArray(vx)
+            config.PoolCurrencies = make([]string, len(arr))
+            for i, v := range arr {
+                config.PoolCurrencies[i] = FastjsonGetString(v)
+            }
+            mask |= 137438953472
+        }
+        if ((mask & 274877906944) == 0 && bytes.Equal(key, configStrChaseDuration)) {
+            config.ChaseDuration = FastjsonGetDuration(vx)
+            mask |= 274877906944
+        }
+        if ((mask & 549755813888) == 0 && bytes.Equal(key, configStrChaseStep)) {
+            config.ChaseStep = FastjsonGetFloat64(vx)
+            mask |= 549755813888
+        }
+        if ((mask & 1099511627776) == 0 && bytes.Equal(key, configStrExchangeMinAmounts)) {
+            config.ExchangeMinAmounts = make(map[string]godec64.UDec64)
+            FastjsonGetObjectRequired(vx).Visit(func(curr []byte, pv *fastjson.Value) {
+                config.ExchangeMinAmounts[string(curr)] = FastjsonGetUDec64(pv, 8)
+            })
+            mask |= 1099511627776
+        }
+        if ((mask & 2199023255552) == 0 && bytes.Equal(key, configStrBumpToExchangeMin)) {
+            config.BumpToExchangeMin = FastjsonGetBool(vx)
+            mask |= 2199023255552
+        }
+        if ((mask & 4398046511104) == 0 && bytes.Equal(key, configStrCheckMargin)) {
+            config.CheckMargin = FastjsonGetBool(vx)
+            mask |= 4398046511104
+        }
+        if ((mask & 8796093022208) == 0 && bytes.Equal(key, configStrExpiryGrace)) {
+            config.ExpiryGrace = FastjsonGetDuration(vx)
+            mask |= 8796093022208
+        }
+        if ((mask & 17592186044416) == 0 && bytes.Equal(key, configStrEventSinkURL)) {
+            config.EventSinkURL = FastjsonGetString(vx)
+            mask |= 17592186044416
+        }
+        if ((mask & 35184372088832) == 0 && bytes.Equal(key, configStrBorrowFee)) {
+            config.BorrowFee = FastjsonGetFloat64(vx)
+            mask |= 35184372088832
+        }
+        if ((mask & 70368744177664) == 0 &&
+                bytes.Equal(key, configStrMinInterestPeriod)) {
+            config.MinInterestPeriod = FastjsonGetDuration(vx)
+            mask |= 70368744177664
+        }
+        if ((mask & 140737488355328) == 0 &&
+                bytes.Equal(key, configStrFallbackOrderBookDepth)) {
+            config.FallbackOrderBookDepth = FastjsonGetUInt(vx)
+            mask |= 140737488355328
+        }
+        if ((mask & 281474976710656) == 0 && bytes.Equal(key, configStrWarmPrefetch)) {
+            config.WarmPrefetch = FastjsonGetBool(vx)
+            mask |= 281474976710656
+        }
+        if ((mask & 562949953421312) == 0 &&
+                bytes.Equal(key, configStrWarmPrefetchTTL)) {
+            config.WarmPrefetchTTL = FastjsonGetDuration(vx)
+            mask |= 562949953421312
+        }
+        if ((mask & 1125899906842624) == 0 &&
+                bytes.Equal(key, configStrIncrementalBorrow)) {
+            config.IncrementalBorrow = FastjsonGetBool(vx)
+            mask |= 1125899906842624
+        }
+        if ((mask & 2251799813685248) == 0 &&
+                bytes.Equal(key, configStrIncrementalBorrowStep)) {
+            config.IncrementalBorrowStep = FastjsonGetUDec64(vx, 8)
+            mask |= 2251799813685248
+        }
+        if ((mask & 4503599627370496) == 0 &&
+                bytes.Equal(key, configStrCloseFundingInterval)) {
+            config.CloseFundingInterval = FastjsonGetDuration(vx)
+            mask |= 4503599627370496
+        }
+        if ((mask & 9007199254740992) == 0 &&
+                bytes.Equal(key, configStrWSCommandTimeout)) {
+            config.WSCommandTimeout = FastjsonGetDuration(vx)
+            mask |= 9007199254740992
+        }
+        if ((mask & 18014398509481984) == 0 &&
+                bytes.Equal(key, configStrDoNotCloseLoanIds)) {
+            arr := FastjsonGetArray(vx)
+            config.DoNotCloseLoanIds = make([]uint64, len(arr))
+            for i, v := range arr {
+                config.DoNotCloseLoanIds[i] = FastjsonGetUInt64(v)
+            }
+            mask |= 18014398509481984
+        }
+        if ((mask & 36028797018963968) == 0 &&
+                bytes.Equal(key, configStrRecheckBeforeClose)) {
+            config.RecheckBeforeClose = FastjsonGetBool(vx)
+            mask |= 36028797018963968
+        }
+        if ((mask & 72057594037927936) == 0 &&
+                bytes.Equal(key, configStrHiddenOffers)) {
+            config.HiddenOffers = FastjsonGetBool(vx)
+            mask |= 72057594037927936
+        }
+        if ((mask & 144115188075855872) == 0 &&
+                bytes.Equal(key, configStrSummaryInterval)) {
+            config.SummaryInterval = FastjsonGetDuration(vx)
+            mask |= 144115188075855872
+        }
+        if ((mask & 288230376151711744) == 0 &&
+                bytes.Equal(key, configStrOrderBookMaxDeviation)) {
+            config.OrderBookMaxDeviation = FastjsonGetFloat64(vx)
+            mask |= 288230376151711744
+        }
+        if ((mask & 576460752303423488) == 0 &&
+                bytes.Equal(key, configStrOrderBookCheckInterval)) {
+            config.OrderBookCheckInterval = FastjsonGetDuration(vx)
+            mask |= 576460752303423488
+        }
+        if ((mask & 1152921504606846976) == 0 &&
+                bytes.Equal(key, configStrMarketsFetchRetries)) {
+            config.MarketsFetchRetries = FastjsonGetUInt(vx)
+            mask |= 1152921504606846976
+        }
+        if ((mask & 2305843009213693952) == 0 &&
+                bytes.Equal(key, configStrUseFundingWalletBalance)) {
+            config.UseFundingWalletBalance = FastjsonGetBool(vx)
+            mask |= 2305843009213693952
+        }
+        if ((mask2 & 1) == 0 && bytes.Equal(key, configStrForecastCandlePeriod)) {
+            config.ForecastCandlePeriod = FastjsonGetDuration(vx)
+            mask2 |= 1
+        }
+        if ((mask2 & 2) == 0 && bytes.Equal(key, configStrForecastCandleLimit)) {
+            config.ForecastCandleLimit = FastjsonGetUInt(vx)
+            mask2 |= 2
+        }
+        if ((mask2 & 4) == 0 && bytes.Equal(key, configStrCloseOrphanCredits)) {
+            config.CloseOrphanCredits = FastjsonGetBool(vx)
+            mask2 |= 4
+        }
+        if ((mask2 & 8) == 0 && bytes.Equal(key, configStrWSMaxChannels)) {
+            config.WSMaxChannels = FastjsonGetUInt(vx)
+            mask2 |= 8
+        }
+        if ((mask2 & 16) == 0 && bytes.Equal(key, configStrCloseMarketPriority)) {
+            arr := FastjsonGetArray(vx)
+            config.CloseMarketPriority = make([]string, len(arr))
+            for i, v := range arr {
+                config.CloseMarketPriority[i] = FastjsonGetString(v)
+            }
+            mask2 |= 16
+        }
+        if ((mask2 & 32) == 0 && bytes.Equal(key, configStrPreferCloseNonRenewing)) {
+            config.PreferCloseNonRenewing = FastjsonGetBool(vx)
+            mask2 |= 32
+        }
+        if ((mask2 & 64) == 0 && bytes.Equal(key, configStrMaxFRRMultiple)) {
+            config.MaxFRRMultiple = FastjsonGetFloat64(vx)
+            mask2 |= 64
+        }
+        if ((mask2 & 128) == 0 && bytes.Equal(key, configStrLogFile)) {
+            config.LogFile = FastjsonGetString(vx)
+            mask2 |= 128
+        }
+        if ((mask2 & 256) == 0 && bytes.Equal(key, configStrLogMaxSizeMB)) {
+            config.LogMaxSizeMB = FastjsonGetUInt(vx)
+            mask2 |= 256
+        }
+        if ((mask2 & 512) == 0 && bytes.Equal(key, configStrLogMaxBackups)) {
+            config.LogMaxBackups = FastjsonGetUInt(vx)
+            mask2 |= 512
+        }
+        if ((mask2 & 1024) == 0 && bytes.Equal(key, configStrObservePhase)) {
+            config.ObservePhase = FastjsonGetDuration(vx)
+            mask2 |= 1024
+        }
+        if ((mask2 & 2048) == 0 && bytes.Equal(key, configStrResubscribeBaseline)) {
+            config.ResubscribeBaseline = FastjsonGetBool(vx)
+            mask2 |= 2048
+        }
+        if ((mask2 & 4096) == 0 && bytes.Equal(key, configStrUseMarkPrice)) {
+            config.UseMarkPrice = FastjsonGetBool(vx)
+            mask2 |= 4096
+        }
+        if ((mask2 & 8192) == 0 && bytes.Equal(key, configStrMaxLastObAge)) {
+            config.MaxLastObAge = FastjsonGetDuration(vx)
+            mask2 |= 8192
+        }
+        if ((mask2 & 16384) == 0 && bytes.Equal(key, configStrCloseUnusedFundings)) {
+            config.CloseUnusedFundings = FastjsonGetBool(vx)
+            mask2 |= 16384
+        }
+        if ((mask2 & 32768) == 0 && bytes.Equal(key, configStrTaskTimeout)) {
+            config.TaskTimeout = FastjsonGetDuration(vx)
+            mask2 |= 32768
+        }
+        if ((mask2 & 65536) == 0 && bytes.Equal(key, configStrExchangeAmountPrecisions)) {
+            config.ExchangeAmountPrecisions = make(map[string]uint)
+            FastjsonGetObjectRequired(vx).Visit(func(curr []byte, pv *fastjson.Value) {
+                config.ExchangeAmountPrecisions[string(curr)] = FastjsonGetUInt(pv)
+            })
+            mask2 |= 65536
+        }
+        if ((mask2 & 131072) == 0 && bytes.Equal(key, configStrParseErrorThreshold)) {
+            config.ParseErrorThreshold = FastjsonGetUInt(vx)
+            mask2 |= 131072
+        }
+        if ((mask2 & 262144) == 0 && bytes.Equal(key, configStrParseErrorWindow)) {
+            config.ParseErrorWindow = FastjsonGetDuration(vx)
+            mask2 |= 262144
+        }
+        if ((mask2 & 524288) == 0 && bytes.Equal(key, configStrPauseOnParseErrors)) {
+            config.PauseOnParseErrors = FastjsonGetBool(vx)
+            mask2 |= 524288
+        }
+        if ((mask2 & 1048576) == 0 && bytes.Equal(key, configStrPprofAddr)) {
+            config.PprofAddr = FastjsonGetString(vx)
+            mask2 |= 1048576
+        }
+        if ((mask2 & 2097152) == 0 && bytes.Equal(key, configStrWarnUncoveredPositions)) {
+            config.WarnUncoveredPositions = FastjsonGetBool(vx)
+            mask2 |= 2097152
+        }
+        if ((mask2 & 4194304) == 0 && bytes.Equal(key, configStrMinBorrowRate)) {
+            config.MinBorrowRate = FastjsonGetUDec64(vx, 12)
+            mask2 |= 4194304
+        }
+        if ((mask2 & 8388608) == 0 && bytes.Equal(key, configStrNonceDivisor)) {
+            config.NonceDivisor = FastjsonGetUInt64(vx)
+            mask2 |= 8388608
+        }
+        if ((mask2 & 16777216) == 0 && bytes.Equal(key, configStrRollExpiringCredits)) {
+            config.RollExpiringCredits = FastjsonGetBool(vx)
+            mask2 |= 16777216
+        }
+        if ((mask2 & 33554432) == 0 && bytes.Equal(key, configStrMaxPriceAge)) {
+            config.MaxPriceAge = FastjsonGetDuration(vx)
+            mask2 |= 33554432
+        }
+        if ((mask2 & 67108864) == 0 && bytes.Equal(key, configStrMaxHandlerCalls)) {
+            config.MaxHandlerCalls = FastjsonGetUInt(vx)
+            mask2 |= 67108864
+        }
+        if ((mask2 & 134217728) == 0 && bytes.Equal(key, configStrHandlerCallWait)) {
+            config.HandlerCallWait = FastjsonGetDuration(vx)
+            mask2 |= 134217728
+        }
+        if ((mask2 & 268435456) == 0 && bytes.Equal(key, configStrMinFillFraction)) {
+            config.MinFillFraction = FastjsonGetFloat64(vx)
+            mask2 |= 268435456
+        }
     })
 }
 
@@ -142,9 +779,172 @@ func (config *Config) Load(filename string) {
     defer JsonParserPool.Put(jp)
     if v, err := jp.ParseBytes(b); err==nil {
         configFromJson(v, config)
+        config.AuthFile = expandPath(config.AuthFile)
+        config.PasswordFile = expandPath(config.PasswordFile)
     } else {
-        ErrorPanic("Can't parse config file", err)
+        ParseErrorPanic("Can't parse config file", err)
+    }
+}
+
+// get candle period (in seconds) and limit used by rate forecast
+func (config *Config) forecastCandles() (uint32, uint) {
+    period, limit := config.ForecastCandlePeriod, config.ForecastCandleLimit
+    if period == 0 { period = defaultForecastCandlePeriod }
+    if limit == 0 { limit = defaultForecastCandleLimit }
+    return uint32(period / time.Second), limit
+}
+
+// check whether config is valid
+func (config *Config) Validate() error {
+    if config.Currency == "" {
+        return errors.New("No currency")
+    }
+    if config.AutoLoanFetchPeriod <= 0 {
+        return errors.New("AutoLoanFetchPeriod must be positive")
+    }
+    if config.AutoLoanFetchShift < 0 ||
+            config.AutoLoanFetchShift >= config.AutoLoanFetchPeriod {
+        return errors.New("AutoLoanFetchShift must be in range of AutoLoanFetchPeriod")
+    }
+    if config.AutoLoanFetchEndShift < 0 ||
+            config.AutoLoanFetchEndShift >= config.AutoLoanFetchPeriod {
+        return errors.New(
+                "AutoLoanFetchEndShift must be in range of AutoLoanFetchPeriod")
+    }
+    if config.MinRateDifference < 0 || config.MinRateDifference >= 1 {
+        return errors.New("MinRateDifference must be in range [0,1)")
+    }
+    if config.MinRateDiffInAskToForceBorrow < 0 ||
+            config.MinRateDiffInAskToForceBorrow >= 1 {
+        return errors.New("MinRateDiffInAskToForceBorrow must be in range [0,1)")
+    }
+    if config.ChaseDuration < 0 {
+        return errors.New("ChaseDuration must be non-negative")
+    }
+    if config.ChaseStep < 0 || config.ChaseStep >= 1 {
+        return errors.New("ChaseStep must be in range [0,1)")
+    }
+    if config.BorrowFee < 0 || config.BorrowFee >= 1 {
+        return errors.New("BorrowFee must be in range [0,1)")
+    }
+    if config.MinInterestPeriod < 0 {
+        return errors.New("MinInterestPeriod must be non-negative")
+    }
+    if config.CloseFundingInterval < 0 {
+        return errors.New("CloseFundingInterval must be non-negative")
+    }
+    if config.ForecastCandlePeriod != 0 {
+        if config.ForecastCandlePeriod % time.Second != 0 {
+            return errors.New("Unsupported ForecastCandlePeriod")
+        }
+        if _, ok := bitfinexCandlePeriodName(
+                uint32(config.ForecastCandlePeriod / time.Second)); !ok {
+            return errors.New("Unsupported ForecastCandlePeriod")
+        }
+    }
+    if config.ForecastCandleLimit > maxForecastCandleLimit {
+        return errors.New("ForecastCandleLimit must be not greater than 10000")
+    }
+    if config.OrderBookMaxDeviation < 0 || config.OrderBookMaxDeviation > 1 {
+        return errors.New("OrderBookMaxDeviation must be in range [0,1]")
+    }
+    if config.OrderBookCheckInterval < 0 {
+        return errors.New("OrderBookCheckInterval must be non-negative")
+    }
+    if config.SummaryInterval < 0 {
+        return errors.New("SummaryInterval must be non-negative")
+    }
+    if config.MaxFRRMultiple < 0 {
+        return errors.New("MaxFRRMultiple must be non-negative")
+    }
+    // nonce must fit in 53 bits
+    if config.NonceDivisor != 0 &&
+            (config.NonceDivisor < 1000 || config.NonceDivisor > 1000000000) {
+        return errors.New("NonceDivisor must be in range [1000,1000000000]")
+    }
+    if config.ParseErrorWindow < 0 {
+        return errors.New("ParseErrorWindow must be non-negative")
+    }
+    if config.TaskTimeout < 0 {
+        return errors.New("TaskTimeout must be non-negative")
+    }
+    if config.TaskCooldown < 0 {
+        return errors.New("TaskCooldown must be non-negative")
+    }
+    if config.ExpiryGrace < 0 {
+        return errors.New("ExpiryGrace must be non-negative")
+    }
+    if config.MaxLastObAge < 0 {
+        return errors.New("MaxLastObAge must be non-negative")
+    }
+    if config.MaxPriceAge < 0 {
+        return errors.New("MaxPriceAge must be non-negative")
+    }
+    if config.HandlerCallWait < 0 {
+        return errors.New("HandlerCallWait must be non-negative")
+    }
+    if config.MinFillFraction < 0 || config.MinFillFraction > 1 {
+        return errors.New("MinFillFraction must be in range [0,1]")
+    }
+    if config.ObservePhase < 0 {
+        return errors.New("ObservePhase must be non-negative")
+    }
+    if config.WSCommandTimeout < 0 {
+        return errors.New("WSCommandTimeout must be non-negative")
+    }
+    if config.IncrementalBorrow && config.IncrementalBorrowStep == 0 {
+        return errors.New("IncrementalBorrowStep must be set for IncrementalBorrow")
+    }
+    if config.IncrementalBorrow && config.TaskCooldown <= 0 {
+        // steps are done by next tasks in the same period
+        return errors.New("TaskCooldown must be set for IncrementalBorrow")
+    }
+    switch config.FallbackOrderBookDepth {
+        case 0, 1, bitfinexOrderBookDepth, bitfinexMaxOrderBookDepth:
+        default:
+            return errors.New("FallbackOrderBookDepth must be 1, 25 or 100")
+    }
+    if config.MaxBookConsumptionFraction < 0 ||
+            config.MaxBookConsumptionFraction > 1 {
+        // fraction, not percent
+        return errors.New("MaxBookConsumptionFraction must be in range [0,1]")
+    }
+    if config.ActiveHoursStart < 0 || config.ActiveHoursStart >= 24*time.Hour ||
+            config.ActiveHoursEnd < 0 || config.ActiveHoursEnd >= 24*time.Hour {
+        return errors.New("ActiveHoursStart and ActiveHoursEnd must be in range [0,24h)")
+    }
+    if config.EventSinkURL != "" {
+        if err := checkEventSinkURL(config.EventSinkURL); err!=nil {
+            return err
+        }
     }
+    switch config.AuthBackend {
+        case "", authBackendFile, authBackendKeyring, authBackendVault:
+        default:
+            return fmt.Errorf("Unknown auth backend %q", config.AuthBackend)
+    }
+    return nil
+}
+
+// check whether MinOrderAmount can be enforced for currency
+func (config *Config) checkMinOrderAmount(hasUSDPrice bool) error {
+    if !hasUSDPrice && config.MinOrderAmount != 0 &&
+            config.MinOrderAmountInCurrency == 0 {
+        return errors.New("No USD price for currency to check MinOrderAmount - " +
+                "set MinOrderAmountInCurrency")
+    }
+    return nil
+}
+
+// check whether time is in active hours window. window can wrap midnight.
+func (config *Config) inActiveHours(t time.Time) bool {
+    if config.ActiveHoursStart == config.ActiveHoursEnd { return true }
+    t = t.UTC()
+    dayTime := t.Sub(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC))
+    if config.ActiveHoursStart < config.ActiveHoursEnd {
+        return dayTime >= config.ActiveHoursStart && dayTime < config.ActiveHoursEnd
+    }
+    return dayTime >= config.ActiveHoursStart || dayTime < config.ActiveHoursEnd
 }
 
 type BorrowTask struct {
@@ -161,48 +961,337 @@ func (bt *BorrowTask) Join(next *BorrowTask) {
 /* Engine stuff */
 
 type Engine struct {
+    chaseOrderId uint64 // atomic, first field for 64-bit alignment
+    // time of last markets update in unix nanoseconds (atomic, 64-bit aligned)
+    marketsUpdateTime int64
     stopCh chan struct{}
+    summaryStopCh chan struct{}
     baseCurrMarkets map[string]bool
     quoteCurrMarkets map[string]bool
+    // markets of pooled currencies (market -> currency)
+    poolBaseMarkets map[string]string
+    poolQuoteMarkets map[string]string
+    marketsMutex sync.RWMutex
     config *Config
     df *DataFetcher
-    bpriv *BitfinexPrivate
+    bpriv PrivateApi
     lastOb *OrderBook
+    lastObTime time.Time    // time of receiving last orderbook
     lastObMutex sync.Mutex
     checkOBEnabled uint32
+    // 1 if orderbook is only observed (in observe phase of period)
+    observing uint32
+    // 1 if borrow task is running or in cooldown, 0 if new task can be started
     btDone uint32
+    // number of current auto loan period, cooldown of task from previous
+    // period must not reset btDone. guarded by btMutex
+    btPeriod uint64
+    btMutex sync.Mutex
     alCreditsMap map[uint64]Credit
     taskMutex sync.Mutex
+    paused uint32
+    rateAlert *rateAlertMonitor
+    parseErrors *parseErrorMonitor
+    // notifier for critical alerts
+    notifier Notifier
+    // receives fatal error (for example invalid API key) after that
+    // the program should exit
+    fatalCh chan error
+    events EventSink
+    prefetch *prefetchData
+    prefetchMutex sync.Mutex
+    incBorrow *incrementalBorrow  // protected by taskMutex
+    // time of orderbook trigger of current task (zero if task is not
+    // triggered by orderbook), protected by taskMutex
+    taskTrigger time.Time
+    // deadline of current borrow task with TaskTimeout (zero - no deadline)
+    // and private API whose requests end at this deadline,
+    // protected by taskMutex
+    taskDeadline time.Time
+    taskBpriv PrivateApi
+    // offer of partially filled attempt left open to be amended by next attempt
+    // (keepRetryOrder - current attempt can leave its offer open) and its
+    // remaining amount at last check, protected by taskMutex
+    keepRetryOrder bool
+    retryOrderId uint64
+    retryOrderRemaining godec64.UDec64
+    // latencies between orderbook trigger and submit of borrow order
+    triggerLatency latencyHistogram
+    clock Clock
+    getMaxOrderBook func(ob *OrderBook)
+    getFRR func() godec64.UDec64
+    getMarketPrices func(markets []string) map[string]godec64.UDec64
+    getCandles func(period uint32, limit uint) []Candle
+    // moving average of lowest ask rate sampled once per forecast candle period
+    // (reported by status; borrow trigger doesn't use it)
+    rateStats rateStats
+}
+
+// private API used by engine (implemented by BitfinexPrivate)
+type PrivateApi interface {
+    GetWallets() []Balance
+    GetMarginBalances() []Balance
+    GetLoans(currency string) []Loan
+    GetCredits(currency string) []Credit
+    GetPositions() []Position
+    GetMarginInfo() MarginInfo
+    GetActiveMarginOrders() []MarginOrder
+    GetActiveOrders(currency string) []Order
+    GetOrder(currency string, orderId uint64) (Order, bool)
+    GetFundingTrades(currency string, since time.Time, limit uint) []FundingTrade
+    SubmitBidOrder(currency string, amount, rate godec64.UDec64, period uint32,
+                   or *OpResult)
+    CancelOrder(orderId uint64, or *OpResult)
+    UpdateOffer(currency string, orderId uint64, amount, rate godec64.UDec64,
+                or *OpResult)
+    CloseFunding(loanId uint64, or *Op2Result)
+    SetKeepCredits(creditIds []uint64, keep bool, or *Op2Result)
+    // get API whose requests fail if they are not finished before deadline
+    WithDeadline(deadline time.Time) PrivateApi
 }
 
-func NewEngine(config *Config, df *DataFetcher, bpriv *BitfinexPrivate) *Engine {
-    return &Engine{ stopCh: make(chan struct{}),
+func NewEngine(config *Config, df *DataFetcher, bpriv PrivateApi) *Engine {
+    eng := &Engine{ stopCh: make(chan struct{}),
                 baseCurrMarkets: make(map[string]bool),
                 quoteCurrMarkets: make(map[string]bool),
                 checkOBEnabled: 0,
-                config: config, df: df, bpriv: bpriv }
+                config: config, df: df, bpriv: bpriv, clock: realClock{},
+                notifier: newNotifier(config),
+                fatalCh: make(chan error, 1) }
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        df.GetPublic().GetMaxOrderBook(config.Currency, ob)
+    }
+    eng.getFRR = func() godec64.UDec64 {
+        return df.GetPublic().GetFRR(config.Currency)
+    }
+    eng.getMarketPrices = func(markets []string) map[string]godec64.UDec64 {
+        return df.GetPublic().GetMarketPrices(markets)
+    }
+    eng.getCandles = func(period uint32, limit uint) []Candle {
+        return df.GetPublic().GetCandles(config.Currency, period, time.Time{}, limit)
+    }
+    if config.AlertRate > 0 {
+        eng.rateAlert = newRateAlertMonitor(config.Currency, config.AlertRate,
+                                            newNotifier(config))
+    }
+    if config.ParseErrorThreshold > 0 {
+        eng.parseErrors = newParseErrorMonitor(config.Currency,
+                    config.ParseErrorThreshold, config.ParseErrorWindow,
+                    newNotifier(config))
+    }
+    eng.events = newEventSink(config)
+    return eng
 }
 
-func (eng *Engine) PrepareMarkets() {
-    bp := eng.df.GetPublic()
-    markets := bp.GetMarkets()
+// publish event if event sink is set
+func (eng *Engine) publishEvent(topic string, payload []byte) {
+    if eng.events!=nil {
+        eng.events.Publish(topic, payload)
+    }
+}
+
+// period of refreshing markets
+const marketsRefreshPeriod = 6*time.Hour
+
+// build markets maps from markets list
+func (eng *Engine) prepareMarketsFrom(markets []Market) {
+    baseCurrMarkets := make(map[string]bool)
+    quoteCurrMarkets := make(map[string]bool)
+    poolBaseMarkets := make(map[string]string)
+    poolQuoteMarkets := make(map[string]string)
     for _, m := range markets {
         if  eng.config.Currency == m.BaseCurrency {
-            eng.baseCurrMarkets[eng.config.Currency] = true
+            baseCurrMarkets[m.Name] = true
         } else if  eng.config.Currency == m.QuoteCurrency {
-            eng.quoteCurrMarkets[eng.config.Currency] = true
+            quoteCurrMarkets[m.Name] = true
+        }
+        for _, curr := range eng.config.PoolCurrencies {
+            if curr == eng.config.Currency { continue }
+            if curr == m.BaseCurrency {
+                poolBaseMarkets[m.Name] = curr
+            } else if curr == m.QuoteCurrency {
+                poolQuoteMarkets[m.Name] = curr
+            }
         }
     }
+    eng.marketsMutex.Lock()
+    eng.baseCurrMarkets = baseCurrMarkets
+    eng.quoteCurrMarkets = quoteCurrMarkets
+    eng.poolBaseMarkets = poolBaseMarkets
+    eng.poolQuoteMarkets = poolQuoteMarkets
+    eng.marketsMutex.Unlock()
+}
+
+func (eng *Engine) PrepareMarkets() {
+    bp := eng.df.GetPublic()
+    eng.prepareMarketsFrom(bp.GetMarkets())
+    atomic.StoreInt64(&eng.marketsUpdateTime, eng.clock.Now().UnixNano())
+}
+
+const safeCallRetries = 2
+
+// count parse errors and escalate if they are repeated, instead of silently
+// skipping every task
+func (eng *Engine) checkParseError(err error) {
+    var pe *ParseError
+    if eng.parseErrors == nil || !errors.As(err, &pe) { return }
+    if eng.parseErrors.add(eng.clock.Now()) && eng.config.PauseOnParseErrors {
+        Logger.Error("Too many parse errors - pause engine")
+        eng.Pause()
+    }
+}
+
+// check whether error is about invalid API key. if yes then pause engine,
+// send critical alert and signal fatal error to main routine.
+func (eng *Engine) checkAuthError(err error) {
+    if !isApiKeyError(err) { return }
+    Logger.Error("API key is invalid - stop engine")
+    eng.Pause()
+    select {
+        case eng.fatalCh <- &StartupError{ exitApiKeyInvalid, "API key invalid", err }:
+            // alert only once
+            if eng.notifier != nil {
+                eng.notifier.Notify(fmt.Sprint("CRITICAL: ", eng.config.Currency,
+                                ": API key is invalid or revoked: ", err))
+            }
+        default:    // already signaled
+    }
+}
+
+// returns channel that receives fatal error of engine
+func (eng *Engine) Fatal() <-chan error {
+    return eng.fatalCh
+}
+
+// log error from panic, publish it and check its kind
+func (eng *Engine) handlePanicError(name string, err error) {
+    Logger.Error("Panic in ", name, ": ", err)
+    eng.publishEvent(eventTopicError,
+                     errorEventPayload(eng.config.Currency, name, err))
+    eng.checkParseError(err)
+    eng.checkAuthError(err)
+}
+
+// call function, recover panic and retry call if error is transient.
+// returns true if function finished without panic.
+func (eng *Engine) callSafe(name string, f func()) bool {
+    for i := 0; ; i++ {
+        err, retry := recoverCall(f)
+        if err==nil { return true }
+        eng.handlePanicError(name, err)
+        if !retry || i >= safeCallRetries { return false }
+        eng.clock.Sleep(time.Second)
+    }
+}
+
+func (eng *Engine) prepareMarketsSafe() {
+    eng.callSafe("PrepareMarkets", eng.PrepareMarkets)
+}
+
+// return true if currency is base currency of market
+func (eng *Engine) isBaseMarket(market string) bool {
+    eng.marketsMutex.RLock()
+    defer eng.marketsMutex.RUnlock()
+    return eng.baseCurrMarkets[market]
+}
+
+// return true if currency is quote currency of market
+func (eng *Engine) isQuoteMarket(market string) bool {
+    eng.marketsMutex.RLock()
+    defer eng.marketsMutex.RUnlock()
+    return eng.quoteCurrMarkets[market]
+}
+
+// return borrowed or pooled currency that must be borrowed for position in market
+func (eng *Engine) marketBorrowCurrency(market string, long bool) (string, bool) {
+    eng.marketsMutex.RLock()
+    defer eng.marketsMutex.RUnlock()
+    if long {
+        if eng.quoteCurrMarkets[market] { return eng.config.Currency, true }
+        curr, ok := eng.poolQuoteMarkets[market]
+        return curr, ok
+    }
+    if eng.baseCurrMarkets[market] { return eng.config.Currency, true }
+    curr, ok := eng.poolBaseMarkets[market]
+    return curr, ok
 }
 
 func (eng *Engine) Start() {
+    eng.PrepareMarkets()
+    eng.seedRateStats()
     eng.df.SetOrderBookHandler(eng.checkOrderBook)
+    eng.startSummary()
     go eng.mainRoutine()
 }
 
+// seed moving average of rate by closing rates of historical candles,
+// so average at start is meaningful. live rates are sampled once per candle
+// period, so first ticks don't replace historical average.
+func (eng *Engine) seedRateStats() {
+    period, limit := eng.config.forecastCandles()
+    eng.rateStats.setSpan(limit, time.Duration(period)*time.Second)
+    var candles []Candle
+    if !eng.callSafe("getCandles", func() { candles = eng.getCandles(period, limit) }) {
+        Logger.Warn("Can't get historical rates - rate average starts empty")
+        return
+    }
+    rates := make([]float64, len(candles))
+    for i := 0; i < len(candles); i++ {
+        rates[i] = candles[i].Close.ToFloat64(12)
+    }
+    eng.rateStats.seed(rates, eng.clock.Now())
+    if ema, ok := eng.rateStats.EMA(); ok {
+        Logger.Info("Rate average seeded from ", len(candles), " candles: ",
+                    strconv.FormatFloat(ema*100, 'f', 6, 64), "%")
+    }
+}
+
 func (eng *Engine) Stop() {
-    eng.stopCh <- struct{}{}
+    close(eng.stopCh)   // also breaks waiting for next auto loan period
+    eng.stopSummary()
     eng.df.SetOrderBookHandler(nil)
+    if eng.events!=nil { eng.events.Close() }
+}
+
+func (eng *Engine) startSummary() {
+    if eng.config.SummaryInterval <= 0 { return }
+    eng.summaryStopCh = make(chan struct{})
+    go eng.summaryRoutine(eng.config.SummaryInterval, eng.summaryStopCh)
+}
+
+func (eng *Engine) stopSummary() {
+    if eng.summaryStopCh == nil { return }
+    close(eng.summaryStopCh)
+    eng.summaryStopCh = nil
+}
+
+// log funding summary periodically independently of auto loan periods
+func (eng *Engine) summaryRoutine(interval time.Duration, stopCh <-chan struct{}) {
+    ticker := eng.clock.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+            case <-ticker.C():
+                eng.printCurrentFundingSummarySafe()
+            case <-stopCh:
+                return
+        }
+    }
+}
+
+// pause engine - no borrow tasks will be done until resume
+func (eng *Engine) Pause() {
+    atomic.StoreUint32(&eng.paused, 1)
+    Logger.Info("Engine paused")
+}
+
+func (eng *Engine) Resume() {
+    atomic.StoreUint32(&eng.paused, 0)
+    Logger.Info("Engine resumed")
+}
+
+func (eng *Engine) IsPaused() bool {
+    return atomic.LoadUint32(&eng.paused) != 0
 }
 
 type CreditsSort []Credit
@@ -219,50 +1308,284 @@ func (cs CreditsSort) Swap(i, j int) {
     cs[i], cs[j] = cs[j], cs[i]
 }
 
+// return number of decimals of amounts in engine currency
+func (eng *Engine) amountPrec() uint {
+    return amountPrecision(eng.config.Currency)
+}
+
+type LoanIdsSort []uint64
+
+func (ls LoanIdsSort) Len() int {
+    return len(ls)
+}
+
+func (ls LoanIdsSort) Less(i, j int) bool {
+    return ls[i] < ls[j]
+}
+
+func (ls LoanIdsSort) Swap(i, j int) {
+    ls[i], ls[j] = ls[j], ls[i]
+}
+
+// open log file with rotation (sizes from config)
+func (config *Config) openLogFile() (*rotatingFile, error) {
+    maxSizeMB := config.LogMaxSizeMB
+    if maxSizeMB == 0 { maxSizeMB = defaultLogMaxSizeMB }
+    maxBackups := config.LogMaxBackups
+    if maxBackups == 0 { maxBackups = defaultLogMaxBackups }
+    return openRotatingFile(expandPath(config.LogFile), int64(maxSizeMB)<<20,
+                            int(maxBackups))
+}
+
+// return settlement currency if position is derivative position
+// (for example BTCF0:USTF0 is settled in UST)
+func derivativeSettlementCurrency(pos *Position) (string, bool) {
+    colonIdx := strings.IndexByte(pos.Market, ':')
+    if colonIdx < 0 {
+        return "", false    // no settlement currency in market
+    }
+    if pos.Type != PositionDerivative && !strings.HasSuffix(pos.Market, "F0") {
+        return "", false
+    }
+    quote := pos.Market[colonIdx+1:]
+    return strings.TrimSuffix(quote, "F0"), true
+}
+
 func (eng *Engine) calculateTotalBorrow(poss []Position, bals []Balance) godec64.UDec64 {
+    return eng.calculateTotalBorrowWithOrders(poss, bals, nil)
+}
+
+// calculate total borrow including pending margin orders (if they will be filled)
+func (eng *Engine) calculateTotalBorrowWithOrders(poss []Position, bals []Balance,
+                            orders []MarginOrder) godec64.UDec64 {
+    return eng.calculateTotalBorrowPooled(poss, bals, orders, nil)
+}
+
+// reduce total borrow by idle balance of funding wallet in currency
+// (it can back positions after transfer to margin wallet).
+func (eng *Engine) netOfFundingWallet(totalBorrow godec64.UDec64,
+                                      wallets []Balance) godec64.UDec64 {
+    for i := 0; i < len(wallets); i++ {
+        if wallets[i].Type != "funding" || wallets[i].Currency != eng.config.Currency {
+            continue
+        }
+        idle := wallets[i].Available
+        if idle >= totalBorrow { return 0 }
+        return totalBorrow - idle
+    }
+    return totalBorrow
+}
+
+// calculate total borrow with positions and balances of pooled currencies.
+// poolPrices - prices of pooled currencies in borrowed currency (8 decimals).
+// pooled currencies without price are skipped.
+func (eng *Engine) calculateTotalBorrowPooled(poss []Position, bals []Balance,
+            orders []MarginOrder, poolPrices map[string]godec64.UDec64) godec64.UDec64 {
+    prec := eng.amountPrec()
     var totalBal godec64.UDec64 = 0
+    // balances of pooled currencies (8 decimals)
+    var poolBal godec64.UDec64 = 0
     for i := 0; i < len(bals); i++ {
         if bals[i].Currency == eng.config.Currency {
             totalBal = bals[i].Total
-            break
+        } else if price, ok := poolPrices[bals[i].Currency]; ok {
+            bal := bals[i].Total
+            if bprec := amountPrecision(bals[i].Currency);
+                    bprec != defaultAmountPrecision {
+                bal = bal.Convert(bprec, defaultAmountPrecision, true)
+            }
+            poolBal += bal.Mul(price, 8, true)
         }
     }
     
     var posTotalVal godec64.UDec64 = 0
+    // add value in currency to total value. returns false if currency is
+    // neither borrowed nor pooled currency (value is not added).
+    addValue := func(curr string, val godec64.UDec64) bool {
+        if curr == eng.config.Currency {
+            posTotalVal += val
+        } else if price, ok := poolPrices[curr]; ok {
+            posTotalVal += val.Mul(price, 8, true)
+        } else {
+            return false
+        }
+        return true
+    }
+    var uncovered []string  // markets of ignored positions
     for i := 0; i < len(poss); i++ {
         pos := &poss[i]
-        if pos.Long {
-            if _, ok :=  eng.quoteCurrMarkets[pos.Market]; !ok {
-                continue // if not this market
+        if !pos.IsActive() {
+            continue    // closing or closed position does not need borrow
+        }
+        if settleCurr, ok := derivativeSettlementCurrency(pos); ok {
+            // derivative position: part of value not covered by collateral
+            posVal := pos.Amount.Mul(pos.BasePrice, 8, true)
+            if posVal > pos.Collateral &&
+                    !addValue(settleCurr, posVal - pos.Collateral) {
+                uncovered = append(uncovered, pos.Market)
             }
-            posTotalVal += poss[i].Amount.Mul(poss[i].BasePrice, 8, true)
+            continue
+        }
+        curr, ok := eng.marketBorrowCurrency(pos.Market, pos.Long)
+        if !ok {
+            uncovered = append(uncovered, pos.Market)
+            continue // if not this market
+        }
+        if pos.Long {
+            addValue(curr, poss[i].Amount.Mul(poss[i].BasePrice, 8, true))
         } else { // short
-            if _, ok :=  eng.baseCurrMarkets[pos.Market]; !ok {
-                continue // if not this market
-            }
-            posTotalVal += poss[i].Amount
+            addValue(curr, poss[i].Amount)
+        }
+    }
+    if eng.config.WarnUncoveredPositions && len(uncovered) != 0 {
+        Logger.Warn("Positions not funded in ", eng.config.Currency,
+                    " are ignored: ", strings.Join(uncovered, ","))
+    }
+    for i := 0; i < len(orders); i++ {
+        order := &orders[i]
+        curr, ok := eng.marketBorrowCurrency(order.Market, order.Long)
+        if !ok || (order.Long && order.Price == 0) {
+            continue // if not this market or no price (market order)
+        }
+        if order.Long {
+            addValue(curr, order.Amount.Mul(order.Price, 8, true))
+        } else { // short
+            addValue(curr, order.Amount)
         }
     }
+    // values of positions are in precision of trading (8 decimals)
+    if prec != defaultAmountPrecision {
+        posTotalVal = posTotalVal.Convert(defaultAmountPrecision, prec, true)
+        poolBal = poolBal.Convert(defaultAmountPrecision, prec, true)
+    }
+    totalBal += poolBal
     if posTotalVal > totalBal {
         return posTotalVal - totalBal
     } else { return 0 }
 }
 
-func (eng *Engine) prepareBorrowTask(ob *OrderBook, credits []Credit,
-                            totalBorrow godec64.UDec64, now time.Time) BorrowTask {
-    var totalCredits godec64.UDec64
-    for i := 0; i < len(credits); i++ {
-        totalCredits += credits[i].Amount
+// get prices of pooled currencies in borrowed currency
+func (eng *Engine) getPoolPrices() map[string]godec64.UDec64 {
+    currs := append([]string{ eng.config.Currency }, eng.config.PoolCurrencies...)
+    usdPrices := eng.df.GetUSDPrices(currs)
+    currPrice, ok := usdPrices[eng.config.Currency]
+    if !ok || currPrice == 0 {
+        Logger.Warn("No USD price for ", eng.config.Currency,
+                    " - pooled currencies are skipped")
+        return nil
     }
-    
-    oblen := len(ob.Ask)
-    
-    var task BorrowTask
-    if oblen == 0 { return task }
-    if len(credits) == 0 { return task }
-    
-    var normCredits, toExpireCredits []Credit
-    for i := 0; i < len(credits); i++ {
+    prices := make(map[string]godec64.UDec64, len(eng.config.PoolCurrencies))
+    for _, curr := range eng.config.PoolCurrencies {
+        if curr == eng.config.Currency { continue }
+        if price, ok := usdPrices[curr]; ok {
+            prices[curr] = price.Div(currPrice, 8)
+        } else {
+            Logger.Warn("No USD price for pooled currency ", curr)
+        }
+    }
+    return prices
+}
+
+// return copy of positions with base prices replaced by current market prices.
+// positions without market price keep base price.
+func (eng *Engine) withMarkPrices(poss []Position) []Position {
+    if len(poss) == 0 { return poss }
+    markets := make([]string, 0, len(poss))
+    for i := 0; i < len(poss); i++ {
+        markets = append(markets, poss[i].Market)
+    }
+    var prices map[string]godec64.UDec64
+    if !eng.callSafe("getMarketPrices", func() {
+        prices = eng.getMarketPrices(markets)
+    }) {
+        Logger.Warn("No market prices - base prices of positions are used")
+        return poss
+    }
+    markPoss := make([]Position, len(poss))
+    copy(markPoss, poss)
+    for i := 0; i < len(markPoss); i++ {
+        if price, ok := prices[markPoss[i].Market]; ok && price != 0 {
+            markPoss[i].BasePrice = price
+        }
+    }
+    return markPoss
+}
+
+// return orderbook with asks limited to fraction of total ask depth
+func limitOrderBookConsumption(ob *OrderBook, fraction float64) *OrderBook {
+    var totalAsk godec64.UDec64
+    for i := 0; i < len(ob.Ask); i++ {
+        totalAsk += ob.Ask[i].Amount
+    }
+    maxAmount := godec64.UDec64(float64(totalAsk) * fraction)
+    limOb := &OrderBook{ Bid: ob.Bid,
+                Ask: make([]OrderBookEntry, 0, len(ob.Ask)) }
+    for i := 0; i < len(ob.Ask) && maxAmount != 0; i++ {
+        obe := ob.Ask[i]
+        if obe.Amount > maxAmount { obe.Amount = maxAmount }
+        maxAmount -= obe.Amount
+        limOb.Ask = append(limOb.Ask, obe)
+    }
+    return limOb
+}
+
+// return orderbook with ask rates raised to minimal rate
+func raiseOrderBookRates(ob *OrderBook, minRate godec64.UDec64) *OrderBook {
+    raisedOb := &OrderBook{ Bid: ob.Bid, Ask: make([]OrderBookEntry, len(ob.Ask)) }
+    copy(raisedOb.Ask, ob.Ask)
+    for i := 0; i < len(raisedOb.Ask); i++ {
+        if raisedOb.Ask[i].Rate < minRate { raisedOb.Ask[i].Rate = minRate }
+    }
+    return raisedOb
+}
+
+// effective cost of borrow (in currency) over period: interest with fee.
+// interest is charged at least for MinInterestPeriod.
+func (eng *Engine) effectiveBorrowCost(rate, amount float64,
+                                       period time.Duration) float64 {
+    if period < eng.config.MinInterestPeriod {
+        period = eng.config.MinInterestPeriod
+    }
+    return amount * rate * (1.0 + eng.config.BorrowFee) * period.Hours() / 24.0
+}
+
+// factor of cost of new borrow that replaces credit to its expiration
+// (1.0 - no fee and no minimal interest). minimal interest is charged only
+// for new borrow.
+func (eng *Engine) borrowCostFactor(credit *Credit, now time.Time) float64 {
+    if eng.config.BorrowFee == 0 && eng.config.MinInterestPeriod == 0 {
+        return 1.0
+    }
+    expireTime := credit.CreateTime.Add(24*time.Hour*time.Duration(credit.Period))
+    horizon := expireTime.Sub(now)
+    if horizon <= 0 { horizon = time.Hour }
+    return eng.effectiveBorrowCost(1.0, 1.0, horizon) / (horizon.Hours() / 24.0)
+}
+
+func (eng *Engine) prepareBorrowTask(ob *OrderBook, credits []Credit,
+                            totalBorrow godec64.UDec64, now time.Time) BorrowTask {
+    prec := eng.amountPrec()
+    var totalCredits godec64.UDec64
+    for i := 0; i < len(credits); i++ {
+        totalCredits += credits[i].Amount
+    }
+    
+    if eng.config.MaxBookConsumptionFraction > 0 {
+        // rest will be borrowed in next ticks or periods
+        ob = limitOrderBookConsumption(ob, eng.config.MaxBookConsumptionFraction)
+    }
+    if eng.config.MinBorrowRate > 0 {
+        // offers below floor will be paid with floor rate
+        ob = raiseOrderBookRates(ob, eng.config.MinBorrowRate)
+    }
+    oblen := len(ob.Ask)
+    
+    var task BorrowTask
+    if oblen == 0 { return task }
+    if len(credits) == 0 { return task }
+    
+    var normCredits, toExpireCredits []Credit
+    for i := 0; i < len(credits); i++ {
         credit := &credits[i]
         expireTime := credit.CreateTime.Add(24*time.Hour*time.Duration(credit.Period))
         afterAutoLoanTime := now.Truncate(eng.config.AutoLoanFetchPeriod).
@@ -271,7 +1594,14 @@ func (eng *Engine) prepareBorrowTask(ob *OrderBook, credits []Credit,
             // if still before now
             afterAutoLoanTime = afterAutoLoanTime.Add(eng.config.AutoLoanFetchPeriod)
         }
-        if !afterAutoLoanTime.After(expireTime) { // if normal
+        // excluded credits are never replaced unless they expire
+        if eng.isDoNotCloseLoan(credit.Id) &&
+                !afterAutoLoanTime.Add(eng.config.ExpiryGrace).After(expireTime) {
+            continue
+        }
+        // renewed credits do not expire
+        if !afterAutoLoanTime.Add(eng.config.ExpiryGrace).After(expireTime) ||
+                (eng.config.AutoRenewBorrow && credit.Renew) { // if normal
             normCredits = append(normCredits, *credit)
         } else {
             toExpireCredits = append(toExpireCredits, *credit)
@@ -279,6 +1609,12 @@ func (eng *Engine) prepareBorrowTask(ob *OrderBook, credits []Credit,
     }
     
     sort.Sort(CreditsSort(normCredits))
+    if eng.config.PreferCloseNonRenewing {
+        // renewing credits are considered after all non-renewing credits
+        sort.SliceStable(normCredits, func(i, j int) bool {
+            return normCredits[i].Renew && !normCredits[j].Renew
+        })
+    }
     var obSumAmountRate float64 = 0
     var csSumAmountRate float64 = 0
     var obTotalAmount float64 = 0
@@ -290,7 +1626,7 @@ func (eng *Engine) prepareBorrowTask(ob *OrderBook, credits []Credit,
     obFill := func(csAmount godec64.UDec64) (godec64.UDec64, float64, bool) {
         var obAmountRate float64 = 0
         for ; obi < oblen && csAmount >= ob.Ask[obi].Amount - obFilled ; obi++ {
-            obAmount := (ob.Ask[obi].Amount - obFilled).ToFloat64(8)
+            obAmount := (ob.Ask[obi].Amount - obFilled).ToFloat64(prec)
             obAmountRate += obAmount * ob.Ask[obi].Rate.ToFloat64(12)
             obTotalAmount += obAmount
             csAmount -= ob.Ask[obi].Amount - obFilled
@@ -301,7 +1637,7 @@ func (eng *Engine) prepareBorrowTask(ob *OrderBook, credits []Credit,
             return csAmount, obAmountRate, false
         }
         if obi != oblen && csAmount != 0 && csAmount < ob.Ask[obi].Amount - obFilled {
-            obAmount := csAmount.ToFloat64(8)
+            obAmount := csAmount.ToFloat64(prec)
             obAmountRate += obAmount * ob.Ask[obi].Rate.ToFloat64(12)
             obTotalAmount += obAmount
             obFilled += csAmount
@@ -311,35 +1647,40 @@ func (eng *Engine) prepareBorrowTask(ob *OrderBook, credits []Credit,
         return csAmount, obAmountRate, true
     }
     
+    // fee is charged also from interest of kept credits
+    keptCostFactor := 1.0 + eng.config.BorrowFee
     // find balance between orderbook average rate and credits average rate.
     // find orderbook average rate starting from lowest orders to highest orders.
     // find credits average rate starting from highest to lowest rate.
     for csi := len(normCredits)-1 ;csi >= 0; csi-- {
         csAmount := normCredits[csi].Amount
         // map credit to orderbook offers.
-        csEntryAmount := csAmount.ToFloat64(8)
-        csAmountRate := csEntryAmount * normCredits[csi].Rate.ToFloat64(12)
+        csEntryAmount := csAmount.ToFloat64(prec)
+        csAmountRate := csEntryAmount * normCredits[csi].Rate.ToFloat64(12) *
+                keptCostFactor
         
         _, obAmountRate, left := obFill(csAmount)
         if !left { break }
+        costFactor := eng.borrowCostFactor(&normCredits[csi], now)
+        obAmountRate *= costFactor
         
         // check whether current rate is not lower than best rate in orderbook
         csAmountLeft := csAmount
         lowestObi := 0
         var lowObAmountRate float64
         for ; lowestObi < oblen && csAmountLeft >= ob.Ask[lowestObi].Amount; lowestObi++ {
-            obAmount := ob.Ask[lowestObi].Amount.ToFloat64(8)
+            obAmount := ob.Ask[lowestObi].Amount.ToFloat64(prec)
             lowObAmountRate += obAmount * ob.Ask[lowestObi].Rate.ToFloat64(12)
             csAmountLeft -= ob.Ask[lowestObi].Amount
         }
         if lowestObi != oblen && csAmountLeft < ob.Ask[lowestObi].Amount {
-            obAmount := csAmountLeft.ToFloat64(8)
+            obAmount := csAmountLeft.ToFloat64(prec)
             lowObAmountRate += obAmount * ob.Ask[lowestObi].Rate.ToFloat64(12)
             csAmountLeft = 0
         }
         // if calculated
         if csAmountLeft == 0 {
-            if csAmountRate < lowObAmountRate {
+            if csAmountRate < lowObAmountRate * costFactor {
                 break  // if credit rate is lower than lowest lowObAmountRate
             }
         }
@@ -349,14 +1690,15 @@ func (eng *Engine) prepareBorrowTask(ob *OrderBook, credits []Credit,
         hcsi := len(normCredits)-1
         csAmountLeft = csAmount
         for ; hcsi >= 0 && csAmountLeft >= normCredits[hcsi].Amount; hcsi-- {
-            hcsAmount := (normCredits[hcsi].Amount).ToFloat64(8)
+            hcsAmount := (normCredits[hcsi].Amount).ToFloat64(prec)
             hcsAmountRate += hcsAmount * normCredits[hcsi].Rate.ToFloat64(12)
             csAmountLeft -= normCredits[hcsi].Amount
         }
         if hcsi >= 0 && csAmountLeft < normCredits[hcsi].Amount {
-            hcsAmount := csAmountLeft.ToFloat64(8)
+            hcsAmount := csAmountLeft.ToFloat64(prec)
             hcsAmountRate += hcsAmount * normCredits[hcsi].Rate.ToFloat64(12)
         }
+        hcsAmountRate *= keptCostFactor
         
         if hcsAmountRate < obAmountRate { break }
         
@@ -372,6 +1714,9 @@ func (eng *Engine) prepareBorrowTask(ob *OrderBook, credits []Credit,
     }
     
     // to expire credits
+    if !eng.config.RollExpiringCredits {
+        toExpireCredits = nil   // they lapse to auto-loan
+    }
     for i := 0; i < len(toExpireCredits); i++ {
         // map credit to orderbook offers.
         if _, _, left := obFill(toExpireCredits[i].Amount); !left { break }
@@ -381,6 +1726,24 @@ func (eng *Engine) prepareBorrowTask(ob *OrderBook, credits []Credit,
         task.Rate = taskRate
     }
     
+    if eng.config.KeepCheaperCredits && len(task.LoanIdsToClose) != 0 {
+        // safety net: do not close credits cheaper than new borrow
+        creditsMap := make(map[uint64]*Credit, len(normCredits))
+        for i := 0; i < len(normCredits); i++ {
+            creditsMap[normCredits[i].Id] = &normCredits[i]
+        }
+        loanIds := make([]uint64, 0, len(task.LoanIdsToClose))
+        for _, id := range task.LoanIdsToClose {
+            if c := creditsMap[id]; c.Rate < task.Rate {
+                task.TotalBorrow -= c.Amount  // keep credit, no replacement
+            } else {
+                loanIds = append(loanIds, id)
+            }
+        }
+        task.LoanIdsToClose = loanIds
+    }
+    // credits that will not be replaced
+    retainedCredits := totalCredits - task.TotalBorrow
     // only if other filled.
     if task.TotalBorrow != 0 {
         // fill rest of not borrowed from total borrow
@@ -391,77 +1754,904 @@ func (eng *Engine) prepareBorrowTask(ob *OrderBook, credits []Credit,
             task.Rate = taskRate
         }
     }
+    if eng.config.StrictCoverage {
+        // borrow only to cover positions: retained credits + borrow <= total borrow
+        var maxBorrow godec64.UDec64
+        if totalBorrow > retainedCredits {
+            maxBorrow = totalBorrow - retainedCredits
+        }
+        if task.TotalBorrow > maxBorrow { task.TotalBorrow = maxBorrow }
+    }
+    if eng.config.SortLoanIdsToClose {
+        sort.Sort(LoanIdsSort(task.LoanIdsToClose))
+    }
+    if len(eng.config.CloseMarketPriority) != 0 {
+        eng.sortLoanIdsByMarketPriority(task.LoanIdsToClose, normCredits)
+    }
     return task
 }
 
+// order loan ids to close credits of markets from CloseMarketPriority first.
+// order of loans with same priority is not changed.
+func (eng *Engine) sortLoanIdsByMarketPriority(loanIds []uint64, credits []Credit) {
+    marketPrios := make(map[string]int, len(eng.config.CloseMarketPriority))
+    for i, market := range eng.config.CloseMarketPriority {
+        if _, ok := marketPrios[market]; !ok { marketPrios[market] = i }
+    }
+    loanPrios := make(map[uint64]int, len(credits))
+    for i := 0; i < len(credits); i++ {
+        prio, ok := marketPrios[credits[i].Market]
+        if !ok { prio = len(eng.config.CloseMarketPriority) }
+        loanPrios[credits[i].Id] = prio
+    }
+    sort.SliceStable(loanIds, func(i, j int) bool {
+        return loanPrios[loanIds[i]] < loanPrios[loanIds[j]]
+    })
+}
+
+// returns copy of current orderbook (realtime or fetched by HTTP if
+// websocket fails) or nil if no orderbook
+func (eng *Engine) CurrentOrderBook() *OrderBook {
+    if eng.df == nil { return nil }
+    cur, ok := eng.df.orderBook.Load().(*OrderBook)
+    if !ok || cur == nil { return nil }
+    ob := new(OrderBook)
+    ob.copyFrom(cur)
+    return ob
+}
+
+// returns copy of last checked orderbook or nil if no orderbook
+func (eng *Engine) LastOrderBook() *OrderBook {
+    eng.lastObMutex.Lock()
+    defer eng.lastObMutex.Unlock()
+    if eng.lastOb == nil { return nil }
+    ob := new(OrderBook)
+    ob.copyFrom(eng.lastOb)
+    return ob
+}
+
 func (eng *Engine) checkOrderBook(ob *OrderBook) {
+    if eng.rateAlert!=nil && len(ob.Ask) != 0 {
+        // independent of borrowing
+        eng.rateAlert.check(ob.Ask[0].Rate.ToFloat64(12)*100.0)
+    }
+    if len(ob.Ask) != 0 {
+        eng.rateStats.add(ob.Ask[0].Rate.ToFloat64(12), eng.clock.Now())
+    }
     if atomic.LoadUint32(&eng.checkOBEnabled) == 0 {
         return
     }
+    now := eng.clock.Now()
     eng.lastObMutex.Lock()
-    lastOb := eng.lastOb
-    eng.lastOb = ob
+    lastOb, lastObTime := eng.lastOb, eng.lastObTime
+    eng.lastOb, eng.lastObTime = ob, now
     eng.lastObMutex.Unlock()
     Logger.Debug("checkOrderBook")
+    if eng.IsPaused() || atomic.LoadUint32(&eng.observing) != 0 {
+        return  // only update last orderbook
+    }
+    if ob.Baseline && eng.config.ResubscribeBaseline {
+        Logger.Debug("Baseline orderbook after resubscription")
+        return  // previous orderbook is before gap in updates
+    }
+    if lastOb!=nil && eng.config.MaxLastObAge > 0 &&
+            now.Sub(lastObTime) > eng.config.MaxLastObAge {
+        Logger.Debug("Last orderbook is too old - new baseline")
+        return
+    }
     if lastOb!=nil && len(lastOb.Ask) != 0 && len(ob.Ask) != 0 {
         lastObAsk := lastOb.Ask[0].Rate.ToFloat64(12)
         obAsk := ob.Ask[0].Rate.ToFloat64(12)
         if lastObAsk < obAsk*(1 - eng.config.MinRateDiffInAskToForceBorrow) {
             // some eat orderbook, initialize makeBorrowTask
-            if atomic.CompareAndSwapUint32(&eng.btDone, 0, 1) {
-                go eng.makeBorrowTaskSafe(time.Now())
-            }
+            eng.startTriggeredBorrowTask(now, now)
         }
     }
 }
 
+const (
+    closeFundingBatchSize = 80
+    closeFundingBatchPause = time.Minute
+)
+
+// check whether funding can not be closed
+func (eng *Engine) isDoNotCloseLoan(loanId uint64) bool {
+    for _, id := range eng.config.DoNotCloseLoanIds {
+        if id == loanId { return true }
+    }
+    return false
+}
+
+// remove fundings that can not be closed
+func (eng *Engine) filterDoNotCloseLoans(fundings []uint64) []uint64 {
+    if len(eng.config.DoNotCloseLoanIds) == 0 { return fundings }
+    res := make([]uint64, 0, len(fundings))
+    for _, loanId := range fundings {
+        if eng.isDoNotCloseLoan(loanId) {
+            Logger.Info("Funding ", loanId, " is excluded from closing")
+            continue
+        }
+        res = append(res, loanId)
+    }
+    return res
+}
+
 func (eng *Engine) closeFundings(fundings []uint64) bool {
+    _, ok := eng.closeFundingsTracked(fundings)
+    return ok
+}
+
+// close fundings and return ids of fundings that have been closed
+// (also if closing failed in middle).
+func (eng *Engine) closeFundingsTracked(fundings []uint64) ([]uint64, bool) {
+    return eng.closeFundingsWith(eng.bpriv, fundings)
+}
+
+// close fundings with given API (see closeFundingsTracked).
+func (eng *Engine) closeFundingsWith(api PrivateApi,
+                        fundings []uint64) ([]uint64, bool) {
+    fundings = eng.filterDoNotCloseLoans(fundings)
+    closed := make([]uint64, 0, len(fundings))
     for i, loanId := range fundings {
+        if i!=0 && eng.config.CloseFundingInterval > 0 {
+            eng.clock.Sleep(eng.config.CloseFundingInterval)
+        }
         var op2r Op2Result
-        eng.bpriv.CloseFunding(loanId, &op2r)
+        api.CloseFunding(loanId, &op2r)
         if !op2r.Success {
             Logger.Error("CloseFunding failed:", op2r.Message)
-            return false
+            return closed, false
         }
-        if i!=0 && i%80 == 0 {
-            time.Sleep(time.Minute) // gap between requests
+        closed = append(closed, loanId)
+        eng.publishEvent(eventTopicClose, closeEventPayload(eng.config.Currency, loanId))
+        if i!=0 && i%closeFundingBatchSize == 0 {
+            eng.clock.Sleep(closeFundingBatchPause) // gap between requests
         }
     }
+    return closed, true
+}
+
+// check whether funding trades of order confirm borrowed amount and
+// that effective rate is not higher than max rate.
+func (eng *Engine) verifyBorrowFill(orderId uint64, since time.Time,
+                        expAmount, maxRate godec64.UDec64) bool {
+    trades := eng.bpriv.GetFundingTrades(eng.config.Currency, since, 100)
+    prec := eng.amountPrec()
+    var amount godec64.UDec64
+    var amountRateSum float64
+    for i := 0; i < len(trades); i++ {
+        if trades[i].OfferId != orderId { continue }
+        amount += trades[i].Amount
+        amountRateSum += trades[i].Amount.ToFloat64(prec) * trades[i].Rate.ToFloat64(12)
+    }
+    // amounts of trades can be rounded by exchange - allow one step difference
+    step := eng.orderAmountStep()
+    if amount + step < expAmount || amount > expAmount + step {
+        Logger.Error("Borrowed amount mismatch: ", amount.Format(prec, true), "!=",
+                     expAmount.Format(prec, true))
+        return false
+    }
+    if amount != 0 && amountRateSum / amount.ToFloat64(prec) > maxRate.ToFloat64(12) {
+        Logger.Error("Effective rate is higher than ", maxRate.Format(12, true))
+        return false
+    }
     return true
 }
 
-func (eng *Engine) doBorrowTask(bt *BorrowTask) bool {
+const cancelConfirmAttempts = 5
+
+// wait until canceled order is closed and return amount filled by order.
+func (eng *Engine) confirmCancel(orderId uint64) (godec64.UDec64, bool) {
+    order, ok := eng.closedOrder(orderId)
+    if !ok { return 0, false }
+    if order.Amount > order.AmountOrig { return 0, true }
+    return order.AmountOrig - order.Amount, true
+}
+
+// wait until canceled order is closed and return its final state.
+func (eng *Engine) closedOrder(orderId uint64) (Order, bool) {
+    for i := 0; i < cancelConfirmAttempts; i++ {
+        if i != 0 { eng.clock.Sleep(time.Second) }
+        order, found := eng.bpriv.GetOrder(eng.config.Currency, orderId)
+        if !found || order.Status == OrderActive ||
+                order.Status == OrderPartiallyFilled ||
+                order.Status == OrderUnknown {
+            continue
+        }
+        return order, true
+    }
+    return Order{}, false
+}
+
+// cancel offer left open for retry and return amount filled since last check.
+// returns false if filled amount is unknown.
+func (eng *Engine) cancelRetryOrder() (godec64.UDec64, bool) {
+    oid, remaining := eng.retryOrderId, eng.retryOrderRemaining
+    eng.retryOrderId, eng.retryOrderRemaining = 0, 0
     var opr OpResult
-    Logger.Info("Borrow ", bt.TotalBorrow.Format(8, true), " for ",
-                bt.Rate.Format(10, true))
-    eng.bpriv.SubmitBidOrder(eng.config.Currency, bt.TotalBorrow,
-                            bt.Rate.Mul(1100000000000, 12, true), 2, &opr)
+    Logger.Info("Cancel order ", oid)
+    eng.bpriv.CancelOrder(oid, &opr)
+    left := opr.Order.Amount
     if !opr.Success {
-        Logger.Error("doBorrowTask SubmitBidOrder failed:", opr.Message)
-        return false
+        Logger.Error("CancelOrder failed:", opr.Message)
+        // order can be already closed (for example filled)
+        order, ok := eng.closedOrder(oid)
+        if !ok { return 0, false }
+        left = order.Amount
     }
-    time.Sleep(2*time.Second)
-    // check whether is fully filled
-    orders := eng.bpriv.GetActiveOrders(eng.config.Currency)
-    oidx := 0
-    for ; oidx < len(orders); oidx++ {
-        if opr.Order.Id == orders[oidx].Id { break }
+    if left >= remaining { return 0, true }
+    return remaining - left, true
+}
+
+// amend offer left open by previous attempt to amount and rate (keeps queue
+// priority). returns id of amended offer (0 if there is no offer or update
+// failed) and amount filled by offer that has been canceled after failed
+// update. returns false if filled amount is unknown.
+func (eng *Engine) amendRetryOrder(amount,
+                        rate godec64.UDec64) (uint64, godec64.UDec64, bool) {
+    oid := eng.retryOrderId
+    if oid == 0 { return 0, 0, true }
+    var opr OpResult
+    Logger.Info("Update offer ", oid, " to ", amount.Format(eng.amountPrec(), true),
+                " for ", rate.Format(10, true))
+    eng.taskRequest("UpdateOffer", func(api PrivateApi) {
+        api.UpdateOffer(eng.config.Currency, oid, amount, rate, &opr)
+    })
+    if opr.Success {
+        eng.retryOrderId, eng.retryOrderRemaining = 0, 0
+        return oid, 0, true
+    }
+    Logger.Error("borrowOrder UpdateOffer failed:", opr.Message)
+    filled, ok := eng.cancelRetryOrder()
+    return 0, filled, ok
+}
+
+// result of borrow task
+type BorrowResult struct {
+    // true if amount is below exchange minimum and borrow has been skipped
+    Skipped bool
+    Submitted bool
+    // true if filled amount is known (cancel and fill confirmed)
+    Verified bool
+    Filled godec64.UDec64
+    // fundings to close that have been kept because of partial fill
+    NotClosed []uint64
+    // fundings that have been closed
+    Closed []uint64
+    // filled amount that has not been used to replace fundings
+    // (carried to next attempt)
+    Unused godec64.UDec64
+}
+
+// check amount against exchange minimum. returns amount to borrow (raised to
+// minimum if BumpToExchangeMin) and false if borrow must be skipped.
+func (eng *Engine) exchangeMinAmount(amount godec64.UDec64) (godec64.UDec64, bool) {
+    minAmount, ok := eng.config.ExchangeMinAmounts[eng.config.Currency]
+    if !ok { return amount, true }
+    prec := eng.amountPrec()
+    if prec != defaultAmountPrecision {
+        minAmount = minAmount.Convert(defaultAmountPrecision, prec, true)
+    }
+    if amount >= minAmount { return amount, true }
+    if eng.config.BumpToExchangeMin {
+        Logger.Info("Amount ", amount.Format(prec, true), " below exchange minimum - ",
+                    "raised to ", minAmount.Format(prec, true))
+        return minAmount, true
+    }
+    Logger.Info("Amount ", amount.Format(prec, true), " below exchange minimum ",
+                minAmount.Format(prec, true), " - skip borrow")
+    return amount, false
+}
+
+// get smallest amount step allowed by exchange
+func (eng *Engine) orderAmountStep() godec64.UDec64 {
+    exPrec, ok := eng.config.ExchangeAmountPrecisions[eng.config.Currency]
+    prec := eng.amountPrec()
+    unit := godec64.UDec64(1)
+    if !ok { return unit }
+    for i := exPrec; i < prec; i++ {
+        unit *= 10
+    }
+    return unit
+}
+
+// round amount down to number of decimals allowed by exchange
+func (eng *Engine) roundOrderAmount(amount godec64.UDec64) godec64.UDec64 {
+    unit := eng.orderAmountStep()
+    return amount - amount % unit
+}
+
+// submit borrow order and cancel it if it is not filled after some time.
+// submitted rate is not higher than rateCap (if it is not zero).
+// offer left open by previous attempt is amended instead of new submit and
+// offer of this attempt is left open if keepRetryOrder is set.
+// returns filled amount and true if fill is confirmed.
+func (eng *Engine) borrowOrder(amount, rate, rateCap godec64.UDec64,
+                submitTime time.Time, res *BorrowResult) (godec64.UDec64, bool) {
+    var opr OpResult
+    Logger.Info("Borrow ", amount.Format(eng.amountPrec(), true), " for ",
+                rate.Format(10, true))
+    maxRate := rate.Mul(1100000000000, 12, true)
+    if rateCap != 0 && maxRate > rateCap { maxRate = rateCap }
+    oid, prevFilled, ok := eng.amendRetryOrder(amount, maxRate)
+    if !ok {
+        res.Submitted = true
+        Logger.Error("Fill of previous order not confirmed - skip closing fundings")
+        return 0, false
+    }
+    if prevFilled >= amount {
+        res.Submitted = true
+        return amount, true // filled by previous order
     }
-    if oidx != len(orders) {  // found and then not fully filled
-        time.Sleep(10*time.Second) // for some time
+    amount -= prevFilled
+    if oid == 0 {
+        eng.taskRequest("SubmitBidOrder", func(api PrivateApi) {
+            api.SubmitBidOrder(eng.config.Currency, amount, maxRate, 2, &opr)
+        })
+        if !opr.Success {
+            Logger.Error("doBorrowTask SubmitBidOrder failed:", opr.Message)
+            return prevFilled, false
+        }
+        oid = opr.Order.Id
+    }
+    res.Submitted = true
+    eng.recordTriggerLatency(eng.clock.Now())
+    eng.publishEvent(eventTopicBorrow, borrowEventPayload(eng.config.Currency,
+                oid, amount, rate, eng.amountPrec()))
+    eng.taskSleep(2*time.Second)
+    // check whether is fully filled. private active orders contain also
+    // hidden offers (they are not visible in public orderbook).
+    active := true  // if request failed, state is unknown and order is canceled
+    eng.taskRequest("GetActiveOrders", func(api PrivateApi) {
+        orders := api.GetActiveOrders(eng.config.Currency)
+        active = false
+        for i := 0; i < len(orders); i++ {
+            if oid == orders[i].Id { active = true; break }
+        }
+    })
+    filled := amount
+    if active {  // found and then not fully filled
+        if eng.taskTimedOut() {
+            Logger.Warn("Borrow task timed out - cancel order ", oid, " immediately")
+        } else {
+            eng.taskSleep(10*time.Second) // for some time
+        }
+        if eng.keepRetryOrder && !eng.taskTimedOut() {
+            if remaining, ok := eng.openOrderRemaining(oid); ok && remaining <= amount {
+                // leave offer open - next attempt amends it in place
+                eng.retryOrderId, eng.retryOrderRemaining = oid, remaining
+                return prevFilled + amount - remaining, true
+            }
+        }
         // and cancel
-        oid := opr.Order.Id
         Logger.Info("Cancel order ", oid)
         eng.bpriv.CancelOrder(oid, &opr)
+        if opr.Success && opr.Order.Amount <= filled {
+            filled -= opr.Order.Amount  // remaining amount is not borrowed
+        } else if !opr.Success {
+            Logger.Error("CancelOrder failed:", opr.Message)
+        }
+        // if cancel failed, filled amount is unknown and must be read
+        if eng.config.ConfirmCancel || !opr.Success {
+            // order can be filled between last check and cancel
+            cfilled, ok := eng.confirmCancel(oid)
+            if !ok {
+                Logger.Error("Cancel of order ", oid,
+                             " not confirmed - skip closing fundings")
+                return prevFilled + filled, false
+            }
+            if cfilled != filled {
+                Logger.Info("Filled amount of order ", oid, " after cancel: ",
+                            cfilled.Format(eng.amountPrec(), true))
+            }
+            filled = cfilled
+        }
     } // if fully filled
     
+    if eng.config.VerifyFill &&
+            !eng.verifyBorrowFill(oid, submitTime.Add(-time.Minute), filled, maxRate) {
+        Logger.Error("Fill of order ", oid, " not confirmed - skip closing fundings")
+        return prevFilled + filled, false
+    }
+    return prevFilled + filled, true
+}
+
+// get remaining amount of order if it is still open
+func (eng *Engine) openOrderRemaining(oid uint64) (godec64.UDec64, bool) {
+    var order Order
+    found := false
+    if !eng.taskRequest("GetOrder", func(api PrivateApi) {
+        order, found = api.GetOrder(eng.config.Currency, oid)
+    }) || !found {
+        return 0, false
+    }
+    if order.Status != OrderActive && order.Status != OrderPartiallyFilled {
+        return 0, false
+    }
+    return order.Amount, true
+}
+
+// get FRR multiplied by MaxFRRMultiple. returns zero (no limit) if
+// MaxFRRMultiple is not set or FRR can not be fetched.
+func (eng *Engine) frrRateCap() godec64.UDec64 {
+    if eng.config.MaxFRRMultiple <= 0 { return 0 }
+    var frr godec64.UDec64
+    if !eng.callSafe("getFRR", func() { frr = eng.getFRR() }) || frr == 0 {
+        return 0
+    }
+    return godec64.UDec64(float64(frr) * eng.config.MaxFRRMultiple)
+}
+
+// limit rate to rateCap. rate is not changed if rateCap is zero.
+func capRateByFRR(rate, rateCap godec64.UDec64) godec64.UDec64 {
+    if rateCap == 0 || rate <= rateCap { return rate }
+    Logger.Info("Rate ", rate.Format(10, true), " clamped to ",
+                rateCap.Format(10, true), " (FRR limit)")
+    return rateCap
+}
+
+// do borrow task and close used fundings. returns true if fundings closed.
+func (eng *Engine) doBorrowTask(bt *BorrowTask, res *BorrowResult) bool {
+    return eng.doBorrowTaskCarry(bt, 0, res)
+}
+
+// do borrow task. carry - filled amount of previous attempt that has not been
+// used to replace fundings (it is added to filled amount of this task).
+func (eng *Engine) doBorrowTaskCarry(bt *BorrowTask, carry godec64.UDec64,
+                                     res *BorrowResult) bool {
+    *res = BorrowResult{}
+    submitTime := eng.clock.Now()
+    task := *bt
+    var ok bool
+    task.TotalBorrow = eng.roundOrderAmount(bt.TotalBorrow)
+    if task.TotalBorrow, ok = eng.exchangeMinAmount(task.TotalBorrow); !ok {
+        res.Skipped = true
+        return false
+    }
+    rateCap := eng.frrRateCap()
+    task.Rate = capRateByFRR(task.Rate, rateCap)
+    if task.Rate < eng.config.MinBorrowRate {
+        Logger.Info("Rate ", task.Rate.Format(10, true), " raised to minimal rate ",
+                    eng.config.MinBorrowRate.Format(10, true))
+        task.Rate = eng.config.MinBorrowRate
+    }
+    var filled godec64.UDec64
+    fillKnown := true
+    if eng.config.ChaseDuration > 0 {
+        filled, res.Submitted, fillKnown = eng.chaseOffer(&task, rateCap)
+    }
+    if filled < task.TotalBorrow && !fillKnown {
+        Logger.Warn("Fill of chased offer is unknown - skip borrow of rest")
+        if filled == 0 { return false }
+    } else if filled < task.TotalBorrow && eng.taskTimedOut() {
+        Logger.Warn("Borrow task timed out - skip borrow of rest")
+        if filled == 0 { return false }
+    } else if filled < task.TotalBorrow {
+        // borrow rest with normal order
+        rest := eng.roundOrderAmount(task.TotalBorrow - filled)
+        if amount, ok := eng.exchangeMinAmount(rest); ok {
+            ofilled, ok := eng.borrowOrder(amount, task.Rate, rateCap,
+                                             submitTime, res)
+            if !ok {
+                if filled == 0 { return false }
+                // close only fundings covered by amount borrowed by chase
+                Logger.Warn("Borrow of rest failed - close fundings covered by ",
+                            filled.Format(eng.amountPrec(), true))
+                res.Verified = true
+                res.Filled = filled
+                eng.closeUsedFundings(bt.LoanIdsToClose, task.TotalBorrow, carry, res)
+                return false
+            }
+            filled += ofilled
+        } else if filled == 0 {
+            res.Skipped = true
+            return false
+        }
+    }
+    res.Verified = true
+    res.Filled = filled
+    if eng.config.AutoRenewBorrow && filled != 0 {
+        eng.keepNewCredits(submitTime.Add(-time.Minute))
+    }
     // now close fundings
-    Logger.Info("Close used funding ", bt.LoanIdsToClose)
-    return eng.closeFundings(bt.LoanIdsToClose)
+    return eng.closeUsedFundings(bt.LoanIdsToClose, task.TotalBorrow, carry, res)
+}
+
+// close fundings replaced by borrow of totalBorrow. if borrow is partially
+// filled (res.Filled with carry), then only fundings covered by filled amount
+// are closed. returns true if fundings closed.
+func (eng *Engine) closeUsedFundings(loanIds []uint64, totalBorrow,
+                                     carry godec64.UDec64, res *BorrowResult) bool {
+    filled := res.Filled + carry
+    totalBorrow += carry
+    if filled < totalBorrow && eng.config.MinFillFraction > 0 &&
+            len(loanIds) != 0 {
+        fraction := filled.ToFloat64(eng.amountPrec()) /
+                    totalBorrow.ToFloat64(eng.amountPrec())
+        if fraction < eng.config.MinFillFraction {
+            Logger.Warn("Filled only ", fraction, " of borrow - skip closing fundings")
+            res.NotClosed, res.Unused = loanIds, filled
+            return false
+        }
+    }
+    if filled < totalBorrow {
+        loanIds, res.NotClosed, res.Unused = eng.limitLoansToCloseByFill(loanIds,
+                                            totalBorrow, filled)
+    }
+    if eng.config.RecheckBeforeClose {
+        loanIds = eng.recheckLoansToClose(loanIds)
+    }
+    Logger.Info("Close used funding ", loanIds)
+    var ok bool
+    res.Closed, ok = eng.closeFundingsTracked(loanIds)
+    return ok
+}
+
+// fetch again positions, balances and fundings (positions could change during
+// borrow task) and remove fundings that do not exist anymore or whose closing
+// leaves less funding than positions need.
+func (eng *Engine) recheckLoansToClose(loanIds []uint64) []uint64 {
+    if len(loanIds) == 0 { return loanIds }
+    prec := eng.amountPrec()
+    bals := eng.bpriv.GetMarginBalances()
+    poss := eng.bpriv.GetPositions()
+    var orders []MarginOrder
+    if eng.config.IncludePendingOrders {
+        orders = eng.bpriv.GetActiveMarginOrders()
+    }
+    var poolPrices map[string]godec64.UDec64
+    if len(eng.config.PoolCurrencies) != 0 {
+        poolPrices = eng.getPoolPrices()
+    }
+    if eng.config.UseMarkPrice {
+        poss = eng.withMarkPrices(poss)
+    }
+    totalBorrow := eng.calculateTotalBorrowPooled(poss, bals, orders, poolPrices)
+    if eng.config.UseFundingWalletBalance {
+        totalBorrow = eng.netOfFundingWallet(totalBorrow, eng.bpriv.GetWallets())
+    }
+    
+    // funding after borrow (used and unused)
+    amounts := make(map[uint64]godec64.UDec64)
+    var funding godec64.UDec64
+    for _, c := range eng.bpriv.GetCredits(eng.config.Currency) {
+        amounts[c.Id] = c.Amount
+        funding += c.Amount
+    }
+    for _, l := range eng.bpriv.GetLoans(eng.config.Currency) {
+        amounts[l.Id] = l.Amount
+        funding += l.Amount
+    }
+    res := make([]uint64, 0, len(loanIds))
+    for _, loanId := range loanIds {
+        amount, ok := amounts[loanId]
+        if !ok {
+            Logger.Info("Funding ", loanId, " not found - skip close")
+            continue
+        }
+        if funding < totalBorrow + amount {
+            Logger.Warn("Closing funding ", loanId, " leaves positions under-funded ",
+                        "(funding ", funding.Format(prec, true), ", needed ",
+                        totalBorrow.Format(prec, true), ") - skip close")
+            continue
+        }
+        funding -= amount
+        res = append(res, loanId)
+    }
+    return res
+}
+
+// choose fundings to close after partial fill: filled amount covers first part
+// of borrow that doesn't replace fundings, then fundings (lowest rate first)
+// whose amount fits in rest of filled amount. returns fundings to close,
+// fundings to keep and filled amount left after closing.
+// fundings that do not exist anymore are skipped.
+func (eng *Engine) limitLoansToCloseByFill(loanIds []uint64,
+            totalBorrow, filled godec64.UDec64) ([]uint64, []uint64, godec64.UDec64) {
+    if len(loanIds) == 0 { return loanIds, nil, 0 }
+    creditsMap := make(map[uint64]Credit)
+    for _, c := range eng.bpriv.GetCredits(eng.config.Currency) {
+        creditsMap[c.Id] = c
+    }
+    credits := make([]Credit, 0, len(loanIds))
+    var closeAmount godec64.UDec64
+    for _, loanId := range loanIds {
+        c, ok := creditsMap[loanId]
+        if !ok {
+            Logger.Info("Funding ", loanId, " not found - skip close")
+            continue
+        }
+        credits = append(credits, c)
+        closeAmount += c.Amount
+    }
+    sort.Stable(CreditsSort(credits))
+    // filled amount for replacing fundings
+    var available godec64.UDec64
+    if closeAmount > totalBorrow {
+        available = filled
+    } else if other := totalBorrow - closeAmount; filled > other {
+        available = filled - other
+    }
+    var toClose, notClosed []uint64
+    for _, c := range credits {
+        if c.Amount <= available {
+            available -= c.Amount
+            toClose = append(toClose, c.Id)
+        } else {
+            notClosed = append(notClosed, c.Id)
+        }
+    }
+    if len(notClosed) != 0 {
+        Logger.Info("Partial fill ", filled.Format(eng.amountPrec(), true),
+                    " - keep fundings ", notClosed)
+    } else {
+        available = 0   // nothing to replace in next attempt
+    }
+    return toClose, notClosed, available
+}
+
+const chaseInterval = 5*time.Second
+
+// keep offer below lowest ask and reprice it downward while orderbook moves down
+// (up to ChaseDuration). offer rate is never higher than rate of task and
+// rateCap (if it is not zero).
+// returns borrowed amount, true if any offer has been submitted and false if
+// offer vanished (then borrowed amount contains only last known fill of it).
+func (eng *Engine) chaseOffer(bt *BorrowTask,
+                    rateCap godec64.UDec64) (godec64.UDec64, bool, bool) {
+    prec := eng.amountPrec()
+    // offerRemaining - not filled amount of offer at last check
+    var borrowed, offerAmount, offerRemaining, offerRate godec64.UDec64
+    var orderId uint64
+    submitted, fillKnown := false, true
+    defer atomic.StoreUint64(&eng.chaseOrderId, 0)
+    // cancel current offer and add its filled amount
+    cancelOffer := func() {
+        var opr OpResult
+        Logger.Info("Cancel order ", orderId)
+        eng.bpriv.CancelOrder(orderId, &opr)
+        if opr.Success && opr.Order.Amount <= offerAmount {
+            borrowed += offerAmount - opr.Order.Amount
+        }
+        orderId = 0
+        atomic.StoreUint64(&eng.chaseOrderId, 0)
+    }
+    steps := int(eng.config.ChaseDuration / chaseInterval)
+    for i := 0; i <= steps; i++ {
+        if i != 0 { eng.taskSleep(chaseInterval) }
+        if eng.taskTimedOut() {
+            Logger.Warn("Borrow task timed out - stop chasing")
+            break
+        }
+        if orderId != 0 {
+            var order Order
+            found := true
+            if !eng.taskRequest("GetOrder", func(api PrivateApi) {
+                order, found = api.GetOrder(eng.config.Currency, orderId)
+            }) {
+                continue    // offer is canceled at end
+            }
+            if !found {
+                // fill is unknown - do not submit again (it can over-borrow)
+                Logger.Warn("Chased offer ", orderId, " not found - stop chasing")
+                if offerRemaining <= offerAmount {
+                    borrowed += offerAmount - offerRemaining
+                }
+                orderId = 0
+                atomic.StoreUint64(&eng.chaseOrderId, 0)
+                fillKnown = false
+                break
+            }
+            if order.Status != OrderActive &&
+                    order.Status != OrderPartiallyFilled &&
+                    order.Status != OrderUnknown {
+                // offer closed
+                if order.Amount <= offerAmount {
+                    borrowed += offerAmount - order.Amount
+                }
+                orderId = 0
+                atomic.StoreUint64(&eng.chaseOrderId, 0)
+            } else {
+                offerRemaining = order.Amount
+            }
+        }
+        if borrowed >= bt.TotalBorrow { break }
+        
+        var ob OrderBook
+        eng.getMaxOrderBook(&ob)
+        if len(ob.Ask) == 0 { continue }
+        rate := ob.Ask[0].Rate
+        if eng.config.ChaseStep > 0 {
+            rate = godec64.UDec64(float64(rate) * (1.0 - eng.config.ChaseStep))
+        }
+        if rate > bt.Rate { rate = bt.Rate }
+        if rate < eng.config.MinBorrowRate { rate = eng.config.MinBorrowRate }
+        if rateCap != 0 && rate > rateCap { rate = rateCap }
+        if orderId != 0 {
+            if rate >= offerRate { continue }
+            // reprice downward in place (keeps queue priority)
+            if offerRemaining <= offerAmount {
+                borrowed += offerAmount - offerRemaining
+                offerAmount = offerRemaining
+            }
+            var opr OpResult
+            Logger.Info("Update offer ", orderId, " to ", rate.Format(10, true))
+            eng.taskRequest("UpdateOffer", func(api PrivateApi) {
+                api.UpdateOffer(eng.config.Currency, orderId, offerAmount, rate, &opr)
+            })
+            if opr.Success {
+                offerRate = rate
+                continue
+            }
+            Logger.Error("chaseOffer UpdateOffer failed:", opr.Message)
+            cancelOffer()  // try cancel and submit
+            if borrowed >= bt.TotalBorrow { break }
+        }
+        var opr OpResult
+        offerAmount = bt.TotalBorrow - borrowed
+        Logger.Info("Chase offer ", offerAmount.Format(prec, true), " for ",
+                    rate.Format(10, true))
+        eng.taskRequest("SubmitBidOrder", func(api PrivateApi) {
+            api.SubmitBidOrder(eng.config.Currency, offerAmount, rate, 2, &opr)
+        })
+        if !opr.Success {
+            Logger.Error("chaseOffer SubmitBidOrder failed:", opr.Message)
+            break
+        }
+        eng.recordTriggerLatency(eng.clock.Now())
+        submitted = true
+        eng.publishEvent(eventTopicBorrow, borrowEventPayload(eng.config.Currency,
+                    opr.Order.Id, offerAmount, rate, prec))
+        orderId, offerRate, offerRemaining = opr.Order.Id, rate, offerAmount
+        atomic.StoreUint64(&eng.chaseOrderId, orderId)
+    }
+    if orderId != 0 { cancelOffer() }
+    return borrowed, submitted, fillKnown
+}
+
+// return id of current chased offer or 0 if no offer
+func (eng *Engine) ChaseOrderId() uint64 {
+    return atomic.LoadUint64(&eng.chaseOrderId)
+}
+
+// set keep (auto-renew) for credits created since time.
+func (eng *Engine) keepNewCredits(since time.Time) bool {
+    credits := eng.bpriv.GetCredits(eng.config.Currency)
+    var creditIds []uint64
+    for i := 0; i < len(credits); i++ {
+        if !credits[i].Renew && !credits[i].CreateTime.Before(since) {
+            creditIds = append(creditIds, credits[i].Id)
+        }
+    }
+    if len(creditIds) == 0 { return true }
+    Logger.Info("Keep new funding ", creditIds)
+    var opr Op2Result
+    eng.bpriv.SetKeepCredits(creditIds, true, &opr)
+    if !opr.Success {
+        Logger.Error("Can't keep funding:", opr.Message)
+    }
+    return opr.Success
+}
+
+// prepare task to borrow amount with rate that fills it in orderbook.
+// if orderbook is too small, then borrow only available amount.
+func (eng *Engine) prepareRemainingBorrowTask(ob *OrderBook, amount godec64.UDec64,
+                            loanIds []uint64) BorrowTask {
+    if eng.config.MaxBookConsumptionFraction > 0 {
+        ob = limitOrderBookConsumption(ob, eng.config.MaxBookConsumptionFraction)
+    }
+    task := BorrowTask{ LoanIdsToClose: loanIds }
+    for i := 0; i < len(ob.Ask) && task.TotalBorrow < amount; i++ {
+        task.TotalBorrow += ob.Ask[i].Amount
+        task.Rate = ob.Ask[i].Rate
+    }
+    if task.TotalBorrow > amount { task.TotalBorrow = amount }
+    return task
+}
+
+func (eng *Engine) maxBorrowAttempts() int {
+    if eng.config.MaxBorrowAttempts > 0 { return int(eng.config.MaxBorrowAttempts) }
+    return 1
+}
+
+// check whether amount is lower than minimal order amount. if usdPrice is zero,
+// then price is not available and only MinOrderAmountInCurrency is checked.
+func (eng *Engine) belowMinOrderAmount(amount, usdPrice godec64.UDec64) bool {
+    prec := eng.amountPrec()
+    if eng.config.MinOrderAmountInCurrency != 0 {
+        minAmount := eng.config.MinOrderAmountInCurrency
+        if prec != defaultAmountPrecision {
+            minAmount = minAmount.Convert(defaultAmountPrecision, prec, true)
+        }
+        return amount < minAmount
+    }
+    if usdPrice == 0 { return false }
+    return amount.Mul(usdPrice, prec, true) < eng.config.MinOrderAmount
+}
+
+// message with inputs of decision that borrow is below minimal order amount
+func (eng *Engine) minOrderAmountSkipMessage(amount,
+                                usdPrice godec64.UDec64) string {
+    prec := eng.amountPrec()
+    usdValue := "unknown"
+    if usdPrice != 0 {
+        usdValue = amount.Mul(usdPrice, prec, true).Format(8, true)
+    }
+    var minAmount string
+    if eng.config.MinOrderAmountInCurrency != 0 {
+        minAmount = eng.config.MinOrderAmountInCurrency.Format(8, true) + " " +
+                eng.config.Currency
+    } else {
+        minAmount = eng.config.MinOrderAmount.Format(8, true) + " USD"
+    }
+    return "Skip borrow below min order amount: amount " +
+            amount.Format(prec, true) + " " + eng.config.Currency +
+            ", USD value " + usdValue + ", min order amount " + minAmount
+}
+
+// do borrow task and if it failed or has been partially filled, then borrow
+// remaining amount with fresh orderbook (up to MaxBorrowAttempts attempts).
+// returns confirmed borrowed amount and closed fundings.
+func (eng *Engine) borrowWithRetries(bt BorrowTask,
+            usdPrice godec64.UDec64) (borrowed godec64.UDec64, closed []uint64) {
+    prec := eng.amountPrec()
+    var carry godec64.UDec64    // filled amount not used to replace fundings
+    defer func() {
+        eng.keepRetryOrder = false
+        if eng.retryOrderId != 0 {
+            // no next attempt - cancel offer left open
+            if filled, ok := eng.cancelRetryOrder(); ok { borrowed += filled }
+        }
+    }()
+    for attempt := 1; ; attempt++ {
+        if eng.belowMinOrderAmount(bt.TotalBorrow, usdPrice) {
+            // do nothing if less than min order amount
+            Logger.Info(eng.minOrderAmountSkipMessage(bt.TotalBorrow, usdPrice))
+            return
+        }
+        var res BorrowResult
+        // partially filled offer is amended by next attempt. fill of amended
+        // offer can not be verified by funding trades of single attempt.
+        eng.keepRetryOrder = attempt < eng.maxBorrowAttempts() &&
+                !eng.config.VerifyFill
+        eng.doBorrowTaskCarry(&bt, carry, &res)
+        borrowed += res.Filled
+        closed = append(closed, res.Closed...)
+        if attempt >= eng.maxBorrowAttempts() { return }
+        if eng.taskTimedOut() {
+            Logger.Warn("Borrow task timed out - no retry")
+            return
+        }
+        var remaining godec64.UDec64
+        var loanIds []uint64
+        switch {
+            case res.Skipped:
+                return
+            case !res.Submitted:
+                // fundings not closed, try again whole task
+                remaining, loanIds = bt.TotalBorrow, bt.LoanIdsToClose
+            case res.Verified && res.Filled < bt.TotalBorrow:
+                // replace also fundings kept because of partial fill
+                remaining, loanIds = bt.TotalBorrow - res.Filled, res.NotClosed
+                carry = res.Unused
+            default:
+                return  // done or unknown state
+        }
+        Logger.Info("Retry borrow of ", remaining.Format(prec, true),
+                    " with fresh orderbook")
+        var ob OrderBook
+        eng.getMaxOrderBook(&ob)
+        bt = eng.prepareRemainingBorrowTask(&ob, remaining, loanIds)
+        if len(loanIds) != 0 && bt.TotalBorrow < remaining {
+            Logger.Info("Not enough offers in orderbook to retry borrow")
+            return
+        }
+    }
 }
 
 func (eng *Engine) doCloseUnusedFundings() bool {
     loans := eng.bpriv.GetLoans(eng.config.Currency)
+    if len(loans) == 0 { return true }    // nothing to close
     Logger.Info("Close unused funding ", loans)
     loanIds := make([]uint64, len(loans))
     for i := 0; i < len(loanIds); i++ {
@@ -471,18 +2661,158 @@ func (eng *Engine) doCloseUnusedFundings() bool {
 }
 
 func (eng *Engine) doCloseUnusedFundingsSafe() bool {
-    defer func() {
-        if x := recover(); x!=nil {
-            Logger.Error("Panic in doCloseUnusedFundings:", x)
+    var ok bool
+    eng.callSafe("doCloseUnusedFundings", func() { ok = eng.doCloseUnusedFundings() })
+    return ok
+}
+
+// close unused fundings at start of auto loan period if it is enabled.
+// returns false if closing failed.
+func (eng *Engine) closeUnusedFundingsAtPeriodStart() bool {
+    if !eng.config.CloseUnusedFundings {
+        Logger.Debug("Closing unused fundings is disabled")
+        return true
+    }
+    return eng.doCloseUnusedFundingsSafe()
+}
+
+// check whether account has enough margin to borrow more
+func (eng *Engine) marginSufficient() bool {
+    mi := eng.taskApi().GetMarginInfo()
+    if mi.MarginNet <= mi.RequiredMargin {
+        Logger.Warn("Insufficient margin - skip borrow task: net ",
+                    mi.MarginNet.Format(8, true), " USD, required ",
+                    mi.RequiredMargin.Format(8, true), " USD")
+        return false
+    }
+    return true
+}
+
+// return true if current borrow task exceeded TaskTimeout
+// (must be called under taskMutex)
+func (eng *Engine) taskTimedOut() bool {
+    return !eng.taskDeadline.IsZero() && !eng.clock.Now().Before(eng.taskDeadline)
+}
+
+// sleep in borrow task, but not longer than to deadline of task
+func (eng *Engine) taskSleep(d time.Duration) {
+    if !eng.taskDeadline.IsZero() {
+        if remaining := eng.taskDeadline.Sub(eng.clock.Now()); remaining < d {
+            if remaining < 0 { remaining = 0 }
+            d = remaining
         }
-    }()
-    return eng.doCloseUnusedFundings()
+    }
+    eng.clock.Sleep(d)
+}
+
+// get private API for requests of borrow task: requests end at deadline
+// of task. canceling offers and closing fundings after borrow use API without
+// deadline, because they must be done also after timeout. (must be called under taskMutex)
+func (eng *Engine) taskApi() PrivateApi {
+    if eng.taskBpriv!=nil { return eng.taskBpriv }
+    return eng.bpriv
+}
+
+// do request of borrow task with task API. returns false if request failed
+// (for example, it has not been finished before deadline of task).
+func (eng *Engine) taskRequest(name string, f func(api PrivateApi)) bool {
+    err, _ := recoverCall(func() { f(eng.taskApi()) })
+    if err==nil { return true }
+    eng.handlePanicError(name, err)
+    return false
 }
 
 func (eng *Engine) makeBorrowTask(t time.Time) {
+    eng.makeTriggeredBorrowTask(t, time.Time{})
+}
+
+// record latency between orderbook trigger and first submit of borrow order
+// in task (must be called under taskMutex)
+func (eng *Engine) recordTriggerLatency(now time.Time) {
+    if eng.taskTrigger.IsZero() { return }
+    d := now.Sub(eng.taskTrigger)
+    eng.taskTrigger = time.Time{}   // only first submit
+    eng.triggerLatency.add(d)
+    Logger.Info("Trigger to submit latency: ", d, " (", &eng.triggerLatency, ")")
+}
+
+// make borrow task triggered by orderbook at trigger time (zero if not triggered)
+func (eng *Engine) makeTriggeredBorrowTask(t, trigger time.Time) {
     eng.taskMutex.Lock()
     defer eng.taskMutex.Unlock()
-    credits := eng.bpriv.GetCredits(eng.config.Currency)
+    eng.makeBorrowTaskLocked(t, trigger)
+}
+
+// cancel all active offers and make borrow task with fresh data and
+// orderbook (for example after change of config). Other tasks can not run
+// between cancel and new offers. returns number of canceled offers.
+// nothing is canceled if engine is paused (no new offers would be made).
+func (eng *Engine) RepriceAll() int {
+    eng.taskMutex.Lock()
+    defer eng.taskMutex.Unlock()
+    if eng.IsPaused() {
+        Logger.Info("Engine paused - skip reprice")
+        return 0
+    }
+    orders := eng.bpriv.GetActiveOrders(eng.config.Currency)
+    canceled := 0
+    for i := 0; i < len(orders); i++ {
+        var opr OpResult
+        Logger.Info("Reprice: cancel order ", orders[i].Id)
+        eng.bpriv.CancelOrder(orders[i].Id, &opr)
+        if !opr.Success {
+            Logger.Error("RepriceAll CancelOrder failed:", opr.Message)
+            continue
+        }
+        canceled++
+    }
+    eng.dropPrefetchData()  // prefetched data can be stale
+    eng.makeBorrowTaskLocked(eng.clock.Now(), time.Time{})
+    return canceled
+}
+
+func (eng *Engine) RepriceAllSafe() {
+    // no retry - offers can be already canceled
+    if err, _ := recoverCall(func() { eng.RepriceAll() }); err!=nil {
+        eng.handlePanicError("RepriceAll", err)
+    }
+}
+
+// make borrow task (must be called under taskMutex)
+func (eng *Engine) makeBorrowTaskLocked(t, trigger time.Time) {
+    eng.taskTrigger = trigger
+    defer func() { eng.taskTrigger = time.Time{} }()
+    if eng.config.TaskTimeout > 0 {
+        // single deadline for task and its requests
+        eng.taskDeadline = eng.clock.Now().Add(eng.config.TaskTimeout)
+        eng.taskBpriv = eng.bpriv.WithDeadline(eng.taskDeadline)
+        defer func() {
+            eng.taskDeadline = time.Time{}
+            eng.taskBpriv = nil
+        }()
+    }
+    if eng.IsPaused() {
+        Logger.Info("Engine paused - skip borrow task")
+        return
+    }
+    if eng.config.CheckMargin && !eng.marginSufficient() {
+        return
+    }
+    var credits []Credit
+    var bals []Balance
+    var poss []Position
+    if pd := eng.takePrefetchData(eng.clock.Now()); pd!=nil {
+        Logger.Debug("Use prefetched data from ", pd.time)
+        credits, bals, poss = pd.credits, pd.bals, pd.poss
+    } else {
+        api := eng.taskApi()
+        credits = api.GetCredits(eng.config.Currency)
+        bals = api.GetMarginBalances()
+        poss = api.GetPositions()
+    }
+    // orderbook is always fresh (rates change too fast to reuse it)
+    var ob OrderBook
+    eng.getMaxOrderBook(&ob)
     
     // outCredits - all credits with already expired
     outCredits := make([]Credit, 0, len(credits))
@@ -495,49 +2825,368 @@ func (eng *Engine) makeBorrowTask(t time.Time) {
         }
     }
     
-    bals := eng.bpriv.GetMarginBalances()
-    poss := eng.bpriv.GetPositions()
-    totalBorrow := eng.calculateTotalBorrow(poss, bals)
-    var ob OrderBook
-    eng.df.GetPublic().GetMaxOrderBook(eng.config.Currency, &ob)
+    if eng.config.CloseOrphanCredits {
+        // only current credits (credits remembered from start of period
+        // can be already expired or closed)
+        outCredits = eng.closeOrphanCredits(outCredits, credits, poss)
+    }
+    
+    var orders []MarginOrder
+    if eng.config.IncludePendingOrders {
+        orders = eng.taskApi().GetActiveMarginOrders()
+    }
+    var poolPrices map[string]godec64.UDec64
+    if len(eng.config.PoolCurrencies) != 0 {
+        poolPrices = eng.getPoolPrices()
+    }
+    if eng.config.UseMarkPrice {
+        poss = eng.withMarkPrices(poss)
+    }
+    totalBorrow := eng.calculateTotalBorrowPooled(poss, bals, orders, poolPrices)
+    if eng.config.UseFundingWalletBalance {
+        totalBorrow = eng.netOfFundingWallet(totalBorrow, eng.taskApi().GetWallets())
+    }
     bt := eng.prepareBorrowTask(&ob, outCredits, totalBorrow, t)
-    if bt.TotalBorrow.Mul(eng.df.GetUSDPrice(), 8, true) < eng.config.MinOrderAmount {
-        return // do nothing if less than min order amount
+    if eng.config.IncrementalBorrow {
+        var ok bool
+        if bt, ok = eng.nextIncrementalTask(&ob, bt, outCredits); !ok {
+            return
+        }
+    }
+    if eng.taskTimedOut() {
+        Logger.Warn("Borrow task timed out before borrow - abort")
+        return
+    }
+    var usdPrice godec64.UDec64
+    if eng.df.IsUSDPrice() {
+        var ok bool
+        if usdPrice, ok = eng.freshUSDPrice(); !ok { return }
+    } else if eng.config.MinOrderAmountInCurrency == 0 &&
+            eng.config.MinOrderAmount != 0 {
+        Logger.Warn("No USD price for ", eng.config.Currency,
+                    " - MinOrderAmount is not checked")
+    }
+    borrowed, closed := eng.borrowWithRetries(bt, usdPrice)
+    if eng.config.IncrementalBorrow {
+        eng.incBorrow.update(borrowed, closed)
     }
-    eng.doBorrowTask(&bt)
 }
 
-func (eng *Engine) makeBorrowTaskSafe(t time.Time) {
-    defer func() {
-        if x := recover(); x!=nil {
-            Logger.Error("Panic in makeBorrowTask:", x)
+// get USD price for MinOrderAmount check. price older than MaxPriceAge is
+// refreshed by HTTP. returns false if price is stale and can't be refreshed.
+func (eng *Engine) freshUSDPrice() (godec64.UDec64, bool) {
+    if eng.config.MaxPriceAge > 0 {
+        age := eng.df.USDPriceAge(eng.clock.Now())
+        if age > eng.config.MaxPriceAge {
+            Logger.Warn("USD price of ", eng.config.Currency, " is stale (age ",
+                        age.Round(time.Second), ") - refresh")
+            if err, _ := recoverCall(eng.df.RefreshUSDPrice); err!=nil {
+                Logger.Warn("Can't refresh USD price: ", err, " - skip borrow task")
+                return 0, false
+            }
         }
+    }
+    return eng.df.GetUSDPrice(), true
+}
+
+// get credits whose market has no open position (position has been closed,
+// so credit is not needed). credits without market are not orphans.
+func (eng *Engine) orphanCredits(credits []Credit, poss []Position) []Credit {
+    posMarkets := make(map[string]bool, len(poss))
+    for i := 0; i < len(poss); i++ {
+        if poss[i].IsActive() { posMarkets[poss[i].Market] = true }
+    }
+    var orphans []Credit
+    for i := 0; i < len(credits); i++ {
+        if credits[i].Market == "" || posMarkets[credits[i].Market] ||
+                eng.isDoNotCloseLoan(credits[i].Id) {
+            continue
+        }
+        orphans = append(orphans, credits[i])
+    }
+    return orphans
+}
+
+// close orphan credits found in current credits and return remaining credits.
+// positions can be prefetched, so orphans are checked again with current
+// positions before closing (position may be opened in meantime).
+// closing is done by task API, hence it ends at deadline of task.
+func (eng *Engine) closeOrphanCredits(credits, current []Credit,
+                        poss []Position) []Credit {
+    orphans := eng.orphanCredits(current, poss)
+    if len(orphans) == 0 { return credits }
+    orphans = eng.orphanCredits(orphans, eng.taskApi().GetPositions())
+    if len(orphans) == 0 { return credits }
+    orphanIds := make([]uint64, len(orphans))
+    for i := 0; i < len(orphans); i++ {
+        orphanIds[i] = orphans[i].Id
+    }
+    Logger.Info("Close credits without position ", orphanIds)
+    // remove only closed credits - some credits can be still open
+    closed, _ := eng.closeFundingsWith(eng.taskApi(), orphanIds)
+    if len(closed) == 0 { return credits }
+    rest := make([]Credit, 0, len(credits))
+    for i := 0; i < len(credits); i++ {
+        isClosed := false
+        for _, id := range closed {
+            if credits[i].Id == id { isClosed = true; break }
+        }
+        if !isClosed { rest = append(rest, credits[i]) }
+    }
+    return rest
+}
+
+// state of incremental borrow in auto loan period
+type incrementalBorrow struct {
+    target BorrowTask   // task prepared at first tick
+    loanAmounts []godec64.UDec64    // amounts of loans to close of target
+    borrowed godec64.UDec64
+    closed map[uint64]bool  // closed loans of target
+}
+
+// add borrowed amount and loans closed in tick
+func (ib *incrementalBorrow) update(borrowed godec64.UDec64, closed []uint64) {
+    ib.borrowed += borrowed
+    if ib.borrowed > ib.target.TotalBorrow { ib.borrowed = ib.target.TotalBorrow }
+    for _, id := range closed {
+        ib.closed[id] = true
+    }
+}
+
+// prepare task for current tick: part of target (up to IncrementalBorrowStep).
+// target is prepared at first tick of auto loan period. returns false if
+// target is reached or rate in orderbook is higher than rate of target.
+func (eng *Engine) nextIncrementalTask(ob *OrderBook, bt BorrowTask,
+                                       credits []Credit) (BorrowTask, bool) {
+    prec := eng.amountPrec()
+    if eng.incBorrow == nil {
+        if bt.TotalBorrow == 0 { return bt, false }
+        ib := &incrementalBorrow{ target: bt,
+                loanAmounts: make([]godec64.UDec64, len(bt.LoanIdsToClose)),
+                closed: make(map[uint64]bool) }
+        for i, id := range bt.LoanIdsToClose {
+            for j := 0; j < len(credits); j++ {
+                if credits[j].Id == id { ib.loanAmounts[i] = credits[j].Amount }
+            }
+        }
+        eng.incBorrow = ib
+        Logger.Info("Incremental borrow target: ", bt.TotalBorrow.Format(prec, true))
+    }
+    ib := eng.incBorrow
+    if ib.borrowed >= ib.target.TotalBorrow {
+        return BorrowTask{}, false  // target reached
+    }
+    if len(ob.Ask) == 0 || ob.Ask[0].Rate > ib.target.Rate {
+        return BorrowTask{}, false  // not favorable
+    }
+    step := eng.config.IncrementalBorrowStep
+    if prec != defaultAmountPrecision {
+        step = step.Convert(defaultAmountPrecision, prec, true)
+    }
+    amount := ib.target.TotalBorrow - ib.borrowed
+    if amount > step { amount = step }
+    // close loans covered by borrowed amount after this tick
+    // (loans closed in previous ticks are skipped)
+    var loanIds []uint64
+    var covered godec64.UDec64
+    for i := 0; i < len(ib.loanAmounts); i++ {
+        covered += ib.loanAmounts[i]
+        if covered > ib.borrowed + amount { break }
+        if id := ib.target.LoanIdsToClose[i]; !ib.closed[id] {
+            loanIds = append(loanIds, id)
+        }
+    }
+    task := eng.prepareRemainingBorrowTask(ob, amount, loanIds)
+    if task.Rate > ib.target.Rate { task.Rate = ib.target.Rate }
+    Logger.Info("Incremental borrow ", task.TotalBorrow.Format(prec, true), " of ",
+                (ib.target.TotalBorrow - ib.borrowed).Format(prec, true))
+    return task, true
+}
+
+// data fetched at start of auto loan period and reused by first borrow task.
+// orderbook is not prefetched.
+type prefetchData struct {
+    time time.Time
+    credits []Credit
+    poss []Position
+    bals []Balance
+}
+
+const defaultWarmPrefetchTTL = 30*time.Second
+
+func (eng *Engine) warmPrefetchTTL() time.Duration {
+    if eng.config.WarmPrefetchTTL > 0 { return eng.config.WarmPrefetchTTL }
+    return defaultWarmPrefetchTTL
+}
+
+func (eng *Engine) prefetchPeriodData() {
+    pd := &prefetchData{ time: eng.clock.Now() }
+    pd.credits = eng.bpriv.GetCredits(eng.config.Currency)
+    pd.poss = eng.bpriv.GetPositions()
+    pd.bals = eng.bpriv.GetMarginBalances()
+    eng.prefetchMutex.Lock()
+    eng.prefetch = pd
+    eng.prefetchMutex.Unlock()
+}
+
+func (eng *Engine) prefetchPeriodDataSafe() {
+    eng.callSafe("prefetchPeriodData", eng.prefetchPeriodData)
+}
+
+// take prefetched data if they are fresh. data are used only once, because
+// they are outdated after borrow.
+func (eng *Engine) takePrefetchData(now time.Time) *prefetchData {
+    eng.prefetchMutex.Lock()
+    pd := eng.prefetch
+    eng.prefetch = nil
+    eng.prefetchMutex.Unlock()
+    if pd==nil || now.Sub(pd.time) > eng.warmPrefetchTTL() { return nil }
+    return pd
+}
+
+// drop prefetched data, so next borrow task fetches fresh data
+func (eng *Engine) dropPrefetchData() {
+    eng.prefetchMutex.Lock()
+    eng.prefetch = nil
+    eng.prefetchMutex.Unlock()
+}
+
+func (eng *Engine) makeBorrowTaskSafe(t, trigger time.Time) {
+    // no retry - borrow task can be partially done
+    if err, _ := recoverCall(func() {
+        eng.makeTriggeredBorrowTask(t, trigger)
+    }); err!=nil {
+        eng.handlePanicError("makeBorrowTask", err)
+    }
+}
+
+// start borrow task if no other task is running or in cooldown.
+// If TaskCooldown is set, many tasks can be done in single auto loan period
+// (if rates improve further), but a next task can be started only after
+// cooldown since end of previous. Otherwise only single task is done in period.
+// Return true if task started.
+func (eng *Engine) startBorrowTask(t time.Time) bool {
+    return eng.startTriggeredBorrowTask(t, time.Time{})
+}
+
+// start borrow task triggered by orderbook change at trigger time
+func (eng *Engine) startTriggeredBorrowTask(t, trigger time.Time) bool {
+    if !atomic.CompareAndSwapUint32(&eng.btDone, 0, 1) {
+        return false
+    }
+    eng.btMutex.Lock()
+    period := eng.btPeriod
+    eng.btMutex.Unlock()
+    go func() {
+        eng.makeBorrowTaskSafe(t, trigger)
+        if eng.config.TaskCooldown <= 0 {
+            return  // next task in next period
+        }
+        cooldownTimer := eng.clock.NewTimer(eng.config.TaskCooldown)
+        select {
+            case <-cooldownTimer.C():
+            case <-eng.stopCh:
+                cooldownTimer.Stop()
+                return
+        }
+        eng.btMutex.Lock()
+        defer eng.btMutex.Unlock()
+        // new period already enabled tasks
+        if eng.btPeriod != period { return }
+        atomic.StoreUint32(&eng.btDone, 0)
     }()
-    eng.makeBorrowTask(t)
+    return true
 }
 
-// return old credits
-func (eng *Engine) printCurrentFundingSummary() []Credit {
-    credits := eng.bpriv.GetCredits(eng.config.Currency)
+// allow borrow tasks in new auto loan period. cooldown of task started
+// in previous period will not affect new period.
+func (eng *Engine) startTaskPeriod() {
+    eng.btMutex.Lock()
+    defer eng.btMutex.Unlock()
+    eng.btPeriod++
+    atomic.StoreUint32(&eng.btDone, 0)
+}
+
+// get average remaining period of credits (in days) weighted by amounts.
+// expired credits have zero remaining period.
+func weightedAvgRemainingPeriod(credits []Credit, now time.Time) float64 {
+    var amountDaysSum, amountSum float64 = 0, 0
+    for i := 0; i < len(credits); i++ {
+        amount := credits[i].Amount.ToFloat64(amountPrecision(credits[i].Currency))
+        expireTime := credits[i].CreateTime.Add(
+                    24*time.Hour*time.Duration(credits[i].Period))
+        remaining := expireTime.Sub(now).Hours() / 24
+        if remaining < 0 { remaining = 0 }
+        amountDaysSum += amount*remaining
+        amountSum += amount
+    }
+    if amountSum == 0 { return 0 }
+    return amountDaysSum / amountSum
+}
+
+// summary of current funding (average rate and total amount)
+func (eng *Engine) fundingSummaryMessage(credits []Credit, now time.Time) string {
     var amountRateSum, amountSum float64 = 0, 0
     for i := 0; i < len(credits); i++ {
-        amount := credits[i].Amount.ToFloat64(8)
+        amount := credits[i].Amount.ToFloat64(eng.amountPrec())
         rate := credits[i].Rate.ToFloat64(12)
         amountRateSum += amount*rate;
         amountSum += amount
     }
-    Logger.Info("Current funding rate: ", amountRateSum / amountSum * 100.0,
-                ", total: ", amountSum)
+    if amountSum == 0 {
+        return "Current funding: no funding"
+    }
+    return fmt.Sprint("Current funding rate: ", amountRateSum / amountSum * 100.0,
+                      ", total: ", amountSum, ", avg remaining period: ",
+                      strconv.FormatFloat(weightedAvgRemainingPeriod(credits, now),
+                                          'f', 2, 64), " days")
+}
+
+func (eng *Engine) printCurrentFundingSummary() []Credit {
+    credits := eng.bpriv.GetCredits(eng.config.Currency)
+    Logger.Info(eng.fundingSummaryMessage(credits, eng.clock.Now()))
     return credits
 }
 
 func (eng *Engine) printCurrentFundingSummarySafe() []Credit {
-    defer func() {
-        if x := recover(); x!=nil {
-            Logger.Error("Panic in printCurrentFundingSummary:", x)
-        }
-    }()
-    return eng.printCurrentFundingSummary()
+    var credits []Credit
+    eng.callSafe("printCurrentFundingSummary", func() {
+        credits = eng.printCurrentFundingSummary()
+    })
+    return credits
+}
+
+func (eng *Engine) depthSummaryMessage(ds *DepthSummary) string {
+    prec := eng.amountPrec()
+    var sb strings.Builder
+    sb.WriteString("Orderbook depth: asks ")
+    sb.WriteString(ds.TotalAsk.Format(prec, true))
+    sb.WriteString(", bids ")
+    sb.WriteString(ds.TotalBid.Format(prec, true))
+    sb.WriteString(", ask rates")
+    for i, p := range depthSummaryPercentiles {
+        sb.WriteString(" ")
+        sb.WriteString(strconv.Itoa(int(p*100)))
+        sb.WriteString("%:")
+        sb.WriteString(ds.AskRates[i].Format(12, true))
+    }
+    return sb.String()
+}
+
+func (eng *Engine) logDepthSummarySafe() {
+    eng.callSafe("logDepthSummary", func() {
+        ob := eng.df.GetOrderBook()
+        if ob == nil { return }
+        ds := ob.DepthSummary()
+        Logger.Info(eng.depthSummaryMessage(&ds))
+    })
+}
+
+// get time of borrow task before end of auto loan period (at alPeriodTime+alDur)
+// with random jitter (100 ms - 60.1 s before end)
+func taskTimeInPeriod(alPeriodTime time.Time, alDur time.Duration) time.Time {
+    return alPeriodTime.Add(alDur -
+            (time.Duration(getRandom(60000))+100)*time.Millisecond)
 }
 
 // return true if auto loan period passed, otherwise if engine stopped.
@@ -545,45 +3194,91 @@ func (eng *Engine) handleAutoLoanPeriod(alPeriodTime time.Time) bool {
     alDur := eng.config.AutoLoanFetchEndShift - eng.config.AutoLoanFetchShift
     if alDur < 0 { alDur = eng.config.AutoLoanFetchPeriod + alDur }
     Logger.Debug("ALEndTime:", alPeriodTime.Add(alDur), alDur)
-    alEndTimer := time.NewTimer(alPeriodTime.Add(alDur).Sub(time.Now()))
+    alEndTimer := eng.clock.NewTimer(alPeriodTime.Add(alDur).Sub(eng.clock.Now()))
     defer alEndTimer.Stop()
-    taskTimer := time.NewTimer(alPeriodTime.Add(alDur -
-            (time.Duration(getRandom(60000))+100)*time.Millisecond).Sub(time.Now()))
+    taskTimer := eng.clock.NewTimer(
+            taskTimeInPeriod(alPeriodTime, alDur).Sub(eng.clock.Now()))
     defer taskTimer.Stop()
     
-    eng.doCloseUnusedFundingsSafe()
+    marketsUpdateTime := time.Unix(0, atomic.LoadInt64(&eng.marketsUpdateTime))
+    if eng.clock.Now().Sub(marketsUpdateTime) >= marketsRefreshPeriod {
+        eng.prepareMarketsSafe()
+    }
+    eng.closeUnusedFundingsAtPeriodStart()
     // prepare credits map for credits before expiring
     alCredits := eng.printCurrentFundingSummarySafe()
     eng.alCreditsMap = make(map[uint64]Credit)
     for i := 0; i < len(alCredits); i++ {
         eng.alCreditsMap[alCredits[i].Id] = alCredits[i]
     }
+    eng.logDepthSummarySafe()
+    
+    // new target of incremental borrow in every auto loan period
+    eng.taskMutex.Lock()
+    eng.incBorrow = nil
+    eng.taskMutex.Unlock()
     
     // clear last orderbook before new auto loan period
     eng.lastObMutex.Lock()
     eng.lastOb = nil
     eng.lastObMutex.Unlock()
     
-    atomic.StoreUint32(&eng.btDone, 0)
+    if !eng.config.inActiveHours(alPeriodTime) {
+        Logger.Info("Outside active hours - skip borrowing")
+        select {
+            case <-alEndTimer.C():
+                return true
+            case <-eng.stopCh:
+                return false
+        }
+    }
+    
+    if eng.config.WarmPrefetch {
+        eng.prefetchPeriodDataSafe()
+    }
+    eng.startTaskPeriod()
+    var observeCh <-chan time.Time
+    if eng.config.ObservePhase > 0 {
+        // get fresh last orderbook before triggering borrow tasks
+        atomic.StoreUint32(&eng.observing, 1)
+        observeTimer := eng.clock.NewTimer(eng.config.ObservePhase)
+        defer observeTimer.Stop()
+        observeCh = observeTimer.C()
+    }
+    defer atomic.StoreUint32(&eng.observing, 0)
     atomic.StoreUint32(&eng.checkOBEnabled, 1)
     defer atomic.StoreUint32(&eng.checkOBEnabled, 0)
     for {
         select {
-            case t := <-taskTimer.C:
-                if atomic.CompareAndSwapUint32(&eng.btDone, 0, 1) {
-                    go eng.makeBorrowTaskSafe(t)
+            case <-observeCh:
+                atomic.StoreUint32(&eng.observing, 0)
+                Logger.Debug("End of observe phase")
+            case t := <-taskTimer.C():
+                if !eng.IsPaused() {
+                    eng.startBorrowTask(t)
                 }
-            case <-alEndTimer.C:
+            case <-alEndTimer.C():
                 return true
             case <-eng.stopCh:
                 return false
         }
     }
-    return true
+}
+
+// wait for duration. returns false if engine has been stopped.
+func (eng *Engine) waitOrStop(d time.Duration) bool {
+    timer := eng.clock.NewTimer(d)
+    defer timer.Stop()
+    select {
+        case <-timer.C():
+            return true
+        case <-eng.stopCh:
+            return false
+    }
 }
 
 func (eng *Engine) mainRoutine() {
-    now := time.Now()
+    now := eng.clock.Now()
     alPeriodTime := now.Truncate(eng.config.AutoLoanFetchPeriod).
                 Add(eng.config.AutoLoanFetchShift)
     
@@ -591,10 +3286,10 @@ func (eng *Engine) mainRoutine() {
     for {
         Logger.Debug("periodtime:", alPeriodTime, alPeriodTime.After(now))
         if alPeriodTime.After(now) { // go to back
-            time.Sleep(alPeriodTime.Sub(now))
+            if !eng.waitOrStop(alPeriodTime.Sub(now)) { break }
         }
         if !eng.handleAutoLoanPeriod(alPeriodTime) { break }
         alPeriodTime = alPeriodTime.Add(eng.config.AutoLoanFetchPeriod)
-        now = time.Now()
+        now = eng.clock.Now()
     }
 }
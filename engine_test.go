@@ -23,8 +23,18 @@
 package main
 
 import (
+    "bytes"
+    "io"
+    "math"
+    "math/rand"
+    "os"
+    "reflect"
+    "strings"
+    "sync"
+    "sync/atomic"
     "time"
     "github.com/matszpk/godec64"
+    "github.com/valyala/fastjson"
     "testing"
 )
 
@@ -38,20 +48,22 @@ func getTestEngine0() *Engine {
             Currency: "UST", AutoLoanFetchPeriod: 20*time.Minute,
             AutoLoanFetchShift: 15*time.Minute,
             AutoLoanFetchEndShift: 9*time.Minute + 20*time.Second,
-            MinRateDifference: 0.2, MinOrderAmount: 150 },
+            MinRateDifference: 0.2, MinOrderAmount: 150,
+            RollExpiringCredits: true },
+        clock: realClock{},
     }
 }
 
 func TestCalculateTotalBorrow(t *testing.T) {
     eng := getTestEngine0()
     poss := []Position{
-        Position{ Market: "BTCUST", Amount: 155000000,
+        Position{ Status: "ACTIVE", Market: "BTCUST", Amount: 155000000,
             BasePrice: 211000000000, Long: true },
-        Position{ Market: "BTCUSD", Amount: 452000000,
+        Position{ Status: "ACTIVE", Market: "BTCUSD", Amount: 452000000,
             BasePrice: 661000000000, Long: true },
-        Position{ Market: "ADAUST", Amount: 1355000000,
+        Position{ Status: "ACTIVE", Market: "ADAUST", Amount: 1355000000,
             BasePrice: 140000000000, Long: true },
-        Position{ Market: "USTUSD", Amount: 2334000000,
+        Position{ Status: "ACTIVE", Market: "USTUSD", Amount: 2334000000,
             BasePrice: 99100000, Long: false } }
     bals := []Balance{
         Balance{ Currency: "UST", Total: 120000000 },
@@ -70,6 +82,248 @@ func TestCalculateTotalBorrow(t *testing.T) {
     }
 }
 
+func TestCalculateTotalBorrowInactivePositions(t *testing.T) {
+    eng := getTestEngine0()
+    poss := []Position{
+        Position{ Status: "ACTIVE", Market: "BTCUST", Amount: 155000000,
+            BasePrice: 211000000000, Long: true },
+        Position{ Status: "CLOSED", Market: "ADAUST", Amount: 1355000000,
+            BasePrice: 140000000000, Long: true } }
+    expTotBorrow := eng.calculateTotalBorrow(poss[:1], nil)
+    if resTotBorrow := eng.calculateTotalBorrow(poss, nil);
+            expTotBorrow != resTotBorrow {
+        t.Errorf("TotBorrow mismatch: %v!=%v", expTotBorrow, resTotBorrow)
+    }
+    if expTotBorrow != 327050000000 {
+        t.Errorf("TotBorrow mismatch: %v!=327050000000", expTotBorrow)
+    }
+}
+
+func TestCalculateTotalBorrowUncoveredPositions(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.WarnUncoveredPositions = true
+    var out bytes.Buffer
+    Logger.SetOutput(&out)
+    defer Logger.SetOutput(os.Stdout)
+    poss := []Position{
+        Position{ Status: "ACTIVE", Market: "BTCUST", Amount: 155000000,
+            BasePrice: 211000000000, Long: true },
+        // market of other currencies
+        Position{ Status: "ACTIVE", Market: "ETHBTC", Amount: 1355000000,
+            BasePrice: 7000000, Long: true },
+        // derivative settled in other currency
+        Position{ Status: "ACTIVE", Market: "BTCF0:EUTF0", Type: PositionDerivative,
+            Amount: 10000000, BasePrice: 4000000000000, Collateral: 10000000000 } }
+    if resTotBorrow := eng.calculateTotalBorrow(poss, nil);
+            resTotBorrow != 327050000000 {
+        t.Errorf("TotBorrow mismatch: %v!=327050000000", resTotBorrow)
+    }
+    if !strings.Contains(out.String(),
+            "Positions not funded in UST are ignored: ETHBTC,BTCF0:EUTF0") {
+        t.Errorf("No warning about uncovered position: %q", out.String())
+    }
+    // no warning without option
+    out.Reset()
+    eng.config.WarnUncoveredPositions = false
+    eng.calculateTotalBorrow(poss, nil)
+    if strings.Contains(out.String(), "ETHBTC") {
+        t.Errorf("Warning without option: %q", out.String())
+    }
+}
+
+func TestCalculateTotalBorrowMarkPrice(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.getMarketPrices = func(markets []string) map[string]godec64.UDec64 {
+        return map[string]godec64.UDec64{ "BTCUST": 250000000000 }
+    }
+    poss := []Position{
+        Position{ Status: "ACTIVE", Market: "BTCUST", Amount: 155000000,
+            BasePrice: 211000000000, Long: true },
+        // no market price - base price is used
+        Position{ Status: "ACTIVE", Market: "ADAUST", Amount: 1000000000,
+            BasePrice: 100000000, Long: true } }
+    if resTotBorrow := eng.calculateTotalBorrow(poss, nil);
+            resTotBorrow != 328050000000 {
+        t.Errorf("TotBorrow mismatch: %v!=328050000000", resTotBorrow)
+    }
+    markPoss := eng.withMarkPrices(poss)
+    if resTotBorrow := eng.calculateTotalBorrow(markPoss, nil);
+            resTotBorrow != 388500000000 {
+        t.Errorf("TotBorrow mismatch: %v!=388500000000", resTotBorrow)
+    }
+    if poss[0].BasePrice != 211000000000 {
+        t.Errorf("Original positions changed")
+    }
+    // failure of fetching prices - base prices are used
+    eng.getMarketPrices = func(markets []string) map[string]godec64.UDec64 {
+        panic(&HTTPError{ "Can't get tickers", 500 })
+    }
+    if resTotBorrow := eng.calculateTotalBorrow(eng.withMarkPrices(poss), nil);
+            resTotBorrow != 328050000000 {
+        t.Errorf("TotBorrow mismatch: %v!=328050000000", resTotBorrow)
+    }
+}
+
+func TestCalculateTotalBorrowWithOrders(t *testing.T) {
+    eng := getTestEngine0()
+    poss := []Position{
+        Position{ Status: "ACTIVE", Market: "BTCUST", Amount: 155000000,
+            BasePrice: 211000000000, Long: true },
+        Position{ Status: "ACTIVE", Market: "ADAUST", Amount: 1355000000,
+            BasePrice: 140000000000, Long: true },
+        Position{ Status: "ACTIVE", Market: "USTUSD", Amount: 2334000000,
+            BasePrice: 99100000, Long: false } }
+    bals := []Balance{
+        Balance{ Currency: "UST", Total: 120000000 },
+    }
+    orders := []MarginOrder{
+        MarginOrder{ Market: "BTCUST", Type: "LIMIT", Amount: 10000000,
+            Long: true, Price: 20000000000 },
+        MarginOrder{ Market: "USTUSD", Type: "LIMIT", Amount: 50000000000,
+            Long: false, Price: 99000000 },
+        MarginOrder{ Market: "BTCUSD", Type: "LIMIT", Amount: 10000000,
+            Long: true, Price: 20000000000 },
+        MarginOrder{ Market: "ADAUST", Type: "MARKET", Amount: 10000000,
+            Long: true, Price: 0 },
+    }
+    noOrdersTotBorrow := eng.calculateTotalBorrow(poss, bals)
+    expTotBorrow := noOrdersTotBorrow + 2000000000 + 50000000000
+    resTotBorrow := eng.calculateTotalBorrowWithOrders(poss, bals, orders)
+    if expTotBorrow != resTotBorrow {
+        t.Errorf("TotBorrow mismatch: %v!=%v", expTotBorrow, resTotBorrow)
+    }
+}
+
+func TestCalculateTotalBorrowPooled(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.PoolCurrencies = []string{ "USD", "UST" }
+    eng.prepareMarketsFrom([]Market{
+        Market{ "BTCUST", "BTC", "UST" },
+        Market{ "BTCUSD", "BTC", "USD" },
+        Market{ "USTUSD", "UST", "USD" },
+        Market{ "ETHUSD", "ETH", "USD" },
+    })
+    poss := []Position{
+        Position{ Status: "ACTIVE", Market: "BTCUST", Amount: 155000000,
+            BasePrice: 211000000000, Long: true },
+        Position{ Status: "ACTIVE", Market: "BTCUSD", Amount: 10000000,
+            BasePrice: 4000000000000, Long: true },
+        Position{ Status: "ACTIVE", Market: "USTUSD", Amount: 10000000000,
+            BasePrice: 100000000, Long: false },
+        Position{ Status: "ACTIVE", Market: "ETHUSD", Amount: 100000000,
+            BasePrice: 300000000000, Long: false } }
+    bals := []Balance{
+        Balance{ Currency: "UST", Type: "margin", Total: 100000000000 },
+        Balance{ Currency: "USD", Type: "margin", Total: 50000000000 } }
+    // USD price in UST is 0.99
+    poolPrices := map[string]godec64.UDec64{ "USD": 99000000 }
+    if res := eng.calculateTotalBorrowPooled(poss, bals, nil, poolPrices);
+            res!=583550000000 {
+        t.Errorf("Pooled total borrow mismatch: %v!=%v",
+                godec64.UDec64(583550000000), res)
+    }
+    // without prices only borrowed currency
+    if res := eng.calculateTotalBorrowPooled(poss, bals, nil, nil); res!=237050000000 {
+        t.Errorf("Total borrow mismatch: %v!=%v",
+                godec64.UDec64(237050000000), res)
+    }
+    // pooled balance covers positions
+    bals[1].Total = 1000000000000
+    if res := eng.calculateTotalBorrowPooled(poss, bals, nil, poolPrices); res!=0 {
+        t.Errorf("Pooled total borrow mismatch: %v!=%v", 0, res)
+    }
+}
+
+func TestCalculateTotalBorrowDerivative(t *testing.T) {
+    eng := getTestEngine0()
+    poss := []Position{
+        Position{ Status: "ACTIVE", Market: "BTCUST", Amount: 155000000,
+            BasePrice: 211000000000, Long: true },
+        // 0.1 BTC for 50000 with 1000 UST collateral
+        Position{ Status: "ACTIVE", Market: "BTCF0:USTF0", Type: PositionDerivative,
+            Amount: 10000000, BasePrice: 5000000000000, Long: true,
+            Collateral: 100000000000 },
+        // other settlement currency
+        Position{ Status: "ACTIVE", Market: "BTCF0:EUTF0", Type: PositionDerivative,
+            Amount: 10000000, BasePrice: 4000000000000, Long: false,
+            Collateral: 10000000000 },
+        // fully covered by collateral
+        Position{ Status: "ACTIVE", Market: "ETHF0:USTF0", Type: PositionDerivative,
+            Amount: 100000000, BasePrice: 300000000000, Long: false,
+            Collateral: 400000000000 },
+    }
+    expTotBorrow := godec64.UDec64(327050000000 + 400000000000)
+    resTotBorrow := eng.calculateTotalBorrow(poss, nil)
+    if expTotBorrow != resTotBorrow {
+        t.Errorf("TotBorrow mismatch: %v!=%v", expTotBorrow, resTotBorrow)
+    }
+}
+
+func TestDerivativeSettlementCurrency(t *testing.T) {
+    cases := []struct{
+        pos Position
+        expCurr string
+        expOk bool
+    }{
+        { Position{ Market: "BTCF0:USTF0", Type: PositionDerivative }, "UST", true },
+        { Position{ Market: "BTCF0:USTF0" }, "UST", true },
+        { Position{ Market: "BTCUST" }, "", false },
+        // derivative without settlement currency in market
+        { Position{ Market: "BTCF0USTF0", Type: PositionDerivative }, "", false },
+    }
+    for _, c := range cases {
+        curr, ok := derivativeSettlementCurrency(&c.pos)
+        if curr!=c.expCurr || ok!=c.expOk {
+            t.Errorf("Settlement currency mismatch for %s: %v,%v!=%v,%v",
+                     c.pos.Market, c.expCurr, c.expOk, curr, ok)
+        }
+    }
+}
+
+func TestPrepareMarketsConcurrent(t *testing.T) {
+    eng := getTestEngine0()
+    markets := []Market{
+        Market{ "BTCUST", "BTC", "UST" },
+        Market{ "ADAUST", "ADA", "UST" },
+        Market{ "USTUSD", "UST", "USD" },
+        Market{ "BTCUSD", "BTC", "USD" },
+    }
+    eng.prepareMarketsFrom(markets)
+    if !eng.isQuoteMarket("BTCUST") || !eng.isQuoteMarket("ADAUST") ||
+            eng.isQuoteMarket("BTCUSD") || eng.isQuoteMarket("USTUSD") {
+        t.Errorf("Quote markets mismatch: %v", eng.quoteCurrMarkets)
+    }
+    if !eng.isBaseMarket("USTUSD") || eng.isBaseMarket("BTCUST") {
+        t.Errorf("Base markets mismatch: %v", eng.baseCurrMarkets)
+    }
+    
+    poss := []Position{
+        Position{ Status: "ACTIVE", Market: "BTCUST", Amount: 155000000,
+            BasePrice: 211000000000, Long: true },
+        Position{ Status: "ACTIVE", Market: "USTUSD", Amount: 2334000000,
+            BasePrice: 99100000, Long: false } }
+    expTotBorrow := eng.calculateTotalBorrow(poss, nil)
+    var wg sync.WaitGroup
+    wg.Add(2)
+    go func() {
+        defer wg.Done()
+        for i := 0; i < 1000; i++ {
+            eng.prepareMarketsFrom(markets)
+        }
+    }()
+    go func() {
+        defer wg.Done()
+        for i := 0; i < 1000; i++ {
+            if res := eng.calculateTotalBorrow(poss, nil); res != expTotBorrow {
+                t.Errorf("TotBorrow mismatch: %v!=%v", expTotBorrow, res)
+                return
+            }
+        }
+    }()
+    wg.Wait()
+}
+
 func equalBorrowTask(a, b *BorrowTask) bool {
     if a.TotalBorrow != b.TotalBorrow { return false }
     if a.Rate != b.Rate { return false }
@@ -459,3 +713,2569 @@ func TestPrepareBorrowTask(t *testing.T) {
         t.Errorf("BorrowTask mismatch: %v!=%v", expTask, resTask)
     }
 }
+
+func TestPrepareBorrowTaskMaxBookConsumption(t *testing.T) {
+    eng := getTestEngine0()
+    now := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    ob := OrderBook{
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 16000000000, 4111000000, 1 },
+            OrderBookEntry{ 3, 20200000000, 4112000000, 1 },
+            OrderBookEntry{ 2, 134177000000, 4115000000, 1 },
+            OrderBookEntry{ 2, 53400000000, 4118000000, 1 },
+            OrderBookEntry{ 2, 78800000000, 4125000000, 1 },
+        },
+    }
+    credits := []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-24*time.Hour),
+                UpdateTime: now.Add(-24*time.Hour),
+                Amount: 32455000000, Status: "ACTIVE",
+                Rate: 7321000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-23*time.Hour),
+                UpdateTime: now.Add(-23*time.Hour),
+                Amount: 128767000000, Status: "ACTIVE",
+                Rate: 6663000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 102, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-22*time.Hour),
+                UpdateTime: now.Add(-22*time.Hour),
+                Amount: 41355000000, Status: "ACTIVE",
+                Rate: 8934000000, Period: 2 }, "ADAUST" },
+    }
+    // without limit all credits are replaced
+    resTask := eng.prepareBorrowTask(&ob, credits, sumTotalCredits(credits), now)
+    expTask := BorrowTask{ 202577000000, []uint64{ 102, 100, 101 }, 4118000000 }
+    if !equalBorrowTask(&expTask, &resTask) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expTask, resTask)
+    }
+    // 25% of 302577000000 - only 75644250000 can be borrowed
+    eng.config.MaxBookConsumptionFraction = 0.25
+    resTask = eng.prepareBorrowTask(&ob, credits, sumTotalCredits(credits), now)
+    expTask = BorrowTask{ 73810000000, []uint64{ 102, 100 }, 4115000000 }
+    if !equalBorrowTask(&expTask, &resTask) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expTask, resTask)
+    }
+    if resTask.TotalBorrow > 75644250000 {
+        t.Errorf("TotalBorrow exceeds limit: %v", resTask.TotalBorrow)
+    }
+}
+
+func TestPrepareBorrowTaskSortLoanIdsToClose(t *testing.T) {
+    eng := getTestEngine0()
+    now := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    ob := OrderBook{
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 300000000000, 4111000000, 1 },
+        },
+    }
+    // credits with highest rates are closed first: 103, 101, 102
+    credits := []Credit{
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-24*time.Hour),
+                UpdateTime: now.Add(-24*time.Hour),
+                Amount: 30000000000, Status: "ACTIVE",
+                Rate: 8000000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 102, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-23*time.Hour),
+                UpdateTime: now.Add(-23*time.Hour),
+                Amount: 40000000000, Status: "ACTIVE",
+                Rate: 7000000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 103, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-22*time.Hour),
+                UpdateTime: now.Add(-22*time.Hour),
+                Amount: 50000000000, Status: "ACTIVE",
+                Rate: 9000000000, Period: 2 }, "ADAUST" },
+    }
+    resTask := eng.prepareBorrowTask(&ob, credits, sumTotalCredits(credits), now)
+    expTask := BorrowTask{ 120000000000, []uint64{ 103, 101, 102 }, 4111000000 }
+    if !equalBorrowTask(&expTask, &resTask) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expTask, resTask)
+    }
+    // sorted ids - the same ids are selected
+    eng.config.SortLoanIdsToClose = true
+    resTask = eng.prepareBorrowTask(&ob, credits, sumTotalCredits(credits), now)
+    expTask = BorrowTask{ 120000000000, []uint64{ 101, 102, 103 }, 4111000000 }
+    if !equalBorrowTask(&expTask, &resTask) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expTask, resTask)
+    }
+}
+
+func TestPrepareBorrowTaskCloseMarketPriority(t *testing.T) {
+    eng := getTestEngine0()
+    now := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    ob := OrderBook{
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 16000000000, 4111000000, 1 },
+            OrderBookEntry{ 3, 20200000000, 4112000000, 1 },
+            OrderBookEntry{ 2, 134177000000, 4115000000, 1 },
+            OrderBookEntry{ 2, 53400000000, 4118000000, 1 },
+            OrderBookEntry{ 2, 78800000000, 4125000000, 1 },
+        },
+    }
+    credits := []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-24*time.Hour),
+                UpdateTime: now.Add(-24*time.Hour),
+                Amount: 32455000000, Status: "ACTIVE",
+                Rate: 7321000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-23*time.Hour),
+                UpdateTime: now.Add(-23*time.Hour),
+                Amount: 128767000000, Status: "ACTIVE",
+                Rate: 6663000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 102, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-22*time.Hour),
+                UpdateTime: now.Add(-22*time.Hour),
+                Amount: 41355000000, Status: "ACTIVE",
+                Rate: 8934000000, Period: 2 }, "ADAUST" },
+    }
+    eng.config.CloseMarketPriority = []string{ "BTCUST" }
+    resTask := eng.prepareBorrowTask(&ob, credits, sumTotalCredits(credits), now)
+    // the same loans are selected, BTCUST loans are closed first
+    expTask := BorrowTask{ 202577000000, []uint64{ 100, 101, 102 }, 4118000000 }
+    if !equalBorrowTask(&expTask, &resTask) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expTask, resTask)
+    }
+    eng.config.CloseMarketPriority = []string{ "ETHUST", "ADAUST", "BTCUST" }
+    eng.config.SortLoanIdsToClose = true
+    resTask = eng.prepareBorrowTask(&ob, credits, sumTotalCredits(credits), now)
+    expTask = BorrowTask{ 202577000000, []uint64{ 102, 100, 101 }, 4118000000 }
+    if !equalBorrowTask(&expTask, &resTask) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expTask, resTask)
+    }
+}
+
+func TestEngineCallSafe(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    // transient errors are retried
+    calls := 0
+    if !eng.callSafe("test", func() {
+        calls++
+        if calls < 3 { HttpPanic("Can't get", 502) }
+    }) || calls!=3 {
+        t.Errorf("Call with transient errors failed: %d", calls)
+    }
+    calls = 0
+    if eng.callSafe("test", func() {
+        calls++
+        HttpPanic("Can't get", 502)
+    }) || calls!=safeCallRetries+1 {
+        t.Errorf("Retries mismatch: %d", calls)
+    }
+    // parse and auth errors are not retried
+    calls = 0
+    if eng.callSafe("test", func() {
+        calls++
+        panic(errWrongJsonBody)
+    }) || calls!=1 {
+        t.Errorf("Parse error retried: %d", calls)
+    }
+    calls = 0
+    if eng.callSafe("test", func() {
+        calls++
+        panic(&APIError{ "Can't get", bitfinexErrApiKey, "apikey: invalid" })
+    }) || calls!=1 {
+        t.Errorf("Auth error retried: %d", calls)
+    }
+}
+
+func TestConfigInActiveHours(t *testing.T) {
+    cases := []struct{
+        start, end time.Duration
+        hour, min int
+        exp bool
+    }{
+        { 0, 0, 3, 0, true },
+        { 8*time.Hour, 20*time.Hour, 12, 30, true },
+        { 8*time.Hour, 20*time.Hour, 8, 0, true },
+        { 8*time.Hour, 20*time.Hour, 20, 0, false },
+        { 8*time.Hour, 20*time.Hour, 7, 59, false },
+        { 8*time.Hour, 20*time.Hour, 23, 0, false },
+        // wrap around midnight
+        { 22*time.Hour, 4*time.Hour, 23, 15, true },
+        { 22*time.Hour, 4*time.Hour, 2, 0, true },
+        { 22*time.Hour, 4*time.Hour, 4, 0, false },
+        { 22*time.Hour, 4*time.Hour, 12, 0, false },
+    }
+    for i, c := range cases {
+        config := Config{ ActiveHoursStart: c.start, ActiveHoursEnd: c.end }
+        tm := time.Date(2021, 9, 14, c.hour, c.min, 0, 0, time.UTC)
+        if res := config.inActiveHours(tm); res!=c.exp {
+            t.Errorf("Result mismatch for %d: %v!=%v", i, c.exp, res)
+        }
+    }
+    // time in other zone
+    config := Config{ ActiveHoursStart: 8*time.Hour, ActiveHoursEnd: 20*time.Hour }
+    tm := time.Date(2021, 9, 14, 21, 0, 0, 0, time.FixedZone("X", 2*3600))
+    if !config.inActiveHours(tm) {
+        t.Errorf("Time in other zone is not in active hours")
+    }
+}
+
+func TestEnginePause(t *testing.T) {
+    eng := getTestEngine0()
+    eng.checkOBEnabled = 1
+    eng.config.MinRateDiffInAskToForceBorrow = 0.1
+    ob1 := &OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 16000000000, 3111000000, 1 } } }
+    ob2 := &OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 16000000000, 4111000000, 1 } } }
+    
+    eng.Pause()
+    eng.checkOrderBook(ob1)
+    eng.checkOrderBook(ob2)
+    if eng.btDone != 0 {
+        t.Errorf("Borrow task triggered while paused")
+    }
+    // makeBorrowTask returns before any request (bpriv is nil)
+    eng.makeBorrowTask(time.Now())
+    
+    eng.Resume()
+    eng.taskMutex.Lock()    // block borrow task
+    eng.checkOrderBook(ob1)
+    eng.checkOrderBook(ob2)
+    if atomic.LoadUint32(&eng.btDone) != 1 {
+        t.Errorf("Borrow task not triggered after resume")
+    }
+    eng.Pause() // triggered task will be skipped
+    eng.taskMutex.Unlock()
+}
+
+func TestEngineObservePhase(t *testing.T) {
+    eng := getTestEngine0()
+    eng.checkOBEnabled = 1
+    eng.config.MinRateDiffInAskToForceBorrow = 0.1
+    ob1 := &OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 16000000000, 3111000000, 1 } } }
+    ob2 := &OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 16000000000, 4111000000, 1 } } }
+    
+    eng.observing = 1
+    eng.checkOrderBook(ob1)
+    eng.checkOrderBook(ob2)
+    if atomic.LoadUint32(&eng.btDone) != 0 {
+        t.Errorf("Borrow task triggered in observe phase")
+    }
+    if eng.LastOrderBook().Ask[0].Rate != 4111000000 {
+        t.Errorf("Last orderbook not updated in observe phase")
+    }
+    
+    atomic.StoreUint32(&eng.observing, 0)
+    eng.taskMutex.Lock()    // block borrow task
+    eng.checkOrderBook(ob1)
+    eng.checkOrderBook(ob2)
+    if atomic.LoadUint32(&eng.btDone) != 1 {
+        t.Errorf("Borrow task not triggered after observe phase")
+    }
+    eng.Pause() // triggered task will be skipped
+    eng.taskMutex.Unlock()
+}
+
+func TestEngineResubscribeBaseline(t *testing.T) {
+    eng := getTestEngine0()
+    eng.checkOBEnabled = 1
+    eng.config.MinRateDiffInAskToForceBorrow = 0.1
+    eng.config.ResubscribeBaseline = true
+    obCh := make(chan *OrderBook, 1)
+    rtOBH := newRtOrderBookHandle("UST", func(ob *OrderBook) { obCh <- ob })
+    pushInitial := func(rate godec64.UDec64) *OrderBook {
+        rtOBH.pushInitial(&OrderBook{ Ask: []OrderBookEntry{
+                OrderBookEntry{ 2, 16000000000, rate, 1 } } })
+        return <-obCh
+    }
+    
+    eng.checkOrderBook(pushInitial(3111000000))
+    // gap in updates, first orderbook after resubscription is baseline
+    rtOBH.clear()
+    rtOBH.markBaseline()
+    ob := pushInitial(4111000000)
+    if !ob.Baseline {
+        t.Errorf("Orderbook after resubscription is not baseline")
+    }
+    eng.checkOrderBook(ob)
+    if atomic.LoadUint32(&eng.btDone) != 0 {
+        t.Errorf("Borrow task triggered by baseline orderbook")
+    }
+    if eng.LastOrderBook().Ask[0].Rate != 4111000000 {
+        t.Errorf("Last orderbook not updated by baseline orderbook")
+    }
+    // next orderbooks are not baseline
+    if ob = pushInitial(3111000000); ob.Baseline {
+        t.Errorf("Next orderbook is baseline")
+    }
+}
+
+func TestEngineMaxLastObAge(t *testing.T) {
+    eng := getTestEngine0()
+    eng.checkOBEnabled = 1
+    eng.config.MinRateDiffInAskToForceBorrow = 0.1
+    eng.config.MaxLastObAge = time.Minute
+    ob1 := &OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 16000000000, 3111000000, 1 } } }
+    ob2 := &OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 16000000000, 4111000000, 1 } } }
+    
+    eng.checkOrderBook(ob1)
+    // stale last orderbook
+    eng.lastObMutex.Lock()
+    eng.lastObTime = time.Now().Add(-2*time.Minute)
+    eng.lastObMutex.Unlock()
+    eng.checkOrderBook(ob2)
+    if atomic.LoadUint32(&eng.btDone) != 0 {
+        t.Errorf("Borrow task triggered by stale last orderbook")
+    }
+    if eng.LastOrderBook().Ask[0].Rate != 4111000000 {
+        t.Errorf("Last orderbook not updated")
+    }
+    // fresh last orderbook triggers
+    eng.taskMutex.Lock()    // block borrow task
+    eng.checkOrderBook(ob1)
+    eng.checkOrderBook(ob2)
+    if atomic.LoadUint32(&eng.btDone) != 1 {
+        t.Errorf("Borrow task not triggered by fresh last orderbook")
+    }
+    eng.Pause() // triggered task will be skipped
+    eng.taskMutex.Unlock()
+}
+
+func TestEngineSeedRateStats(t *testing.T) {
+    eng := getTestEngine0()
+    eng.Pause() // only update last orderbook
+    fc := newFakeClock(time.Date(2021, 9, 14, 15, 0, 0, 0, time.UTC))
+    eng.clock = fc
+    var reqPeriod uint32
+    var reqLimit uint
+    eng.getCandles = func(period uint32, limit uint) []Candle {
+        reqPeriod, reqLimit = period, limit
+        candles := make([]Candle, limit)
+        for i := range candles {
+            // alternate around 0.0003
+            candles[i].Close = godec64.UDec64(290000000 + (i&1)*20000000)
+        }
+        return candles
+    }
+    eng.seedRateStats()
+    if reqPeriod!=30*60 || reqLimit!=48 {
+        t.Errorf("Candles request mismatch: %v,%v", reqPeriod, reqLimit)
+    }
+    ema, ok := eng.rateStats.EMA()
+    if !ok || math.Abs(ema-0.0003) > 0.00001 {
+        t.Errorf("Seeded average mismatch: %v,%v", ema, ok)
+    }
+    // many live ticks in candle period don't replace historical average
+    for i := 0; i < 1000; i++ {
+        fc.Advance(time.Second)
+        eng.checkOrderBook(&OrderBook{ Ask: []OrderBookEntry{
+                OrderBookEntry{ 2, 16000000000, 900000000, 1 } } })
+    }
+    ema, ok = eng.rateStats.EMA()
+    if !ok || math.Abs(ema-0.0003) > 0.00001 {
+        t.Errorf("Average after live ticks mismatch: %v,%v", ema, ok)
+    }
+    // single sample after candle period
+    fc.Advance(30*time.Minute)
+    for i := 0; i < 100; i++ {
+        eng.checkOrderBook(&OrderBook{ Ask: []OrderBookEntry{
+                OrderBookEntry{ 2, 16000000000, 900000000, 1 } } })
+    }
+    expEma := ema + (0.0009 - ema)*2/49
+    if ema, ok = eng.rateStats.EMA(); !ok || math.Abs(ema-expEma) > 1e-12 {
+        t.Errorf("Average after candle period mismatch: %v!=%v", ema, expEma)
+    }
+    
+    // without history first live tick is average
+    eng = getTestEngine0()
+    eng.Pause()
+    eng.getCandles = func(period uint32, limit uint) []Candle {
+        panic(&APIError{ "getCandles", 0, "error" })
+    }
+    eng.seedRateStats()
+    if _, ok = eng.rateStats.EMA(); ok {
+        t.Errorf("Average without samples")
+    }
+    eng.checkOrderBook(&OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 16000000000, 900000000, 1 } } })
+    if ema, ok = eng.rateStats.EMA(); !ok || math.Abs(ema-0.0009) > 1e-12 {
+        t.Errorf("Average mismatch: %v,%v", ema, ok)
+    }
+}
+
+func TestEngineLastOrderBookConcurrent(t *testing.T) {
+    eng := getTestEngine0()
+    eng.Pause() // only update last orderbook
+    atomic.StoreUint32(&eng.checkOBEnabled, 1)
+    if eng.LastOrderBook()!=nil {
+        t.Errorf("Last orderbook without check")
+    }
+    var wg sync.WaitGroup
+    wg.Add(2)
+    go func() {
+        defer wg.Done()
+        for i := 0; i < 1000; i++ {
+            eng.checkOrderBook(&OrderBook{ Ask: []OrderBookEntry{
+                OrderBookEntry{ 2, godec64.UDec64(i+1), 300000000, 1 } } })
+        }
+    }()
+    go func() {
+        defer wg.Done()
+        for i := 0; i < 1000; i++ {
+            if ob := eng.LastOrderBook(); ob!=nil && len(ob.Ask)!=1 {
+                t.Errorf("Orderbook mismatch: %v", ob)
+            }
+        }
+    }()
+    wg.Wait()
+    ob := eng.LastOrderBook()
+    if ob==nil || ob.Ask[0].Amount!=1000 {
+        t.Errorf("Last orderbook mismatch: %v", ob)
+    }
+    // copy is independent of engine state
+    ob.Ask[0].Amount = 5
+    if eng.LastOrderBook().Ask[0].Amount!=1000 {
+        t.Errorf("Last orderbook is not copy")
+    }
+}
+
+func TestEngineStartBorrowTaskCooldown(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.TaskCooldown = 50*time.Millisecond
+    eng.paused = 1  // borrow task returns immediately
+    
+    eng.taskMutex.Lock()    // block borrow task
+    if !eng.startBorrowTask(time.Now()) {
+        t.Fatalf("First task not started")
+    }
+    if eng.startBorrowTask(time.Now()) {
+        t.Errorf("Second task started while first is running")
+    }
+    eng.taskMutex.Unlock()
+    time.Sleep(10*time.Millisecond)
+    if eng.startBorrowTask(time.Now()) {
+        t.Errorf("Task started in cooldown")
+    }
+    // after cooldown next task can be started
+    deadline := time.Now().Add(5*time.Second)
+    for atomic.LoadUint32(&eng.btDone) != 0 && time.Now().Before(deadline) {
+        time.Sleep(5*time.Millisecond)
+    }
+    if !eng.startBorrowTask(time.Now()) {
+        t.Errorf("Task not started after cooldown")
+    }
+}
+
+func TestEngineSingleTaskInPeriod(t *testing.T) {
+    eng := getTestEngine0()
+    eng.paused = 1  // borrow task returns immediately
+    
+    if !eng.startBorrowTask(time.Now()) {
+        t.Fatalf("First task not started")
+    }
+    time.Sleep(50*time.Millisecond)
+    if eng.startBorrowTask(time.Now()) {
+        t.Errorf("Second task started in same period without cooldown")
+    }
+    eng.startTaskPeriod()
+    if !eng.startBorrowTask(time.Now()) {
+        t.Errorf("Task not started in next period")
+    }
+}
+
+func TestEngineCooldownFromPreviousPeriod(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.TaskCooldown = 50*time.Millisecond
+    eng.paused = 1  // borrow task returns immediately
+    
+    if !eng.startBorrowTask(time.Now()) {
+        t.Fatalf("First task not started")
+    }
+    eng.startTaskPeriod()
+    eng.taskMutex.Lock()    // block borrow task
+    if !eng.startBorrowTask(time.Now()) {
+        t.Fatalf("Task not started in new period")
+    }
+    // cooldown of task from previous period expires
+    time.Sleep(100*time.Millisecond)
+    if atomic.LoadUint32(&eng.btDone) != 1 {
+        t.Errorf("Cooldown from previous period reset task in new period")
+    }
+    eng.taskMutex.Unlock()
+}
+
+func TestEngineTriggerLatency(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.df = &DataFetcher{ usdFiat: true }
+    eng.config.MinRateDiffInAskToForceBorrow = 0.1
+    // orderbook cheaper than credit - credit is replaced
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 2000000000, 1 } } }
+    }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    fp.credits = []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: time.Now().Add(-time.Hour), Amount: 50000000000,
+                Status: "ACTIVE", Rate: 5000000000, Period: 2 }, "BTCUST" } }
+    fp.positions = []Position{ Position{ Id: 1, Market: "BTCUST", Status: "ACTIVE",
+                Amount: 1000000, Long: true, BasePrice: 5000000000000 } }
+    eng.bpriv = fp
+    
+    // task not triggered by orderbook does not record latency
+    eng.makeBorrowTask(time.Now())
+    if len(fp.submitted)!=1 || eng.triggerLatency.Count()!=0 {
+        t.Fatalf("Latency recorded without trigger: %v %v", fp.submitted,
+                 eng.triggerLatency.Count())
+    }
+    eng.config.TaskCooldown = time.Hour
+    eng.checkOBEnabled = 1
+    eng.checkOrderBook(&OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 16000000000, 3111000000, 1 } } })
+    eng.checkOrderBook(&OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 16000000000, 4111000000, 1 } } })
+    deadline := time.Now().Add(5*time.Second)
+    for eng.triggerLatency.Count()==0 && time.Now().Before(deadline) {
+        time.Sleep(5*time.Millisecond)
+    }
+    if eng.triggerLatency.Count()!=1 {
+        t.Errorf("Latency not recorded for trigger")
+    }
+    if s := eng.triggerLatency.String(); !strings.HasPrefix(s, "count: 1, ") {
+        t.Errorf("Histogram summary mismatch: %v", s)
+    }
+}
+
+func TestEngineRepriceAll(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.df = &DataFetcher{ usdFiat: true }
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 2000000000, 1 } } }
+    }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    // old offer with higher rate
+    fp.orders = []Order{ Order{ Id: 501, Currency: "UST", Amount: 50000000000,
+                AmountOrig: 50000000000, Status: OrderActive, Rate: 3000000000,
+                Period: 2 } }
+    fp.credits = []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: time.Now().Add(-time.Hour), Amount: 50000000000,
+                Status: "ACTIVE", Rate: 5000000000, Period: 2 }, "BTCUST" } }
+    fp.positions = []Position{ Position{ Id: 1, Market: "BTCUST", Status: "ACTIVE",
+                Amount: 1000000, Long: true, BasePrice: 5000000000000 } }
+    eng.bpriv = fp
+    // prefetched data without credits and positions are stale
+    eng.prefetch = &prefetchData{ time: time.Now() }
+    if n := eng.RepriceAll(); n!=1 || !reflect.DeepEqual(fp.canceled, []uint64{ 501 }) {
+        t.Errorf("Canceled offers mismatch: %v %v", n, fp.canceled)
+    }
+    // new offer based on current orderbook
+    if len(fp.submitted)!=1 || fp.submitted[0].Amount!=50000000000 ||
+            fp.submitted[0].Rate!=2200000000 {
+        t.Errorf("Submitted offers mismatch: %v", fp.submitted)
+    }
+}
+
+// private API with slow endpoints
+type slowPrivateApi struct {
+    *fakePrivateApi
+    delay time.Duration
+    deadline time.Time
+    slowPositions, slowActiveOrders bool
+}
+
+func (sp *slowPrivateApi) WithDeadline(deadline time.Time) PrivateApi {
+    dsp := *sp
+    dsp.deadline = deadline
+    return &dsp
+}
+
+// hang request for delay, but fail at deadline (like HTTP client)
+func (sp *slowPrivateApi) hang() {
+    if !sp.deadline.IsZero() && time.Until(sp.deadline) < sp.delay {
+        time.Sleep(time.Until(sp.deadline))
+        ErrorPanic("Error while doing HTTP request", os.ErrDeadlineExceeded)
+    }
+    time.Sleep(sp.delay)
+}
+
+func (sp *slowPrivateApi) GetPositions() []Position {
+    if sp.slowPositions { sp.hang() }
+    return sp.fakePrivateApi.GetPositions()
+}
+
+func (sp *slowPrivateApi) GetActiveOrders(currency string) []Order {
+    if sp.slowActiveOrders { sp.hang() }
+    return sp.fakePrivateApi.GetActiveOrders(currency)
+}
+
+func TestMakeBorrowTaskTimeout(t *testing.T) {
+    eng := getTestEngine0()
+    var sleeps []time.Duration
+    eng.clock = sleepFuncClock{ sleep: func(d time.Duration) { sleeps = append(sleeps, d) } }
+    eng.df = &DataFetcher{ usdFiat: true }
+    eng.config.TaskTimeout = 50*time.Millisecond
+    // orderbook cheaper than credit - credit is replaced
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 2000000000, 1 } } }
+    }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true }, keepSubmitted: true }
+    fp.credits = []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: time.Now().Add(-time.Hour), Amount: 50000000000,
+                Status: "ACTIVE", Rate: 5000000000, Period: 2 }, "BTCUST" } }
+    fp.positions = []Position{ Position{ Id: 1, Market: "BTCUST", Status: "ACTIVE",
+                Amount: 1000000, Long: true, BasePrice: 5000000000000 } }
+    // requests hang much longer than task timeout
+    sp := &slowPrivateApi{ fakePrivateApi: fp, delay: 10*time.Second }
+    eng.bpriv = sp
+    
+    // hanging endpoint before borrow - task aborted at timeout without offer
+    sp.slowPositions = true
+    start := time.Now()
+    eng.makeBorrowTaskSafe(time.Now(), time.Time{})
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("Task not aborted at timeout: %v", d)
+    }
+    if len(fp.submitted)!=0 || len(fp.closed)!=0 {
+        t.Errorf("Task not aborted: %v %v", fp.submitted, fp.closed)
+    }
+    if !eng.taskDeadline.IsZero() || eng.taskBpriv!=nil {
+        t.Errorf("Task deadline not cleared")
+    }
+    
+    // hanging endpoint after submit - offer canceled at timeout
+    sp.slowPositions, sp.slowActiveOrders = false, true
+    start = time.Now()
+    eng.makeBorrowTaskSafe(time.Now(), time.Time{})
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("Task not aborted at timeout: %v", d)
+    }
+    if len(fp.submitted)!=1 || !reflect.DeepEqual(fp.canceled, []uint64{ 555 }) {
+        t.Errorf("Offer not canceled: %v %v", fp.submitted, fp.canceled)
+    }
+    for _, d := range sleeps {
+        if d > eng.config.TaskTimeout {
+            t.Errorf("Sleep beyond task timeout: %v", sleeps)
+        }
+    }
+}
+
+// records deadline of task requests
+type deadlinePrivateApi struct {
+    *fakePrivateApi
+    deadlines []time.Time
+}
+
+func (dp *deadlinePrivateApi) WithDeadline(deadline time.Time) PrivateApi {
+    dp.deadlines = append(dp.deadlines, deadline)
+    return dp
+}
+
+func TestMakeBorrowTaskDeadlineClock(t *testing.T) {
+    eng := getTestEngine0()
+    now := time.Date(2021, 5, 12, 10, 0, 0, 0, time.UTC)
+    eng.clock = newFakeClock(now)
+    eng.df = &DataFetcher{ usdFiat: true }
+    eng.config.TaskTimeout = 30*time.Second
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 2000000000, 1 } } }
+    }
+    dp := &deadlinePrivateApi{ fakePrivateApi: &fakePrivateApi{} }
+    eng.bpriv = dp
+    eng.makeBorrowTask(now)
+    // deadline of requests is taken from engine clock
+    if len(dp.deadlines)!=1 || !dp.deadlines[0].Equal(now.Add(30*time.Second)) {
+        t.Errorf("Request deadline mismatch: %v", dp.deadlines)
+    }
+}
+
+func TestLatencyHistogram(t *testing.T) {
+    var lh latencyHistogram
+    if lh.String()!="no samples" {
+        t.Errorf("Empty histogram mismatch: %v", lh.String())
+    }
+    for _, d := range []time.Duration{ 50*time.Millisecond, 100*time.Millisecond,
+            300*time.Millisecond, 20*time.Second } {
+        lh.add(d)
+    }
+    expBuckets := [len(latencyBucketBounds)+1]uint64{ 2, 0, 1, 0, 0, 0, 0, 1 }
+    if lh.buckets!=expBuckets || lh.Count()!=4 || lh.max!=20*time.Second {
+        t.Errorf("Histogram mismatch: %v %v %v", lh.buckets, lh.Count(), lh.max)
+    }
+}
+
+func TestPrepareBorrowTaskStrictCoverage(t *testing.T) {
+    eng := getTestEngine0()
+    now := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    ob := OrderBook{
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 16000000000, 4111000000, 1 },
+            OrderBookEntry{ 3, 20200000000, 4112000000, 1 },
+            OrderBookEntry{ 2, 134177000000, 4115000000, 1 },
+            OrderBookEntry{ 2, 53400000000, 4118000000, 1 },
+            OrderBookEntry{ 2, 78800000000, 4125000000, 1 },
+        },
+    }
+    credits := []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-24*time.Hour),
+                UpdateTime: now.Add(-24*time.Hour),
+                Amount: 32455000000, Status: "ACTIVE",
+                Rate: 7321000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-23*time.Hour),
+                UpdateTime: now.Add(-23*time.Hour),
+                Amount: 128767000000, Status: "ACTIVE",
+                Rate: 6663000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 102, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-22*time.Hour),
+                UpdateTime: now.Add(-22*time.Hour),
+                Amount: 41355000000, Status: "ACTIVE",
+                Rate: 8934000000, Period: 2 }, "ADAUST" },
+    }
+    // credits exceed position requirement - without strict mode all are replaced
+    resTask := eng.prepareBorrowTask(&ob, credits, 100000000000, now)
+    expTask := BorrowTask{ 202577000000, []uint64{ 102, 100, 101 }, 4118000000 }
+    if !equalBorrowTask(&expTask, &resTask) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expTask, resTask)
+    }
+    eng.config.StrictCoverage = true
+    resTask = eng.prepareBorrowTask(&ob, credits, 100000000000, now)
+    expTask = BorrowTask{ 100000000000, []uint64{ 102, 100, 101 }, 4118000000 }
+    if !equalBorrowTask(&expTask, &resTask) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expTask, resTask)
+    }
+    // credits cover positions - no extra borrow
+    resTask = eng.prepareBorrowTask(&ob, credits, 0, now)
+    if resTask.TotalBorrow != 0 {
+        t.Errorf("TotalBorrow mismatch: 0!=%v", resTask.TotalBorrow)
+    }
+    // credits to expire and retained credits cover positions
+    expCredits := append([]Credit{}, credits...)
+    expCredits[1].CreateTime = now.Add(-48*time.Hour+10*time.Minute)
+    resTask = eng.prepareBorrowTask(&ob, expCredits, 128767000000, now)
+    if resTask.TotalBorrow > 128767000000 {
+        t.Errorf("TotalBorrow exceeds coverage: %v", resTask.TotalBorrow)
+    }
+}
+
+type fakePrivateApi struct {
+    credits []Credit
+    loans []Loan
+    balances []Balance
+    wallets []Balance
+    positions []Position
+    orders []Order
+    marginOrders []MarginOrder
+    fundingTrades []FundingTrade
+    orderStates []Order // returned by next calls of GetOrder
+    submitResult OpResult
+    keepSubmitted bool  // submitted orders stay in active orders
+    cancelFail bool
+    submitted []Order
+    canceled []uint64
+    updated []Order
+    closed []uint64
+    kept []uint64
+    marginInfo MarginInfo
+}
+
+func (fp *fakePrivateApi) GetWallets() []Balance {
+    return fp.wallets
+}
+
+func (fp *fakePrivateApi) GetMarginBalances() []Balance {
+    return fp.balances
+}
+
+func (fp *fakePrivateApi) GetLoans(currency string) []Loan {
+    return fp.loans
+}
+
+func (fp *fakePrivateApi) GetCredits(currency string) []Credit {
+    return fp.credits
+}
+
+func (fp *fakePrivateApi) WithDeadline(deadline time.Time) PrivateApi {
+    return fp
+}
+
+func (fp *fakePrivateApi) GetPositions() []Position {
+    return fp.positions
+}
+
+func (fp *fakePrivateApi) GetMarginInfo() MarginInfo {
+    return fp.marginInfo
+}
+
+func (fp *fakePrivateApi) GetActiveMarginOrders() []MarginOrder {
+    return fp.marginOrders
+}
+
+func (fp *fakePrivateApi) GetActiveOrders(currency string) []Order {
+    return fp.orders
+}
+
+func (fp *fakePrivateApi) GetOrder(currency string, orderId uint64) (Order, bool) {
+    if len(fp.orderStates)==0 {
+        for i := 0; i < len(fp.orders); i++ {
+            if fp.orders[i].Id==orderId { return fp.orders[i], true }
+        }
+        return Order{}, false
+    }
+    order := fp.orderStates[0]
+    fp.orderStates = fp.orderStates[1:]
+    return order, order.Id==orderId
+}
+
+func (fp *fakePrivateApi) GetFundingTrades(currency string, since time.Time,
+                                limit uint) []FundingTrade {
+    return fp.fundingTrades
+}
+
+func (fp *fakePrivateApi) SubmitBidOrder(currency string,
+                amount, rate godec64.UDec64, period uint32, or *OpResult) {
+    fp.submitted = append(fp.submitted, Order{ Currency: currency,
+                    Amount: amount, Rate: rate, Period: period })
+    *or = fp.submitResult
+    if fp.keepSubmitted && or.Success {
+        fp.orders = append(fp.orders, Order{ Id: or.Order.Id, Currency: currency,
+                    Amount: amount, AmountOrig: amount, Status: OrderActive,
+                    Rate: rate, Period: period })
+    }
+}
+
+func (fp *fakePrivateApi) CancelOrder(orderId uint64, or *OpResult) {
+    fp.canceled = append(fp.canceled, orderId)
+    if fp.cancelFail {
+        *or = OpResult{ Message: "cancel failed" }
+        return
+    }
+    *or = OpResult{ Success: true }
+    // canceled order is no longer active
+    for i := 0; i < len(fp.orders); i++ {
+        if fp.orders[i].Id == orderId {
+            or.Order = fp.orders[i]
+            fp.orders = append(fp.orders[:i:i], fp.orders[i+1:]...)
+            break
+        }
+    }
+}
+
+func (fp *fakePrivateApi) CloseFunding(loanId uint64, or *Op2Result) {
+    fp.closed = append(fp.closed, loanId)
+    *or = Op2Result{ Success: true }
+}
+
+func (fp *fakePrivateApi) SetKeepCredits(creditIds []uint64, keep bool,
+                                          or *Op2Result) {
+    fp.kept = append(fp.kept, creditIds...)
+    *or = Op2Result{ Success: true }
+}
+
+func (fp *fakePrivateApi) UpdateOffer(currency string, orderId uint64,
+                amount, rate godec64.UDec64, or *OpResult) {
+    fp.updated = append(fp.updated, Order{ Id: orderId, Currency: currency,
+                    Amount: amount, Rate: rate })
+    *or = OpResult{ Message: "not found" }
+    for i := 0; i < len(fp.orders); i++ {
+        if fp.orders[i].Id == orderId {
+            fp.orders[i].Amount, fp.orders[i].AmountOrig = amount, amount
+            fp.orders[i].Rate = rate
+            *or = OpResult{ Order: fp.orders[i], Success: true }
+            break
+        }
+    }
+}
+
+func noSleep(time.Duration) {}
+
+// system clock with sleep replaced by function
+type sleepFuncClock struct {
+    realClock
+    sleep func(time.Duration)
+}
+
+func (sc sleepFuncClock) Sleep(d time.Duration) {
+    sc.sleep(d)
+}
+
+func TestDoBorrowTaskVerifyFill(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.VerifyFill = true
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    bt := BorrowTask{ 100000000000, []uint64{ 100, 101 }, 400000000 }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    eng.bpriv = fp
+    var res BorrowResult
+    
+    // order not in active orders, but funding trades don't confirm fill
+    fp.fundingTrades = []FundingTrade{
+        FundingTrade{ Id: 1, OfferId: 555, Amount: 60000000000, Borrow: true,
+                    Rate: 400000000 },
+        FundingTrade{ Id: 2, OfferId: 554, Amount: 40000000000, Borrow: true,
+                    Rate: 400000000 } }
+    if eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task succeeded without confirmed fill")
+    }
+    if len(fp.closed)!=0 {
+        t.Errorf("Fundings closed without confirmed fill: %v", fp.closed)
+    }
+    // effective rate is too high
+    fp.fundingTrades[1] = FundingTrade{ Id: 2, OfferId: 555, Amount: 40000000000,
+                    Borrow: true, Rate: 900000000 }
+    if eng.doBorrowTask(&bt, &res) || len(fp.closed)!=0 {
+        t.Errorf("Fundings closed with too high rate: %v", fp.closed)
+    }
+    // confirmed fill
+    fp.fundingTrades[1].Rate = 410000000
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed")
+    }
+    if len(fp.closed)!=2 || fp.closed[0]!=100 || fp.closed[1]!=101 {
+        t.Errorf("Closed fundings mismatch: %v", fp.closed)
+    }
+    // amount of trade rounded by one step
+    fp.closed = nil
+    fp.fundingTrades[1].Amount = 39999999999
+    if !eng.doBorrowTask(&bt, &res) || len(fp.closed)!=2 {
+        t.Errorf("Fill rounded by one step not confirmed: %v", fp.closed)
+    }
+    fp.closed = nil
+    fp.fundingTrades[1].Amount = 39999999998
+    if eng.doBorrowTask(&bt, &res) || len(fp.closed)!=0 {
+        t.Errorf("Fill differing by two steps confirmed: %v", fp.closed)
+    }
+}
+
+// credits 100 (60, lower rate) and 101 (40) replaced by borrow of 100
+func testReplacedCredits() []Credit {
+    return []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1, Amount: 60000000000,
+                Status: "ACTIVE", Rate: 300000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1, Amount: 40000000000,
+                Status: "ACTIVE", Rate: 500000000, Period: 2 }, "BTCUST" },
+    }
+}
+
+func TestDoBorrowTaskConfirmCancel(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.ConfirmCancel = true
+    eng.config.VerifyFill = true
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    bt := BorrowTask{ 100000000000, []uint64{ 100, 101 }, 400000000 }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true }, credits: testReplacedCredits() }
+    eng.bpriv = fp
+    var res BorrowResult
+    // order is still in active orders, cancel returns 40 as remaining amount
+    activeOrder := Order{ Id: 555, Amount: 40000000000,
+                        AmountOrig: 100000000000, Status: OrderPartiallyFilled }
+    
+    // cancel is not yet confirmed at first check
+    fp.orderStates = []Order{
+        Order{ Id: 555, Amount: 40000000000, AmountOrig: 100000000000,
+                Status: OrderPartiallyFilled },
+        Order{ Id: 555, Amount: 40000000000, AmountOrig: 100000000000,
+                Status: OrderCanceled } }
+    fp.fundingTrades = []FundingTrade{
+        FundingTrade{ Id: 1, OfferId: 555, Amount: 60000000000, Borrow: true,
+                    Rate: 400000000 } }
+    if filled, ok := eng.confirmCancel(555); !ok || filled!=60000000000 {
+        t.Errorf("Cancel confirmation mismatch: %v,%v", filled, ok)
+    }
+    
+    fp.orderStates = []Order{ Order{ Id: 555, Amount: 40000000000,
+                AmountOrig: 100000000000, Status: OrderCanceled } }
+    fp.orders = []Order{ activeOrder }
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed")
+    }
+    if !res.Verified || res.Filled!=60000000000 {
+        t.Errorf("Result mismatch: %v", res)
+    }
+    // partial fill replaces only funding 100
+    if !reflect.DeepEqual(fp.closed, []uint64{ 100 }) ||
+            !reflect.DeepEqual(res.NotClosed, []uint64{ 101 }) {
+        t.Errorf("Closed fundings mismatch: %v %v", fp.closed, res.NotClosed)
+    }
+    
+    // last-moment partial fill: order filled 70 before it has been canceled
+    fp.closed = nil
+    fp.orderStates = []Order{ Order{ Id: 555, Amount: 30000000000,
+                AmountOrig: 100000000000, Status: OrderCanceled } }
+    fp.fundingTrades = []FundingTrade{
+        FundingTrade{ Id: 1, OfferId: 555, Amount: 60000000000, Borrow: true,
+                    Rate: 400000000 },
+        FundingTrade{ Id: 2, OfferId: 555, Amount: 10000000000, Borrow: true,
+                    Rate: 400000000 } }
+    fp.orders = []Order{ activeOrder }
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed for last-moment fill")
+    }
+    if !res.Verified || res.Filled!=70000000000 {
+        t.Errorf("Result mismatch: %v", res)
+    }
+    if len(fp.closed)!=1 {
+        t.Errorf("Closed fundings mismatch: %v", fp.closed)
+    }
+    
+    // cancel never confirmed
+    fp.closed = nil
+    fp.orderStates = nil
+    if filled, ok := eng.confirmCancel(555); ok || filled!=0 {
+        t.Errorf("Cancel confirmed without order: %v,%v", filled, ok)
+    }
+    fp.orders = []Order{ activeOrder }
+    if eng.doBorrowTask(&bt, &res) || len(fp.closed)!=0 {
+        t.Errorf("Fundings closed without confirmed cancel: %v", fp.closed)
+    }
+}
+
+func TestDoBorrowTaskFailedCancel(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    bt := BorrowTask{ 100000000000, []uint64{ 100, 101 }, 400000000 }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true }, credits: testReplacedCredits(),
+                        cancelFail: true }
+    eng.bpriv = fp
+    var res BorrowResult
+    activeOrder := Order{ Id: 555, Amount: 40000000000,
+                        AmountOrig: 100000000000, Status: OrderPartiallyFilled }
+    // order stays active - filled amount is unknown
+    fp.orders = []Order{ activeOrder }
+    if eng.doBorrowTask(&bt, &res) || len(fp.closed)!=0 {
+        t.Errorf("Fundings closed after failed cancel: %v", fp.closed)
+    }
+    // order has been closed by exchange - filled amount is read from order
+    fp.orders = []Order{ activeOrder }
+    fp.orderStates = []Order{ Order{ Id: 555, Amount: 40000000000,
+                AmountOrig: 100000000000, Status: OrderCanceled } }
+    if !eng.doBorrowTask(&bt, &res) || res.Filled!=60000000000 {
+        t.Errorf("Result mismatch: %v", res)
+    }
+    if !reflect.DeepEqual(fp.closed, []uint64{ 100 }) {
+        t.Errorf("Closed fundings mismatch: %v", fp.closed)
+    }
+}
+
+func TestBelowMinOrderAmount(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.MinOrderAmount = 15000000000
+    // USD price 0.5
+    if !eng.belowMinOrderAmount(20000000000, 50000000) ||
+            eng.belowMinOrderAmount(40000000000, 50000000) {
+        t.Errorf("Wrong check with USD price")
+    }
+    // no USD price and no minimum in currency
+    if eng.belowMinOrderAmount(100000000, 0) {
+        t.Errorf("Wrong check without USD price")
+    }
+    if err := eng.config.checkMinOrderAmount(false); err==nil {
+        t.Errorf("No error for currency without USD price")
+    }
+    if err := eng.config.checkMinOrderAmount(true); err!=nil {
+        t.Errorf("Unexpected error: %v", err)
+    }
+    // minimum in currency
+    eng.config.MinOrderAmountInCurrency = 5000000000
+    if err := eng.config.checkMinOrderAmount(false); err!=nil {
+        t.Errorf("Unexpected error: %v", err)
+    }
+    if !eng.belowMinOrderAmount(4000000000, 0) ||
+            eng.belowMinOrderAmount(5000000000, 0) ||
+            eng.belowMinOrderAmount(5000000000, 50000000) {
+        t.Errorf("Wrong check with minimum in currency")
+    }
+    // no-price currency goes to borrow without panic
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    eng.bpriv = fp
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.borrowWithRetries(BorrowTask{ 4000000000, nil, 400000000 }, 0)
+    eng.borrowWithRetries(BorrowTask{ 6000000000, nil, 400000000 }, 0)
+    if len(fp.submitted)!=1 || fp.submitted[0].Amount!=6000000000 {
+        t.Errorf("Submitted orders mismatch: %v", fp.submitted)
+    }
+}
+
+func TestMinOrderAmountSkipLog(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.MinOrderAmount = 15000000000
+    var out bytes.Buffer
+    Logger.SetOutput(&out)
+    defer Logger.SetOutput(os.Stdout)
+    // USD price 0.5
+    eng.borrowWithRetries(BorrowTask{ 20000000000, nil, 400000000 }, 50000000)
+    for _, exp := range []string{ "amount 200.0 UST", "USD value 100.0",
+                "min order amount 150.0 USD" } {
+        if !strings.Contains(out.String(), exp) {
+            t.Errorf("Skip log %q doesn't contain %q", out.String(), exp)
+        }
+    }
+    out.Reset()
+    eng.config.MinOrderAmountInCurrency = 5000000000
+    eng.borrowWithRetries(BorrowTask{ 4000000000, nil, 400000000 }, 0)
+    for _, exp := range []string{ "amount 40.0 UST", "USD value unknown",
+                "min order amount 50.0 UST" } {
+        if !strings.Contains(out.String(), exp) {
+            t.Errorf("Skip log %q doesn't contain %q", out.String(), exp)
+        }
+    }
+    // USD values have 8 decimals regardless of amount precision
+    SetAmountPrecisions(map[string]uint{ "UST": 6 })
+    defer SetAmountPrecisions(nil)
+    out.Reset()
+    eng.config.MinOrderAmountInCurrency = 0
+    eng.borrowWithRetries(BorrowTask{ 200000000, nil, 400000000 }, 50000000)
+    for _, exp := range []string{ "amount 200.0 UST", "USD value 100.0",
+                "min order amount 150.0 USD" } {
+        if !strings.Contains(out.String(), exp) {
+            t.Errorf("Skip log %q doesn't contain %q", out.String(), exp)
+        }
+    }
+}
+
+func TestMakeBorrowTaskCheckMargin(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    fp := &fakePrivateApi{ marginInfo: MarginInfo{ MarginBalance: 100000000000,
+                MarginNet: 90000000000, RequiredMargin: 50000000000 } }
+    eng.bpriv = fp
+    if !eng.marginSufficient() {
+        t.Errorf("Margin is not sufficient")
+    }
+    fp.marginInfo.MarginNet = 40000000000
+    if eng.marginSufficient() {
+        t.Errorf("Low margin is sufficient")
+    }
+    // low margin suppresses borrow before fetching any data
+    eng.config.CheckMargin = true
+    fp.positions = []Position{ Position{ Id: 1, Market: "BTCUST", Status: "ACTIVE",
+                Amount: 100000000, Long: true, BasePrice: 5000000000000 } }
+    eng.makeBorrowTask(time.Now())
+    if len(fp.submitted)!=0 {
+        t.Errorf("Borrow with low margin: %v", fp.submitted)
+    }
+}
+
+func TestMakeBorrowTaskFundingWalletBalance(t *testing.T) {
+    eng := getTestEngine0()
+    wallets := []Balance{
+        Balance{ Currency: "UST", Type: "margin", Total: 10000000000,
+                Available: 10000000000 },
+        Balance{ Currency: "UST", Type: "funding", Total: 30000000000,
+                Available: 20000000000 },
+        Balance{ Currency: "BTC", Type: "funding", Total: 100000000,
+                Available: 100000000 },
+    }
+    if tb := eng.netOfFundingWallet(50000000000, wallets); tb!=30000000000 {
+        t.Errorf("Total borrow mismatch: %v", tb)
+    }
+    if tb := eng.netOfFundingWallet(15000000000, wallets); tb!=0 {
+        t.Errorf("Total borrow mismatch: %v", tb)
+    }
+    if tb := eng.netOfFundingWallet(15000000000, wallets[:1]); tb!=15000000000 {
+        t.Errorf("Total borrow mismatch: %v", tb)
+    }
+    
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.df = &DataFetcher{ usdFiat: true }
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 200000000, 1 } } }
+    }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true }, wallets: wallets }
+    // positions need 1000 UST, credits cover only 500
+    fp.credits = []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: time.Now().Add(-time.Hour), Amount: 50000000000,
+                Status: "ACTIVE", Rate: 1000000000, Period: 2 }, "BTCUST" },
+    }
+    fp.positions = []Position{ Position{ Id: 1, Market: "BTCUST", Status: "ACTIVE",
+                Amount: 2000000, Long: true, BasePrice: 5000000000000 } }
+    eng.bpriv = fp
+    eng.makeBorrowTask(time.Now())
+    if len(fp.submitted)!=1 || fp.submitted[0].Amount!=100000000000 {
+        t.Errorf("Submitted mismatch: %v", fp.submitted)
+    }
+    // idle funding balance reduces borrow
+    fp.submitted = nil
+    eng.config.UseFundingWalletBalance = true
+    eng.makeBorrowTask(time.Now())
+    if len(fp.submitted)!=1 || fp.submitted[0].Amount!=80000000000 {
+        t.Errorf("Submitted mismatch: %v", fp.submitted)
+    }
+}
+
+func TestMakeBorrowTaskCloseOrphanCredits(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.df = &DataFetcher{ usdFiat: true }
+    eng.config.CloseOrphanCredits = true
+    // orderbook more expensive than credits - nothing to replace
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 2000000000, 1 } } }
+    }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    fp.credits = []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: time.Now().Add(-time.Hour), Amount: 50000000000,
+                Status: "ACTIVE", Rate: 100000000, Period: 2 }, "BTCUST" },
+        // position of ADAUST has been closed
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1,
+                CreateTime: time.Now().Add(-time.Hour), Amount: 20000000000,
+                Status: "ACTIVE", Rate: 100000000, Period: 2 }, "ADAUST" },
+    }
+    fp.positions = []Position{ Position{ Id: 1, Market: "BTCUST", Status: "ACTIVE",
+                Amount: 1000000, Long: true, BasePrice: 5000000000000 } }
+    eng.bpriv = fp
+    if orphans := eng.orphanCredits(fp.credits, fp.positions);
+            len(orphans)!=1 || orphans[0].Id!=101 {
+        t.Errorf("Orphan credits mismatch: %v", orphans)
+    }
+    // credit remembered from start of period has been already closed
+    eng.alCreditsMap = map[uint64]Credit{
+        99: Credit{ Loan{ Id: 99, Currency: "UST", Side: -1,
+                CreateTime: time.Now().Add(-2*time.Hour), Amount: 10000000000,
+                Status: "ACTIVE", Rate: 100000000, Period: 2 }, "ETHUST" } }
+    eng.makeBorrowTask(time.Now())
+    if !reflect.DeepEqual(fp.closed, []uint64{ 101 }) || len(fp.submitted)!=0 {
+        t.Errorf("Closed fundings mismatch: %v %v", fp.closed, fp.submitted)
+    }
+    eng.alCreditsMap = nil
+    // without option orphan credit is kept
+    fp.closed = nil
+    eng.config.CloseOrphanCredits = false
+    eng.makeBorrowTask(time.Now())
+    if len(fp.closed)!=0 {
+        t.Errorf("Closed fundings mismatch: %v", fp.closed)
+    }
+    // position opened after prefetch - credit is not orphan
+    stalePoss := fp.positions
+    fp.positions = append([]Position{ Position{ Id: 2, Market: "ADAUST",
+                Status: "ACTIVE", Amount: 100000000, Long: true,
+                BasePrice: 150000000 } }, stalePoss...)
+    if rest := eng.closeOrphanCredits(fp.credits, fp.credits,
+                stalePoss);
+            len(rest)!=2 || len(fp.closed)!=0 {
+        t.Errorf("Closed fundings with fresh position mismatch: %v %v", rest, fp.closed)
+    }
+}
+
+func TestFundingSummaryNoCredits(t *testing.T) {
+    eng := getTestEngine0()
+    fp := &fakePrivateApi{}
+    eng.bpriv = fp
+    now := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    if msg := eng.fundingSummaryMessage(nil, now); msg!="Current funding: no funding" {
+        t.Errorf("Summary mismatch: %q", msg)
+    }
+    if credits := eng.printCurrentFundingSummary(); len(credits)!=0 {
+        t.Errorf("Credits mismatch: %v", credits)
+    }
+    credits := []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1, Amount: 10000000000,
+                Status: "ACTIVE", Rate: 100000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1, Amount: 30000000000,
+                Status: "ACTIVE", Rate: 300000000, Period: 2 }, "BTCUST" },
+    }
+    if msg := eng.fundingSummaryMessage(credits, now); msg!="Current funding rate: " +
+            "0.025, total: 400, avg remaining period: 0.00 days" {
+        t.Errorf("Summary mismatch: %q", msg)
+    }
+    // nothing to close without loans
+    if !eng.doCloseUnusedFundings() || len(fp.closed)!=0 {
+        t.Errorf("Close unused fundings mismatch: %v", fp.closed)
+    }
+}
+
+func TestWeightedAvgRemainingPeriod(t *testing.T) {
+    now := time.Date(2021, 9, 14, 12, 0, 0, 0, time.UTC)
+    credits := []Credit{
+        // 1.5 days remaining
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1, Amount: 10000000000,
+                CreateTime: now.Add(-12*time.Hour), Status: "ACTIVE",
+                Rate: 100000000, Period: 2 }, "BTCUST" },
+        // 25 days remaining
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1, Amount: 30000000000,
+                CreateTime: now.Add(-5*24*time.Hour), Status: "ACTIVE",
+                Rate: 300000000, Period: 30 }, "BTCUST" },
+        // expired
+        Credit{ Loan{ Id: 102, Currency: "UST", Side: -1, Amount: 10000000000,
+                CreateTime: now.Add(-3*24*time.Hour), Status: "ACTIVE",
+                Rate: 300000000, Period: 2 }, "BTCUST" },
+    }
+    // (100*1.5 + 300*25 + 100*0) / 500
+    if p := weightedAvgRemainingPeriod(credits, now); math.Abs(p - 15.3) > 1e-9 {
+        t.Errorf("Period mismatch: %v", p)
+    }
+    if p := weightedAvgRemainingPeriod(nil, now); p!=0 {
+        t.Errorf("Period mismatch: %v", p)
+    }
+    eng := getTestEngine0()
+    if msg := eng.fundingSummaryMessage(credits, now);
+            !strings.HasSuffix(msg, ", total: 500, avg remaining period: 15.30 days") {
+        t.Errorf("Summary mismatch: %q", msg)
+    }
+}
+
+// buffer safe for concurrent logging
+type syncBuffer struct {
+    mutex sync.Mutex
+    buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+    sb.mutex.Lock()
+    defer sb.mutex.Unlock()
+    return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+    sb.mutex.Lock()
+    defer sb.mutex.Unlock()
+    return sb.buf.String()
+}
+
+func TestEngineSummaryInterval(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.SummaryInterval = 20*time.Millisecond
+    eng.bpriv = &fakePrivateApi{ credits: []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1, Amount: 10000000000,
+                Status: "ACTIVE", Rate: 100000000, Period: 2 }, "BTCUST" } } }
+    var buf syncBuffer
+    Logger.SetOutput(&buf)
+    defer Logger.SetOutput(os.Stdout)
+    eng.startSummary()
+    time.Sleep(110*time.Millisecond)
+    eng.stopSummary()
+    n := strings.Count(buf.String(), "Current funding rate: ")
+    if n < 2 {
+        t.Errorf("Summary logged %d times", n)
+    }
+}
+
+func TestEngineSummaryIntervalFakeClock(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.SummaryInterval = time.Hour
+    fc := newFakeClock(time.Date(2021, 9, 14, 15, 0, 0, 0, time.UTC))
+    eng.clock = fc
+    eng.bpriv = &fakePrivateApi{ credits: []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1, Amount: 10000000000,
+                Status: "ACTIVE", Rate: 100000000, Period: 2 }, "BTCUST" } } }
+    var buf syncBuffer
+    Logger.SetOutput(&buf)
+    defer Logger.SetOutput(os.Stdout)
+    count := func() int {
+        return strings.Count(buf.String(), "Current funding rate: ")
+    }
+    eng.startSummary()
+    waitFor(t, "summary ticker", func() bool { return fc.Timers()==1 })
+    fc.Advance(59*time.Minute)
+    if n := count(); n!=0 {
+        t.Errorf("Summary logged before interval %d times", n)
+    }
+    fc.Advance(time.Minute)
+    waitFor(t, "first summary", func() bool { return count()==1 })
+    fc.Advance(time.Hour)
+    waitFor(t, "second summary", func() bool { return count()==2 })
+    eng.stopSummary()
+    waitFor(t, "stopped ticker", func() bool { return fc.Timers()==0 })
+}
+
+// counts fetches of data used by borrow task
+type countingPrivateApi struct {
+    *fakePrivateApi
+    fetches int
+}
+
+func (cp *countingPrivateApi) GetCredits(currency string) []Credit {
+    cp.fetches++
+    return cp.fakePrivateApi.GetCredits(currency)
+}
+
+func (cp *countingPrivateApi) GetPositions() []Position {
+    cp.fetches++
+    return cp.fakePrivateApi.GetPositions()
+}
+
+func (cp *countingPrivateApi) GetMarginBalances() []Balance {
+    cp.fetches++
+    return cp.fakePrivateApi.GetMarginBalances()
+}
+
+func TestMakeBorrowTaskWarmPrefetch(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.df = &DataFetcher{ usdFiat: true }
+    obFetches := 0
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        obFetches++
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 200000000, 1 } } }
+    }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    fp.credits = []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: time.Now().Add(-time.Hour), Amount: 50000000000,
+                Status: "ACTIVE", Rate: 1000000000, Period: 2 }, "BTCUST" },
+    }
+    fp.positions = []Position{ Position{ Id: 1, Market: "BTCUST", Status: "ACTIVE",
+                Amount: 1000000, Long: true, BasePrice: 5000000000000 } }
+    cp := &countingPrivateApi{ fakePrivateApi: fp }
+    eng.bpriv = cp
+    eng.prefetchPeriodData()
+    if eng.prefetch==nil || len(eng.prefetch.credits)!=1 ||
+            len(eng.prefetch.poss)!=1 {
+        t.Fatalf("Prefetch mismatch: %v", eng.prefetch)
+    }
+    if cp.fetches!=3 || obFetches!=0 {
+        t.Errorf("Fetches mismatch: %v %v", cp.fetches, obFetches)
+    }
+    // fresh prefetched data are reused, orderbook is fetched
+    eng.makeBorrowTask(time.Now())
+    if cp.fetches!=3 || obFetches!=1 {
+        t.Errorf("Fetches mismatch: %v %v", cp.fetches, obFetches)
+    }
+    if len(fp.submitted)!=1 || fp.submitted[0].Amount!=50000000000 {
+        t.Errorf("Submitted mismatch: %v", fp.submitted)
+    }
+    // prefetched data are used only once
+    if eng.prefetch!=nil {
+        t.Errorf("Prefetched data not consumed")
+    }
+    eng.makeBorrowTask(time.Now())
+    if cp.fetches!=6 || obFetches!=2 {
+        t.Errorf("Fetches mismatch: %v %v", cp.fetches, obFetches)
+    }
+    // outdated prefetched data are not used
+    eng.prefetchPeriodData()
+    eng.prefetch.time = time.Now().Add(-time.Minute)
+    if eng.takePrefetchData(time.Now())!=nil {
+        t.Errorf("Outdated prefetch data used")
+    }
+}
+
+func TestMakeBorrowTaskIncremental(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.df = &DataFetcher{ usdFiat: true }
+    eng.config.IncrementalBorrow = true
+    eng.config.IncrementalBorrowStep = 20000000000
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 200000000, 1 } } }
+    }
+    now := time.Now()
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    fp.credits = []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-time.Hour), Amount: 20000000000,
+                Status: "ACTIVE", Rate: 1200000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-time.Hour), Amount: 20000000000,
+                Status: "ACTIVE", Rate: 1100000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 102, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-time.Hour), Amount: 10000000000,
+                Status: "ACTIVE", Rate: 1000000000, Period: 2 }, "BTCUST" },
+    }
+    fp.positions = []Position{ Position{ Id: 1, Market: "BTCUST", Status: "ACTIVE",
+                Amount: 1000000, Long: true, BasePrice: 5000000000000 } }
+    eng.bpriv = fp
+    expSubmitted := []godec64.UDec64{ 20000000000, 20000000000, 10000000000 }
+    expClosed := [][]uint64{ { 100 }, { 100, 101 }, { 100, 101, 102 } }
+    for i := 0; i < 4; i++ {
+        eng.makeBorrowTask(now)
+        if i < len(expSubmitted) {
+            if len(fp.submitted)!=i+1 || fp.submitted[i].Amount!=expSubmitted[i] {
+                t.Errorf("Submitted mismatch in tick %d: %v", i, fp.submitted)
+            }
+            if len(fp.closed)!=len(expClosed[i]) {
+                t.Errorf("Closed mismatch in tick %d: %v", i, fp.closed)
+                continue
+            }
+            for j := range expClosed[i] {
+                if fp.closed[j]!=expClosed[i][j] {
+                    t.Errorf("Closed mismatch in tick %d: %v", i, fp.closed)
+                }
+            }
+        } else if len(fp.submitted)!=len(expSubmitted) {
+            // target reached
+            t.Errorf("Submitted mismatch in tick %d: %v", i, fp.submitted)
+        }
+    }
+    if eng.incBorrow.borrowed!=50000000000 {
+        t.Errorf("Borrowed mismatch: %v", eng.incBorrow.borrowed)
+    }
+}
+
+func TestMakeBorrowTaskIncrementalPartialFill(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.df = &DataFetcher{ usdFiat: true }
+    eng.config.IncrementalBorrow = true
+    eng.config.IncrementalBorrowStep = 40000000000
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 200000000, 1 } } }
+    }
+    now := time.Now()
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    fp.credits = []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-time.Hour), Amount: 20000000000,
+                Status: "ACTIVE", Rate: 1200000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-time.Hour), Amount: 20000000000,
+                Status: "ACTIVE", Rate: 1100000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 102, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-time.Hour), Amount: 10000000000,
+                Status: "ACTIVE", Rate: 1000000000, Period: 2 }, "BTCUST" },
+    }
+    fp.positions = []Position{ Position{ Id: 1, Market: "BTCUST", Status: "ACTIVE",
+                Amount: 1000000, Long: true, BasePrice: 5000000000000 } }
+    // first tick filled 30 of 40: only 101 (lowest rate) is closed
+    fp.orders = []Order{ Order{ Id: 555, Currency: "UST", Amount: 10000000000,
+                AmountOrig: 40000000000, Status: OrderPartiallyFilled,
+                Rate: 200000000, Period: 2 } }
+    eng.bpriv = fp
+    eng.makeBorrowTask(now)
+    if !reflect.DeepEqual(fp.closed, []uint64{ 101 }) {
+        t.Errorf("Closed mismatch in first tick: %v", fp.closed)
+    }
+    // second tick must not close 101 again and must close 100
+    eng.makeBorrowTask(now)
+    if !reflect.DeepEqual(fp.closed, []uint64{ 101, 100, 102 }) {
+        t.Errorf("Closed mismatch in second tick: %v", fp.closed)
+    }
+    if eng.incBorrow.borrowed!=50000000000 {
+        t.Errorf("Borrowed mismatch: %v", eng.incBorrow.borrowed)
+    }
+}
+
+func TestCloseFundingsInterval(t *testing.T) {
+    eng := getTestEngine0()
+    var sleeps []time.Duration
+    eng.clock = sleepFuncClock{ sleep: func(d time.Duration) { sleeps = append(sleeps, d) } }
+    fp := &fakePrivateApi{}
+    eng.bpriv = fp
+    ids := make([]uint64, 82)
+    for i := range ids { ids[i] = uint64(100+i) }
+    // only pause after batch
+    if !eng.closeFundings(ids) || len(fp.closed)!=82 {
+        t.Errorf("Close fundings failed: %v", len(fp.closed))
+    }
+    if len(sleeps)!=1 || sleeps[0]!=time.Minute {
+        t.Errorf("Sleeps mismatch: %v", sleeps)
+    }
+    // interval between every call
+    sleeps = nil
+    eng.config.CloseFundingInterval = 500*time.Millisecond
+    if !eng.closeFundings(ids[:3]) {
+        t.Errorf("Close fundings failed")
+    }
+    if len(sleeps)!=2 || sleeps[0]!=500*time.Millisecond ||
+            sleeps[1]!=500*time.Millisecond {
+        t.Errorf("Sleeps mismatch: %v", sleeps)
+    }
+}
+
+func TestDoNotCloseLoanIds(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.DoNotCloseLoanIds = []uint64{ 101 }
+    fp := &fakePrivateApi{ loans: []Loan{
+        Loan{ Id: 100, Currency: "UST", Side: -1, Amount: 5000000000,
+                Status: "ACTIVE", Rate: 1000000000, Period: 2 },
+        Loan{ Id: 101, Currency: "UST", Side: -1, Amount: 3000000000,
+                Status: "ACTIVE", Rate: 1200000000, Period: 2 },
+    } }
+    eng.bpriv = fp
+    if !eng.doCloseUnusedFundings() || !reflect.DeepEqual(fp.closed, []uint64{ 100 }) {
+        t.Errorf("Closed fundings mismatch: %v", fp.closed)
+    }
+    
+    // excluded credit is not replaced by borrow
+    now := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    ob := OrderBook{
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 200000000, 1 },
+        },
+    }
+    credits := []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-time.Hour), UpdateTime: now.Add(-time.Hour),
+                Amount: 5000000000, Status: "ACTIVE",
+                Rate: 1000000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-time.Hour), UpdateTime: now.Add(-time.Hour),
+                Amount: 3000000000, Status: "ACTIVE",
+                Rate: 1200000000, Period: 2 }, "BTCUST" },
+    }
+    bt := eng.prepareBorrowTask(&ob, credits, 8000000000, now)
+    for _, id := range bt.LoanIdsToClose {
+        if id == 101 { t.Errorf("Excluded credit in task: %v", bt) }
+    }
+    if len(bt.LoanIdsToClose)!=1 {
+        t.Errorf("BorrowTask mismatch: %v", bt)
+    }
+    fp.closed = nil
+    if !eng.closeFundings([]uint64{ 101, 100 }) ||
+            !reflect.DeepEqual(fp.closed, []uint64{ 100 }) {
+        t.Errorf("Closed fundings mismatch: %v", fp.closed)
+    }
+}
+
+func TestCloseUnusedFundingsAtPeriodStart(t *testing.T) {
+    loans := []Loan{
+        Loan{ Id: 100, Currency: "UST", Side: -1, Amount: 5000000000,
+                Status: "ACTIVE", Rate: 1000000000, Period: 2 },
+    }
+    eng := getTestEngine0()
+    fp := &fakePrivateApi{ loans: loans }
+    eng.bpriv = fp
+    // disabled - unused funding kept as reserve
+    if !eng.closeUnusedFundingsAtPeriodStart() || len(fp.closed)!=0 {
+        t.Errorf("Closed fundings mismatch: %v", fp.closed)
+    }
+    eng.config.CloseUnusedFundings = true
+    if !eng.closeUnusedFundingsAtPeriodStart() ||
+            !reflect.DeepEqual(fp.closed, []uint64{ 100 }) {
+        t.Errorf("Closed fundings mismatch: %v", fp.closed)
+    }
+    
+    // enabled by default
+    var config Config
+    configFromJson(fastjson.MustParse(`{"currency":"UST"}`), &config)
+    if !config.CloseUnusedFundings {
+        t.Errorf("Closing unused fundings is not enabled by default")
+    }
+    configFromJson(fastjson.MustParse(`{"closeUnusedFundings":false}`), &config)
+    if config.CloseUnusedFundings {
+        t.Errorf("Closing unused fundings is not disabled")
+    }
+}
+
+func TestConfigMinOrderAmountUnit(t *testing.T) {
+    // all forms are 150 USD
+    for _, str := range []string{ `150`, `150.0`, `"150"`, `"150 USD"`, `" 150 usd "`,
+                    `"150.00000000 USD"` } {
+        var config Config
+        configFromJson(fastjson.MustParse(`{"minOrderAmount":` + str + `}`), &config)
+        if config.MinOrderAmount!=15000000000 {
+            t.Errorf("MinOrderAmount mismatch for %s: %v", str, config.MinOrderAmount)
+        }
+    }
+    for _, str := range []string{ `"150 EUR"`, `"150 USD x"`, `"USD"`, `""`, `"abc"` } {
+        err, _ := recoverCall(func() {
+            var config Config
+            configFromJson(fastjson.MustParse(`{"minOrderAmount":` + str + `}`),
+                           &config)
+        })
+        if _, ok := err.(*ParseError); !ok {
+            t.Errorf("No parse error for %s: %v", str, err)
+        }
+    }
+}
+
+func TestDoBorrowTaskRecheckBeforeClose(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.RecheckBeforeClose = true
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    // task prepared for short position 80 UST
+    bt := BorrowTask{ 8000000000, []uint64{ 100, 101 }, 400000000 }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    fp.loans = []Loan{
+        Loan{ Id: 200, Currency: "UST", Side: -1, Amount: 8000000000,
+                Status: "ACTIVE", Rate: 400000000, Period: 2 } }
+    fp.credits = []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1, Amount: 5000000000,
+                Status: "ACTIVE", Rate: 900000000, Period: 2 }, "USTUSD" },
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1, Amount: 3000000000,
+                Status: "ACTIVE", Rate: 800000000, Period: 2 }, "USTUSD" },
+    }
+    eng.bpriv = fp
+    var res BorrowResult
+    
+    // position did not change
+    fp.positions = []Position{ Position{ Status: "ACTIVE", Market: "USTUSD",
+                Amount: 8000000000 } }
+    if !eng.doBorrowTask(&bt, &res) || !reflect.DeepEqual(fp.closed, []uint64{ 100, 101 }) {
+        t.Errorf("Closed fundings mismatch: %v", fp.closed)
+    }
+    // position shrank during task - its funding has been returned
+    fp.closed = nil
+    fp.positions = []Position{ Position{ Status: "ACTIVE", Market: "USTUSD",
+                Amount: 5000000000 } }
+    fp.credits = fp.credits[:1]
+    if !eng.doBorrowTask(&bt, &res) || !reflect.DeepEqual(fp.closed, []uint64{ 100 }) {
+        t.Errorf("Closed fundings mismatch: %v", fp.closed)
+    }
+    // position grew during task - close would leave it under-funded
+    fp.closed = nil
+    fp.positions = []Position{ Position{ Status: "ACTIVE", Market: "USTUSD",
+                Amount: 9000000000 } }
+    if !eng.doBorrowTask(&bt, &res) || len(fp.closed)!=0 {
+        t.Errorf("Closed fundings mismatch: %v", fp.closed)
+    }
+}
+
+func TestDoBorrowTaskHiddenPartialFill(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    bt := BorrowTask{ 8000000000, []uint64{ 100 }, 400000000 }
+    // hidden offer is not in public orderbook, but it is in private active orders
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555,
+                Hidden: true }, Success: true } }
+    fp.orders = []Order{ Order{ Id: 555, Currency: "UST", Amount: 3000000000,
+                AmountOrig: 8000000000, Status: OrderPartiallyFilled,
+                Rate: 440000000, Period: 2, Hidden: true } }
+    eng.bpriv = fp
+    var res BorrowResult
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed")
+    }
+    if !res.Verified || res.Filled!=5000000000 {
+        t.Errorf("Result mismatch: %v", res)
+    }
+    if !reflect.DeepEqual(fp.canceled, []uint64{ 555 }) {
+        t.Errorf("Canceled orders mismatch: %v", fp.canceled)
+    }
+}
+
+func TestDoBorrowTaskProportionalClose(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    // 20 for uncovered positions and 100 for replaced fundings
+    bt := BorrowTask{ 120000000000, []uint64{ 101, 100 }, 400000000 }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true }, credits: testReplacedCredits() }
+    eng.bpriv = fp
+    cases := []struct {
+        remaining godec64.UDec64
+        expClosed []uint64
+        expNotClosed []uint64
+    }{
+        // filled 90: 70 for fundings, lowest rate first
+        { 30000000000, []uint64{ 100 }, []uint64{ 101 } },
+        // filled 30: only 10 for fundings
+        { 90000000000, nil, []uint64{ 100, 101 } },
+        // filled 110: 90 for fundings
+        { 10000000000, []uint64{ 100 }, []uint64{ 101 } },
+        // fully filled - all closed
+        { 0, []uint64{ 101, 100 }, nil },
+    }
+    for i, c := range cases {
+        fp.closed, fp.canceled = nil, nil
+        fp.orders = nil
+        if c.remaining != 0 {
+            fp.orders = []Order{ Order{ Id: 555, Currency: "UST", Amount: c.remaining,
+                        AmountOrig: 120000000000, Status: OrderPartiallyFilled,
+                        Rate: 400000000, Period: 2 } }
+        }
+        var res BorrowResult
+        if !eng.doBorrowTask(&bt, &res) {
+            t.Errorf("Borrow task %d failed", i)
+        }
+        if res.Filled != 120000000000 - c.remaining {
+            t.Errorf("Filled mismatch %d: %v", i, res)
+        }
+        if !reflect.DeepEqual(fp.closed, c.expClosed) ||
+                !reflect.DeepEqual(res.NotClosed, c.expNotClosed) {
+            t.Errorf("Closed fundings mismatch %d: %v,%v!=%v,%v", i, c.expClosed,
+                     c.expNotClosed, fp.closed, res.NotClosed)
+        }
+    }
+}
+
+func TestDoBorrowTaskMinFillFraction(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.config.MinFillFraction = 0.95
+    bt := BorrowTask{ 120000000000, []uint64{ 101, 100 }, 400000000 }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true }, credits: testReplacedCredits() }
+    eng.bpriv = fp
+    // filled 90 of 120 - nothing closed
+    fp.orders = []Order{ Order{ Id: 555, Currency: "UST", Amount: 30000000000,
+                AmountOrig: 120000000000, Status: OrderPartiallyFilled,
+                Rate: 400000000, Period: 2 } }
+    var res BorrowResult
+    if eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task with low fill succeeded")
+    }
+    if len(fp.closed)!=0 || !reflect.DeepEqual(res.NotClosed, []uint64{ 101, 100 }) {
+        t.Errorf("Closed fundings mismatch: %v %v", fp.closed, res.NotClosed)
+    }
+    if !res.Verified || res.Filled!=90000000000 {
+        t.Errorf("Result mismatch: %v", res)
+    }
+    // filled 115 of 120 - fundings covered by fill are closed
+    fp.orders = []Order{ Order{ Id: 555, Currency: "UST", Amount: 5000000000,
+                AmountOrig: 120000000000, Status: OrderPartiallyFilled,
+                Rate: 400000000, Period: 2 } }
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed")
+    }
+    if !reflect.DeepEqual(fp.closed, []uint64{ 100 }) {
+        t.Errorf("Closed fundings mismatch: %v", fp.closed)
+    }
+}
+
+func TestDoBorrowTaskMaxFRRMultiple(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.config.MaxFRRMultiple = 1.5
+    eng.getFRR = func() godec64.UDec64 { return 400000000 }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    eng.bpriv = fp
+    // task rate above 1.5*FRR is clamped to 600000000
+    bt := BorrowTask{ 8000000000, []uint64{ 100 }, 1000000000 }
+    var res BorrowResult
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed")
+    }
+    // also max rate of order (rate+10%) is clamped
+    if len(fp.submitted)!=1 || fp.submitted[0].Rate!=600000000 {
+        t.Errorf("Submitted orders mismatch: %v", fp.submitted)
+    }
+    // rate below limit is not changed
+    fp.submitted = nil
+    bt = BorrowTask{ 8000000000, []uint64{ 100 }, 500000000 }
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed")
+    }
+    if len(fp.submitted)!=1 || fp.submitted[0].Rate!=550000000 {
+        t.Errorf("Submitted orders mismatch: %v", fp.submitted)
+    }
+}
+
+func TestDoBorrowTaskMinBorrowRate(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.config.MinBorrowRate = 500000000
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    eng.bpriv = fp
+    // task rate below floor is raised to 500000000
+    bt := BorrowTask{ 8000000000, []uint64{ 100 }, 300000000 }
+    var res BorrowResult
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed")
+    }
+    if len(fp.submitted)!=1 || fp.submitted[0].Rate!=550000000 {
+        t.Errorf("Submitted orders mismatch: %v", fp.submitted)
+    }
+    // rate above floor is not changed
+    fp.submitted = nil
+    bt = BorrowTask{ 8000000000, []uint64{ 100 }, 700000000 }
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed")
+    }
+    if len(fp.submitted)!=1 || fp.submitted[0].Rate!=770000000 {
+        t.Errorf("Submitted orders mismatch: %v", fp.submitted)
+    }
+    // orderbook offers below floor have floor rate
+    ob := &OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 1000000000, 300000000, 1 },
+            OrderBookEntry{ 2, 1000000000, 600000000, 1 } } }
+    raisedOb := raiseOrderBookRates(ob, eng.config.MinBorrowRate)
+    if raisedOb.Ask[0].Rate!=500000000 || raisedOb.Ask[1].Rate!=600000000 ||
+            ob.Ask[0].Rate!=300000000 {
+        t.Errorf("Raised orderbook mismatch: %v %v", raisedOb, ob)
+    }
+}
+
+func TestDoBorrowTaskRoundAmount(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.config.ExchangeAmountPrecisions = map[string]uint{ "UST": 2 }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    eng.bpriv = fp
+    // 1234.56789012 rounded down to 1234.56
+    bt := BorrowTask{ 123456789012, []uint64{ 100 }, 500000000 }
+    var res BorrowResult
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed")
+    }
+    if len(fp.submitted)!=1 || fp.submitted[0].Amount!=123456000000 {
+        t.Errorf("Submitted orders mismatch: %v", fp.submitted)
+    }
+    // other currency is not rounded
+    eng.config.ExchangeAmountPrecisions = map[string]uint{ "USD": 2 }
+    fp.submitted = nil
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed")
+    }
+    if len(fp.submitted)!=1 || fp.submitted[0].Amount!=123456789012 {
+        t.Errorf("Submitted orders mismatch: %v", fp.submitted)
+    }
+}
+
+func TestBorrowWithRetries(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.MinOrderAmount = 0
+    eng.config.MaxBorrowAttempts = 2
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    obs := 0
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        obs++
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 30000000000, 410000000, 1 },
+            OrderBookEntry{ 2, 50000000000, 420000000, 1 } } }
+    }
+    bt := BorrowTask{ 100000000000, []uint64{ 100, 101 }, 400000000 }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true }, credits: testReplacedCredits() }
+    eng.bpriv = fp
+    // first attempt partially fills 60 and leaves offer open, second amends
+    // it to rest with fresh orderbook and replaces funding kept by first attempt
+    fp.orders = []Order{ Order{ Id: 555, Amount: 40000000000,
+                AmountOrig: 100000000000, Status: OrderPartiallyFilled } }
+    eng.clock = sleepFuncClock{ sleep: func(time.Duration) {
+        // amended offer is filled
+        if len(fp.updated) != 0 { fp.orders = nil }
+    } }
+    eng.borrowWithRetries(bt, 100000000)
+    if obs!=1 || len(fp.submitted)!=1 || len(fp.updated)!=1 {
+        t.Fatalf("Attempts mismatch: %d,%v,%v", obs, fp.submitted, fp.updated)
+    }
+    expUpdated := Order{ Id: 555, Currency: "UST", Amount: 40000000000,
+                Rate: 462000000 }
+    if fp.updated[0]!=expUpdated {
+        t.Errorf("Retry order mismatch: %v!=%v", expUpdated, fp.updated[0])
+    }
+    // no cancel and submit of new offer
+    if len(fp.canceled)!=0 || len(fp.closed)!=2 {
+        t.Errorf("Canceled or closed mismatch: %v %v", fp.canceled, fp.closed)
+    }
+    if eng.retryOrderId!=0 || eng.keepRetryOrder {
+        t.Errorf("Retry order not cleared: %v", eng.retryOrderId)
+    }
+    
+    // failed submit - retry whole task with fresh orderbook
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    obs = 0
+    fp.submitted, fp.canceled, fp.closed, fp.updated = nil, nil, nil, nil
+    fp.submitResult = OpResult{ Message: "error" }
+    bt = BorrowTask{ 60000000000, []uint64{ 100 }, 400000000 }
+    eng.borrowWithRetries(bt, 100000000)
+    if obs!=1 || len(fp.submitted)!=2 || fp.submitted[1].Amount!=60000000000 ||
+            fp.submitted[1].Rate!=462000000 || len(fp.closed)!=0 {
+        t.Errorf("Retry after failed submit mismatch: %d,%v,%v", obs, fp.submitted,
+                 fp.closed)
+    }
+    
+    // no retries by default
+    obs = 0
+    fp.submitted = nil
+    fp.submitResult = OpResult{ Order: Order{ Id: 555 }, Success: true }
+    eng.config.MaxBorrowAttempts = 0
+    fp.orders = []Order{ Order{ Id: 555, Amount: 40000000000,
+                AmountOrig: 100000000000, Status: OrderPartiallyFilled } }
+    eng.borrowWithRetries(BorrowTask{ 100000000000, []uint64{ 100, 101 }, 400000000 },
+                          100000000)
+    if obs!=0 || len(fp.submitted)!=1 {
+        t.Errorf("Retry without MaxBorrowAttempts: %d,%v", obs, fp.submitted)
+    }
+    
+    // offer left open is filled before retry - update fails and filled
+    // amount of canceled offer is used
+    fp.submitted, fp.canceled, fp.closed, fp.updated = nil, nil, nil, nil
+    eng.config.MaxBorrowAttempts = 2
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        fp.orders = nil
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 80000000000, 410000000, 1 } } }
+    }
+    fp.orders = []Order{ Order{ Id: 555, Amount: 40000000000,
+                AmountOrig: 100000000000, Status: OrderPartiallyFilled } }
+    borrowed, _ := eng.borrowWithRetries(
+            BorrowTask{ 100000000000, []uint64{ 100, 101 }, 400000000 }, 100000000)
+    if len(fp.submitted)!=1 || len(fp.updated)!=1 ||
+            !reflect.DeepEqual(fp.canceled, []uint64{ 555 }) {
+        t.Errorf("Orders mismatch: %v %v %v", fp.submitted, fp.updated, fp.canceled)
+    }
+    if borrowed!=100000000000 || len(fp.closed)!=2 {
+        t.Errorf("Borrowed or closed mismatch: %v %v", borrowed, fp.closed)
+    }
+}
+
+func TestBorrowWithRetriesCarry(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.MinOrderAmount = 0
+    eng.config.MaxBorrowAttempts = 2
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true }, credits: testReplacedCredits() }
+    eng.bpriv = fp
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 30000000000, 410000000, 1 },
+            OrderBookEntry{ 2, 50000000000, 420000000, 1 } } }
+    }
+    eng.clock = sleepFuncClock{ sleep: func(time.Duration) {
+        // retry fills 20 of 70
+        if len(fp.updated) != 0 && len(fp.orders) != 0 {
+            fp.orders[0].Amount = 50000000000
+        }
+    } }
+    // first attempt fills 30: too little for any funding, 30 is carried
+    fp.orders = []Order{ Order{ Id: 555, Amount: 70000000000,
+                AmountOrig: 100000000000, Status: OrderPartiallyFilled } }
+    borrowed, closed := eng.borrowWithRetries(
+            BorrowTask{ 100000000000, []uint64{ 100, 101 }, 400000000 }, 100000000)
+    if len(fp.submitted)!=1 || len(fp.updated)!=1 ||
+            fp.updated[0].Amount!=70000000000 {
+        t.Fatalf("Attempts mismatch: %v %v", fp.submitted, fp.updated)
+    }
+    // amended offer is canceled after last attempt
+    if !reflect.DeepEqual(fp.canceled, []uint64{ 555 }) {
+        t.Errorf("Canceled mismatch: %v", fp.canceled)
+    }
+    // 30+20 covers funding 101
+    if borrowed!=50000000000 || !reflect.DeepEqual(closed, []uint64{ 101 }) ||
+            !reflect.DeepEqual(fp.closed, []uint64{ 101 }) {
+        t.Errorf("Closed mismatch: %v %v %v", borrowed, closed, fp.closed)
+    }
+}
+
+func TestDoBorrowTaskAutoRenew(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    bt := BorrowTask{ 100000000000, []uint64{ 100 }, 400000000 }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    eng.bpriv = fp
+    now := time.Now()
+    fp.credits = []Credit{
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-48*time.Hour), Amount: 10000000000,
+                Status: "ACTIVE", Rate: 1000000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 102, Currency: "UST", Side: -1, CreateTime: now,
+                Amount: 70000000000, Status: "ACTIVE",
+                Rate: 400000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 103, Currency: "UST", Side: -1, CreateTime: now,
+                Amount: 30000000000, Status: "ACTIVE",
+                Rate: 400000000, Period: 2, Renew: true }, "BTCUST" },
+    }
+    var res BorrowResult
+    if !eng.doBorrowTask(&bt, &res) || len(fp.kept)!=0 {
+        t.Errorf("Keep funding without AutoRenewBorrow: %v", fp.kept)
+    }
+    eng.config.AutoRenewBorrow = true
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed")
+    }
+    if len(fp.kept)!=1 || fp.kept[0]!=102 {
+        t.Errorf("Kept fundings mismatch: %v", fp.kept)
+    }
+}
+
+func TestDoBorrowTaskExchangeMin(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    eng.config.ExchangeMinAmounts = map[string]godec64.UDec64{
+        "UST": 15000000000 }
+    bt := BorrowTask{ 10000000000, []uint64{ 100 }, 400000000 }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    eng.bpriv = fp
+    // skip borrow
+    var res BorrowResult
+    if eng.doBorrowTask(&bt, &res) || !res.Skipped || len(fp.submitted)!=0 {
+        t.Errorf("Borrow not skipped: %v %v", res, fp.submitted)
+    }
+    // bump to exchange minimum
+    eng.config.BumpToExchangeMin = true
+    if !eng.doBorrowTask(&bt, &res) || res.Skipped {
+        t.Errorf("Borrow task failed: %v", res)
+    }
+    if len(fp.submitted)!=1 || fp.submitted[0].Amount!=15000000000 {
+        t.Errorf("Submitted mismatch: %v", fp.submitted)
+    }
+    // amount above minimum is unchanged
+    fp.submitted = nil
+    bt.TotalBorrow = 20000000000
+    if !eng.doBorrowTask(&bt, &res) || len(fp.submitted)!=1 ||
+            fp.submitted[0].Amount!=20000000000 {
+        t.Errorf("Submitted mismatch: %v", fp.submitted)
+    }
+}
+
+func TestPrepareBorrowTaskExpiryGrace(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.ExpiryGrace = 10*time.Minute
+    // next auto loan time is 15:55:00
+    now := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    ob := OrderBook{
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 200000000, 1 },
+        },
+    }
+    getCredits := func(expireTime time.Time) []Credit {
+        return []Credit{
+            Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                    CreateTime: now.Add(-time.Hour), UpdateTime: now.Add(-time.Hour),
+                    Amount: 5000000000, Status: "ACTIVE",
+                    Rate: 1000000000, Period: 2 }, "BTCUST" },
+            Credit{ Loan{ Id: 101, Currency: "UST", Side: -1,
+                    CreateTime: expireTime.Add(-48*time.Hour),
+                    UpdateTime: expireTime.Add(-48*time.Hour),
+                    Amount: 3000000000, Status: "ACTIVE",
+                    Rate: 1200000000, Period: 2 }, "BTCUST" },
+        }
+    }
+    // expires within grace - rolled, not closed
+    credits := getCredits(time.Date(2021, 9, 14, 16, 4, 59, 0, time.UTC))
+    bt := eng.prepareBorrowTask(&ob, credits, 8000000000, now)
+    expBt := BorrowTask{ 8000000000, []uint64{ 100 }, 200000000 }
+    if !equalBorrowTask(&expBt, &bt) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expBt, bt)
+    }
+    // expires exactly at end of grace - normal credit
+    credits = getCredits(time.Date(2021, 9, 14, 16, 5, 0, 0, time.UTC))
+    bt = eng.prepareBorrowTask(&ob, credits, 8000000000, now)
+    expBt = BorrowTask{ 8000000000, []uint64{ 101, 100 }, 200000000 }
+    if !equalBorrowTask(&expBt, &bt) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expBt, bt)
+    }
+    // without grace
+    eng.config.ExpiryGrace = 0
+    credits = getCredits(time.Date(2021, 9, 14, 16, 4, 59, 0, time.UTC))
+    bt = eng.prepareBorrowTask(&ob, credits, 8000000000, now)
+    if !equalBorrowTask(&expBt, &bt) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expBt, bt)
+    }
+}
+
+func TestPrepareBorrowTaskRollExpiringCredits(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.RollExpiringCredits = false
+    // next auto loan time is 15:55:00
+    now := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    ob := OrderBook{
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 200000000, 1 },
+        },
+    }
+    expireTime := time.Date(2021, 9, 14, 15, 50, 0, 0, time.UTC)
+    credits := []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-time.Hour), UpdateTime: now.Add(-time.Hour),
+                Amount: 5000000000, Status: "ACTIVE",
+                Rate: 1000000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1,
+                CreateTime: expireTime.Add(-48*time.Hour),
+                UpdateTime: expireTime.Add(-48*time.Hour),
+                Amount: 3000000000, Status: "ACTIVE",
+                Rate: 1200000000, Period: 2 }, "BTCUST" },
+    }
+    // expiring credit lapses - not borrowed again
+    bt := eng.prepareBorrowTask(&ob, credits, 8000000000, now)
+    expBt := BorrowTask{ 5000000000, []uint64{ 100 }, 200000000 }
+    if !equalBorrowTask(&expBt, &bt) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expBt, bt)
+    }
+    // rolled by default
+    eng.config.RollExpiringCredits = true
+    bt = eng.prepareBorrowTask(&ob, credits, 8000000000, now)
+    expBt = BorrowTask{ 8000000000, []uint64{ 100 }, 200000000 }
+    if !equalBorrowTask(&expBt, &bt) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expBt, bt)
+    }
+}
+
+func TestPrepareBorrowTaskCostModel(t *testing.T) {
+    eng := getTestEngine0()
+    // next auto loan time is 15:55:00
+    now := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    ob := OrderBook{
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 200000000, 1 },
+        },
+    }
+    credits := []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-time.Hour), UpdateTime: now.Add(-time.Hour),
+                Amount: 5000000000, Status: "ACTIVE",
+                Rate: 280000000, Period: 2 }, "BTCUST" },
+    }
+    // without fee credit is replaced: 0.002 <= 0.0028*0.8
+    bt := eng.prepareBorrowTask(&ob, credits, 5000000000, now)
+    expBt := BorrowTask{ 5000000000, []uint64{ 100 }, 200000000 }
+    if !equalBorrowTask(&expBt, &bt) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expBt, bt)
+    }
+    // fee is charged from both sides - decision is unchanged:
+    // 0.002*1.15 <= 0.0028*1.15*0.8
+    eng.config.BorrowFee = 0.15
+    bt = eng.prepareBorrowTask(&ob, credits, 5000000000, now)
+    expBt = BorrowTask{ 5000000000, []uint64{ 100 }, 200000000 }
+    if !equalBorrowTask(&expBt, &bt) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expBt, bt)
+    }
+    // credit rate close to orderbook - kept with and without fee
+    credits[0].Rate = 240000000
+    for _, fee := range []float64{ 0, 0.15 } {
+        eng.config.BorrowFee = fee
+        bt = eng.prepareBorrowTask(&ob, credits, 5000000000, now)
+        expBt = BorrowTask{}
+        if !equalBorrowTask(&expBt, &bt) {
+            t.Errorf("BorrowTask mismatch for fee %v: %v!=%v", fee, expBt, bt)
+        }
+    }
+    credits[0].Rate = 280000000
+    // minimal interest for credit expiring soon
+    eng.config.BorrowFee = 0
+    eng.config.MinInterestPeriod = 2*time.Hour
+    bt = eng.prepareBorrowTask(&ob, credits, 5000000000, now)
+    expBt = BorrowTask{ 5000000000, []uint64{ 100 }, 200000000 }
+    if !equalBorrowTask(&expBt, &bt) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expBt, bt)
+    }
+    credits[0].CreateTime = time.Date(2021, 9, 12, 16, 20, 0, 0, time.UTC)
+    bt = eng.prepareBorrowTask(&ob, credits, 5000000000, now)
+    expBt = BorrowTask{}
+    if !equalBorrowTask(&expBt, &bt) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expBt, bt)
+    }
+    // interest for 2 hours (minimal period) instead 1 hour
+    cost := eng.effectiveBorrowCost(0.001, 1000, time.Hour)
+    if cost < 0.0833 || cost > 0.0834 {
+        t.Errorf("Cost mismatch: %v", cost)
+    }
+}
+
+func TestPrepareBorrowTaskAutoRenew(t *testing.T) {
+    eng := getTestEngine0()
+    now := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    ob := OrderBook{
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 200000000, 1 },
+        },
+    }
+    credits := []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-time.Hour), UpdateTime: now.Add(-time.Hour),
+                Amount: 5000000000, Status: "ACTIVE",
+                Rate: 1000000000, Period: 2 }, "BTCUST" },
+        // expires before next auto loan time, but it will be renewed
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-48*time.Hour + 5*time.Minute),
+                UpdateTime: now.Add(-48*time.Hour + 5*time.Minute),
+                Amount: 3000000000, Status: "ACTIVE",
+                Rate: 100000000, Period: 2, Renew: true }, "BTCUST" },
+    }
+    bt := eng.prepareBorrowTask(&ob, credits, 8000000000, now)
+    expBt := BorrowTask{ 8000000000, []uint64{ 100 }, 200000000 }
+    if !equalBorrowTask(&expBt, &bt) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expBt, bt)
+    }
+    eng.config.AutoRenewBorrow = true
+    bt = eng.prepareBorrowTask(&ob, credits, 8000000000, now)
+    expBt = BorrowTask{ 5000000000, []uint64{ 100 }, 200000000 }
+    if !equalBorrowTask(&expBt, &bt) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expBt, bt)
+    }
+}
+
+func TestPrepareBorrowTaskPreferCloseNonRenewing(t *testing.T) {
+    eng := getTestEngine0()
+    now := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    // orderbook can replace only one credit
+    ob := OrderBook{
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 5000000000, 200000000, 1 },
+        },
+    }
+    credits := []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-time.Hour), UpdateTime: now.Add(-time.Hour),
+                Amount: 5000000000, Status: "ACTIVE",
+                Rate: 3000000000, Period: 2, Renew: true }, "BTCUST" },
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-time.Hour), UpdateTime: now.Add(-time.Hour),
+                Amount: 5000000000, Status: "ACTIVE",
+                Rate: 2000000000, Period: 2 }, "BTCUST" },
+    }
+    bt := eng.prepareBorrowTask(&ob, credits, 10000000000, now)
+    expBt := BorrowTask{ 5000000000, []uint64{ 100 }, 200000000 }
+    if !equalBorrowTask(&expBt, &bt) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expBt, bt)
+    }
+    // non-renewing credit is closed first
+    eng.config.PreferCloseNonRenewing = true
+    bt = eng.prepareBorrowTask(&ob, credits, 10000000000, now)
+    expBt = BorrowTask{ 5000000000, []uint64{ 101 }, 200000000 }
+    if !equalBorrowTask(&expBt, &bt) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expBt, bt)
+    }
+    // renewing credit is closed if orderbook can replace both
+    ob.Ask[0].Amount = 10000000000
+    bt = eng.prepareBorrowTask(&ob, credits, 10000000000, now)
+    expBt = BorrowTask{ 10000000000, []uint64{ 101, 100 }, 200000000 }
+    if !equalBorrowTask(&expBt, &bt) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expBt, bt)
+    }
+}
+
+func TestDoBorrowTaskChase(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.ChaseDuration = 3*chaseInterval
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true }, keepSubmitted: true }
+    eng.bpriv = fp
+    // descending orderbook, 40 filled at third check
+    askRates := []godec64.UDec64{ 500000000, 400000000, 400000000, 300000000 }
+    obs := 0
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        if obs == 2 { fp.orders[0].Amount = 60000000000 }
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, askRates[obs], 1 } } }
+        obs++
+    }
+    bt := BorrowTask{ 100000000000, []uint64{ 100 }, 450000000 }
+    var res BorrowResult
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed")
+    }
+    // offer rate never higher than task rate
+    expSubmitted := []Order{
+        Order{ Currency: "UST", Amount: 100000000000, Rate: 450000000, Period: 2 },
+        // rest with normal order
+        Order{ Currency: "UST", Amount: 60000000000, Rate: 495000000, Period: 2 } }
+    if len(fp.submitted)!=len(expSubmitted) {
+        t.Fatalf("Submitted orders mismatch: %v!=%v", expSubmitted, fp.submitted)
+    }
+    for i := range expSubmitted {
+        if fp.submitted[i]!=expSubmitted[i] {
+            t.Errorf("Submitted order %d mismatch: %v!=%v", i, expSubmitted[i],
+                     fp.submitted[i])
+        }
+    }
+    // repriced downward in place
+    expUpdated := []Order{
+        Order{ Id: 555, Currency: "UST", Amount: 100000000000, Rate: 400000000 },
+        Order{ Id: 555, Currency: "UST", Amount: 60000000000, Rate: 300000000 } }
+    if len(fp.updated)!=len(expUpdated) || fp.updated[0]!=expUpdated[0] ||
+            fp.updated[1]!=expUpdated[1] {
+        t.Errorf("Updated orders mismatch: %v!=%v", expUpdated, fp.updated)
+    }
+    if len(fp.canceled)!=2 || !res.Submitted || !res.Verified ||
+            res.Filled!=40000000000 {
+        t.Errorf("Result mismatch: %v %v", fp.canceled, res)
+    }
+    if eng.ChaseOrderId()!=0 {
+        t.Errorf("Chase order id not cleared: %v", eng.ChaseOrderId())
+    }
+    
+    // chased offer filled
+    fp.submitted, fp.canceled, fp.orders = nil, nil, nil
+    obs = 0
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, askRates[obs], 1 } } }
+        obs++
+    }
+    eng.clock = sleepFuncClock{ sleep: func(time.Duration) {
+        // executed while waiting
+        fp.orders = nil
+        fp.orderStates = []Order{ Order{ Id: 555, AmountOrig: 100000000000,
+                    Status: OrderExecuted } }
+    } }
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed")
+    }
+    if len(fp.submitted)!=1 || len(fp.canceled)!=0 || res.Filled!=100000000000 {
+        t.Errorf("Orders mismatch: %v %v %v", fp.submitted, fp.canceled, res)
+    }
+}
+
+func TestDoBorrowTaskChaseOfferNotFound(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.ChaseDuration = 3*chaseInterval
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true }, keepSubmitted: true,
+                        credits: testReplacedCredits() }
+    eng.bpriv = fp
+    // 60 filled at second check, then offer vanishes
+    obs := 0
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        switch obs {
+            case 1: fp.orders[0].Amount = 40000000000
+            case 2: fp.orders = nil
+        }
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 400000000, 1 } } }
+        obs++
+    }
+    bt := BorrowTask{ 100000000000, []uint64{ 100, 101 }, 450000000 }
+    var res BorrowResult
+    eng.doBorrowTask(&bt, &res)
+    // no new offer for rest - last known fill is assumed
+    if len(fp.submitted)!=1 || len(fp.canceled)!=0 {
+        t.Errorf("Orders mismatch: %v %v", fp.submitted, fp.canceled)
+    }
+    if !res.Verified || res.Filled!=60000000000 {
+        t.Errorf("Result mismatch: %v", res)
+    }
+    if !reflect.DeepEqual(fp.closed, []uint64{ 100 }) ||
+            !reflect.DeepEqual(res.NotClosed, []uint64{ 101 }) {
+        t.Errorf("Closed fundings mismatch: %v %v", fp.closed, res.NotClosed)
+    }
+    if eng.ChaseOrderId()!=0 {
+        t.Errorf("Chase order id not cleared: %v", eng.ChaseOrderId())
+    }
+}
+
+func TestDoBorrowTaskChaseRestFailed(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.ChaseDuration = 3*chaseInterval
+    eng.config.ConfirmCancel = true
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    fp := &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true }, keepSubmitted: true,
+                        credits: testReplacedCredits() }
+    eng.bpriv = fp
+    // 40 filled by chase, cancel of rest order is not confirmed
+    obs := 0
+    eng.getMaxOrderBook = func(ob *OrderBook) {
+        if obs == 2 { fp.orders[0].Amount = 60000000000 }
+        *ob = OrderBook{ Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 100000000000, 400000000, 1 } } }
+        obs++
+    }
+    bt := BorrowTask{ 100000000000, []uint64{ 101, 100 }, 450000000 }
+    var res BorrowResult
+    if eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task succeeded")
+    }
+    if !res.Verified || res.Filled!=40000000000 {
+        t.Errorf("Result mismatch: %v", res)
+    }
+    // only funding covered by chase fill is closed
+    if !reflect.DeepEqual(fp.closed, []uint64{ 101 }) ||
+            !reflect.DeepEqual(res.NotClosed, []uint64{ 100 }) {
+        t.Errorf("Closed fundings mismatch: %v %v", fp.closed, res.NotClosed)
+    }
+}
+func TestPrepareBorrowTaskKeepCheaperCredits(t *testing.T) {
+    eng := getTestEngine0()
+    now := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    ob := OrderBook{
+        Ask: []OrderBookEntry{
+            OrderBookEntry{ 2, 10000000000, 200000000, 1 },
+            OrderBookEntry{ 2, 10000000000, 400000000, 1 },
+        },
+    }
+    credits := []Credit{
+        Credit{ Loan{ Id: 100, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-24*time.Hour),
+                UpdateTime: now.Add(-24*time.Hour),
+                Amount: 10000000000, Status: "ACTIVE",
+                Rate: 1000000000, Period: 2 }, "BTCUST" },
+        Credit{ Loan{ Id: 101, Currency: "UST", Side: -1,
+                CreateTime: now.Add(-23*time.Hour),
+                UpdateTime: now.Add(-23*time.Hour),
+                Amount: 10000000000, Status: "ACTIVE",
+                Rate: 300000000, Period: 2 }, "BTCUST" },
+    }
+    // cheap credit 101 closed because average rate is better
+    resTask := eng.prepareBorrowTask(&ob, credits, sumTotalCredits(credits), now)
+    expTask := BorrowTask{ 20000000000, []uint64{ 100, 101 }, 400000000 }
+    if !equalBorrowTask(&expTask, &resTask) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expTask, resTask)
+    }
+    eng.config.KeepCheaperCredits = true
+    resTask = eng.prepareBorrowTask(&ob, credits, sumTotalCredits(credits), now)
+    expTask = BorrowTask{ 10000000000, []uint64{ 100 }, 400000000 }
+    if !equalBorrowTask(&expTask, &resTask) {
+        t.Errorf("BorrowTask mismatch: %v!=%v", expTask, resTask)
+    }
+}
+
+func TestTaskTimeInPeriodSeeded(t *testing.T) {
+    defer func(src io.Reader) { randomSource = src }(randomSource)
+    alPeriodTime := time.Date(2021, 9, 14, 15, 0, 0, 0, time.UTC)
+    alEnd := alPeriodTime.Add(10*time.Minute)
+    // task time for seed 17
+    expTaskTime := time.Date(2021, 9, 14, 15, 9, 47, 202000000, time.UTC)
+    
+    randomSource = rand.New(rand.NewSource(17))
+    taskTime := taskTimeInPeriod(alPeriodTime, 10*time.Minute)
+    if !taskTime.Equal(expTaskTime) {
+        t.Errorf("Task time mismatch: %v!=%v", expTaskTime, taskTime)
+    }
+    if taskTime.Before(alEnd.Add(-60100*time.Millisecond)) ||
+            taskTime.After(alEnd.Add(-100*time.Millisecond)) {
+        t.Errorf("Task time out of range: %v", taskTime)
+    }
+    // same seed gives same time
+    randomSource = rand.New(rand.NewSource(17))
+    if taskTime2 := taskTimeInPeriod(alPeriodTime, 10*time.Minute);
+            !taskTime2.Equal(taskTime) {
+        t.Errorf("Task time not deterministic: %v!=%v", taskTime, taskTime2)
+    }
+}
+
+func TestEngineFreshUSDPrice(t *testing.T) {
+    eng := getTestEngine0()
+    eng.config.Currency = "BTC"
+    eng.config.MaxPriceAge = 5*time.Minute
+    refreshes := 0
+    var refreshErr error
+    df := &DataFetcher{ currency: "BTC",
+        getMarketPrice: func(market string) godec64.UDec64 {
+            refreshes++
+            if refreshErr!=nil { panic(refreshErr) }
+            return 5000000000000
+        } }
+    df.marketPrice.Store(godec64.UDec64(4000000000000))
+    eng.df = df
+    // fresh price from websocket
+    atomic.StoreInt64(&df.rtMarketPriceLastUpdate, time.Now().Add(-time.Minute).Unix())
+    if price, ok := eng.freshUSDPrice(); !ok || price!=4000000000000 || refreshes!=0 {
+        t.Errorf("Fresh price mismatch: %v %v %d", price, ok, refreshes)
+    }
+    // stale price is refreshed
+    atomic.StoreInt64(&df.rtMarketPriceLastUpdate, time.Now().Add(-10*time.Minute).Unix())
+    if price, ok := eng.freshUSDPrice(); !ok || price!=5000000000000 || refreshes!=1 {
+        t.Errorf("Refreshed price mismatch: %v %v %d", price, ok, refreshes)
+    }
+    if age := df.USDPriceAge(time.Now()); age > time.Minute {
+        t.Errorf("Age after refresh is too big: %v", age)
+    }
+    // stale price and refresh fails - skip task
+    atomic.StoreInt64(&df.marketPriceLastUpdate, time.Now().Add(-10*time.Minute).Unix())
+    refreshErr = &HTTPError{ "Can't get ticker", 500 }
+    if _, ok := eng.freshUSDPrice(); ok || refreshes!=2 {
+        t.Errorf("Stale price used: %v %d", ok, refreshes)
+    }
+    // no limit
+    eng.config.MaxPriceAge = 0
+    if price, ok := eng.freshUSDPrice(); !ok || price!=5000000000000 || refreshes!=2 {
+        t.Errorf("Price without limit mismatch: %v %v %d", price, ok, refreshes)
+    }
+}
@@ -0,0 +1,173 @@
+/*
+ * errors.go - error types
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "github.com/valyala/fasthttp"
+)
+
+// bitfinex error codes
+const (
+    bitfinexErrNonceSmall = 10114
+    bitfinexErrApiKey = 10100
+    bitfinexErrRateLimit = 11010
+    bitfinexErrMaintenance = 20060
+    bitfinexErrWSSubscribeLimit = 10305  // reached limit of open channels
+)
+
+// error returned by exchange API
+type APIError struct {
+    Context string
+    Code uint64 // 0 if no code
+    Message string
+}
+
+func (e *APIError) Error() string {
+    if e.Code == 0 {
+        return fmt.Sprint(e.Context, ": ", e.Message)
+    }
+    return fmt.Sprint(e.Context, ": ", e.Code, " ", e.Message)
+}
+
+// error while parsing response or wrong layout of response
+type ParseError struct {
+    Context string
+    Err error
+}
+
+func (e *ParseError) Error() string {
+    if e.Err == nil { return e.Context }
+    return fmt.Sprint(e.Context, ": ", e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+    return e.Err
+}
+
+var errWrongJsonBody = &ParseError{ Context: "Wrong json body" }
+
+// error status of HTTP response
+type HTTPError struct {
+    Context string
+    Status int
+}
+
+func (e *HTTPError) Error() string {
+    return fmt.Sprint(e.Context, ": status code: ", fasthttp.StatusMessage(e.Status),
+                     " (", e.Status, ")")
+}
+
+func ParseErrorPanic(msg string, err error) {
+    panic(&ParseError{ Context: msg, Err: err })
+}
+
+// convert recovered panic value to error and check whether operation can be
+// retried (error is transient). auth, parse and client errors aborts operation.
+func classifyPanic(x interface{}) (error, bool) {
+    switch e := x.(type) {
+        case *APIError:
+            switch e.Code {
+                case bitfinexErrNonceSmall, bitfinexErrRateLimit,
+                        bitfinexErrMaintenance, bitfinexErrWSSubscribeLimit:
+                    return e, true
+            }
+            return e, false
+        case *HTTPError:
+            return e, e.Status >= 500 || e.Status == fasthttp.StatusTooManyRequests
+        case *ParseError:
+            return e, false
+        case error:
+            var netErr net.Error
+            return e, errors.As(e, &netErr)
+    }
+    return errors.New(fmt.Sprint(x)), false
+}
+
+// return true if error is websocket error about limit of subscribed channels
+func isSubscribeLimitError(err error) bool {
+    var apiErr *APIError
+    return errors.As(err, &apiErr) && apiErr.Code == bitfinexErrWSSubscribeLimit
+}
+
+// return true if error is exchange error about invalid (revoked) API key
+func isApiKeyError(err error) bool {
+    var apiErr *APIError
+    return errors.As(err, &apiErr) && apiErr.Code == bitfinexErrApiKey
+}
+
+// call function and recover panic. returns nil if no panic.
+func recoverCall(f func()) (err error, retry bool) {
+    defer func() {
+        if x := recover(); x!=nil {
+            err, retry = classifyPanic(x)
+        }
+    }()
+    f()
+    return nil, false
+}
+
+// exit codes of fatal failures
+const (
+    exitFatal = 1
+    exitConfigInvalid = 2
+    exitAuthFailed = 3
+    exitMarketsFetchFailed = 4
+    exitWebsocketDialFailed = 5
+    exitApiKeyInvalid = 6
+)
+
+// fatal failure (at startup or at runtime) with exit code
+type StartupError struct {
+    Code int
+    Context string
+    Err error
+}
+
+func (e *StartupError) Error() string {
+    return fmt.Sprint(e.Context, ": ", e.Err)
+}
+
+func (e *StartupError) Unwrap() error {
+    return e.Err
+}
+
+// call startup stage and convert its panic to StartupError with exit code
+func startupStage(code int, context string, f func()) {
+    if err, _ := recoverCall(f); err!=nil {
+        panic(&StartupError{ Code: code, Context: context, Err: err })
+    }
+}
+
+// get exit code and single line message for recovered panic
+func fatalExitInfo(x interface{}) (int, string) {
+    err, _ := classifyPanic(x)
+    code := exitFatal
+    var se *StartupError
+    if errors.As(err, &se) { code = se.Code }
+    msg := strings.ReplaceAll(strings.TrimSpace(err.Error()), "\n", " ")
+    return code, msg
+}
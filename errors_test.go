@@ -0,0 +1,148 @@
+/*
+ * errors_test.go - error types tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "errors"
+    "net"
+    "testing"
+    "github.com/valyala/fastjson"
+)
+
+func TestClassifyPanic(t *testing.T) {
+    cases := []struct{
+        f func()
+        expMsg string
+        expRetry bool
+    }{
+        { func() {
+            bitfinexPanic("Can't get loans",
+                    fastjson.MustParse(`["error",10100,"apikey: invalid"]`), 500)
+        }, "Can't get loans: 10100 apikey: invalid", false },
+        { func() {
+            bitfinexPanic("Can't get loans",
+                    fastjson.MustParse(`["error",11010,"ratelimit: error"]`), 500)
+        }, "Can't get loans: 11010 ratelimit: error", true },
+        { func() { HttpPanic("Can't get", 503) },
+            "Can't get: status code: Service Unavailable (503)", true },
+        { func() { HttpPanic("Can't get", 429) },
+            "Can't get: status code: Too Many Requests (429)", true },
+        { func() { HttpPanic("Can't get", 404) },
+            "Can't get: status code: Not Found (404)", false },
+        { func() { FastjsonGetArray(fastjson.MustParse(`{}`)) },
+            "Wrong json body: no array field", false },
+        { func() {
+            var order Order
+            bitfinexGetOrderFromJson(fastjson.MustParse(`[1,2]`), &order)
+        }, "Wrong json body", false },
+        { func() {
+            ErrorPanic("Error while doing HTTP request",
+                    &net.OpError{ Op: "dial", Err: errors.New("refused") })
+        }, "Error while doing HTTP request: dial: refused", true },
+        { func() { panic("Something wrong") }, "Something wrong", false },
+    }
+    for i, c := range cases {
+        err, retry := recoverCall(c.f)
+        if err==nil {
+            t.Errorf("No error for %d", i)
+            continue
+        }
+        if err.Error()!=c.expMsg || retry!=c.expRetry {
+            t.Errorf("Result mismatch for %d: %q,%v!=%q,%v", i, c.expMsg, c.expRetry,
+                     err.Error(), retry)
+        }
+    }
+    if err, retry := recoverCall(func() {}); err!=nil || retry {
+        t.Errorf("Error without panic: %v,%v", err, retry)
+    }
+    
+    // check types
+    err, _ := recoverCall(func() { HttpPanic("Can't get", 401) })
+    if herr, ok := err.(*HTTPError); !ok || herr.Status!=401 {
+        t.Errorf("Wrong HTTP error: %v", err)
+    }
+    err, _ = recoverCall(func() {
+        bitfinexPanic("Can't get", fastjson.MustParse(`["error",10100,"apikey: invalid"]`),
+                      500)
+    })
+    if aerr, ok := err.(*APIError); !ok || aerr.Code!=bitfinexErrApiKey {
+        t.Errorf("Wrong API error: %v", err)
+    }
+    perr := errors.New("bad")
+    err, _ = recoverCall(func() { ParseErrorPanic("Can't parse", perr) })
+    if _, ok := err.(*ParseError); !ok || !errors.Is(err, perr) {
+        t.Errorf("Wrong parse error: %v", err)
+    }
+}
+
+func TestFatalExitInfo(t *testing.T) {
+    cases := []struct{
+        f func()
+        expCode int
+        expMsg string
+    }{
+        { func() {
+            startupStage(exitConfigInvalid, "Wrong config", func() {
+                ParseErrorPanic("Can't parse config file", errors.New("bad json"))
+            })
+        }, exitConfigInvalid, "Wrong config: Can't parse config file: bad json" },
+        { func() {
+            panic(&StartupError{ exitConfigInvalid, "Wrong config",
+                    errors.New("No currency") })
+        }, exitConfigInvalid, "Wrong config: No currency" },
+        { func() {
+            startupStage(exitAuthFailed, "Authentication failed", func() {
+                panic("Wrong password")
+            })
+        }, exitAuthFailed, "Authentication failed: Wrong password" },
+        { func() {
+            startupStage(exitMarketsFetchFailed, "Can't fetch markets", func() {
+                HttpPanic("Can't get markets", 503)
+            })
+        }, exitMarketsFetchFailed, "Can't fetch markets: Can't get markets: " +
+                "status code: Service Unavailable (503)" },
+        { func() {
+            startupStage(exitWebsocketDialFailed, "Can't connect websocket", func() {
+                panic("Can't WSDial")
+            })
+        }, exitWebsocketDialFailed, "Can't connect websocket: Can't WSDial" },
+        { func() { panic("Something\nwrong") }, exitFatal, "Something wrong" },
+    }
+    for i, c := range cases {
+        func() {
+            defer func() {
+                x := recover()
+                if x==nil {
+                    t.Errorf("No panic for %d", i)
+                    return
+                }
+                code, msg := fatalExitInfo(x)
+                if code!=c.expCode || msg!=c.expMsg {
+                    t.Errorf("Result mismatch for %d: %d,%q!=%d,%q", i, c.expCode,
+                             c.expMsg, code, msg)
+                }
+            }()
+            c.f()
+        }()
+    }
+}
@@ -0,0 +1,249 @@
+/*
+ * events.go - events for external systems
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/matszpk/godec64"
+    "github.com/valyala/fastjson"
+)
+
+// event topics
+const (
+    eventTopicBorrow = "bbc.borrow"
+    eventTopicClose = "bbc.close"
+    eventTopicError = "bbc.error"
+)
+
+// EventSink publishes events (JSON payloads) to external systems.
+type EventSink interface {
+    Publish(topic string, payload []byte)
+    // stop publishing and release connection
+    Close()
+}
+
+type noopEventSink struct{}
+
+func (ns noopEventSink) Publish(topic string, payload []byte) {}
+
+func (ns noopEventSink) Close() {}
+
+const (
+    natsEventQueueSize = 256
+    natsReconnectDelay = 5*time.Second
+)
+
+// publishes events to NATS server (core protocol, without acknowledgements).
+// events are queued and dropped if queue is full or server is not available.
+type natsEventSink struct {
+    addr string
+    queue chan natsEvent
+    stopCh chan struct{}
+    doneCh chan struct{}
+    closeOnce sync.Once
+    writeMutex sync.Mutex   // PUB and PONG are written by different goroutines
+}
+
+type natsEvent struct {
+    topic string
+    payload []byte
+}
+
+func newNatsEventSink(addr string) *natsEventSink {
+    ns := &natsEventSink{ addr: addr, queue: make(chan natsEvent, natsEventQueueSize),
+                stopCh: make(chan struct{}), doneCh: make(chan struct{}) }
+    go ns.run()
+    return ns
+}
+
+// stop publishing and wait until connection is closed. queued events are dropped.
+func (ns *natsEventSink) Close() {
+    ns.closeOnce.Do(func() { close(ns.stopCh) })
+    <-ns.doneCh
+}
+
+func (ns *natsEventSink) Publish(topic string, payload []byte) {
+    select {
+        case ns.queue <- natsEvent{ topic, payload }:
+        default:
+            Logger.Warn("Event queue is full - drop event ", topic)
+    }
+}
+
+func (ns *natsEventSink) connect() (net.Conn, error) {
+    conn, err := net.DialTimeout("tcp", ns.addr, 10*time.Second)
+    if err!=nil { return nil, err }
+    // server sends INFO line first
+    conn.SetReadDeadline(time.Now().Add(10*time.Second))
+    rd := bufio.NewReader(conn)
+    if _, err = rd.ReadString('\n'); err!=nil {
+        conn.Close()
+        return nil, err
+    }
+    conn.SetReadDeadline(time.Time{})
+    if err = ns.write(conn,
+                []byte("CONNECT {\"verbose\":false,\"pedantic\":false}\r\n")); err!=nil {
+        conn.Close()
+        return nil, err
+    }
+    go ns.readLoop(conn, rd)
+    return conn, nil
+}
+
+func (ns *natsEventSink) write(conn net.Conn, msg []byte) error {
+    ns.writeMutex.Lock()
+    defer ns.writeMutex.Unlock()
+    conn.SetWriteDeadline(time.Now().Add(10*time.Second))
+    _, err := conn.Write(msg)
+    return err
+}
+
+// read messages from server: answer PING (server closes connection if
+// client doesn't respond) and log errors. returns when connection is closed.
+func (ns *natsEventSink) readLoop(conn net.Conn, rd *bufio.Reader) {
+    for {
+        line, err := rd.ReadString('\n')
+        if err!=nil { return }
+        line = strings.TrimRight(line, "\r\n")
+        switch {
+            case line == "PING":
+                if ns.write(conn, []byte("PONG\r\n"))!=nil { return }
+            case strings.HasPrefix(line, "-ERR"):
+                Logger.Error("NATS server error: ", strings.TrimSpace(line[4:]))
+        }
+    }
+}
+
+func natsPubMessage(topic string, payload []byte) []byte {
+    msg := make([]byte, 0, len(topic) + len(payload) + 20)
+    msg = append(msg, "PUB "...)
+    msg = append(msg, topic...)
+    msg = append(msg, ' ')
+    msg = strconv.AppendInt(msg, int64(len(payload)), 10)
+    msg = append(msg, "\r\n"...)
+    msg = append(msg, payload...)
+    msg = append(msg, "\r\n"...)
+    return msg
+}
+
+func (ns *natsEventSink) run() {
+    defer close(ns.doneCh)
+    var conn net.Conn
+    defer func() {
+        if conn!=nil { conn.Close() }
+    }()
+    var lastDial time.Time
+    for {
+        var ev natsEvent
+        select {
+            case ev = <-ns.queue:
+            case <-ns.stopCh:
+                return
+        }
+        if conn==nil {
+            if time.Since(lastDial) < natsReconnectDelay { continue } // drop
+            lastDial = time.Now()
+            var err error
+            if conn, err = ns.connect(); err!=nil {
+                Logger.Error("Can't connect to NATS server: ", err)
+                continue
+            }
+        }
+        if err := ns.write(conn, natsPubMessage(ev.topic, ev.payload)); err!=nil {
+            Logger.Error("Can't publish event to NATS server: ", err)
+            conn.Close()
+            conn = nil
+        }
+    }
+}
+
+// check event sink URL. only NATS (nats://host:port) is supported.
+func checkEventSinkURL(sinkURL string) error {
+    u, err := url.Parse(sinkURL)
+    if err!=nil { return err }
+    if u.Scheme != "nats" {
+        return fmt.Errorf("Unsupported event sink scheme %q", u.Scheme)
+    }
+    return nil
+}
+
+func newEventSink(config *Config) EventSink {
+    if config.EventSinkURL == "" {
+        return noopEventSink{}
+    }
+    u, _ := url.Parse(config.EventSinkURL)  // already validated
+    host := u.Host
+    if !strings.Contains(host, ":") {
+        host += ":4222"
+    }
+    return newNatsEventSink(host)
+}
+
+// append JSON string field with comma if not first
+func appendEventField(payload []byte, name, value string) []byte {
+    if len(payload) > 1 { payload = append(payload, ',') }
+    var a fastjson.Arena
+    payload = a.NewString(name).MarshalTo(payload)
+    payload = append(payload, ':')
+    return a.NewString(value).MarshalTo(payload)
+}
+
+func appendEventUint(payload []byte, name string, value uint64) []byte {
+    if len(payload) > 1 { payload = append(payload, ',') }
+    var a fastjson.Arena
+    payload = a.NewString(name).MarshalTo(payload)
+    payload = append(payload, ':')
+    return strconv.AppendUint(payload, value, 10)
+}
+
+func borrowEventPayload(currency string, orderId uint64,
+                        amount, rate godec64.UDec64, prec uint) []byte {
+    payload := []byte{ '{' }
+    payload = appendEventField(payload, "currency", currency)
+    payload = appendEventUint(payload, "orderId", orderId)
+    payload = appendEventField(payload, "amount", amount.Format(prec, true))
+    payload = appendEventField(payload, "rate", rate.Format(12, true))
+    return append(payload, '}')
+}
+
+func closeEventPayload(currency string, loanId uint64) []byte {
+    payload := []byte{ '{' }
+    payload = appendEventField(payload, "currency", currency)
+    payload = appendEventUint(payload, "loanId", loanId)
+    return append(payload, '}')
+}
+
+func errorEventPayload(currency, context string, err error) []byte {
+    payload := []byte{ '{' }
+    payload = appendEventField(payload, "currency", currency)
+    payload = appendEventField(payload, "context", context)
+    payload = appendEventField(payload, "error", err.Error())
+    return append(payload, '}')
+}
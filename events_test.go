@@ -0,0 +1,128 @@
+/*
+ * events_test.go - events tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "bufio"
+    "net"
+    "testing"
+    "time"
+)
+
+type fakeEventSink struct {
+    topics []string
+    payloads []string
+}
+
+func (fs *fakeEventSink) Publish(topic string, payload []byte) {
+    fs.topics = append(fs.topics, topic)
+    fs.payloads = append(fs.payloads, string(payload))
+}
+
+func (fs *fakeEventSink) Close() {}
+
+func TestEngineBorrowEvent(t *testing.T) {
+    eng := getTestEngine0()
+    eng.clock = sleepFuncClock{ sleep: noSleep }
+    fs := &fakeEventSink{}
+    eng.events = fs
+    eng.bpriv = &fakePrivateApi{ submitResult: OpResult{ Order: Order{ Id: 555 },
+                        Success: true } }
+    bt := BorrowTask{ 15050000000, []uint64{ 100 }, 400000000 }
+    var res BorrowResult
+    if !eng.doBorrowTask(&bt, &res) {
+        t.Errorf("Borrow task failed")
+    }
+    expTopics := []string{ eventTopicBorrow, eventTopicClose }
+    expPayloads := []string{
+        `{"currency":"UST","orderId":555,"amount":"150.5","rate":"0.0004"}`,
+        `{"currency":"UST","loanId":100}` }
+    if len(fs.topics)!=len(expTopics) {
+        t.Fatalf("Events mismatch: %v %v", fs.topics, fs.payloads)
+    }
+    for i := range expTopics {
+        if fs.topics[i]!=expTopics[i] || fs.payloads[i]!=expPayloads[i] {
+            t.Errorf("Event %d mismatch: %v %v!=%v %v", i, expTopics[i],
+                     expPayloads[i], fs.topics[i], fs.payloads[i])
+        }
+    }
+    // error event
+    fs.topics, fs.payloads = nil, nil
+    eng.callSafe("test", func() { panic(errWrongJsonBody) })
+    if len(fs.payloads)!=1 || fs.topics[0]!=eventTopicError || fs.payloads[0]!=
+            `{"currency":"UST","context":"test","error":"Wrong json body"}` {
+        t.Errorf("Error event mismatch: %v %v", fs.topics, fs.payloads)
+    }
+}
+
+func TestNatsEventSink(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err!=nil {
+        t.Fatal("Can't listen:", err)
+    }
+    defer ln.Close()
+    lines := make(chan string, 4)
+    closed := make(chan struct{})
+    go func() {
+        conn, err := ln.Accept()
+        if err!=nil { return }
+        defer conn.Close()
+        conn.Write([]byte("INFO {}\r\n"))
+        rd := bufio.NewReader(conn)
+        for i := 0; i < 4; i++ {
+            if i == 3 {
+                // server checks whether client is alive
+                conn.Write([]byte("-ERR 'Unknown Protocol Operation'\r\nPING\r\n"))
+            }
+            line, err := rd.ReadString('\n')
+            if err!=nil { return }
+            lines <- line
+        }
+        // connection closed by Close
+        if _, err := rd.ReadString('\n'); err!=nil { close(closed) }
+    }()
+    ns := newNatsEventSink(ln.Addr().String())
+    ns.Publish("bbc.test", []byte(`{"a":1}`))
+    expLines := []string{ "CONNECT {\"verbose\":false,\"pedantic\":false}\r\n",
+            "PUB bbc.test 7\r\n", "{\"a\":1}\r\n", "PONG\r\n" }
+    for _, exp := range expLines {
+        select {
+            case line := <-lines:
+                if line!=exp {
+                    t.Errorf("Line mismatch: %q!=%q", exp, line)
+                }
+            case <-time.After(5*time.Second):
+                t.Fatal("Timeout")
+        }
+    }
+    ns.Close()
+    select {
+        case <-closed:
+        case <-time.After(5*time.Second):
+            t.Fatal("Connection not closed")
+    }
+    if checkEventSinkURL("nats://localhost:4222")!=nil ||
+            checkEventSinkURL("kafka://localhost:9092")==nil {
+        t.Errorf("Wrong event sink URL check")
+    }
+}
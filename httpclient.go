@@ -24,8 +24,14 @@ package main
 
 import (
     "bytes"
-    "fmt"
+    "context"
+    "errors"
     "math"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
     "time"
     "github.com/matszpk/godec64"
     "github.com/valyala/fasthttp"
@@ -33,8 +39,7 @@ import (
 )
 
 func HttpPanic(msg string, statusCode int) {
-    panic(fmt.Sprint(msg, ": status code: ", fasthttp.StatusMessage(statusCode),
-                     " (", statusCode, ")"))
+    panic(&HTTPError{ Context: msg, Status: statusCode })
 }
 
 var jsonContentType []byte = []byte("application/json")
@@ -61,6 +66,15 @@ var JsonArenaPool fastjson.ArenaPool
 type RequestHandle struct {
     JsonParser *fastjson.Parser
     Response *fasthttp.Response
+    // deadline of request (zero - only timeouts of client)
+    Deadline time.Time
+}
+
+// do request, request fails if it is not finished before deadline of handle
+func (rh *RequestHandle) doRequest(httpClient *fasthttp.HostClient,
+                                   req *fasthttp.Request) error {
+    if rh.Deadline.IsZero() { return httpClient.Do(req, rh.Response) }
+    return httpClient.DoDeadline(req, rh.Response, rh.Deadline)
 }
 
 // handle http get with json. it returns json value and http status code.
@@ -88,20 +102,21 @@ func (rh *RequestHandle) HandleHttpGetJson(httpClient *fasthttp.HostClient,
     req.Header.Add("Accept", "application/json")
     req.Header.Add("Accept-Encoding", "utf-8")
     rh.Response = fasthttp.AcquireResponse()
-    if err := httpClient.Do(req, rh.Response); err!=nil {
+    if err := rh.doRequest(httpClient, req); err!=nil {
         ErrorPanic("Error while doing HTTP request", err)
     }
     status := rh.Response.Header.StatusCode()
     if !CheckJsonContentType(rh.Response.Header.ContentType()) {
         // wrong content type (must be json encoded in utf-8
-        panic("HTTP response have wrong content-type")
+        if status >= 400 { HttpPanic("HTTP response have wrong content-type", status) }
+        panic(&ParseError{ Context: "HTTP response have wrong content-type" })
     }
     
     // parse json
     rh.JsonParser = JsonParserPool.Get()
     v, err := rh.JsonParser.ParseBytes(rh.Response.Body())
     if err!=nil {
-        ErrorPanic("Error while parsing response", err)
+        ParseErrorPanic("Error while parsing response", err)
     }
     return v, status
 }
@@ -137,20 +152,21 @@ func (rh *RequestHandle) HandleHttpPostJson(httpClient *fasthttp.HostClient,
     req.SetBody(body)
     
     rh.Response = fasthttp.AcquireResponse()
-    if err := httpClient.Do(req, rh.Response); err!=nil {
+    if err := rh.doRequest(httpClient, req); err!=nil {
         ErrorPanic("Error while doing HTTP request", err)
     }
     status := rh.Response.Header.StatusCode()
     if !CheckJsonContentType(rh.Response.Header.ContentType()) {
         // wrong content type (must be json encoded in utf-8
-        panic("HTTP response have wrong content-type")
+        if status >= 400 { HttpPanic("HTTP response have wrong content-type", status) }
+        panic(&ParseError{ Context: "HTTP response have wrong content-type" })
     }
     
     // parse json
     rh.JsonParser = JsonParserPool.Get()
     v, err := rh.JsonParser.ParseBytes(rh.Response.Body())
     if err!=nil {
-        ErrorPanic("Error while parsing response", err)
+        ParseErrorPanic("Error while parsing response", err)
     }
     return v, status
 }
@@ -173,7 +189,7 @@ func FastjsonGetObjectRequired(vx *fastjson.Value) *fastjson.Object {
     if o, err := vx.Object(); err==nil {
         return o
     }
-    panic("Wrong json body: no object field")
+    panic(&ParseError{ Context: "Wrong json body: no object field" })
 }
 
 func FastjsonGetString(vx *fastjson.Value) string {
@@ -181,7 +197,7 @@ func FastjsonGetString(vx *fastjson.Value) string {
     if s, err := vx.StringBytes(); err==nil {
         return string(s)
     }
-    panic("Wrong json body: no string field")
+    panic(&ParseError{ Context: "Wrong json body: no string field" })
 }
 
 func FastjsonGetBool(vx *fastjson.Value) bool {
@@ -189,7 +205,7 @@ func FastjsonGetBool(vx *fastjson.Value) bool {
     if b, err := vx.Bool(); err==nil {
         return b
     }
-    panic("Wrong json body: no bool field")
+    panic(&ParseError{ Context: "Wrong json body: no bool field" })
 }
 
 func FastjsonGetStringBytes(vx *fastjson.Value) []byte {
@@ -197,14 +213,15 @@ func FastjsonGetStringBytes(vx *fastjson.Value) []byte {
     if s, err := vx.StringBytes(); err==nil {
         return s
     }
-    panic("Wrong json body: no string field")
+    panic(&ParseError{ Context: "Wrong json body: no string field" })
 }
 
 func FastjsonCheckString(vx *fastjson.Value, expected []byte) bool {
+    if vx.Type()==fastjson.TypeNull { return false }
     if s, err := vx.StringBytes(); err==nil {
         return bytes.Equal(s, expected)
     }
-    panic("Wrong json body: no string field")
+    panic(&ParseError{ Context: "Wrong json body: no string field" })
 }
 
 func FastjsonGetInt(vx *fastjson.Value) int {
@@ -212,7 +229,7 @@ func FastjsonGetInt(vx *fastjson.Value) int {
     if iv, err := vx.Int(); err==nil {
         return iv
     }
-    panic("Wrong json body: no integer field")
+    panic(&ParseError{ Context: "Wrong json body: no integer field" })
 }
 
 func FastjsonGetUInt(vx *fastjson.Value) uint {
@@ -220,18 +237,18 @@ func FastjsonGetUInt(vx *fastjson.Value) uint {
     if iv, err := vx.Uint(); err==nil {
         return iv
     }
-    panic("Wrong json body: no integer field")
+    panic(&ParseError{ Context: "Wrong json body: no integer field" })
 }
 
 func FastjsonGetUInt32(vx *fastjson.Value) uint32 {
     if vx.Type()==fastjson.TypeNull { return 0 }
     if iv, err := vx.Uint(); err==nil {
         if iv > math.MaxUint32 {
-            panic("Unsigned integer overflow in json")
+            panic(&ParseError{ Context: "Unsigned integer overflow in json" })
         }
         return uint32(iv)
     }
-    panic("Wrong json body: no integer field")
+    panic(&ParseError{ Context: "Wrong json body: no integer field" })
 }
 
 func FastjsonGetUInt64(vx *fastjson.Value) uint64 {
@@ -239,7 +256,7 @@ func FastjsonGetUInt64(vx *fastjson.Value) uint64 {
     if iv, err := vx.Uint64(); err==nil {
         return iv
     }
-    panic("Wrong json body: no integer field")
+    panic(&ParseError{ Context: "Wrong json body: no integer field" })
 }
 
 func FastjsonGetFloat64(vx *fastjson.Value) float64 {
@@ -247,7 +264,7 @@ func FastjsonGetFloat64(vx *fastjson.Value) float64 {
     if fv, err := vx.Float64(); err==nil {
         return fv
     }
-    panic("Wrong json body: no float field")
+    panic(&ParseError{ Context: "Wrong json body: no float field" })
 }
 
 func FastjsonGetArray(vx *fastjson.Value) []*fastjson.Value {
@@ -255,7 +272,7 @@ func FastjsonGetArray(vx *fastjson.Value) []*fastjson.Value {
     if arr, err := vx.Array(); err==nil {
         return arr
     }
-    panic("Wrong json body: no array field")
+    panic(&ParseError{ Context: "Wrong json body: no array field" })
 }
 
 func FastjsonGetUDec64(vx *fastjson.Value, precision uint) godec64.UDec64 {
@@ -263,11 +280,30 @@ func FastjsonGetUDec64(vx *fastjson.Value, precision uint) godec64.UDec64 {
     if vx.Type()==fastjson.TypeNumber {
         ud, err := godec64.ParseUDec64Bytes(vx.MarshalTo(nil), precision, false)
         if err!=nil {
-            panic("Wrong json body: no udec64 field")
+            panic(&ParseError{ Context: "Wrong json body: no udec64 field" })
         }
         return ud
     }
-    panic("Wrong json body: no udec64 field")
+    panic(&ParseError{ Context: "Wrong json body: no udec64 field" })
+}
+
+// decimal amount as number or as string with optional unit, for example
+// 150, "150" or "150 USD". number is in units (150 is 150.0, not 0.0000015).
+func FastjsonGetUDec64Unit(vx *fastjson.Value, precision uint,
+                           unit string) godec64.UDec64 {
+    if vx.Type()!=fastjson.TypeString { return FastjsonGetUDec64(vx, precision) }
+    fields := strings.Fields(string(vx.GetStringBytes()))
+    if len(fields)==0 || len(fields)>2 ||
+            (len(fields)==2 && !strings.EqualFold(fields[1], unit)) {
+        panic(&ParseError{ Context: "Wrong json body: no udec64 field with unit " +
+                    unit })
+    }
+    ud, err := godec64.ParseUDec64(fields[0], precision, false)
+    if err!=nil {
+        panic(&ParseError{ Context: "Wrong json body: no udec64 field with unit " +
+                    unit })
+    }
+    return ud
 }
 
 func FastjsonGetUDec64Signed(vx *fastjson.Value,
@@ -282,29 +318,121 @@ func FastjsonGetUDec64Signed(vx *fastjson.Value,
         }
         ud, err := godec64.ParseUDec64Bytes(str, precision, false)
         if err!=nil {
-            panic("Wrong json body: no signed udec64 field")
+            panic(&ParseError{ Context: "Wrong json body: no signed udec64 field" })
         }
         return ud, neg
     }
-    panic("Wrong json body: no signed udec64 field")
+    panic(&ParseError{ Context: "Wrong json body: no signed udec64 field" })
 }
 
+// get unix time in milliseconds (Bitfinex timestamps)
 func FastjsonGetUnixTimeMilli(vx *fastjson.Value) time.Time {
     if vx.Type()==fastjson.TypeNull { return time.Time{} }
     if iv, err := vx.Int64(); err==nil {
         return time.Unix(iv/1000, (iv%1000)*1000000)
     }
-    panic("Wrong json body: no unix time")
+    panic(&ParseError{ Context: "Wrong json body: no unix time" })
 }
 
 func FastjsonGetDuration(vx *fastjson.Value) time.Duration {
     if vx.Type()==fastjson.TypeNull { return 0 }
     if s, err := vx.StringBytes(); err==nil {
         if d, err := time.ParseDuration(string(s)); err!=nil {
-            panic("Wrong json body: no time duration field")
+            panic(&ParseError{ Context: "Wrong json body: no time duration field" })
         } else {
             return d
         }
     }
-    panic("Wrong json body: no time duration field")
+    panic(&ParseError{ Context: "Wrong json body: no time duration field" })
+}
+
+// file mode as octal string (for example "0600")
+func FastjsonGetFileMode(vx *fastjson.Value) os.FileMode {
+    if vx.Type()==fastjson.TypeNull { return 0 }
+    if s, err := vx.StringBytes(); err==nil {
+        if m, err := strconv.ParseUint(string(s), 8, 32); err!=nil || m > 0777 {
+            panic(&ParseError{ Context: "Wrong json body: no file mode field" })
+        } else {
+            return os.FileMode(m)
+        }
+    }
+    panic(&ParseError{ Context: "Wrong json body: no file mode field" })
+}
+
+// DNS resolver (net.Resolver implements it)
+type dnsResolver interface {
+    LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type dnsEntry struct {
+    addrs []net.IPAddr
+    resolveTime time.Time
+    next int
+}
+
+// dialer that resolves host again after refresh period. It dials
+// both IPv4 and IPv6 addresses (in round-robin manner).
+type dnsDialer struct {
+    mutex sync.Mutex
+    resolver dnsResolver
+    refresh time.Duration
+    entries map[string]*dnsEntry
+    now func() time.Time
+    dialTimeout func(network, addr string, timeout time.Duration) (net.Conn, error)
+}
+
+const dnsDialTimeout = 30*time.Second
+
+func newDnsDialer(resolver dnsResolver, refresh time.Duration) *dnsDialer {
+    return &dnsDialer{ resolver: resolver, refresh: refresh,
+                entries: make(map[string]*dnsEntry),
+                now: time.Now, dialTimeout: net.DialTimeout }
+}
+
+// get resolved addresses of host, resolve again if entry is too old
+func (d *dnsDialer) lookup(host string) ([]net.IPAddr, int, error) {
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+    now := d.now()
+    e, ok := d.entries[host]
+    if !ok || now.Sub(e.resolveTime) >= d.refresh {
+        ctx, cancel := context.WithTimeout(context.Background(), dnsDialTimeout)
+        addrs, err := d.resolver.LookupIPAddr(ctx, host)
+        cancel()
+        if err!=nil || len(addrs)==0 {
+            if ok { return e.addrs, e.next, nil } // use old addresses
+            if err==nil { err = errors.New("No addresses for " + host) }
+            return nil, 0, err
+        }
+        e = &dnsEntry{ addrs: addrs, resolveTime: now }
+        d.entries[host] = e
+    }
+    next := e.next
+    e.next = (e.next + 1) % len(e.addrs)
+    return e.addrs, next, nil
+}
+
+func (d *dnsDialer) Dial(addr string) (net.Conn, error) {
+    host, port, err := net.SplitHostPort(addr)
+    if err!=nil { return nil, err }
+    if ip := net.ParseIP(host); ip!=nil {
+        return d.dialTimeout("tcp", addr, dnsDialTimeout)
+    }
+    addrs, next, err := d.lookup(host)
+    if err!=nil { return nil, err }
+    for i := 0; i < len(addrs); i++ {
+        ipAddr := addrs[(next + i) % len(addrs)]
+        var conn net.Conn
+        conn, err = d.dialTimeout("tcp",
+                    net.JoinHostPort(ipAddr.String(), port), dnsDialTimeout)
+        if err==nil { return conn, nil }
+    }
+    return nil, err
+}
+
+// set DNS refreshing for http client: connections will be closed after
+// refresh period, and host will be resolved again.
+func SetHttpClientDNSRefresh(httpClient *fasthttp.HostClient, refresh time.Duration) {
+    httpClient.Dial = newDnsDialer(net.DefaultResolver, refresh).Dial
+    httpClient.MaxConnDuration = refresh
 }
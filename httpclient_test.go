@@ -0,0 +1,113 @@
+/*
+ * httpclient_test.go - HTTP client utilities tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "context"
+    "errors"
+    "net"
+    "testing"
+    "time"
+    "github.com/valyala/fastjson"
+)
+
+type fakeResolver struct {
+    addrs []string
+    lookups int
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context,
+                        host string) ([]net.IPAddr, error) {
+    r.lookups++
+    if r.addrs==nil { return nil, errors.New("DNS failure") }
+    res := make([]net.IPAddr, len(r.addrs))
+    for i, a := range r.addrs {
+        res[i] = net.IPAddr{ IP: net.ParseIP(a) }
+    }
+    return res, nil
+}
+
+func TestDnsDialer(t *testing.T) {
+    resolver := &fakeResolver{ addrs: []string{ "10.0.0.1", "2001:db8::1" } }
+    d := newDnsDialer(resolver, time.Minute)
+    now := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+    d.now = func() time.Time { return now }
+    var dialed []string
+    d.dialTimeout = func(network, addr string,
+                    timeout time.Duration) (net.Conn, error) {
+        dialed = append(dialed, addr)
+        return nil, errors.New("refused")
+    }
+    
+    // all addresses (IPv4 and IPv6) are tried
+    if _, err := d.Dial("api.bitfinex.com:443"); err==nil {
+        t.Errorf("No error")
+    }
+    expDialed := []string{ "10.0.0.1:443", "[2001:db8::1]:443" }
+    if len(dialed)!=2 || dialed[0]!=expDialed[0] || dialed[1]!=expDialed[1] {
+        t.Errorf("Dialed mismatch: %v!=%v", expDialed, dialed)
+    }
+    // cached before refresh period, next address first
+    resolver.addrs = []string{ "10.0.0.2" }
+    now = now.Add(30*time.Second)
+    dialed = nil
+    d.Dial("api.bitfinex.com:443")
+    if resolver.lookups!=1 || len(dialed)!=2 || dialed[0]!=expDialed[1] {
+        t.Errorf("Cache mismatch: %v %v", resolver.lookups, dialed)
+    }
+    // resolved again after refresh period
+    now = now.Add(time.Minute)
+    dialed = nil
+    d.Dial("api.bitfinex.com:443")
+    if resolver.lookups!=2 || len(dialed)!=1 || dialed[0]!="10.0.0.2:443" {
+        t.Errorf("Refresh mismatch: %v %v", resolver.lookups, dialed)
+    }
+    // old addresses are used if resolving fails
+    resolver.addrs = nil
+    now = now.Add(time.Minute)
+    dialed = nil
+    d.Dial("api.bitfinex.com:443")
+    if resolver.lookups!=3 || len(dialed)!=1 || dialed[0]!="10.0.0.2:443" {
+        t.Errorf("Fallback mismatch: %v %v", resolver.lookups, dialed)
+    }
+    // no addresses at all
+    if _, err := d.Dial("api-pub.bitfinex.com:443"); err==nil {
+        t.Errorf("No error for unresolved host")
+    }
+}
+
+func TestFastjsonGetUnixTime(t *testing.T) {
+    v := fastjson.MustParse(`[1621845005123,null]`).GetArray()
+    if tm := FastjsonGetUnixTimeMilli(v[0]);
+            !tm.Equal(time.Unix(1621845005, 123000000)) {
+        t.Errorf("Time mismatch: %v", tm)
+    }
+    if !FastjsonGetUnixTimeMilli(v[1]).IsZero() {
+        t.Errorf("Null time is not zero")
+    }
+    if err, _ := recoverCall(func() {
+        FastjsonGetUnixTimeMilli(fastjson.MustParse(`"x"`))
+    }); err==nil {
+        t.Errorf("No error for wrong time")
+    }
+}
@@ -0,0 +1,77 @@
+/*
+ * latency.go - latency histogram
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+)
+
+// upper bounds of latency histogram buckets (last bucket is unbounded)
+var latencyBucketBounds = [...]time.Duration{ 100*time.Millisecond,
+    250*time.Millisecond, 500*time.Millisecond, time.Second, 2*time.Second,
+    5*time.Second, 10*time.Second }
+
+// histogram of latencies (zero value is empty histogram)
+type latencyHistogram struct {
+    mutex sync.Mutex
+    buckets [len(latencyBucketBounds)+1]uint64
+    count uint64
+    sum time.Duration
+    max time.Duration
+}
+
+func (lh *latencyHistogram) add(d time.Duration) {
+    lh.mutex.Lock()
+    defer lh.mutex.Unlock()
+    i := 0
+    for ; i < len(latencyBucketBounds) && d > latencyBucketBounds[i]; i++ {}
+    lh.buckets[i]++
+    lh.count++
+    lh.sum += d
+    if d > lh.max { lh.max = d }
+}
+
+// get number of recorded latencies
+func (lh *latencyHistogram) Count() uint64 {
+    lh.mutex.Lock()
+    defer lh.mutex.Unlock()
+    return lh.count
+}
+
+func (lh *latencyHistogram) String() string {
+    lh.mutex.Lock()
+    defer lh.mutex.Unlock()
+    if lh.count == 0 { return "no samples" }
+    var sb strings.Builder
+    fmt.Fprint(&sb, "count: ", lh.count, ", avg: ", lh.sum / time.Duration(lh.count),
+               ", max: ", lh.max)
+    for i, bound := range latencyBucketBounds {
+        fmt.Fprint(&sb, ", <=", bound, ": ", lh.buckets[i])
+    }
+    fmt.Fprint(&sb, ", >", latencyBucketBounds[len(latencyBucketBounds)-1], ": ",
+               lh.buckets[len(latencyBucketBounds)])
+    return sb.String()
+}
@@ -0,0 +1,107 @@
+/*
+ * logfile.go - log file with size-based rotation
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "os"
+    "strconv"
+    "sync"
+)
+
+const (
+    defaultLogMaxSizeMB = 100
+    defaultLogMaxBackups = 5
+)
+
+// log file rotated when its size exceeds maximal size. old files are renamed
+// to path.1, path.2, ... (path.1 is newest) and files above maxBackups are removed.
+type rotatingFile struct {
+    mutex sync.Mutex
+    path string
+    maxSize int64
+    maxBackups int
+    file *os.File
+    size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+    rf := &rotatingFile{ path: path, maxSize: maxSize, maxBackups: maxBackups }
+    if err := rf.open(); err!=nil { return nil, err }
+    return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+    file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+    if err!=nil { return err }
+    info, err := file.Stat()
+    if err!=nil {
+        file.Close()
+        return err
+    }
+    rf.file, rf.size = file, info.Size()
+    return nil
+}
+
+func (rf *rotatingFile) backupPath(i int) string {
+    return rf.path + "." + strconv.Itoa(i)
+}
+
+// close current file, shift backups and open new file
+func (rf *rotatingFile) rotate() error {
+    if err := rf.file.Close(); err!=nil { return err }
+    rf.file = nil
+    if rf.maxBackups > 0 {
+        os.Remove(rf.backupPath(rf.maxBackups))
+        for i := rf.maxBackups-1; i >= 1; i-- {
+            os.Rename(rf.backupPath(i), rf.backupPath(i+1))
+        }
+        if err := os.Rename(rf.path, rf.backupPath(1)); err!=nil { return err }
+    } else if err := os.Remove(rf.path); err!=nil {
+        return err
+    }
+    return rf.open()
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+    rf.mutex.Lock()
+    defer rf.mutex.Unlock()
+    if rf.file==nil {
+        // reopen after failed rotation
+        if err := rf.open(); err!=nil { return 0, err }
+    }
+    if rf.size!=0 && rf.size + int64(len(p)) > rf.maxSize {
+        if err := rf.rotate(); err!=nil { return 0, err }
+    }
+    n, err := rf.file.Write(p)
+    rf.size += int64(n)
+    return n, err
+}
+
+func (rf *rotatingFile) Close() error {
+    rf.mutex.Lock()
+    defer rf.mutex.Unlock()
+    if rf.file==nil { return nil }
+    err := rf.file.Close()
+    rf.file = nil
+    return err
+}
@@ -0,0 +1,78 @@
+/*
+ * logfile_test.go - log file rotation tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func readTestFile(t *testing.T, path string) string {
+    data, err := ioutil.ReadFile(path)
+    if err!=nil { t.Fatal("Can't read file:", err) }
+    return string(data)
+}
+
+func TestRotatingFile(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "bbc.log")
+    rf, err := openRotatingFile(path, 10, 2)
+    if err!=nil { t.Fatal("Can't open log file:", err) }
+    defer func() { rf.Close() }()
+    
+    // logs are routed to file
+    Logger.SetOutput(rf)
+    Logger.Info("hello")
+    Logger.SetOutput(os.Stdout)
+    if !strings.Contains(readTestFile(t, path), "hello") {
+        t.Errorf("Log message not written to file")
+    }
+    for _, msg := range []string{ "aaaaa", "bbbbb", "ccccc", "ddddd", "eeeeee" } {
+        if _, err := rf.Write([]byte(msg)); err!=nil {
+            t.Fatal("Can't write:", err)
+        }
+    }
+    // 'aaaaa' exceeds size of file with log message, 'ccccc' exceeds 10 bytes,
+    // 'eeeeee' exceeds 10 bytes again, oldest backup is removed
+    expFiles := map[string]string{ path: "eeeeee", path+".1": "cccccddddd",
+                        path+".2": "aaaaabbbbb" }
+    for p, exp := range expFiles {
+        if content := readTestFile(t, p); content!=exp {
+            t.Errorf("File %v mismatch: %q!=%q", p, exp, content)
+        }
+    }
+    if _, err := os.Stat(path+".3"); !os.IsNotExist(err) {
+        t.Errorf("Too many backups: %v", err)
+    }
+    
+    // reopened file is appended
+    rf.Close()
+    rf, err = openRotatingFile(path, 10, 2)
+    if err!=nil { t.Fatal("Can't open log file:", err) }
+    rf.Write([]byte("ff"))
+    if content := readTestFile(t, path); content!="eeeeeeff" {
+        t.Errorf("Appended file mismatch: %q", content)
+    }
+}
@@ -23,36 +23,123 @@
 package main
 
 import (
+    "fmt"
     "os"
     "os/signal"
     "syscall"
 )
 
 func main() {
-    defer RecoverPanicAndExit("main")
+    os.Exit(run())
+}
+
+// run program and return exit code. all deferred cleanups are done
+// before exit.
+func run() int {
+    defer RecoverStartupPanicAndExit()
     var config Config
     signal.Ignore(syscall.SIGHUP)
-    config.Load("bbc_config.json")
+    startupStage(exitConfigInvalid, "Wrong config", func() {
+        config.Load("bbc_config.json")
+    })
     Logger.SetOutput(os.Stderr)
     Logger.SetLevel("info")
     
+    if config.LogFile != "" {
+        lf, err := config.openLogFile()
+        if err!=nil {
+            panic(&StartupError{ exitConfigInvalid, "Can't open log file", err })
+        }
+        defer lf.Close()
+        Logger.SetOutput(lf)
+    }
+    
+    SetAmountPrecisions(config.CurrencyPrecisions)
+    
     if len(os.Args) >= 3 && os.Args[1] == "genpassword" {
-        GenPassword(os.Args[2])
-        return
+        GenPassword(expandPath(os.Args[2]), config.fileMode())
+        return 0
+    }
+    
+    pwdStdin := false
+    for _, arg := range os.Args[1:] {
+        if arg == "--password-stdin" { pwdStdin = true }
+    }
+    
+    if err := config.checkFiles(); err!=nil {
+        panic(&StartupError{ exitConfigInvalid, "Wrong config", err })
     }
+    var keys []KeyPair
+    startupStage(exitAuthFailed, "Authentication failed", func() {
+        keys = AuthenticateExchangeKeys(&config, pwdStdin)
+    })
+    apiKey, secretKey := keys[0].ApiKey, keys[0].SecretKey
     
-    apiKey, secretKey := AuthenticateExchange(&config)
+    if len(os.Args) >= 2 && os.Args[1] == "whichkey" {
+        PrintWhichKey(os.Stdout, apiKey, secretKey)
+        return 0
+    }
+    
+    if len(os.Args) >= 2 && os.Args[1] == "doctor" {
+        if !RunDoctor(&config, apiKey, secretKey) {
+            return 1
+        }
+        return 0
+    }
+    
+    // validate only when engine will be run
+    if err := config.Validate(); err!=nil {
+        panic(&StartupError{ exitConfigInvalid, "Wrong config", err })
+    }
     
     bp := NewBitfinexPublic()
-    var bprt *BitfinexRTPublic = nil
+    if config.DNSRefresh > 0 { bp.SetDNSRefresh(config.DNSRefresh) }
+    if config.MarketsCacheTTL > 0 { bp.SetMarketsCacheTTL(config.MarketsCacheTTL) }
+    if config.MarketsFetchRetries > 0 {
+        bp.SetMarketsFetchRetries(int(config.MarketsFetchRetries))
+    }
+    var bprt *BitfinexRTPublicPool = nil
     if config.Realtime {
         Logger.Info("Initialize realtime")
-        bprt = NewBitfinexRTPublic()
-        bprt.Start()
+        bprt = NewBitfinexRTPublicPool()
+        bprt.SetMaxChannels(int(config.WSMaxChannels))
+        bprt.SetCompression(config.WSCompression)
+        bprt.SetCommandTimeout(config.WSCommandTimeout)
+        SetHandlerLimit(int(config.MaxHandlerCalls), config.HandlerCallWait)
+        startupStage(exitWebsocketDialFailed, "Can't connect websocket", bprt.Start)
         defer bprt.Stop()
     }
     bpriv := NewBitfinexPrivate(apiKey, secretKey)
-    df := NewDataFetcher(bp, bprt, config.Currency)
+    for _, kp := range keys[1:] {
+        bpriv.AddBackupKey(kp.ApiKey, kp.SecretKey)
+    }
+    if len(keys) > 1 { Logger.Info("Backup API keys: ", len(keys)-1) }
+    if config.PrivateRateLimit > 0 {
+        burst := config.PrivateRateBurst
+        if burst == 0 { burst = defaultPrivateRateBurst }
+        bpriv.SetRateLimit(config.PrivateRateLimit, burst)
+    }
+    if config.DNSRefresh > 0 { bpriv.SetDNSRefresh(config.DNSRefresh) }
+    bpriv.SetHiddenOffers(config.HiddenOffers)
+    bpriv.SetNonceDivisor(int64(config.NonceDivisor))
+    startupStage(exitMarketsFetchFailed, "Can't fetch markets", func() {
+        bp.GetMarkets()     // cached for data fetcher and engine
+    })
+    bpriv.SetKnownCurrencies(bp.GetMarkets())
+    var df *DataFetcher
+    startupStage(exitWebsocketDialFailed, "Can't subscribe realtime channels", func() {
+        df = NewDataFetcher(bp, bprt, config.Currency)
+    })
+    if config.FallbackOrderBookDepth > 0 {
+        df.SetFallbackOrderBookDepth(config.FallbackOrderBookDepth)
+    }
+    if config.Realtime && config.OrderBookMaxDeviation > 0 {
+        df.SetOrderBookCheck(config.OrderBookMaxDeviation,
+                             config.OrderBookCheckInterval, newNotifier(&config))
+    }
+    if err := config.checkMinOrderAmount(df.IsUSDPrice()); err!=nil {
+        panic(&StartupError{ exitConfigInvalid, "Wrong config", err })
+    }
     df.Start()
     defer df.Stop()
     
@@ -60,5 +147,22 @@ func main() {
     eng.Start()
     defer eng.Stop()
     
-    select{}
+    if config.ControlAddr != "" {
+        Logger.Info("Start control server on ", config.ControlAddr)
+        cs := NewControlServer(config.ControlAddr, eng)
+        cs.Start()
+        defer cs.Stop()
+    }
+    if config.PprofAddr != "" {
+        Logger.Info("Start pprof server on ", config.PprofAddr)
+        defer startPprofServer(config.PprofAddr).Close()
+    }
+    
+    // wait for fatal runtime error (for example revoked API key).
+    // stop engine and exit, because engine can't do anything without valid key.
+    err := <-eng.Fatal()
+    code, msg := fatalExitInfo(err)
+    Logger.Error("Fatal error: ", msg)
+    fmt.Fprintln(os.Stderr, "Fatal error:", msg)
+    return code
 }
@@ -0,0 +1,90 @@
+/*
+ * rate_stats.go - statistics of funding rates
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "sync"
+    "time"
+)
+
+// default span (in samples) of exponential moving average
+const defaultRateEMASpan = 48
+
+// exponential moving average of lowest ask rate (zero value is empty).
+// live rates are sampled at most once per period, so they have the same
+// weight as closing rates of historical candles used to seed average.
+type rateStats struct {
+    mutex sync.Mutex
+    alpha float64
+    period time.Duration    // minimal time between samples (0 - no limit)
+    lastTime time.Time      // time of last sample
+    ema float64
+    samples uint64
+}
+
+// set span of moving average (in samples) and period of samples
+func (rs *rateStats) setSpan(span uint, period time.Duration) {
+    rs.mutex.Lock()
+    defer rs.mutex.Unlock()
+    rs.alpha = 2.0 / float64(span+1)
+    rs.period = period
+}
+
+func (rs *rateStats) addInt(rate float64) {
+    if rs.samples == 0 {
+        rs.ema = rate
+    } else {
+        alpha := rs.alpha
+        if alpha == 0 { alpha = 2.0 / (defaultRateEMASpan+1) }
+        rs.ema += alpha * (rate - rs.ema)
+    }
+    rs.samples++
+}
+
+// add live rate. rate is skipped if period has not elapsed since last sample.
+func (rs *rateStats) add(rate float64, now time.Time) {
+    rs.mutex.Lock()
+    defer rs.mutex.Unlock()
+    if rs.samples != 0 && now.Sub(rs.lastTime) < rs.period { return }
+    rs.addInt(rate)
+    rs.lastTime = now
+}
+
+// reset statistics and fill them by historical rates (from oldest).
+// now - time of last historical rate (next live sample is after period).
+func (rs *rateStats) seed(rates []float64, now time.Time) {
+    rs.mutex.Lock()
+    defer rs.mutex.Unlock()
+    rs.ema, rs.samples = 0, 0
+    for _, rate := range rates {
+        rs.addInt(rate)
+    }
+    rs.lastTime = now
+}
+
+// get moving average of rate. returns false if no samples.
+func (rs *rateStats) EMA() (float64, bool) {
+    rs.mutex.Lock()
+    defer rs.mutex.Unlock()
+    return rs.ema, rs.samples != 0
+}
@@ -0,0 +1,121 @@
+/*
+ * ratelimit.go - rate limiter for private API calls
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "bytes"
+    "sync"
+    "time"
+)
+
+// default burst if rate limit is set (rate limit is off by default)
+const defaultPrivateRateBurst = 10
+
+type tokenBucket struct {
+    mutex sync.Mutex
+    rate float64    // tokens per second
+    burst float64
+    tokens float64
+    last time.Time
+}
+
+type rateLimiter struct {
+    mutex sync.Mutex
+    rate float64
+    burst float64
+    buckets map[string]*tokenBucket
+    now func() time.Time
+    sleep func(time.Duration)
+}
+
+// perMinute - requests per minute, burst - maximal number of requests at once
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+    if burst < 1 { burst = 1 }
+    return &rateLimiter{ rate: perMinute/60.0, burst: float64(burst),
+        buckets: make(map[string]*tokenBucket),
+        now: time.Now, sleep: time.Sleep }
+}
+
+func (rl *rateLimiter) getBucket(group string) *tokenBucket {
+    rl.mutex.Lock()
+    defer rl.mutex.Unlock()
+    tb, ok := rl.buckets[group]
+    if !ok {
+        tb = &tokenBucket{ rate: rl.rate, burst: rl.burst, tokens: rl.burst,
+                last: rl.now() }
+        rl.buckets[group] = tb
+    }
+    return tb
+}
+
+// wait for token for endpoint group
+func (rl *rateLimiter) wait(group string) {
+    if rl.rate <= 0 { return } // no limit
+    tb := rl.getBucket(group)
+    for {
+        tb.mutex.Lock()
+        now := rl.now()
+        tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+        if tb.tokens > tb.burst { tb.tokens = tb.burst }
+        tb.last = now
+        if tb.tokens >= 1 {
+            tb.tokens -= 1
+            tb.mutex.Unlock()
+            return
+        }
+        waitTime := time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+        tb.mutex.Unlock()
+        rl.sleep(waitTime)
+    }
+}
+
+// endpoints that are limited separately (prefixes of paths)
+var bitfinexPrivEndpointGroups = [][]byte{
+    bitfinexApiWallets,
+    bitfinexApiFundingLoans,
+    bitfinexApiFundingCredits,
+    bitfinexApiFundingTrades,
+    bitfinexApiMarginOrders,
+    bitfinexApiPositions,
+    bitfinexApiMarginInfo,
+    bitfinexApiFundingClose,
+    bitfinexApiFundingKeep,
+    bitfinexApiSubmit,
+    bitfinexApiCancel,
+    bitfinexApiUpdate,
+    bitfinexApiOrders,
+}
+
+// return endpoint group for uri (without currency and history suffix)
+func bitfinexEndpointGroup(uri []byte) string {
+    for _, g := range bitfinexPrivEndpointGroups {
+        if bytes.HasPrefix(uri, g) {
+            group := string(bytes.TrimSuffix(g, []byte("/")))
+            if bytes.HasSuffix(uri, []byte("/hist")) {
+                return group + "/hist"
+            }
+            return group
+        }
+    }
+    return string(uri)
+}
@@ -0,0 +1,86 @@
+/*
+ * ratelimit_test.go - rate limiter tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func getTestRateLimiter(perMinute float64, burst int, now *time.Time) *rateLimiter {
+    rl := newRateLimiter(perMinute, burst)
+    rl.now = func() time.Time { return *now }
+    rl.sleep = func(d time.Duration) { *now = now.Add(d) }
+    return rl
+}
+
+func TestRateLimiter(t *testing.T) {
+    start := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    now := start
+    rl := getTestRateLimiter(60, 2, &now)
+    // two first calls (burst) are not throttled, next calls - one per second
+    for i := 0; i < 10; i++ {
+        rl.wait("v2/auth/r/funding/credits/f")
+    }
+    if elapsed := now.Sub(start); elapsed < 8*time.Second ||
+            elapsed > 8*time.Second+time.Millisecond {
+        t.Errorf("Elapsed time mismatch: %v", elapsed)
+    }
+    
+    // other endpoint group has own bucket
+    groupStart := now
+    rl.wait("v2/auth/r/positions")
+    rl.wait("v2/auth/r/positions")
+    if now != groupStart {
+        t.Errorf("Other endpoint group throttled: %v", now.Sub(groupStart))
+    }
+}
+
+func TestRateLimiterDefaultNoLimit(t *testing.T) {
+    start := time.Date(2021, 9, 14, 15, 37, 11, 0, time.UTC)
+    now := start
+    drv := NewBitfinexPrivate([]byte("key"), []byte("secret"))
+    drv.limiter.now = func() time.Time { return now }
+    drv.limiter.sleep = func(d time.Duration) { now = now.Add(d) }
+    for i := 0; i < 100; i++ {
+        drv.limiter.wait("v2/auth/r/funding/credits")
+    }
+    if now != start {
+        t.Errorf("Default limiter throttled: %v", now.Sub(start))
+    }
+}
+
+func TestBitfinexEndpointGroup(t *testing.T) {
+    cases := [][2]string{
+        { "v2/auth/r/funding/credits/fUST", "v2/auth/r/funding/credits" },
+        { "v2/auth/r/funding/credits/fUST/hist", "v2/auth/r/funding/credits/hist" },
+        { "v2/auth/r/positions", "v2/auth/r/positions" },
+        { "v2/auth/w/funding/offer/submit", "v2/auth/w/funding/offer/submit" },
+        { "v2/auth/r/other", "v2/auth/r/other" },
+    }
+    for _, c := range cases {
+        if res := bitfinexEndpointGroup([]byte(c[0])); res!=c[1] {
+            t.Errorf("Group mismatch for %v: %v!=%v", c[0], c[1], res)
+        }
+    }
+}
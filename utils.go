@@ -66,6 +66,16 @@ func RecoverPanicAndExit(name string) {
     }
 }
 
+// exit with code of fatal startup failure and single line message
+func RecoverStartupPanicAndExit() {
+    defer FatalRecoverPanicAndExit()
+    if x := recover(); x!=nil {
+        code, msg := fatalExitInfo(x)
+        fmt.Fprintln(os.Stderr, "Fatal error:", msg)
+        os.Exit(code)
+    }
+}
+
 func ErrorPanic(msg string, err error) {
-    panic(fmt.Sprint(msg, ": ", err))
+    panic(fmt.Errorf("%s: %w", msg, err))
 }
@@ -38,6 +38,7 @@ import (
 type MarketPriceHandler func(godec64.UDec64)
 type TradeHandler func(*Trade)
 type OrderBookHandler func(*OrderBook)
+type CandleHandler func(*Candle)
 
 type ErrorHandler func(error)
 
@@ -47,23 +48,170 @@ type errorHandlerPack struct {
 
 var dummyErrorHandlerPack errorHandlerPack = errorHandlerPack{}
 
+// number of handler calls of realtime messages that are not finished (atomic)
+var pendingHandlers int64
+
+// number of handler calls dropped by limit of concurrent calls (atomic)
+var droppedHandlers uint64
+
+// limiter of concurrent handler calls
+type handlerLimiter struct {
+    sem chan struct{}
+    // slots of calls waiting for free slot of sem
+    waiting chan struct{}
+    wait time.Duration
+}
+
+// current limiter (*handlerLimiter, nil - no limit)
+var handlerLimit atomic.Value
+
+// take slot for handler call if it is free
+func (hl *handlerLimiter) tryAcquire() bool {
+    select {
+        case hl.sem <- struct{}{}:
+            return true
+        default:
+            return false
+    }
+}
+
+// wait for free slot for handler call up to wait time
+func (hl *handlerLimiter) acquireWait() bool {
+    timer := time.NewTimer(hl.wait)
+    defer timer.Stop()
+    select {
+        case hl.sem <- struct{}{}:
+            return true
+        case <-timer.C:
+            return false
+    }
+}
+
+func (hl *handlerLimiter) release() {
+    <-hl.sem
+}
+
+// set maximal number of concurrent handler calls (0 - no limit). if limit
+// is reached, handler call waits for free slot up to wait time and then
+// it is dropped (0 - dropped immediately). number of waiting calls is
+// also limited by limit.
+func SetHandlerLimit(limit int, wait time.Duration) {
+    var hl *handlerLimiter
+    if limit > 0 {
+        hl = &handlerLimiter{ sem: make(chan struct{}, limit),
+                waiting: make(chan struct{}, limit), wait: wait }
+    }
+    handlerLimit.Store(hl)
+}
+
+// call handler in new goroutine and count it as pending until it returns
+func goHandler(f func()) {
+    goHandlerOrDrop(f, nil)
+}
+
+// call handler in new goroutine and count it as pending until it returns.
+// onDrop (if not nil) is called if call is dropped by limit. caller (read loop
+// of websocket) is never blocked: call waiting for free slot waits in its
+// goroutine.
+func goHandlerOrDrop(f func(), onDrop func()) {
+    drop := func() {
+        atomic.AddUint64(&droppedHandlers, 1)
+        if onDrop!=nil { onDrop() }
+    }
+    hl, _ := handlerLimit.Load().(*handlerLimiter)
+    acquired := hl==nil || hl.tryAcquire()
+    if !acquired {
+        if hl.wait <= 0 { drop(); return }
+        select {
+            case hl.waiting <- struct{}{}:
+            default:
+                drop()  // too many waiting calls
+                return
+        }
+    }
+    atomic.AddInt64(&pendingHandlers, 1)
+    go func() {
+        defer atomic.AddInt64(&pendingHandlers, -1)
+        if !acquired {
+            acquired = hl.acquireWait()
+            <-hl.waiting
+            if !acquired { drop(); return }
+        }
+        if hl!=nil { defer hl.release() }
+        f()
+    }()
+}
+
+// get number of pending handler calls
+func PendingHandlers() int64 {
+    return atomic.LoadInt64(&pendingHandlers)
+}
+
+// get number of handler calls dropped by limit of concurrent calls
+func DroppedHandlers() uint64 {
+    return atomic.LoadUint64(&droppedHandlers)
+}
+
 type wsChannelType uint8
 
 const (
     wsMarketPrice = iota
     wsTrades
     wsDiffOrderBook
+    wsCandles
     wsInitialize
 )
 
+// index of messages that don't belong to data channel (commands, heartbeats
+// of unknown channels, messages before subscription) in message statistics
+const wsStatsOther = wsCandles + 1
+
+// names of channel types in message statistics
+var wsStatsNames = [wsStatsOther+1]string{ bitfinexChannelTicker,
+            bitfinexChannelTrades, bitfinexChannelBook, bitfinexChannelCandles,
+            "other" }
+
+// counters of received websocket messages and their bytes by channel type
+type wsMessageStats struct {
+    Messages [wsStatsOther+1]uint64
+    Bytes [wsStatsOther+1]uint64
+}
+
+// count message (atomic)
+func (st *wsMessageStats) add(chType wsChannelType, n int) {
+    atomic.AddUint64(&st.Messages[chType], 1)
+    atomic.AddUint64(&st.Bytes[chType], uint64(n))
+}
+
+// get copy of counters (atomic)
+func (st *wsMessageStats) load() wsMessageStats {
+    var res wsMessageStats
+    for i := range st.Messages {
+        res.Messages[i] = atomic.LoadUint64(&st.Messages[i])
+        res.Bytes[i] = atomic.LoadUint64(&st.Bytes[i])
+    }
+    return res
+}
+
+// add counters of other statistics
+func (st *wsMessageStats) merge(other *wsMessageStats) {
+    for i := range st.Messages {
+        st.Messages[i] += other.Messages[i]
+        st.Bytes[i] += other.Bytes[i]
+    }
+}
+
 type wsFunc func()
 type wsDialParamsFunc func() (string, http.Header)
 type wsHandleMessageFunc func(msg []byte)
 type wsResubscribeChannelFunc func(wsChannelType, string)
 
 type websocketDriver struct {
+    // first field - 64-bit alignment for atomic operations
+    msgStats wsMessageStats
     netDial func(network, addr string) (net.Conn, error)
     dialTrials uint32
+    compression bool
     mutex sync.Mutex
     connMutex sync.Mutex
     conn *websocket.Conn
@@ -78,12 +226,14 @@ type websocketDriver struct {
     funcRetCh chan string
     funcErrCh chan error
     awaitingFuncRet uint32
+    cmdTimeout time.Duration
     
     callMutex sync.Mutex
     
     marketPriceHandlers sync.Map
     tradeHandlers sync.Map
     diffOrderBookHandlers sync.Map // with rtOBHandler
+    candleHandlers sync.Map
     
     dialParams wsDialParamsFunc
     initMessage wsFunc
@@ -91,6 +241,11 @@ type websocketDriver struct {
     handleMessage wsHandleMessageFunc
 }
 
+// default time of waiting for confirmation of command
+const defaultWSCommandTimeout = 30*time.Second
+
+var errWSCommandTimeout = errors.New("Timeout of waiting for command confirmation")
+
 // websocket
 
 // dial routine
@@ -100,6 +255,7 @@ func (drv *websocketDriver) dial() (bool, bool) {
     var dialer websocket.Dialer
     dialer.NetDial = drv.netDial
     dialer.HandshakeTimeout = time.Minute
+    dialer.EnableCompression = drv.compression
     
     wsConn, resp, err := dialer.Dial(destUrl, header)
     if err!=nil && (resp==nil || resp.StatusCode==503) {
@@ -108,6 +264,7 @@ func (drv *websocketDriver) dial() (bool, bool) {
     if resp.StatusCode >= 400 {
         return false, false
     }
+    wsConn.EnableWriteCompression(drv.compression)
     drv.conn = wsConn
     return true, false
 }
@@ -119,13 +276,13 @@ func (drv *websocketDriver) start() {
     
     drv.awaitingFuncRet = 0
     
+    drv.connMutex.Lock()
+    defer drv.connMutex.Unlock()
     if drv.conn!=nil {
         panic("Websocket already started")
     }
     drv.stopCh = make(chan struct{})
     
-    drv.connMutex.Lock()
-    defer drv.connMutex.Unlock()
     var good, tryAgain bool
     tryAgain = true
     // try 5 times to dial
@@ -144,11 +301,12 @@ func (drv *websocketDriver) start() {
     drv.errorHandler.Store(dummyErrorHandlerPack)
     
     drv.errCh = make(chan error, 2)
-    drv.channelsOpened = 1
+    atomic.StoreUint32(&drv.channelsOpened, 1)
     
     drv.marketPriceHandlers = sync.Map{}
     drv.tradeHandlers = sync.Map{}
     drv.diffOrderBookHandlers = sync.Map{}
+    drv.candleHandlers = sync.Map{}
     
     go drv.handleMessages()
 }
@@ -167,15 +325,18 @@ func (drv *websocketDriver) stop() {
     drv.marketPriceHandlers = sync.Map{}
     drv.tradeHandlers = sync.Map{}
     drv.diffOrderBookHandlers = sync.Map{}
-    drv.errorHandler.Store(&dummyErrorHandlerPack)
+    drv.candleHandlers = sync.Map{}
+    drv.errorHandler.Store(dummyErrorHandlerPack)
     drv.reconnHandler = nil
-    atomic.StoreUint32(&drv.channelsOpened, 0)
-    if drv.conn==nil { return }
+    // connection can not be checked under connMutex, because reconnect holds
+    // it while waiting for stop. channels are opened only if started.
+    if atomic.SwapUint32(&drv.channelsOpened, 0)==0 { return }
     drv.stopCh <- struct{}{}
     close(drv.stopCh)
     if drv.errCh!=nil { close(drv.errCh) }
-    drv.conn.Close()
+    // handleMessages has finished and reconnect doesn't replace connection
     drv.connMutex.Lock()
+    drv.conn.Close()
     drv.conn = nil
     drv.connMutex.Unlock()
     drv.errCh = nil
@@ -234,7 +395,6 @@ func (drv *websocketDriver) tryReconnect() bool {
             return true
         }
     }
-    return false
 }
 
 func (drv *websocketDriver) reconnect() bool {
@@ -324,7 +484,8 @@ func (drv *websocketDriver) handleMessages() {
             case err := <-drv.errCh: {
                 Logger.Error("websocket:", err)
                 errStr := fmt.Sprint(err)
-                if errStr=="repeated read on failed websocket connection" ||
+                if err==errWSCommandTimeout ||
+                    errStr=="repeated read on failed websocket connection" ||
                     strings.LastIndex(errStr, "connection timed out")!=-1 ||
                     websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure,
                             websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
@@ -386,9 +547,37 @@ func (drv *websocketDriver) getDiffOrderBookHandle(
     return nil
 }
 
+func (drv *websocketDriver) setCandleHandler(key string, h CandleHandler) {
+    drv.candleHandlers.Store(key, h)
+}
+
+func (drv *websocketDriver) unsetCandleHandler(key string) {
+    drv.candleHandlers.Delete(key)
+}
+
+func (drv *websocketDriver) callCandleHandler(key string, candle *Candle) {
+    h, ok := drv.candleHandlers.Load(key)
+    if ok { h.(CandleHandler)(candle) }
+}
+
+// enable permessage-deflate compression (must be called before start)
+func (drv *websocketDriver) SetCompression(enable bool) {
+    drv.compression = enable
+}
+
+// set time of waiting for confirmation of command (0 - default)
+func (drv *websocketDriver) SetCommandTimeout(d time.Duration) {
+    drv.cmdTimeout = d
+}
+
+func (drv *websocketDriver) commandTimeout() time.Duration {
+    if drv.cmdTimeout > 0 { return drv.cmdTimeout }
+    return defaultWSCommandTimeout
+}
+
 func (drv *websocketDriver) SetErrorHandler(h ErrorHandler) {
-    if h!=nil { drv.errorHandler.Store(&errorHandlerPack{ h })
-    } else { drv.errorHandler.Store(&dummyErrorHandlerPack) }
+    if h!=nil { drv.errorHandler.Store(errorHandlerPack{ h })
+    } else { drv.errorHandler.Store(dummyErrorHandlerPack) }
 }
 
 // resubscribe channels after reconnection
@@ -409,4 +598,8 @@ func (drv* websocketDriver) resubscribeChannels() {
         drv.resubscribeChannel(wsDiffOrderBook, key.(string))
         return true
     })
+    drv.candleHandlers.Range(func(key, value interface{}) bool {
+        drv.resubscribeChannel(wsCandles, key.(string))
+        return true
+    })
 }
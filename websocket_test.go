@@ -0,0 +1,627 @@
+/*
+ * websocket_test.go - websocket driver tests
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    "github.com/gorilla/websocket"
+    "github.com/matszpk/godec64"
+)
+
+func TestWebsocketDriverCompression(t *testing.T) {
+    msgs := []string{
+        `[1,"hb"]`,
+        `[17082,[[0.000123,2,1000.5,3],[0.000124,30,-200,1]]]`,
+        "[17082,[" + strings.Repeat(`[0.000125,2,1000.5,3],`, 100) +
+                    `[0.000126,2,1000.5,3]]]`,
+    }
+    extCh := make(chan string, 2)
+    upgrader := websocket.Upgrader{ EnableCompression: true }
+    server := httptest.NewServer(http.HandlerFunc(
+                func(w http.ResponseWriter, r *http.Request) {
+        extCh <- r.Header.Get("Sec-WebSocket-Extensions")
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err!=nil { return }
+        defer conn.Close()
+        conn.EnableWriteCompression(true)
+        for _, msg := range msgs {
+            conn.WriteMessage(websocket.TextMessage, []byte(msg))
+        }
+        // wait for client closing
+        conn.ReadMessage()
+    }))
+    defer server.Close()
+    
+    for _, compression := range []bool{ false, true } {
+        recvCh := make(chan string, len(msgs))
+        drv := &websocketDriver{}
+        drv.dialTrials = 1
+        drv.SetCompression(compression)
+        drv.dialParams = func() (string, http.Header) {
+            return "ws" + strings.TrimPrefix(server.URL, "http"), nil
+        }
+        drv.handleMessage = func(msg []byte) { recvCh <- string(msg) }
+        drv.start()
+        
+        ext := <-extCh
+        if compression != strings.Contains(ext, "permessage-deflate") {
+            t.Errorf("Compression negotiation mismatch %v: %q", compression, ext)
+        }
+        for i, expMsg := range msgs {
+            select {
+                case msg := <-recvCh:
+                    if msg!=expMsg {
+                        t.Errorf("Message mismatch %v %d: %v!=%v",
+                                 compression, i, expMsg, msg)
+                    }
+                case <-time.After(5*time.Second):
+                    t.Fatalf("Message %d not received", i)
+            }
+        }
+        drv.stop()
+    }
+}
+
+func TestBitfinexRTPublicCommandTimeout(t *testing.T) {
+    connCh := make(chan struct{}, 4)
+    upgrader := websocket.Upgrader{}
+    server := httptest.NewServer(http.HandlerFunc(
+                func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err!=nil { return }
+        defer conn.Close()
+        connCh <- struct{}{}
+        conn.WriteMessage(websocket.TextMessage,
+                []byte(`{"event":"info","version":2,"platform":{"status":1}}`))
+        // never acknowledge subscriptions
+        for {
+            if _, _, err := conn.ReadMessage(); err!=nil { return }
+        }
+    }))
+    defer server.Close()
+    
+    drv := NewBitfinexRTPublic()
+    drv.dialTrials = 1
+    drv.dialParams = func() (string, http.Header) {
+        return "ws" + strings.TrimPrefix(server.URL, "http"), nil
+    }
+    drv.SetCommandTimeout(200*time.Millisecond)
+    drv.Start()
+    defer drv.Stop()
+    <-connCh
+    
+    start := time.Now()
+    err, _ := recoverCall(func() { drv.SubscribeOrderBook("UST", nil) })
+    if err==nil || !errors.Is(err, errWSCommandTimeout) {
+        t.Errorf("No timeout error: %v", err)
+    }
+    if d := time.Since(start); d > 5*time.Second {
+        t.Errorf("Timeout took too long: %v", d)
+    }
+    // timeout forces reconnection
+    select {
+        case <-connCh:
+        case <-time.After(5*time.Second):
+            t.Errorf("No reconnection after timeout")
+    }
+}
+
+// websocket server that acknowledges every command with new channel id
+func newSubscribeAckServer() *httptest.Server {
+    var chanIdMutex sync.Mutex
+    chanId := 100
+    upgrader := websocket.Upgrader{}
+    return httptest.NewServer(http.HandlerFunc(
+                func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err!=nil { return }
+        defer conn.Close()
+        conn.WriteMessage(websocket.TextMessage,
+                []byte(`{"event":"info","version":2,"platform":{"status":1}}`))
+        for {
+            if _, _, err := conn.ReadMessage(); err!=nil { return }
+            chanIdMutex.Lock()
+            chanId++
+            msg := fmt.Sprint(`{"event":"subscribed","chanId":`, chanId, `}`)
+            chanIdMutex.Unlock()
+            conn.WriteMessage(websocket.TextMessage, []byte(msg))
+        }
+    }))
+}
+
+func newTestBitfinexRTPublic(server *httptest.Server) *BitfinexRTPublic {
+    drv := NewBitfinexRTPublic()
+    drv.dialTrials = 1
+    drv.dialParams = func() (string, http.Header) {
+        return "ws" + strings.TrimPrefix(server.URL, "http"), nil
+    }
+    return drv
+}
+
+func TestBitfinexRTPublicSubscriptions(t *testing.T) {
+    server := newSubscribeAckServer()
+    defer server.Close()
+    drv := newTestBitfinexRTPublic(server)
+    drv.Start()
+    defer drv.Stop()
+    
+    if subs := drv.Subscriptions(); len(subs)!=0 {
+        t.Errorf("Subscriptions without channels: %v", subs)
+    }
+    drv.SubscribeMarketPrice("BTCUST", func(godec64.UDec64) {})
+    drv.SubscribeOrderBook("UST", func(*OrderBook) {})
+    drv.SubscribeOrderBook("BTC", func(*OrderBook) {})
+    drv.SubscribeTrades("UST", func(*Trade) {})
+    expSubs := map[string][]string{ "ticker": { "BTCUST" },
+                "trades": { "UST" }, "book": { "BTC", "UST" } }
+    if subs := drv.Subscriptions(); !reflect.DeepEqual(subs, expSubs) {
+        t.Errorf("Subscriptions mismatch: %v!=%v", expSubs, subs)
+    }
+    drv.UnsubscribeOrderBook("BTC")
+    expSubs["book"] = []string{ "UST" }
+    if subs := drv.Subscriptions(); !reflect.DeepEqual(subs, expSubs) {
+        t.Errorf("Subscriptions mismatch: %v!=%v", expSubs, subs)
+    }
+}
+
+func TestBitfinexRTPublicPoolSpillOver(t *testing.T) {
+    server := newSubscribeAckServer()
+    defer server.Close()
+    
+    pool := NewBitfinexRTPublicPool()
+    pool.SetMaxChannels(2)
+    pool.newConn = func() *BitfinexRTPublic {
+        return newTestBitfinexRTPublic(server)
+    }
+    pool.Start()
+    defer pool.Stop()
+    
+    pool.SubscribeOrderBook("UST", func(*OrderBook) {})
+    pool.SubscribeTrades("UST", func(*Trade) {})
+    if n := pool.Connections(); n!=1 {
+        t.Errorf("Connections mismatch: %v!=1", n)
+    }
+    // third channel spills over to second connection
+    pool.SubscribeOrderBook("BTC", func(*OrderBook) {})
+    if n := pool.Connections(); n!=2 {
+        t.Fatalf("Connections mismatch: %v!=2", n)
+    }
+    if pool.owners[wsChannelKey{ wsDiffOrderBook, "UST" }]!=pool.conns[0] ||
+        pool.owners[wsChannelKey{ wsTrades, "UST" }]!=pool.conns[0] ||
+        pool.owners[wsChannelKey{ wsDiffOrderBook, "BTC" }]!=pool.conns[1] {
+        t.Errorf("Channel owners mismatch")
+    }
+    if _, ok := pool.conns[1].wsOrderBookChanIdMap["BTC"]; !ok {
+        t.Errorf("Orderbook not subscribed on second connection")
+    }
+    // freed place is reused
+    pool.UnsubscribeTrades("UST")
+    pool.SubscribeTrades("BTC", func(*Trade) {})
+    if n := pool.Connections(); n!=2 ||
+        pool.owners[wsChannelKey{ wsTrades, "BTC" }]!=pool.conns[0] {
+        t.Errorf("Freed channel place is not reused")
+    }
+    expSubs := map[string][]string{ "trades": { "BTC" }, "book": { "BTC", "UST" } }
+    if subs := pool.Subscriptions(); !reflect.DeepEqual(subs, expSubs) {
+        t.Errorf("Subscriptions mismatch: %v!=%v", expSubs, subs)
+    }
+}
+
+// server acknowledges subscriptions, but rejects them by limit of channels
+// if reject returns true (for number of command in all connections)
+func newSubscribeLimitServer(reject func(n int) bool) *httptest.Server {
+    var mutex sync.Mutex
+    n, chanId := 0, 100
+    upgrader := websocket.Upgrader{}
+    return httptest.NewServer(http.HandlerFunc(
+                func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err!=nil { return }
+        defer conn.Close()
+        conn.WriteMessage(websocket.TextMessage,
+                []byte(`{"event":"info","version":2,"platform":{"status":1}}`))
+        for {
+            if _, _, err := conn.ReadMessage(); err!=nil { return }
+            mutex.Lock()
+            var msg string
+            if reject(n) {
+                msg = `{"event":"error","msg":"subscribe: limit","code":10305}`
+            } else {
+                chanId++
+                msg = fmt.Sprint(`{"event":"subscribed","chanId":`, chanId, `}`)
+            }
+            n++
+            mutex.Unlock()
+            conn.WriteMessage(websocket.TextMessage, []byte(msg))
+        }
+    }))
+}
+
+func TestBitfinexRTPublicSubscribeLimit(t *testing.T) {
+    // every second subscription is rejected
+    server := newSubscribeLimitServer(func(n int) bool { return n==1 })
+    defer server.Close()
+    drv := newTestBitfinexRTPublic(server)
+    drv.Start()
+    defer drv.Stop()
+    
+    drv.SubscribeOrderBook("UST", func(*OrderBook) {})
+    err, retry := recoverCall(func() { drv.SubscribeTrades("UST", func(*Trade) {}) })
+    if !isSubscribeLimitError(err) || !retry {
+        t.Errorf("Error mismatch: %v %v", err, retry)
+    }
+    // connection is still usable
+    drv.SubscribeOrderBook("BTC", func(*OrderBook) {})
+    expSubs := map[string][]string{ "book": { "BTC", "UST" } }
+    if subs := drv.Subscriptions(); !reflect.DeepEqual(subs, expSubs) {
+        t.Errorf("Subscriptions mismatch: %v!=%v", expSubs, subs)
+    }
+}
+
+func TestBitfinexRTPublicPoolSubscribeLimit(t *testing.T) {
+    // first connection accepts only one channel
+    server := newSubscribeLimitServer(func(n int) bool { return n==1 })
+    defer server.Close()
+    pool := NewBitfinexRTPublicPool()
+    pool.newConn = func() *BitfinexRTPublic {
+        return newTestBitfinexRTPublic(server)
+    }
+    pool.Start()
+    defer pool.Stop()
+    
+    pool.SubscribeOrderBook("UST", func(*OrderBook) {})
+    pool.SubscribeTrades("UST", func(*Trade) {})
+    if n := pool.Connections(); n!=2 {
+        t.Fatalf("Connections mismatch: %v!=2", n)
+    }
+    if pool.owners[wsChannelKey{ wsTrades, "UST" }]!=pool.conns[1] {
+        t.Errorf("Channel not moved to another connection")
+    }
+    // full connection is not used again
+    pool.SubscribeOrderBook("BTC", func(*OrderBook) {})
+    if pool.Connections()!=2 ||
+            pool.owners[wsChannelKey{ wsDiffOrderBook, "BTC" }]!=pool.conns[1] {
+        t.Errorf("Full connection used again")
+    }
+}
+
+func TestBitfinexRTPublicPoolSubscribeRetry(t *testing.T) {
+    oldDelay := wsSubscribeRetryDelay
+    wsSubscribeRetryDelay = 10*time.Millisecond
+    defer func() { wsSubscribeRetryDelay = oldDelay }()
+    // both connections reject first subscription
+    server := newSubscribeLimitServer(func(n int) bool { return n<2 })
+    defer server.Close()
+    pool := NewBitfinexRTPublicPool()
+    pool.newConn = func() *BitfinexRTPublic {
+        return newTestBitfinexRTPublic(server)
+    }
+    pool.Start()
+    defer pool.Stop()
+    
+    // no panic, subscription is retried later
+    pool.SubscribeOrderBook("UST", func(*OrderBook) {})
+    expSubs := map[string][]string{ "book": { "UST" } }
+    deadline := time.Now().Add(5*time.Second)
+    for !reflect.DeepEqual(pool.Subscriptions(), expSubs) &&
+            time.Now().Before(deadline) {
+        time.Sleep(5*time.Millisecond)
+    }
+    if subs := pool.Subscriptions(); !reflect.DeepEqual(subs, expSubs) {
+        t.Errorf("Subscriptions mismatch: %v!=%v", expSubs, subs)
+    }
+    // new connection that rejected first subscription is closed
+    if n := pool.Connections(); n!=2 {
+        t.Errorf("Connections mismatch: %v!=2", n)
+    }
+}
+
+func TestBitfinexRTPublicPoolSubscribeUnlocked(t *testing.T) {
+    ackCh := make(chan struct{})
+    var ackOnce sync.Once
+    ack := func() { ackOnce.Do(func() { close(ackCh) }) }
+    defer ack()
+    upgrader := websocket.Upgrader{}
+    server := httptest.NewServer(http.HandlerFunc(
+                func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err!=nil { return }
+        defer conn.Close()
+        conn.WriteMessage(websocket.TextMessage,
+                []byte(`{"event":"info","version":2,"platform":{"status":1}}`))
+        if _, _, err := conn.ReadMessage(); err!=nil { return }
+        <-ackCh    // delayed confirmation
+        conn.WriteMessage(websocket.TextMessage,
+                []byte(`{"event":"subscribed","chanId":100}`))
+        conn.ReadMessage()
+    }))
+    defer server.Close()
+    pool := NewBitfinexRTPublicPool()
+    pool.newConn = func() *BitfinexRTPublic {
+        return newTestBitfinexRTPublic(server)
+    }
+    pool.Start()
+    defer pool.Stop()
+    
+    done := make(chan struct{})
+    go func() {
+        pool.SubscribeOrderBook("UST", func(*OrderBook) {})
+        close(done)
+    }()
+    // pool is not locked while waiting for confirmation
+    waitFor(t, "reserved channel", func() bool { return pool.Channels()==1 })
+    if n := pool.Connections(); n!=1 {
+        t.Errorf("Connections mismatch: %v!=1", n)
+    }
+    ack()
+    select {
+        case <-done:
+        case <-time.After(5*time.Second):
+            t.Fatal("Subscription not finished")
+    }
+    expSubs := map[string][]string{ "book": { "UST" } }
+    if subs := pool.Subscriptions(); !reflect.DeepEqual(subs, expSubs) {
+        t.Errorf("Subscriptions mismatch: %v!=%v", expSubs, subs)
+    }
+}
+
+func TestBitfinexRTPublicMessageStats(t *testing.T) {
+    drv := NewBitfinexRTPublic()
+    drv.wsChannelMap.Store("5", &bitfinexChannelEntry{ channelType: wsMarketPrice,
+                key: "tBTCUST" })
+    drv.wsChannelMap.Store("7", &bitfinexChannelEntry{ channelType: wsDiffOrderBook,
+                key: "fUST" })
+    msgs := []struct {
+        msg string
+        chType wsChannelType
+    }{
+        { `[5,[1,2,3,4,5,6,7.5,8,9,10]]`, wsMarketPrice },
+        { `[5,"hb"]`, wsMarketPrice },
+        { `[7,"hb"]`, wsDiffOrderBook },
+        { `{"event":"info","version":2}`, wsStatsOther },
+        { `[9,[1,2]]`, wsStatsOther },  // not yet subscribed channel
+    }
+    var expStats wsMessageStats
+    for _, m := range msgs {
+        drv.wsHandleMessage([]byte(m.msg))
+        expStats.Messages[m.chType]++
+        expStats.Bytes[m.chType] += uint64(len(m.msg))
+    }
+    if stats := drv.MessageStats(); stats!=expStats {
+        t.Errorf("Stats mismatch: %v!=%v", expStats, stats)
+    }
+    // summed in pool
+    pool := &BitfinexRTPublicPool{ conns: []*BitfinexRTPublic{ drv, drv } }
+    expStats.merge(&expStats)
+    if stats := pool.MessageStats(); stats!=expStats {
+        t.Errorf("Pool stats mismatch: %v!=%v", expStats, stats)
+    }
+}
+
+func TestBitfinexRTPublicCandleMessage(t *testing.T) {
+    drv := NewBitfinexRTPublic()
+    drv.wsChannelMap.Store("12", &bitfinexChannelEntry{ channelType: wsCandles,
+                key: "trade:1m:fUSD" })
+    candleCh := make(chan Candle, 2)
+    drv.setCandleHandler("trade:1m:fUSD", func(c *Candle) { candleCh <- *c })
+    // snapshot is ignored
+    drv.wsHandleMessage([]byte(`[12,[[1634400060000,0.0002,0.00021,0.00022,0.00019,100],` +
+                `[1634400000000,0.0001,0.0002,0.0002,0.0001,50]]]`))
+    drv.wsHandleMessage([]byte(`[12,[1634400120000,0.0002,0.00021,0.00022,0.00019,` +
+                `12345.6]]`))
+    expCandle := Candle{ TimeStamp: time.Unix(1634400120, 0),
+                Open: 200000000, Close: 210000000, High: 220000000, Low: 190000000,
+                Volume: 12345600000000000 }
+    select {
+        case candle := <-candleCh:
+            if !candle.TimeStamp.Equal(expCandle.TimeStamp) {
+                t.Errorf("Candle time mismatch: %v!=%v", expCandle.TimeStamp,
+                         candle.TimeStamp)
+            }
+            candle.TimeStamp = expCandle.TimeStamp
+            if candle!=expCandle {
+                t.Errorf("Candle mismatch: %v!=%v", expCandle, candle)
+            }
+        case <-time.After(time.Second):
+            t.Fatalf("No candle")
+    }
+    select {
+        case candle := <-candleCh:
+            t.Errorf("Unexpected candle from snapshot: %v", candle)
+        default:
+    }
+}
+
+func TestBitfinexRTPublicSubscribeCandles(t *testing.T) {
+    cmdCh := make(chan string, 4)
+    upgrader := websocket.Upgrader{}
+    server := httptest.NewServer(http.HandlerFunc(
+                func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err!=nil { return }
+        defer conn.Close()
+        conn.WriteMessage(websocket.TextMessage,
+                []byte(`{"event":"info","version":2,"platform":{"status":1}}`))
+        for {
+            _, msg, err := conn.ReadMessage()
+            if err!=nil { return }
+            cmdCh <- string(msg)
+            if strings.Contains(string(msg), `"unsubscribe"`) {
+                conn.WriteMessage(websocket.TextMessage,
+                        []byte(`{"event":"unsubscribed","status":"OK","chanId":77}`))
+                continue
+            }
+            conn.WriteMessage(websocket.TextMessage, []byte(
+                    `{"event":"subscribed","channel":"candles","chanId":77,` +
+                    `"key":"trade:1m:fUSD"}`))
+            conn.WriteMessage(websocket.TextMessage, []byte(
+                    `[77,[1634400120000,0.0002,0.00021,0.00022,0.00019,10]]`))
+        }
+    }))
+    defer server.Close()
+    drv := newTestBitfinexRTPublic(server)
+    drv.Start()
+    defer drv.Stop()
+    
+    candleCh := make(chan Candle, 2)
+    drv.SubscribeCandles("trade:1m:fUSD", func(c *Candle) { candleCh <- *c })
+    expCmd := `{"event":"subscribe","channel":"candles","key":"trade:1m:fUSD"}`
+    if cmd := <-cmdCh; cmd!=expCmd {
+        t.Errorf("Command mismatch: %v!=%v", expCmd, cmd)
+    }
+    expSubs := map[string][]string{ "candles": { "trade:1m:fUSD" } }
+    if subs := drv.Subscriptions(); !reflect.DeepEqual(subs, expSubs) {
+        t.Errorf("Subscriptions mismatch: %v!=%v", expSubs, subs)
+    }
+    select {
+        case candle := <-candleCh:
+            if candle.Close!=210000000 || candle.Volume!=10000000000000 {
+                t.Errorf("Candle mismatch: %v", candle)
+            }
+        case <-time.After(2*time.Second):
+            t.Fatalf("No candle update")
+    }
+    drv.UnsubscribeCandles("trade:1m:fUSD")
+    if cmd := <-cmdCh; cmd!=`{"event":"unsubscribe","chanId":77}` {
+        t.Errorf("Unsubscribe command mismatch: %v", cmd)
+    }
+    if subs := drv.Subscriptions(); len(subs)!=0 {
+        t.Errorf("Subscriptions after unsubscribe: %v", subs)
+    }
+}
+
+func TestGoHandlerLimit(t *testing.T) {
+    defer SetHandlerLimit(0, 0)
+    var running, maxRunning int64
+    trackRunning := func(f func()) func() {
+        return func() {
+            n := atomic.AddInt64(&running, 1)
+            for {
+                m := atomic.LoadInt64(&maxRunning)
+                if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) { break }
+            }
+            f()
+            atomic.AddInt64(&running, -1)
+        }
+    }
+    // flood blocked handlers - calls above limit are dropped
+    SetHandlerLimit(3, 0)
+    blockCh := make(chan struct{})
+    dropped := DroppedHandlers()
+    var wg sync.WaitGroup
+    for i := 0; i < 50; i++ {
+        goHandler(trackRunning(func() { <-blockCh }))
+    }
+    if n := DroppedHandlers() - dropped; n!=47 {
+        t.Errorf("Dropped calls mismatch: %d", n)
+    }
+    if m := atomic.LoadInt64(&maxRunning); m > 3 {
+        t.Errorf("Too many concurrent handlers: %d", m)
+    }
+    close(blockCh)
+    waitFor(t, "blocked handlers", func() bool { return atomic.LoadInt64(&running)==0 })
+    // with waiting - calls wait in own goroutines, caller is not blocked
+    atomic.StoreInt64(&maxRunning, 0)
+    SetHandlerLimit(2, 5*time.Second)
+    dropped = DroppedHandlers()
+    waitBlockCh := make(chan struct{})
+    start := time.Now()
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        goHandler(trackRunning(func() {
+            defer wg.Done()
+            <-waitBlockCh
+        }))
+    }
+    // too many waiting calls
+    droppedCh := make(chan struct{})
+    goHandlerOrDrop(func() {}, func() { close(droppedCh) })
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("Caller blocked by waiting calls: %v", d)
+    }
+    select {
+        case <-droppedCh:
+        default:
+            t.Errorf("Call above waiting limit not dropped")
+    }
+    close(waitBlockCh)
+    wg.Wait()
+    if n := DroppedHandlers() - dropped; n!=1 {
+        t.Errorf("Dropped calls with waiting: %d", n)
+    }
+    if m := atomic.LoadInt64(&maxRunning); m > 2 {
+        t.Errorf("Too many concurrent handlers: %d", m)
+    }
+    // waiting call is dropped after wait time
+    SetHandlerLimit(1, 20*time.Millisecond)
+    dropBlockCh := make(chan struct{})
+    defer close(dropBlockCh)
+    goHandler(func() { <-dropBlockCh })
+    droppedCh = make(chan struct{})
+    goHandlerOrDrop(func() { t.Errorf("Waiting call not dropped") },
+                    func() { close(droppedCh) })
+    select {
+        case <-droppedCh:
+        case <-time.After(5*time.Second):
+            t.Errorf("Waiting call not dropped after wait time")
+    }
+}
+
+func TestRtOrderBookDroppedBaseline(t *testing.T) {
+    defer SetHandlerLimit(0, 0)
+    SetHandlerLimit(1, 0)
+    obCh := make(chan *OrderBook, 2)
+    blockCh := make(chan struct{})
+    rtOBH := newRtOrderBookHandle("UST", func(ob *OrderBook) {
+        <-blockCh
+        obCh <- ob
+    })
+    newOb := func(rate godec64.UDec64) *OrderBook {
+        return &OrderBook{ Ask: []OrderBookEntry{
+                OrderBookEntry{ 2, 16000000000, rate, 1 } } }
+    }
+    rtOBH.pushInitial(newOb(3111000000))    // takes only slot
+    rtOBH.clear()
+    rtOBH.markBaseline()
+    rtOBH.pushInitial(newOb(4111000000))    // dropped
+    close(blockCh)
+    if ob := <-obCh; ob.Baseline {
+        t.Errorf("First orderbook is baseline")
+    }
+    waitFor(t, "free slot", func() bool { return PendingHandlers()==0 })
+    // baseline flag of dropped orderbook is carried to next orderbook
+    rtOBH.pushDiff(&OrderBookEntryDiff{ SideOffer,
+            OrderBookEntry{ 2, 16000000000, 4011000000, 1 } })
+    if ob := <-obCh; !ob.Baseline {
+        t.Errorf("Next orderbook after dropped baseline is not baseline")
+    }
+}
@@ -22,6 +22,10 @@
 
 package main
 
+import (
+    "sync/atomic"
+)
+
 // apply orderbook diff
 
 type OrderBookEntryDiff struct {
@@ -147,6 +151,8 @@ type rtOrderBookHandle struct {
     initial OrderBook
     haveInitial bool
     h OrderBookHandler
+    // 1 if next initial orderbook is baseline (after resubscription)
+    baselineNext uint32
 }
 
 func newRtOrderBookHandle(rtName string, fh OrderBookHandler) *rtOrderBookHandle {
@@ -168,12 +174,26 @@ func (rtob *rtOrderBookHandle) clear() {
 func (rtob *rtOrderBookHandle) pushInitial(ob *OrderBook) {
     rtob.haveInitial = true
     rtob.initial.copyFrom(ob)
-    go rtob.h(ob)
+    rtob.deliver(ob)
+}
+
+// call handler with orderbook. if call is dropped, then next delivered
+// orderbook inherits baseline flag (previous orderbook is before gap).
+func (rtob *rtOrderBookHandle) deliver(ob *OrderBook) {
+    ob.Baseline = atomic.SwapUint32(&rtob.baselineNext, 0) != 0
+    goHandlerOrDrop(func() { rtob.h(ob) }, func() {
+        if ob.Baseline { rtob.markBaseline() }
+    })
+}
+
+// mark next initial orderbook as baseline (it follows gap in updates)
+func (rtob *rtOrderBookHandle) markBaseline() {
+    atomic.StoreUint32(&rtob.baselineNext, 1)
 }
 
 func (rtob *rtOrderBookHandle) pushDiff(diff *OrderBookEntryDiff) {
     var ob OrderBook
     rtob.initial.applyDiff(&ob, diff)
     rtob.initial.copyFrom(&ob)
-    go rtob.h(&ob)
+    rtob.deliver(&ob)
 }
@@ -0,0 +1,358 @@
+/*
+ * ws_pool.go - pool of Bitfinex Realtime Public connections
+ *
+ * bitfinex_borrow_catcher - Automatic borrow catcher for open positions in
+ *                            the Bitfinex exchange
+ * Copyright (C) 2021  Mateusz Szpakowski
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ */
+
+package main
+
+import (
+    "sort"
+    "sync"
+    "time"
+)
+
+// default maximal number of channels per websocket connection
+// (Bitfinex limits it to 25 channels)
+const defaultWSMaxChannels = 25
+
+// key of subscribed channel
+type wsChannelKey struct {
+    channelType wsChannelType
+    key string
+}
+
+// pool of realtime connections. channels are distributed across connections,
+// new connection is opened if all connections have maximal number of channels.
+type BitfinexRTPublicPool struct {
+    mutex sync.Mutex
+    maxChannels int
+    compression bool
+    cmdTimeout time.Duration
+    conns []*BitfinexRTPublic
+    channelCounts []int
+    // maximal number of channels of connections (lowered if exchange
+    // reports limit of channels)
+    connMaxChannels []int
+    // connection that owns channel (reconnected connection resubscribes
+    // only own channels)
+    owners map[wsChannelKey]*BitfinexRTPublic
+    running bool
+    newConn func() *BitfinexRTPublic
+}
+
+func NewBitfinexRTPublicPool() *BitfinexRTPublicPool {
+    return &BitfinexRTPublicPool{ maxChannels: defaultWSMaxChannels,
+            owners: make(map[wsChannelKey]*BitfinexRTPublic),
+            newConn: NewBitfinexRTPublic }
+}
+
+// set maximal number of channels per connection (0 - default)
+func (pool *BitfinexRTPublicPool) SetMaxChannels(n int) {
+    if n <= 0 { n = defaultWSMaxChannels }
+    pool.maxChannels = n
+}
+
+// enable permessage-deflate compression (must be called before start)
+func (pool *BitfinexRTPublicPool) SetCompression(enable bool) {
+    pool.compression = enable
+}
+
+// set time of waiting for confirmation of command (0 - default)
+func (pool *BitfinexRTPublicPool) SetCommandTimeout(d time.Duration) {
+    pool.cmdTimeout = d
+}
+
+// create and start new connection (dials websocket)
+func (pool *BitfinexRTPublicPool) dialConn() *BitfinexRTPublic {
+    conn := pool.newConn()
+    conn.SetCompression(pool.compression)
+    conn.SetCommandTimeout(pool.cmdTimeout)
+    conn.Start()
+    return conn
+}
+
+// add started connection with number of channels (must be called under mutex)
+func (pool *BitfinexRTPublicPool) addConn(conn *BitfinexRTPublic, channels int) {
+    pool.conns = append(pool.conns, conn)
+    pool.channelCounts = append(pool.channelCounts, channels)
+    pool.connMaxChannels = append(pool.connMaxChannels, pool.maxChannels)
+    if len(pool.conns) > 1 {
+        Logger.Info("Open websocket connection ", len(pool.conns))
+    }
+}
+
+// remove connection (must be called under mutex)
+func (pool *BitfinexRTPublicPool) removeConn(idx int) {
+    pool.conns = append(pool.conns[:idx], pool.conns[idx+1:]...)
+    pool.channelCounts = append(pool.channelCounts[:idx], pool.channelCounts[idx+1:]...)
+    pool.connMaxChannels = append(pool.connMaxChannels[:idx],
+                                  pool.connMaxChannels[idx+1:]...)
+}
+
+// start first connection
+func (pool *BitfinexRTPublicPool) Start() {
+    pool.mutex.Lock()
+    defer pool.mutex.Unlock()
+    if pool.running {
+        panic("Websocket pool already started")
+    }
+    pool.addConn(pool.dialConn(), 0)
+    pool.running = true
+}
+
+func (pool *BitfinexRTPublicPool) Stop() {
+    pool.mutex.Lock()
+    defer pool.mutex.Unlock()
+    for _, conn := range pool.conns {
+        conn.Stop()
+    }
+    pool.running = false
+    pool.conns = nil
+    pool.channelCounts = nil
+    pool.connMaxChannels = nil
+    pool.owners = make(map[wsChannelKey]*BitfinexRTPublic)
+}
+
+func (pool *BitfinexRTPublicPool) connIndex(conn *BitfinexRTPublic) int {
+    for i, c := range pool.conns {
+        if c==conn { return i }
+    }
+    return -1
+}
+
+// get connection for new channel: owner of channel or connection with
+// free place for channel (place is reserved). opens new connection
+// (without holding mutex) if all are full. returns connection, true if
+// channel is owned by connection and true if connection is new.
+func (pool *BitfinexRTPublicPool) acquireConn(
+                chKey wsChannelKey) (*BitfinexRTPublic, bool, bool) {
+    pool.mutex.Lock()
+    if conn, ok := pool.owners[chKey]; ok {
+        pool.mutex.Unlock()
+        return conn, true, false
+    }
+    for i, count := range pool.channelCounts {
+        if count < pool.connMaxChannels[i] {
+            pool.channelCounts[i]++
+            conn := pool.conns[i]
+            pool.mutex.Unlock()
+            return conn, false, false
+        }
+    }
+    pool.mutex.Unlock()
+    conn := pool.dialConn()
+    pool.mutex.Lock()
+    defer pool.mutex.Unlock()
+    if !pool.running {
+        conn.Stop()
+        panic("Websocket pool stopped")
+    }
+    pool.addConn(conn, 1)
+    return conn, false, true
+}
+
+// release place reserved for channel. if full is true, then connection
+// doesn't accept more channels. new connection without channels is closed.
+func (pool *BitfinexRTPublicPool) releaseConn(conn *BitfinexRTPublic,
+                                              isNew, full bool) {
+    pool.mutex.Lock()
+    idx := pool.connIndex(conn)
+    if idx < 0 {
+        pool.mutex.Unlock()
+        return  // pool stopped
+    }
+    pool.channelCounts[idx]--
+    if full {
+        Logger.Warn("Websocket connection ", idx+1, " reached limit of channels: ",
+                    pool.channelCounts[idx])
+        pool.connMaxChannels[idx] = pool.channelCounts[idx]
+    }
+    remove := isNew && pool.channelCounts[idx]==0
+    if remove { pool.removeConn(idx) }
+    pool.mutex.Unlock()
+    if remove {
+        Logger.Info("Close websocket connection without channels")
+        conn.Stop()
+    }
+}
+
+// register connection as owner of channel (place is already reserved)
+func (pool *BitfinexRTPublicPool) registerOwner(chKey wsChannelKey,
+                                                conn *BitfinexRTPublic) {
+    pool.mutex.Lock()
+    defer pool.mutex.Unlock()
+    idx := pool.connIndex(conn)
+    if idx < 0 { return }   // pool stopped
+    if _, ok := pool.owners[chKey]; ok {
+        pool.channelCounts[idx]--   // subscribed concurrently
+        return
+    }
+    pool.owners[chKey] = conn
+}
+
+// delay of retry of subscription rejected by limit of channels
+var wsSubscribeRetryDelay = 30*time.Second
+
+// call subscription on connection and register owner of channel.
+// dial and waiting for confirmation are done without holding mutex.
+// if exchange rejects subscription by limit of channels, then subscription
+// is moved to another connection or retried later.
+func (pool *BitfinexRTPublicPool) subscribe(chKey wsChannelKey,
+                            f func(conn *BitfinexRTPublic)) {
+    conn, owned, isNew := pool.acquireConn(chKey)
+    err, _ := recoverCall(func() { f(conn) })
+    if err!=nil && !owned && isSubscribeLimitError(err) {
+        // connection is full - use another connection
+        pool.releaseConn(conn, isNew, true)
+        conn, owned, isNew = pool.acquireConn(chKey)
+        err, _ = recoverCall(func() { f(conn) })
+        if err!=nil && !owned && isSubscribeLimitError(err) {
+            pool.releaseConn(conn, isNew, true)
+            Logger.Error("Can't subscribe websocket channel: ", err,
+                         " - retry after ", wsSubscribeRetryDelay)
+            time.AfterFunc(wsSubscribeRetryDelay, func() {
+                pool.mutex.Lock()
+                stopped := !pool.running
+                pool.mutex.Unlock()
+                if stopped { return }
+                if err, _ := recoverCall(func() { pool.subscribe(chKey, f) });
+                        err!=nil {
+                    Logger.Error("Retry of websocket subscription failed: ", err)
+                }
+            })
+            return
+        }
+    }
+    if err!=nil {
+        if !owned { pool.releaseConn(conn, isNew, false) }
+        panic(err)
+    }
+    if !owned { pool.registerOwner(chKey, conn) }
+}
+
+// call unsubscription on owner of channel and unregister channel
+func (pool *BitfinexRTPublicPool) unsubscribe(chKey wsChannelKey,
+                            f func(conn *BitfinexRTPublic)) {
+    pool.mutex.Lock()
+    defer pool.mutex.Unlock()
+    conn, ok := pool.owners[chKey]
+    if !ok { return }
+    f(conn)
+    delete(pool.owners, chKey)
+    pool.channelCounts[pool.connIndex(conn)]--
+}
+
+func (pool *BitfinexRTPublicPool) SubscribeMarketPrice(market string,
+                            h MarketPriceHandler) {
+    pool.subscribe(wsChannelKey{ wsMarketPrice, market },
+            func(conn *BitfinexRTPublic) { conn.SubscribeMarketPrice(market, h) })
+}
+
+func (pool *BitfinexRTPublicPool) UnsubscribeMarketPrice(market string) {
+    pool.unsubscribe(wsChannelKey{ wsMarketPrice, market },
+            func(conn *BitfinexRTPublic) { conn.UnsubscribeMarketPrice(market) })
+}
+
+func (pool *BitfinexRTPublicPool) SubscribeTrades(currency string, h TradeHandler) {
+    pool.subscribe(wsChannelKey{ wsTrades, currency },
+            func(conn *BitfinexRTPublic) { conn.SubscribeTrades(currency, h) })
+}
+
+func (pool *BitfinexRTPublicPool) UnsubscribeTrades(currency string) {
+    pool.unsubscribe(wsChannelKey{ wsTrades, currency },
+            func(conn *BitfinexRTPublic) { conn.UnsubscribeTrades(currency) })
+}
+
+func (pool *BitfinexRTPublicPool) SubscribeOrderBook(currency string,
+                            h OrderBookHandler) {
+    pool.subscribe(wsChannelKey{ wsDiffOrderBook, currency },
+            func(conn *BitfinexRTPublic) { conn.SubscribeOrderBook(currency, h) })
+}
+
+func (pool *BitfinexRTPublicPool) UnsubscribeOrderBook(currency string) {
+    pool.unsubscribe(wsChannelKey{ wsDiffOrderBook, currency },
+            func(conn *BitfinexRTPublic) { conn.UnsubscribeOrderBook(currency) })
+}
+
+func (pool *BitfinexRTPublicPool) SubscribeCandles(key string, h CandleHandler) {
+    pool.subscribe(wsChannelKey{ wsCandles, key },
+            func(conn *BitfinexRTPublic) { conn.SubscribeCandles(key, h) })
+}
+
+func (pool *BitfinexRTPublicPool) UnsubscribeCandles(key string) {
+    pool.unsubscribe(wsChannelKey{ wsCandles, key },
+            func(conn *BitfinexRTPublic) { conn.UnsubscribeCandles(key) })
+}
+
+// resubscribe OrderBook on connection that owns it
+func (pool *BitfinexRTPublicPool) resubscribeOrderBook(currency string) {
+    pool.mutex.Lock()
+    conn, ok := pool.owners[wsChannelKey{ wsDiffOrderBook, currency }]
+    pool.mutex.Unlock()
+    if ok { conn.resubscribeOrderBook(currency) }
+}
+
+// get number of opened connections
+func (pool *BitfinexRTPublicPool) Connections() int {
+    pool.mutex.Lock()
+    defer pool.mutex.Unlock()
+    return len(pool.conns)
+}
+
+// get number of subscribed channels in all connections
+func (pool *BitfinexRTPublicPool) Channels() int {
+    pool.mutex.Lock()
+    defer pool.mutex.Unlock()
+    n := 0
+    for _, count := range pool.channelCounts {
+        n += count
+    }
+    return n
+}
+
+// get statistics of received messages summed from all connections
+func (pool *BitfinexRTPublicPool) MessageStats() wsMessageStats {
+    pool.mutex.Lock()
+    conns := append([]*BitfinexRTPublic(nil), pool.conns...)
+    pool.mutex.Unlock()
+    var stats wsMessageStats
+    for _, conn := range conns {
+        connStats := conn.MessageStats()
+        stats.merge(&connStats)
+    }
+    return stats
+}
+
+// get currently subscribed keys for every channel type from all connections
+func (pool *BitfinexRTPublicPool) Subscriptions() map[string][]string {
+    pool.mutex.Lock()
+    conns := append([]*BitfinexRTPublic(nil), pool.conns...)
+    pool.mutex.Unlock()
+    subs := make(map[string][]string)
+    for _, conn := range conns {
+        for chType, keys := range conn.Subscriptions() {
+            subs[chType] = append(subs[chType], keys...)
+        }
+    }
+    for _, keys := range subs {
+        sort.Strings(keys)
+    }
+    return subs
+}